@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"github.com/garyburd/go-websocket/websocket"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
@@ -29,36 +32,76 @@ type connection struct {
 
 	// Buffered channel of outbound messages.
 	send chan []byte
+
+	// The user name.
+	name string
+
+	// The rooms joined by the connection. The field is accessed by the hub
+	// goroutine only.
+	rooms map[string]bool
+
+	// The room for messages without a command. The field is accessed by the
+	// readPump goroutine only.
+	room string
+
+	// The close code sent to the client when the hub closes the send
+	// channel. Zero means normal closure. The hub sets the field before
+	// closing the send channel.
+	closeCode int
+}
+
+// handleMessage handles a message from the client. Messages are commands of
+// the form:
+//
+//  /join room
+//  /leave room
+//  /msg user text
+//
+// Other messages are sent to the room most recently joined by the client.
+func (c *connection) handleMessage(p []byte) {
+	if !bytes.HasPrefix(p, []byte("/")) {
+		h.broadcast <- message{from: c, to: c.room, data: p}
+		return
+	}
+	fields := bytes.SplitN(p, []byte(" "), 3)
+	switch {
+	case string(fields[0]) == "/join" && len(fields) == 2:
+		c.room = string(fields[1])
+		h.join <- subscription{c, c.room}
+	case string(fields[0]) == "/leave" && len(fields) == 2:
+		h.leave <- subscription{c, string(fields[1])}
+	case string(fields[0]) == "/msg" && len(fields) == 3:
+		h.direct <- message{from: c, to: string(fields[1]), data: fields[2]}
+	default:
+		h.direct <- message{from: c, to: c.name, data: []byte("unknown command " + string(p))}
+	}
 }
 
 // readPump pumps messages from the websocket connection to the hub.
 func (c *connection) readPump() {
 	defer func() {
-		h.unregister <- c
 		c.ws.Close()
+		h.unregister <- c
 	}()
 	c.ws.SetReadLimit(maxMessageSize)
-	c.ws.SetReadDeadline(time.Now().Add(readWait))
+	c.ws.SetPongWait(readWait)
 	for {
 		op, r, err := c.ws.NextReader()
 		if err != nil {
 			break
 		}
-		switch op {
-		case websocket.OpPong:
-			c.ws.SetReadDeadline(time.Now().Add(readWait))
-		case websocket.OpText:
+		if op == websocket.OpText {
 			message, err := ioutil.ReadAll(r)
 			if err != nil {
 				break
 			}
-			h.broadcast <- message
+			c.handleMessage(message)
 		}
 	}
 }
 
 // write writes a message with the given opCode and payload.
-func (c *connection) write(opCode int, payload []byte) error {
+func (c *connection) write(opCode websocket.MessageType, payload []byte) error {
 	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
 	return c.ws.WriteMessage(opCode, payload)
 }
@@ -66,47 +109,54 @@ func (c *connection) write(opCode int, payload []byte) error {
 // writePump pumps messages from the hub to the websocket connection.
 func (c *connection) writePump() {
 	ticker := time.NewTicker(pingPeriod)
-	defer func() {
-		ticker.Stop()
-		c.ws.Close()
-	}()
+	defer ticker.Stop()
 	for {
 		select {
 		case message, ok := <-c.send:
 			if !ok {
-				c.write(websocket.OpClose, []byte{})
+				// The hub closed the channel. Start the closing handshake.
+				// The readPump goroutine closes the connection when the
+				// client responds or the read deadline expires.
+				code, text := websocket.CloseNormalClosure, ""
+				if c.closeCode != 0 {
+					code, text = c.closeCode, "server shutting down"
+				}
+				c.ws.CloseHandshake(code, text, time.Now().Add(writeWait))
 				return
 			}
 			if err := c.write(websocket.OpText, message); err != nil {
+				c.ws.Close()
 				return
 			}
 		case <-ticker.C:
 			if err := c.write(websocket.OpPing, []byte{}); err != nil {
+				c.ws.Close()
 				return
 			}
 		}
 	}
 }
 
+// guestCount is used to generate names for clients that do not specify a
+// name.
+var guestCount int64
+
+// upgrader upgrades requests from clients with the same origin as the
+// request host. The check works for both ws:// and wss:// connections.
+var upgrader = &websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024}
+
 // serverWs handles webocket requests from the client.
 func serveWs(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		http.Error(w, "Method not allowed", 405)
-		return
-	}
-	if r.Header.Get("Origin") != "http://"+r.Host {
-		http.Error(w, "Origin not allowed", 403)
-		return
-	}
-	ws, err := websocket.Upgrade(w, r.Header, nil, 1024, 1024)
-	if _, ok := err.(websocket.HandshakeError); ok {
-		http.Error(w, "Not a websocket handshake", 400)
-		return
-	} else if err != nil {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
 		log.Println(err)
 		return
 	}
-	c := &connection{send: make(chan []byte, 256), ws: ws}
+	name := r.FormValue("name")
+	if name == "" {
+		name = "guest" + strconv.FormatInt(atomic.AddInt64(&guestCount, 1), 10)
+	}
+	c := &connection{send: make(chan []byte, 256), ws: ws, name: name, rooms: make(map[string]bool), room: defaultRoom}
 	h.register <- c
 	go c.writePump()
 	c.readPump()
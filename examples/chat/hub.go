@@ -1,45 +1,340 @@
 package main
 
-// hub maintains the set of active connections and broadcasts messages to the
-// connections.
+import (
+	"context"
+	"github.com/garyburd/go-websocket/websocket"
+	"strconv"
+	"strings"
+)
+
+// message is a message sent from a connection to a room or user.
+type message struct {
+	// The connection that sent the message.
+	from *connection
+
+	// The destination room or user name.
+	to string
+
+	// The message text.
+	data []byte
+}
+
+// subscription is a request to join or leave a room.
+type subscription struct {
+	conn *connection
+	room string
+}
+
+// hub maintains the set of active connections and the rooms joined by the
+// connections. The hub routes messages to rooms and users.
 type hub struct {
 	// Registered connections.
 	connections map[*connection]bool
 
-	// Inbound messages from the connections.
-	broadcast chan []byte
+	// Registered connections by user name.
+	users map[string]*connection
+
+	// Connections in each room.
+	rooms map[string]map[*connection]bool
+
+	// Message history for the rooms.
+	store Store
+
+	// Inbound messages to rooms.
+	broadcast chan message
+
+	// Inbound messages to users.
+	direct chan message
+
+	// Join requests from the connections.
+	join chan subscription
+
+	// Leave requests from the connections.
+	leave chan subscription
 
 	// Register requests from the connections.
 	register chan *connection
 
-	// Unregister requests from connections.
+	// Unregister requests from connections. The channel is buffered so
+	// that connections do not wait for the hub when many clients disconnect
+	// at once.
 	unregister chan *connection
+
+	// The largest number of registered connections since the connections
+	// map was last rebuilt.
+	peak int
+
+	// Shutdown requests.
+	shutdown chan bool
+
+	// True after the hub starts shutting down.
+	closing bool
+
+	// Connections closed by shutdown that have not unregistered.
+	draining map[*connection]bool
+
+	// Closed when all draining connections have unregistered.
+	drained chan bool
 }
 
 var h = hub{
-	broadcast:   make(chan []byte),
+	broadcast:   make(chan message),
+	direct:      make(chan message),
+	join:        make(chan subscription),
+	leave:       make(chan subscription),
 	register:    make(chan *connection),
-	unregister:  make(chan *connection),
+	unregister:  make(chan *connection, maxUnregisterBatch),
+	shutdown:    make(chan bool),
+	drained:     make(chan bool),
+	draining:    make(map[*connection]bool),
 	connections: make(map[*connection]bool),
+	users:       make(map[string]*connection),
+	rooms:       make(map[string]map[*connection]bool),
+	store:       newMemoryStore(0),
 }
 
+// defaultRoom is the room joined by new connections.
+const defaultRoom = "lobby"
+
+const (
+	// maxUnregisterBatch is the maximum number of unregister requests that
+	// the hub handles together.
+	maxUnregisterBatch = 1024
+
+	// maxLeaveNames is the maximum number of user names listed in a
+	// notice to a room that users left.
+	maxLeaveNames = 10
+)
+
 func (h *hub) run() {
 	for {
 		select {
 		case c := <-h.register:
+			if h.closing {
+				c.closeCode = websocket.CloseGoingAway
+				close(c.send)
+				break
+			}
+			if h.users[c.name] != nil {
+				c.send <- []byte("* name " + c.name + " is in use")
+				close(c.send)
+				break
+			}
 			h.connections[c] = true
+			if len(h.connections) > h.peak {
+				h.peak = len(h.connections)
+			}
+			h.users[c.name] = c
+			h.joinRoom(c, defaultRoom)
 		case c := <-h.unregister:
-			delete(h.connections, c)
-			close(c.send)
-		case m := <-h.broadcast:
-			for c := range h.connections {
+			// Handle the pending requests in a batch so that a disconnect
+			// storm results in one notice per room instead of one per
+			// connection.
+			batch := []*connection{c}
+		drain:
+			for len(batch) < maxUnregisterBatch {
 				select {
-				case c.send <- m:
+				case c := <-h.unregister:
+					batch = append(batch, c)
 				default:
-					close(c.send)
-					delete(h.connections, c)
+					break drain
 				}
 			}
+			h.unregisterAll(batch)
+		case <-h.shutdown:
+			if h.closing {
+				break
+			}
+			h.closing = true
+			for c := range h.connections {
+				c.closeCode = websocket.CloseGoingAway
+				close(c.send)
+				h.draining[c] = true
+			}
+			h.connections = make(map[*connection]bool)
+			h.users = make(map[string]*connection)
+			h.rooms = make(map[string]map[*connection]bool)
+			if len(h.draining) == 0 {
+				close(h.drained)
+			}
+		case s := <-h.join:
+			if h.connections[s.conn] {
+				h.joinRoom(s.conn, s.room)
+			}
+		case s := <-h.leave:
+			if h.connections[s.conn] {
+				h.leaveRoom(s.conn, s.room)
+			}
+		case m := <-h.broadcast:
+			if !h.connections[m.from] {
+				break
+			}
+			if !m.from.rooms[m.to] {
+				h.send(m.from, []byte("* you are not in room "+m.to))
+				break
+			}
+			data := []byte("[" + m.to + "] " + m.from.name + ": " + string(m.data))
+			h.store.Add(m.to, data)
+			h.sendRoom(m.to, data)
+		case m := <-h.direct:
+			if !h.connections[m.from] {
+				break
+			}
+			c := h.users[m.to]
+			if c == nil {
+				h.send(m.from, []byte("* no such user "+m.to))
+				break
+			}
+			h.send(c, []byte("<"+m.from.name+"> "+string(m.data)))
+			if c != m.from {
+				h.send(m.from, []byte("-> <"+m.to+"> "+string(m.data)))
+			}
+		}
+	}
+}
+
+// Shutdown sends a going away close message to all connections and waits for
+// the closing handshakes to complete or for the context to be done. New
+// connections are rejected after Shutdown is called.
+func (h *hub) Shutdown(ctx context.Context) error {
+	select {
+	case h.shutdown <- true:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-h.drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// send sends data to the connection. If the connection's send buffer is
+// full, then the hub assumes that the client is dead or stuck and removes the
+// connection.
+func (h *hub) send(c *connection, data []byte) {
+	if !h.connections[c] {
+		return
+	}
+	select {
+	case c.send <- data:
+	default:
+		h.remove(c)
+	}
+}
+
+func (h *hub) sendRoom(room string, data []byte) {
+	for c := range h.rooms[room] {
+		h.send(c, data)
+	}
+}
+
+func (h *hub) joinRoom(c *connection, room string) {
+	if c.rooms[room] {
+		return
+	}
+	conns := h.rooms[room]
+	if conns == nil {
+		conns = make(map[*connection]bool)
+		h.rooms[room] = conns
+	}
+	// Replay the room's history to the new member.
+	for _, data := range h.store.History(room) {
+		h.send(c, data)
+	}
+	if !h.connections[c] {
+		return
+	}
+	conns[c] = true
+	c.rooms[room] = true
+	h.sendRoom(room, []byte("* "+c.name+" joined "+room))
+}
+
+func (h *hub) leaveRoom(c *connection, room string) {
+	if !c.rooms[room] {
+		return
+	}
+	h.sendRoom(room, []byte("* "+c.name+" left "+room))
+	delete(c.rooms, room)
+	delete(h.rooms[room], c)
+	if len(h.rooms[room]) == 0 {
+		delete(h.rooms, room)
+	}
+}
+
+// unregisterAll handles unregister requests from the connections.
+func (h *hub) unregisterAll(conns []*connection) {
+	var registered []*connection
+	for _, c := range conns {
+		if h.connections[c] {
+			registered = append(registered, c)
+		}
+		if h.draining[c] {
+			delete(h.draining, c)
+			if len(h.draining) == 0 {
+				close(h.drained)
+			}
+		}
+	}
+	h.removeAll(registered)
+}
+
+// remove removes the connection from the hub and closes the connection's
+// send channel.
+func (h *hub) remove(c *connection) {
+	h.removeAll([]*connection{c})
+}
+
+// removeAll removes the connections from the hub, closes the connections'
+// send channels and sends one notice to each room that the connections
+// left.
+func (h *hub) removeAll(conns []*connection) {
+	left := make(map[string][]string)
+	for _, c := range conns {
+		delete(h.connections, c)
+		delete(h.users, c.name)
+		close(c.send)
+		for room := range c.rooms {
+			delete(h.rooms[room], c)
+			if len(h.rooms[room]) == 0 {
+				delete(h.rooms, room)
+			} else {
+				left[room] = append(left[room], c.name)
+			}
 		}
 	}
+	h.compact()
+	for room, names := range left {
+		h.sendRoom(room, []byte(leaveNotice(names, room)))
+	}
+}
+
+// compact rebuilds the connection maps after the number of connections
+// drops to a fraction of the peak. Go maps do not shrink when entries are
+// deleted, so the maps would otherwise hold the memory for the peak number
+// of connections. The cost of the copy is amortized over the removals
+// since the last rebuild.
+func (h *hub) compact() {
+	if h.peak < 1024 || len(h.connections) > h.peak/4 {
+		return
+	}
+	connections := make(map[*connection]bool, len(h.connections))
+	users := make(map[string]*connection, len(h.users))
+	for c := range h.connections {
+		connections[c] = true
+		users[c.name] = c
+	}
+	h.connections = connections
+	h.users = users
+	h.peak = len(connections)
+}
+
+// leaveNotice returns the notice sent to a room when the named users leave
+// the room.
+func leaveNotice(names []string, room string) string {
+	if len(names) > maxLeaveNames {
+		return "* " + strconv.Itoa(len(names)) + " users left " + room
+	}
+	return "* " + strings.Join(names, ", ") + " left " + room
 }
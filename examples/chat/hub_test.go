@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"github.com/garyburd/go-websocket/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const numClients = 30
+
+// readUntil reads messages from the connection until a message with the
+// given text is received.
+func readUntil(t *testing.T, ws *websocket.Conn, text string) {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		op, p, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for %q: %v", text, err)
+		}
+		if op == websocket.OpText && string(p) == text {
+			return
+		}
+	}
+}
+
+// TestHub drives the hub with simulated clients. The phases share the global
+// hub and run in order: broadcast delivery, slow client eviction and
+// graceful shutdown.
+func TestHub(t *testing.T) {
+	go h.run()
+	s := httptest.NewServer(http.HandlerFunc(serveWs))
+	defer s.Close()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	clients := make([]*websocket.Conn, numClients)
+	for i := range clients {
+		name := "user" + strconv.Itoa(i)
+		ws, _, err := websocket.DefaultDialer.Dial(wsURL+"?name="+name, nil)
+		if err != nil {
+			t.Fatalf("Dial %s: %v", name, err)
+		}
+		defer ws.Close()
+		readUntil(t, ws, "* "+name+" joined "+defaultRoom)
+		clients[i] = ws
+	}
+
+	// Broadcast delivery: every client receives a message sent to the
+	// room.
+	if err := clients[0].WriteMessage(websocket.OpText, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	for _, ws := range clients {
+		readUntil(t, ws, "["+defaultRoom+"] user0: hello")
+	}
+
+	// Slow client eviction: a connection that does not drain its send
+	// buffer is removed from the hub.
+	slow := &connection{send: make(chan []byte, 1), name: "slow", rooms: make(map[string]bool), room: defaultRoom}
+	h.register <- slow
+	clients[1].WriteMessage(websocket.OpText, []byte("are you there?"))
+	for _, ws := range clients {
+		readUntil(t, ws, "* slow left "+defaultRoom)
+	}
+	for range slow.send {
+	}
+
+	// Graceful shutdown: every client receives a going away close message
+	// and the hub waits for the clients to complete the handshake.
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- h.Shutdown(ctx)
+	}()
+	for i, ws := range clients {
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			_, _, err := ws.ReadMessage()
+			if err == nil {
+				continue
+			}
+			if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+				t.Errorf("client %d: ReadMessage() returned %v, want going away", i, err)
+			}
+			break
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Shutdown() returned %v", err)
+	}
+
+	// New connections are rejected after shutdown.
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL+"?name=late", nil)
+	if err != nil {
+		t.Fatalf("Dial after shutdown: %v", err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("ReadMessage() after shutdown returned %v, want going away", err)
+	}
+}
@@ -1,13 +1,22 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"text/template"
+	"time"
 )
 
 var addr = flag.String("addr", ":8080", "http service address")
+var historySize = flag.Int("history", 50, "number of messages stored for each room")
+var certFile = flag.String("cert", "", "TLS certificate file")
+var keyFile = flag.String("key", "", "TLS key file")
+var shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "time allowed for clients to close connections on shutdown")
 var homeTempl = template.Must(template.ParseFiles("home.html"))
 
 func serveHome(w http.ResponseWriter, r *http.Request) {
@@ -25,11 +34,40 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
 
 func main() {
 	flag.Parse()
+	h.store = newMemoryStore(*historySize)
 	go h.run()
 	http.HandleFunc("/", serveHome)
 	http.HandleFunc("/ws", serveWs)
-	err := http.ListenAndServe(*addr, nil)
-	if err != nil {
+	server := &http.Server{Addr: *addr}
+
+	done := make(chan bool)
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		log.Println("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		// Stop accepting connections and upgrades. The server does not
+		// track hijacked connections, so the hub closes the WebSocket
+		// connections after the server stops.
+		if err := server.Shutdown(ctx); err != nil {
+			log.Println("server shutdown: ", err)
+		}
+		if err := h.Shutdown(ctx); err != nil {
+			log.Println("hub shutdown: ", err)
+		}
+		close(done)
+	}()
+
+	var err error
+	if *certFile != "" || *keyFile != "" {
+		err = server.ListenAndServeTLS(*certFile, *keyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
 		log.Fatal("ListenAndServe: ", err)
 	}
+	<-done
 }
@@ -0,0 +1,59 @@
+package main
+
+// Store stores the message history for rooms.
+type Store interface {
+	// Add adds a message to the room's history.
+	Add(room string, message []byte)
+
+	// History returns the room's history, oldest message first.
+	History(room string) [][]byte
+}
+
+// memoryStore is a Store that keeps the most recent messages for each room
+// in memory. The store is not safe for concurrent use. The hub goroutine is
+// the only user of the store.
+type memoryStore struct {
+	// Maximum number of messages stored for each room.
+	size int
+
+	rooms map[string]*ring
+}
+
+// ring is a ring buffer of messages.
+type ring struct {
+	messages [][]byte
+
+	// Index of the oldest message when the buffer is full.
+	next int
+}
+
+func newMemoryStore(size int) *memoryStore {
+	return &memoryStore{size: size, rooms: make(map[string]*ring)}
+}
+
+func (s *memoryStore) Add(room string, message []byte) {
+	if s.size <= 0 {
+		return
+	}
+	r := s.rooms[room]
+	if r == nil {
+		r = &ring{}
+		s.rooms[room] = r
+	}
+	if len(r.messages) < s.size {
+		r.messages = append(r.messages, message)
+		return
+	}
+	r.messages[r.next] = message
+	r.next = (r.next + 1) % len(r.messages)
+}
+
+func (s *memoryStore) History(room string) [][]byte {
+	r := s.rooms[room]
+	if r == nil {
+		return nil
+	}
+	history := make([][]byte, 0, len(r.messages))
+	history = append(history, r.messages[r.next:]...)
+	return append(history, r.messages[:r.next]...)
+}
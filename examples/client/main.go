@@ -0,0 +1,155 @@
+// Command client is a terminal client for the chat example.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"github.com/garyburd/go-websocket/websocket"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+var (
+	addr = flag.String("addr", "localhost:8080", "chat service address")
+	name = flag.String("name", "", "user name")
+)
+
+const (
+	// Time allowed to write a message to the server.
+	writeWait = 10 * time.Second
+
+	// Time allowed to read the next message from the server.
+	readWait = 60 * time.Second
+
+	// Send pings to the server with this period. Must be less than readWait.
+	pingPeriod = (readWait * 9) / 10
+
+	// Maximum message size allowed from the server.
+	maxMessageSize = 1024
+
+	// Maximum delay between reconnect attempts.
+	maxBackoff = 30 * time.Second
+)
+
+// readLines sends lines from standard input to the lines channel and closes
+// the channel at end of input.
+func readLines(lines chan<- string) {
+	defer close(lines)
+	s := bufio.NewScanner(os.Stdin)
+	for s.Scan() {
+		if s.Text() != "" {
+			lines <- s.Text()
+		}
+	}
+	if err := s.Err(); err != nil {
+		log.Println("read input:", err)
+	}
+}
+
+// readPump prints messages from the server. The read pump sends the error
+// that ended the pump to the done channel.
+func readPump(ws *websocket.Conn, done chan<- error) {
+	ws.SetReadLimit(maxMessageSize)
+	ws.SetReadDeadline(time.Now().Add(readWait))
+	for {
+		op, r, err := ws.NextReader()
+		if err != nil {
+			done <- err
+			return
+		}
+		switch op {
+		case websocket.OpPong:
+			ws.SetReadDeadline(time.Now().Add(readWait))
+		case websocket.OpText:
+			message, err := ioutil.ReadAll(r)
+			if err != nil {
+				done <- err
+				return
+			}
+			os.Stdout.Write(append(message, '\n'))
+		}
+	}
+}
+
+func write(ws *websocket.Conn, opCode websocket.MessageType, payload []byte) error {
+	ws.SetWriteDeadline(time.Now().Add(writeWait))
+	return ws.WriteMessage(opCode, payload)
+}
+
+// session runs a single connection to the server. The session writes lines
+// to the server and pings the server from the calling goroutine, the write
+// pump. The session returns true if the input is exhausted.
+func session(u string, lines <-chan string) (bool, error) {
+	ws, _, err := websocket.DefaultDialer.Dial(u, http.Header{"Origin": {"http://" + *addr}})
+	if err != nil {
+		return false, err
+	}
+	defer ws.Close()
+	log.Println("connected to", *addr)
+
+	done := make(chan error, 1)
+	go readPump(ws, done)
+
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				// Close the connection cleanly and wait for the server to
+				// close the connection.
+				write(ws, websocket.OpClose, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				select {
+				case <-done:
+				case <-time.After(time.Second):
+				}
+				return true, nil
+			}
+			if err := write(ws, websocket.OpText, []byte(line)); err != nil {
+				return false, err
+			}
+		case <-ticker.C:
+			if err := write(ws, websocket.OpPing, []byte{}); err != nil {
+				return false, err
+			}
+		case err := <-done:
+			return false, err
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+	u := url.URL{Scheme: "ws", Host: *addr, Path: "/ws"}
+	if *name != "" {
+		u.RawQuery = url.Values{"name": {*name}}.Encode()
+	}
+
+	lines := make(chan string)
+	go readLines(lines)
+
+	backoff := time.Second
+	for {
+		start := time.Now()
+		eof, err := session(u.String(), lines)
+		if eof {
+			return
+		}
+		log.Println("disconnected:", err)
+
+		// Reset the backoff after a long session. Otherwise, double the
+		// backoff up to the maximum.
+		if time.Since(start) > maxBackoff {
+			backoff = time.Second
+		}
+		log.Printf("reconnecting in %v", backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"github.com/garyburd/go-websocket/websocket"
 	"io"
 	"log"
@@ -8,10 +9,20 @@ import (
 	_ "net/http/pprof"
 )
 
+var (
+	addr            = flag.String("addr", ":8000", "http service address")
+	readBufferSize  = flag.Int("read-buffer-size", 1024, "read buffer size")
+	writeBufferSize = flag.Int("write-buffer-size", 1024, "write buffer size")
+	certFile        = flag.String("cert", "", "TLS certificate file")
+	keyFile         = flag.String("key", "", "TLS key file")
+)
+
+var upgrader *websocket.Upgrader
+
 func echo(w http.ResponseWriter, r *http.Request) {
-	conn, err := websocket.Upgrade(w, r.Header, nil, 1024, 1024)
+	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		http.Error(w, err.Error(), 400)
+		log.Println(err)
 		return
 	}
 	defer conn.Close()
@@ -33,8 +44,18 @@ func echo(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	flag.Parse()
+	upgrader = &websocket.Upgrader{
+		ReadBufferSize:  *readBufferSize,
+		WriteBufferSize: *writeBufferSize,
+	}
 	http.HandleFunc("/", echo)
-	err := http.ListenAndServe(":8000", nil)
+	var err error
+	if *certFile != "" || *keyFile != "" {
+		err = http.ListenAndServeTLS(*addr, *certFile, *keyFile, nil)
+	} else {
+		err = http.ListenAndServe(*addr, nil)
+	}
 	if err != nil {
 		log.Fatal("ListenAndServe: ", err)
 	}
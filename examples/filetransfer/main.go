@@ -0,0 +1,401 @@
+// Command filetransfer streams files over WebSocket binary messages.
+//
+// Run the server with
+//
+//  filetransfer -dir /tmp/files
+//
+// and transfer files with
+//
+//  filetransfer -put localfile
+//  filetransfer -get name
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/garyburd/go-websocket/websocket"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	addr    = flag.String("addr", "localhost:8080", "http service address")
+	dir     = flag.String("dir", "", "serve files from this directory")
+	get     = flag.String("get", "", "download the named file from the server")
+	put     = flag.String("put", "", "upload a file to the server")
+	maxSize = flag.Int64("max-size", 1<<30, "maximum size of an uploaded file")
+)
+
+const (
+	// Time allowed to write a chunk of a file or a control message.
+	writeWait = 10 * time.Second
+
+	// Time allowed to read a chunk of a file or a request.
+	readWait = 60 * time.Second
+
+	// Report progress after each progressInterval bytes.
+	progressInterval = 1 << 20
+)
+
+// progressWriter reports the number of bytes written with the report
+// function.
+type progressWriter struct {
+	w      io.Writer
+	n      int64
+	next   int64
+	report func(n int64) error
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.n += int64(n)
+	if pw.n >= pw.next {
+		pw.next = pw.n + progressInterval
+		if err := pw.report(pw.n); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// deadlineReader extends the connection read deadline before each read so
+// that a large message can take longer than readWait as long as data keeps
+// arriving.
+type deadlineReader struct {
+	conn *websocket.Conn
+	r    io.Reader
+}
+
+func (dr deadlineReader) Read(p []byte) (int, error) {
+	dr.conn.SetReadDeadline(time.Now().Add(readWait))
+	return dr.r.Read(p)
+}
+
+// deadlineWriter extends the connection write deadline before each write.
+type deadlineWriter struct {
+	conn *websocket.Conn
+	w    io.Writer
+}
+
+func (dw deadlineWriter) Write(p []byte) (int, error) {
+	dw.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return dw.w.Write(p)
+}
+
+func writeText(conn *websocket.Conn, s string) error {
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return conn.WriteMessage(websocket.OpText, []byte(s))
+}
+
+// readText reads the next text message from the connection.
+func readText(conn *websocket.Conn) (string, error) {
+	for {
+		conn.SetReadDeadline(time.Now().Add(readWait))
+		op, r, err := conn.NextReader()
+		if err != nil {
+			return "", err
+		}
+		if op != websocket.OpText {
+			continue
+		}
+		p, err := ioutil.ReadAll(r)
+		return string(p), err
+	}
+}
+
+// localPath returns the path in the served directory for a file name.
+func localPath(name string) (string, error) {
+	name = filepath.Base(name)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return "", errors.New("bad file name")
+	}
+	return filepath.Join(*dir, name), nil
+}
+
+var upgrader = &websocket.Upgrader{ReadBufferSize: 32 * 1024, WriteBufferSize: 32 * 1024}
+
+// serveWs handles a single get or put request from a client.
+func serveWs(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer conn.Close()
+
+	// Limit the size of the request message.
+	conn.SetReadLimit(1024)
+	request, err := readText(conn)
+	if err != nil {
+		log.Println("read request:", err)
+		return
+	}
+	fields := strings.Fields(request)
+	switch {
+	case len(fields) == 2 && fields[0] == "get":
+		err = serveGet(conn, fields[1])
+	case len(fields) == 3 && fields[0] == "put":
+		err = servePut(conn, fields[1], fields[2])
+	default:
+		err = errors.New("bad request")
+	}
+	if err != nil {
+		log.Printf("%s: %v", request, err)
+		writeText(conn, "error "+err.Error())
+	}
+	conn.WriteControl(websocket.OpClose, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeWait))
+}
+
+// serveGet streams a file to the client as a single binary message. The
+// binary message is fragmented into frames as the connection's write buffer
+// fills. Blocking writes provide flow control.
+func serveGet(conn *websocket.Conn, name string) error {
+	path, err := localPath(name)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.New("file not found")
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := writeText(conn, "size "+strconv.FormatInt(fi.Size(), 10)); err != nil {
+		return err
+	}
+	w, err := conn.NextWriter(websocket.OpBinary)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(deadlineWriter{conn, w}, f); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// servePut reads a file from the client and reports progress to the client.
+func servePut(conn *websocket.Conn, name, size string) error {
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || n < 0 {
+		return errors.New("bad size")
+	}
+	if n > *maxSize {
+		return errors.New("file too large")
+	}
+	path, err := localPath(name)
+	if err != nil {
+		return err
+	}
+	if err := writeText(conn, "ok"); err != nil {
+		return err
+	}
+
+	// The read limit bounds the size of the message, even if the client
+	// sends more data than announced. A limit of zero disables the check, so
+	// an empty file is read with a limit of one and the size is checked
+	// below.
+	limit := n
+	if limit == 0 {
+		limit = 1
+	}
+	conn.SetReadLimit(limit)
+	var r io.Reader
+	for {
+		conn.SetReadDeadline(time.Now().Add(readWait))
+		op, mr, err := conn.NextReader()
+		if err != nil {
+			return err
+		}
+		if op == websocket.OpBinary {
+			r = mr
+			break
+		}
+	}
+
+	f, err := ioutil.TempFile(*dir, ".upload")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	pw := &progressWriter{w: f, report: func(n int64) error {
+		return writeText(conn, "received "+strconv.FormatInt(n, 10))
+	}}
+	if _, err := io.Copy(pw, deadlineReader{conn, r}); err != nil {
+		return err
+	}
+	if pw.n != n {
+		return errors.New("size mismatch")
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	return writeText(conn, "done "+strconv.FormatInt(pw.n, 10))
+}
+
+func dial() (*websocket.Conn, error) {
+	u := &url.URL{Scheme: "ws", Host: *addr, Path: "/ws"}
+	c, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	conn, _, err := websocket.NewClient(c, u, nil, 32*1024, 32*1024)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// reply returns the argument from a server reply of the form "want arg".
+func reply(s, want string) (string, error) {
+	if strings.HasPrefix(s, "error ") {
+		return "", errors.New(s[len("error "):])
+	}
+	if !strings.HasPrefix(s, want) {
+		return "", fmt.Errorf("unexpected reply %q", s)
+	}
+	return strings.TrimSpace(s[len(want):]), nil
+}
+
+func doGet(name string) error {
+	conn, err := dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := writeText(conn, "get "+name); err != nil {
+		return err
+	}
+	s, err := readText(conn)
+	if err != nil {
+		return err
+	}
+	s, err = reply(s, "size")
+	if err != nil {
+		return err
+	}
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(readWait))
+	_, r, err := conn.NextReader()
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Base(name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	pw := &progressWriter{w: f, report: func(n int64) error {
+		log.Printf("downloaded %d of %d bytes", n, size)
+		return nil
+	}}
+	if _, err := io.Copy(pw, deadlineReader{conn, r}); err != nil {
+		return err
+	}
+	log.Printf("downloaded %d bytes", pw.n)
+	return f.Close()
+}
+
+func doPut(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	conn, err := dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := writeText(conn, fmt.Sprintf("put %s %d", filepath.Base(path), fi.Size())); err != nil {
+		return err
+	}
+	s, err := readText(conn)
+	if err != nil {
+		return err
+	}
+	if _, err := reply(s, "ok"); err != nil {
+		return err
+	}
+
+	// Read progress reports from the server while sending the file.
+	done := make(chan error, 1)
+	go func() {
+		for {
+			s, err := readText(conn)
+			if err != nil {
+				done <- err
+				return
+			}
+			if n, err := reply(s, "received"); err == nil {
+				log.Printf("server received %s of %d bytes", n, fi.Size())
+				continue
+			}
+			n, err := reply(s, "done")
+			if err == nil {
+				log.Printf("server stored %s bytes", n)
+			}
+			done <- err
+			return
+		}
+	}()
+
+	w, err := conn.NextWriter(websocket.OpBinary)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(deadlineWriter{conn, w}, f); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return <-done
+}
+
+func main() {
+	flag.Parse()
+	var err error
+	switch {
+	case *get != "":
+		err = doGet(*get)
+	case *put != "":
+		err = doPut(*put)
+	case *dir != "":
+		http.HandleFunc("/ws", serveWs)
+		err = http.ListenAndServe(*addr, nil)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
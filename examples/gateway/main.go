@@ -0,0 +1,98 @@
+// Command gateway bridges WebSocket connections to a TCP backend.
+//
+// Each WebSocket connection accepted by the gateway is connected to a new
+// TCP connection to the backend. Data messages received from the client are
+// written to the backend and data read from the backend is sent to the
+// client in binary messages. Use -type=text to send text messages or
+// -type=auto to send text messages for data that is valid UTF-8. Run the
+// gateway in front of a Redis server with
+//
+//  gateway -backend localhost:6379
+//
+// and connect browser clients to ws://localhost:8080/.
+package main
+
+import (
+	"flag"
+	"github.com/garyburd/go-websocket/websocket"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+var (
+	addr        = flag.String("addr", ":8080", "http service address")
+	backend     = flag.String("backend", "", "TCP address of the backend")
+	dialTimeout = flag.Duration("dial-timeout", 10*time.Second, "timeout for connecting to the backend")
+	anyOrigin   = flag.Bool("any-origin", false, "accept connections from any origin")
+	messageType = flag.String("type", "binary", "type of messages sent to the client: binary, text or auto")
+)
+
+var upgrader = &websocket.Upgrader{ReadBufferSize: 4096, WriteBufferSize: 4096}
+
+func serveWs(w http.ResponseWriter, r *http.Request) {
+	// Connect to the backend before the upgrade so that the gateway can
+	// report an HTTP error to the client when the backend is unavailable.
+	bc, err := net.DialTimeout("tcp", *backend, *dialTimeout)
+	if err != nil {
+		log.Printf("dial %s: %v", *backend, err)
+		http.Error(w, "Backend unavailable", 502)
+		return
+	}
+	defer bc.Close()
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	var wc net.Conn
+	switch *messageType {
+	case "text":
+		wc = websocket.NetConn(ws, websocket.OpText)
+	case "auto":
+		wc = websocket.NetConnDetect(ws)
+	default:
+		wc = websocket.NetConn(ws, websocket.OpBinary)
+	}
+	defer wc.Close()
+
+	done := make(chan bool, 2)
+	go func() {
+		io.Copy(bc, wc)
+		// Tell the backend that the client is done sending.
+		if tc, ok := bc.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
+		done <- true
+	}()
+	go func() {
+		io.Copy(wc, bc)
+		done <- true
+	}()
+
+	// Close both connections when either direction finishes. The deferred
+	// close of the WebSocket connection sends a close message to the client.
+	<-done
+}
+
+func main() {
+	flag.Parse()
+	if *backend == "" {
+		log.Fatal("the -backend flag is required")
+	}
+	switch *messageType {
+	case "binary", "text", "auto":
+	default:
+		log.Fatal("the -type flag must be binary, text or auto")
+	}
+	if *anyOrigin {
+		upgrader.CheckOrigin = func(r *http.Request) bool { return true }
+	}
+	http.HandleFunc("/", serveWs)
+	if err := http.ListenAndServe(*addr, nil); err != nil {
+		log.Fatal("ListenAndServe: ", err)
+	}
+}
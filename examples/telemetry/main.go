@@ -0,0 +1,305 @@
+// Command telemetry streams high-frequency binary samples to many clients.
+//
+// The server generates samples from simulated sensors, packs batches of
+// samples into binary messages and broadcasts each message to all connected
+// clients. The message frame is encoded once per broadcast using a
+// PreparedMessage. Each client connection coalesces frames to reduce the
+// number of writes to the network. Messages are dropped for clients that
+// cannot keep up with the stream.
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"github.com/garyburd/go-websocket/websocket"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+var (
+	addr     = flag.String("addr", ":8080", "http service address")
+	sensors  = flag.Int("sensors", 8, "number of simulated sensors")
+	rate     = flag.Int("rate", 100, "messages broadcast per second")
+	batch    = flag.Int("batch", 16, "samples per sensor in each message")
+	coalesce = flag.Duration("coalesce", 5*time.Millisecond, "write coalescing delay, 0 to disable")
+	queue    = flag.Int("queue", 64, "messages queued for each client before dropping")
+)
+
+const (
+	// Time allowed to write a message to the client.
+	writeWait = 10 * time.Second
+
+	// Time allowed to read the next message from the client.
+	readWait = 60 * time.Second
+
+	// Send pings to client with this period. Must be less than readWait.
+	pingPeriod = (readWait * 9) / 10
+
+	// Maximum number of bytes buffered for write coalescing.
+	coalesceSize = 16 * 1024
+
+	// Log statistics with this period.
+	statsPeriod = 10 * time.Second
+
+	// Size of an encoded sample.
+	sampleSize = 14
+)
+
+// sample is a single sensor reading.
+type sample struct {
+	// Time of the reading in microseconds since the Unix epoch.
+	Time int64
+
+	// The sensor that made the reading.
+	Sensor uint16
+
+	// The reading.
+	Value float32
+}
+
+// appendSample appends the big-endian encoding of s to p.
+func appendSample(p []byte, s sample) []byte {
+	var b [sampleSize]byte
+	binary.BigEndian.PutUint64(b[0:], uint64(s.Time))
+	binary.BigEndian.PutUint16(b[8:], s.Sensor)
+	binary.BigEndian.PutUint32(b[10:], math.Float32bits(s.Value))
+	return append(p, b[:]...)
+}
+
+// client is a middleman between the websocket connection and the hub.
+type client struct {
+	ws *websocket.Conn
+
+	// Buffered channel of outbound messages.
+	send chan *websocket.PreparedMessage
+
+	// Number of messages dropped because the send channel was full.
+	dropped int64
+}
+
+// hub maintains the set of clients and broadcasts messages to the clients.
+type hub struct {
+	clients    map[*client]bool
+	broadcast  chan *websocket.PreparedMessage
+	register   chan *client
+	unregister chan *client
+}
+
+var h = hub{
+	clients:    make(map[*client]bool),
+	broadcast:  make(chan *websocket.PreparedMessage, 1),
+	register:   make(chan *client),
+	unregister: make(chan *client),
+}
+
+func (h *hub) run() {
+	stats := time.NewTicker(statsPeriod)
+	defer stats.Stop()
+	var sent, dropped int64
+	for {
+		select {
+		case c := <-h.register:
+			h.clients[c] = true
+		case c := <-h.unregister:
+			if h.clients[c] {
+				delete(h.clients, c)
+				close(c.send)
+				dropped += c.dropped
+			}
+		case pm := <-h.broadcast:
+			for c := range h.clients {
+				select {
+				case c.send <- pm:
+					sent++
+				default:
+					// The client is not keeping up. Drop the message
+					// instead of blocking the broadcast to other clients.
+					c.dropped++
+				}
+			}
+		case <-stats.C:
+			n := dropped
+			for c := range h.clients {
+				n += c.dropped
+			}
+			log.Printf("clients: %d, sent: %d, dropped: %d", len(h.clients), sent, n)
+		}
+	}
+}
+
+// generate broadcasts batches of simulated samples at the configured rate.
+func generate() {
+	ticker := time.NewTicker(time.Second / time.Duration(*rate))
+	defer ticker.Stop()
+	buf := make([]byte, 0, *sensors**batch*sampleSize)
+	phase := 0.0
+	for t := range ticker.C {
+		buf = buf[:0]
+		step := time.Second / time.Duration(*rate) / time.Duration(*batch)
+		for i := 0; i < *batch; i++ {
+			ts := t.Add(time.Duration(i) * step)
+			for j := 0; j < *sensors; j++ {
+				v := math.Sin(phase + float64(j)*math.Pi/float64(*sensors))
+				buf = appendSample(buf, sample{Time: ts.UnixNano() / 1000, Sensor: uint16(j), Value: float32(v)})
+			}
+			phase += 0.01
+		}
+		// The prepared message retains the payload. Copy the buffer so
+		// that it can be reused for the next batch.
+		pm, err := websocket.NewPreparedMessage(websocket.OpBinary, append([]byte(nil), buf...))
+		if err != nil {
+			log.Fatal(err)
+		}
+		select {
+		case h.broadcast <- pm:
+		default:
+			// The hub is busy. Skip the batch.
+		}
+	}
+}
+
+// readPump reads control messages from the client. The client is not
+// expected to send data messages.
+func (c *client) readPump() {
+	defer func() {
+		h.unregister <- c
+		c.ws.Close()
+	}()
+	c.ws.SetReadLimit(512)
+	c.ws.SetReadDeadline(time.Now().Add(readWait))
+	for {
+		op, r, err := c.ws.NextReader()
+		if err != nil {
+			return
+		}
+		if op == websocket.OpPong {
+			c.ws.SetReadDeadline(time.Now().Add(readWait))
+		}
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			return
+		}
+	}
+}
+
+// writePump writes messages from the hub to the websocket connection.
+func (c *client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.ws.Close()
+	}()
+	if *coalesce > 0 {
+		c.ws.SetWriteCoalescing(*coalesce, coalesceSize)
+	}
+	for {
+		select {
+		case pm, ok := <-c.send:
+			if !ok {
+				c.ws.WriteControl(websocket.OpClose, []byte{}, time.Now().Add(writeWait))
+				return
+			}
+			c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.ws.WritePreparedMessage(pm); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := c.ws.WriteControl(websocket.OpPing, []byte{}, time.Now().Add(writeWait)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+var upgrader = &websocket.Upgrader{ReadBufferSize: 512, WriteBufferSize: 4096}
+
+func serveWs(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	c := &client{ws: ws, send: make(chan *websocket.PreparedMessage, *queue)}
+	h.register <- c
+	go c.writePump()
+	c.readPump()
+}
+
+var homeTempl = template.Must(template.New("").Parse(homeHTML))
+
+func serveHome(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	homeTempl.Execute(w, r.Host)
+}
+
+func main() {
+	flag.Parse()
+	if *rate <= 0 || *batch <= 0 || *sensors <= 0 {
+		log.Fatal("rate, batch and sensors must be positive")
+	}
+	go h.run()
+	go generate()
+	http.HandleFunc("/", serveHome)
+	http.HandleFunc("/ws", serveWs)
+	if err := http.ListenAndServe(*addr, nil); err != nil {
+		log.Fatal("ListenAndServe: ", err)
+	}
+}
+
+const homeHTML = `<html>
+<head>
+<title>Telemetry Example</title>
+<script type="text/javascript">
+window.onload = function() {
+    var status = document.getElementById("status");
+    var values = document.getElementById("values");
+    if (!window["WebSocket"]) {
+        status.textContent = "Your browser does not support WebSockets.";
+        return;
+    }
+    var scheme = window.location.protocol == "https:" ? "wss://" : "ws://";
+    var conn = new WebSocket(scheme + "{{.}}/ws");
+    conn.binaryType = "arraybuffer";
+    var messages = 0, samples = 0, latest = {};
+    conn.onclose = function(evt) {
+        status.textContent = "Connection closed.";
+    };
+    conn.onmessage = function(evt) {
+        var view = new DataView(evt.data);
+        for (var i = 0; i + 14 <= view.byteLength; i += 14) {
+            var sensor = view.getUint16(i + 8);
+            latest[sensor] = view.getFloat32(i + 10);
+            samples++;
+        }
+        messages++;
+    };
+    setInterval(function() {
+        status.textContent = messages + " messages, " + samples + " samples per second";
+        messages = samples = 0;
+        var text = "";
+        for (var sensor in latest) {
+            text += "sensor " + sensor + ": " + latest[sensor].toFixed(3) + "\n";
+        }
+        values.textContent = text;
+    }, 1000);
+};
+</script>
+</head>
+<body>
+<div id="status">Connecting...</div>
+<pre id="values"></pre>
+</body>
+</html>
+`
@@ -0,0 +1,276 @@
+// Command workerpool shows how to decouple the per-connection read loop from
+// expensive message processing.
+//
+// Each connection has a read goroutine and a write goroutine. The read
+// goroutine submits each message to a bounded pool of worker goroutines
+// shared by all connections. The workers send results to the connection's
+// write goroutine.
+//
+// Backpressure is applied at two levels. A connection can have at most
+// -inflight messages submitted to the pool. When a connection reaches the
+// limit, its read goroutine stops reading until a result is written to the
+// client. The pool has a queue of -queue pending jobs. When the queue is
+// full, read goroutines block until a worker is free. In both cases the
+// server stops reading from the network and TCP flow control slows down the
+// clients.
+//
+// Send a number n to the server to count the primes less than or equal to n.
+package main
+
+import (
+	"flag"
+	"github.com/garyburd/go-websocket/websocket"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"runtime"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+var (
+	addr     = flag.String("addr", ":8080", "http service address")
+	workers  = flag.Int("workers", runtime.NumCPU(), "number of worker goroutines")
+	queue    = flag.Int("queue", 64, "number of jobs queued for the workers")
+	inflight = flag.Int("inflight", 4, "maximum number of jobs in progress for each connection")
+)
+
+const (
+	// Time allowed to write a message to the client.
+	writeWait = 10 * time.Second
+
+	// Time allowed to read the next message from the client.
+	readWait = 60 * time.Second
+
+	// Send pings to client with this period. Must be less than readWait.
+	pingPeriod = (readWait * 9) / 10
+
+	// Maximum message size allowed from client.
+	maxMessageSize = 64
+
+	// Largest number accepted from the client.
+	maxN = 50000000
+)
+
+// job is a message submitted to the worker pool.
+type job struct {
+	c    *connection
+	data []byte
+}
+
+// jobs is the queue of jobs for the worker pool.
+var jobs chan job
+
+// worker processes jobs until the jobs channel is closed.
+func worker() {
+	for j := range jobs {
+		// The send does not block because the connection has at most
+		// cap(j.c.send) jobs in progress.
+		j.c.send <- process(j.data)
+	}
+}
+
+// process counts the primes less than or equal to the number in p.
+func process(p []byte) []byte {
+	n, err := strconv.Atoi(string(p))
+	if err != nil || n < 0 || n > maxN {
+		return []byte("error: expected a number between 0 and " + strconv.Itoa(maxN))
+	}
+	composite := make([]bool, n+1)
+	count := 0
+	for i := 2; i <= n; i++ {
+		if composite[i] {
+			continue
+		}
+		count++
+		for j := i * i; j <= n; j += i {
+			composite[j] = true
+		}
+	}
+	return []byte(strconv.Itoa(count) + " primes <= " + strconv.Itoa(n))
+}
+
+// connection is a middleman between the websocket connection and the worker
+// pool.
+type connection struct {
+	ws *websocket.Conn
+
+	// Results from the workers. The capacity of the channel is the maximum
+	// number of jobs in progress for the connection.
+	send chan []byte
+
+	// Semaphore limiting the number of jobs in progress for the connection.
+	tokens chan bool
+
+	// Closed when the read goroutine exits.
+	done chan bool
+
+	// Closed when the write goroutine exits.
+	stopped chan bool
+}
+
+// readPump reads messages from the connection and submits them to the worker
+// pool.
+func (c *connection) readPump() {
+	defer func() {
+		close(c.done)
+		c.ws.Close()
+	}()
+	c.ws.SetReadLimit(maxMessageSize)
+	c.ws.SetReadDeadline(time.Now().Add(readWait))
+	for {
+		op, r, err := c.ws.NextReader()
+		if err != nil {
+			return
+		}
+		switch op {
+		case websocket.OpPong:
+			c.ws.SetReadDeadline(time.Now().Add(readWait))
+		case websocket.OpText:
+			p, err := ioutil.ReadAll(r)
+			if err != nil {
+				return
+			}
+			// Acquire a token and submit the job. Both operations block
+			// when the limits are reached. The read deadline is extended
+			// after the job is accepted so that time spent waiting for the
+			// pool does not count against the client.
+			select {
+			case c.tokens <- true:
+			case <-c.stopped:
+				return
+			}
+			jobs <- job{c, p}
+			c.ws.SetReadDeadline(time.Now().Add(readWait))
+		}
+	}
+}
+
+// write writes a message with the given opCode and payload.
+func (c *connection) write(opCode websocket.MessageType, payload []byte) error {
+	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.ws.WriteMessage(opCode, payload)
+}
+
+// writePump writes results from the workers to the websocket connection.
+func (c *connection) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.ws.Close()
+		close(c.stopped)
+	}()
+	for {
+		select {
+		case result := <-c.send:
+			// Release the token so that the read goroutine can submit the
+			// next job.
+			<-c.tokens
+			if err := c.write(websocket.OpText, result); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := c.write(websocket.OpPing, []byte{}); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+var upgrader = &websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024}
+
+func serveWs(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	c := &connection{
+		ws:      ws,
+		send:    make(chan []byte, *inflight),
+		tokens:  make(chan bool, *inflight),
+		done:    make(chan bool),
+		stopped: make(chan bool),
+	}
+	go c.writePump()
+	c.readPump()
+}
+
+var homeTempl = template.Must(template.New("").Parse(homeHTML))
+
+func serveHome(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	homeTempl.Execute(w, r.Host)
+}
+
+func main() {
+	flag.Parse()
+	if *workers <= 0 || *queue < 0 || *inflight <= 0 {
+		log.Fatal("workers and inflight must be positive")
+	}
+	jobs = make(chan job, *queue)
+	for i := 0; i < *workers; i++ {
+		go worker()
+	}
+	http.HandleFunc("/", serveHome)
+	http.HandleFunc("/ws", serveWs)
+	if err := http.ListenAndServe(*addr, nil); err != nil {
+		log.Fatal("ListenAndServe: ", err)
+	}
+}
+
+const homeHTML = `<html>
+<head>
+<title>Worker Pool Example</title>
+<script type="text/javascript">
+window.onload = function() {
+    var log = document.getElementById("log");
+    var form = document.getElementById("form");
+    var n = document.getElementById("n");
+    function appendLog(text) {
+        var d = document.createElement("div");
+        d.textContent = text;
+        log.appendChild(d);
+    }
+    if (!window["WebSocket"]) {
+        appendLog("Your browser does not support WebSockets.");
+        return;
+    }
+    var scheme = window.location.protocol == "https:" ? "wss://" : "ws://";
+    var conn = new WebSocket(scheme + "{{.}}/ws");
+    conn.onclose = function(evt) {
+        appendLog("Connection closed.");
+    };
+    conn.onmessage = function(evt) {
+        appendLog(evt.data);
+    };
+    form.onsubmit = function() {
+        // Send a burst of jobs to show the limits in action.
+        for (var i = 0; i < 10; i++) {
+            conn.send(n.value);
+        }
+        return false;
+    };
+};
+</script>
+</head>
+<body>
+<form id="form">
+<input type="text" id="n" value="10000000"/>
+<input type="submit" value="Count primes x 10"/>
+</form>
+<div id="log"></div>
+</body>
+</html>
+`
@@ -0,0 +1,119 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseCIDRs parses a list of CIDR blocks and IP addresses. An IP address is
+// treated as a block containing the single address.
+func ParseCIDRs(s ...string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(s))
+	for _, v := range s {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: v}
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoteIP returns the IP address of the client that sent the request. If
+// the request is from one of the trusted proxies, then RemoteIP returns the
+// address closest to the server in the X-Forwarded-For header that is not a
+// trusted proxy. RemoteIP returns nil if the address cannot be determined.
+func RemoteIP(r *http.Request, trustedProxies []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(trustedProxies, ip) {
+		return ip
+	}
+
+	// Collect the forwarded addresses from all headers in order.
+	var forwarded []string
+	for _, v := range r.Header["X-Forwarded-For"] {
+		forwarded = append(forwarded, strings.Split(v, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		fip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if fip == nil {
+			// Do not trust addresses added before a malformed entry.
+			return ip
+		}
+		ip = fip
+		if !containsIP(trustedProxies, ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// AddressPolicy specifies the client addresses allowed to connect to a
+// server. Use the Check method as the Upgrader CheckAddress function:
+//
+//  internal, _ := websocket.ParseCIDRs("10.0.0.0/8", "fd00::/8")
+//  policy := &websocket.AddressPolicy{Allow: internal}
+//  upgrader := websocket.Upgrader{CheckAddress: policy.Check}
+type AddressPolicy struct {
+	// Allow is the list of allowed address ranges. If Allow is empty, then
+	// all addresses not in Deny are allowed.
+	Allow []*net.IPNet
+
+	// Deny is the list of denied address ranges. Deny takes precedence over
+	// Allow.
+	Deny []*net.IPNet
+
+	// TrustedProxies is the list of proxy address ranges trusted to report
+	// the client address in the X-Forwarded-For header.
+	TrustedProxies []*net.IPNet
+}
+
+// Check returns true if the request's client address is allowed by the
+// policy.
+func (p *AddressPolicy) Check(r *http.Request) bool {
+	ip := RemoteIP(r, p.TrustedProxies)
+	if ip == nil || containsIP(p.Deny, ip) {
+		return false
+	}
+	return len(p.Allow) == 0 || containsIP(p.Allow, ip)
+}
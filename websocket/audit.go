@@ -0,0 +1,275 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// ConnRecord describes the lifecycle of a connection.
+type ConnRecord struct {
+	// ID is the connection's ID. See the Conn ID method.
+	ID string
+
+	// Opened and Closed are the times the connection was opened and closed.
+	Opened, Closed time.Time
+
+	// Principal is the connection's principal. See the Conn Value method.
+	Principal interface{}
+
+	// RemoteAddr is the remote network address.
+	RemoteAddr net.Addr
+
+	// BytesRead and BytesWritten are the number of bytes read from and
+	// written to the network after the handshake.
+	BytesRead, BytesWritten int64
+
+	// CloseCode and CloseText are from the first close message sent or
+	// received on the connection. If no close message was sent or received,
+	// then CloseCode is CloseAbnormalClosure.
+	CloseCode int
+	CloseText string
+
+	// ClosedByPeer is true if the peer sent the first close message.
+	ClosedByPeer bool
+}
+
+// Duration returns the time the connection was open.
+func (r *ConnRecord) Duration() time.Duration {
+	return r.Closed.Sub(r.Opened)
+}
+
+// connIDPrefix distinguishes the IDs of connections created by this process
+// from the IDs created by other processes.
+var connIDPrefix = func() string {
+	var p [6]byte
+	io.ReadFull(crand.Reader, p[:])
+	return hex.EncodeToString(p[:]) + "-"
+}()
+
+// connIDCounter is the number of connection IDs assigned by this process.
+var connIDCounter uint64
+
+func newConnID() string {
+	return connIDPrefix + strconv.FormatUint(atomic.AddUint64(&connIDCounter, 1), 10)
+}
+
+// ID returns the connection's ID. The ID is assigned when the connection is
+// created by the upgrade or dial and is unique with high probability across
+// processes. Include the ID in log messages and metrics to correlate the
+// events for a connection. ID can be called concurrently with all other
+// methods.
+func (c *Conn) ID() string {
+	return c.id
+}
+
+// WriteStats describes the writes to the network connection. Operators use
+// the statistics to check that write coalescing and vectored writes reduce
+// the number of system calls for the workload.
+type WriteStats struct {
+	// Messages is the number of data and control messages written.
+	Messages int64
+
+	// Writes is the number of writes to the network connection. A vectored
+	// write counts as one write.
+	Writes int64
+
+	// Bytes is the number of bytes written to the network connection.
+	Bytes int64
+}
+
+// WritesPerMessage returns the average number of writes for each message.
+func (s WriteStats) WritesPerMessage() float64 {
+	if s.Messages == 0 {
+		return 0
+	}
+	return float64(s.Writes) / float64(s.Messages)
+}
+
+// BytesPerWrite returns the average number of bytes written in each write.
+func (s WriteStats) BytesPerWrite() float64 {
+	if s.Writes == 0 {
+		return 0
+	}
+	return float64(s.Bytes) / float64(s.Writes)
+}
+
+// WriteStats returns the statistics for the writes to the network connection
+// since the connection was opened. WriteStats can be called concurrently
+// with all other methods.
+func (c *Conn) WriteStats() WriteStats {
+	return WriteStats{
+		Messages: atomic.LoadInt64(&c.messagesWritten),
+		Writes:   atomic.LoadInt64(&c.writeCalls),
+		Bytes:    atomic.LoadInt64(&c.bytesWritten),
+	}
+}
+
+// countWrite records a write of n bytes to the network connection.
+func (c *Conn) countWrite(n int64) {
+	atomic.AddInt64(&c.writeCalls, 1)
+	atomic.AddInt64(&c.bytesWritten, n)
+	if c.tenant != nil {
+		c.tenant.transfer(&c.tenant.bytesWritten, int(n))
+	}
+}
+
+// countingReader counts the bytes read from the network connection.
+type countingReader struct {
+	c *Conn
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.c.conn.Read(p)
+	atomic.AddInt64(&r.c.bytesRead, int64(n))
+	if r.c.tenant != nil {
+		r.c.tenant.transfer(&r.c.tenant.bytesRead, n)
+	}
+	return n, err
+}
+
+// recordClose records the first close message sent or received on the
+// connection.
+func (c *Conn) recordClose(payload []byte, byPeer bool) {
+	c.auditMu.Lock()
+	defer c.auditMu.Unlock()
+	if c.closeRecorded {
+		return
+	}
+	c.closeRecorded = true
+	c.closedByPeer = byPeer
+	c.closeCode = CloseNoStatusReceived
+	if len(payload) >= 2 {
+		c.closeCode = int(binary.BigEndian.Uint16(payload))
+		c.closeText = string(payload[2:])
+	}
+}
+
+// SetCloseHook sets a function that is called with the connection's
+// lifecycle record when the application closes the connection. The function
+// is called at most once.
+func (c *Conn) SetCloseHook(f func(r *ConnRecord)) {
+	c.auditMu.Lock()
+	c.closeHook = f
+	c.auditMu.Unlock()
+}
+
+// record returns the lifecycle record for the connection. The caller must
+// hold auditMu.
+func (c *Conn) record() *ConnRecord {
+	r := &ConnRecord{
+		ID:           c.id,
+		Opened:       c.opened,
+		Closed:       time.Now(),
+		Principal:    c.Value(),
+		RemoteAddr:   c.conn.RemoteAddr(),
+		BytesRead:    atomic.LoadInt64(&c.bytesRead),
+		BytesWritten: atomic.LoadInt64(&c.bytesWritten),
+		CloseCode:    CloseAbnormalClosure,
+	}
+	if c.closeRecorded {
+		r.CloseCode = c.closeCode
+		r.CloseText = c.closeText
+		r.ClosedByPeer = c.closedByPeer
+	}
+	return r
+}
+
+// MemoryUsage describes the memory held by connections for buffers and
+// queues. The sizes are in bytes.
+type MemoryUsage struct {
+	// Conns is the number of connections.
+	Conns int64
+
+	// ReadBuffer and WriteBuffer are the sizes of the read and write
+	// buffers.
+	ReadBuffer, WriteBuffer int64
+
+	// Queued is the capacity of the write coalescing buffer and the queue
+	// of control frames. See the Conn SetWriteCoalescing and
+	// SetControlQueueLimit methods.
+	Queued int64
+}
+
+// Total returns the total number of bytes held.
+func (m MemoryUsage) Total() int64 {
+	return m.ReadBuffer + m.WriteBuffer + m.Queued
+}
+
+// memoryTotals is the memory usage of all open connections. The fields are
+// accessed atomically.
+type memoryTotals MemoryUsage
+
+var openMemory memoryTotals
+
+func (t *memoryTotals) add(m MemoryUsage, sign int64) {
+	atomic.AddInt64(&t.Conns, sign*m.Conns)
+	atomic.AddInt64(&t.ReadBuffer, sign*m.ReadBuffer)
+	atomic.AddInt64(&t.WriteBuffer, sign*m.WriteBuffer)
+	atomic.AddInt64(&t.Queued, sign*m.Queued)
+}
+
+// TotalMemoryUsage returns the memory usage of all connections created by
+// the package that the application has not closed. Use TotalMemoryUsage with
+// the number of connections to plan the capacity of servers with many
+// connections. The totals do not include memory held by the operating system
+// for the network connections or memory held by the application.
+func TotalMemoryUsage() MemoryUsage {
+	return MemoryUsage{
+		Conns:       atomic.LoadInt64(&openMemory.Conns),
+		ReadBuffer:  atomic.LoadInt64(&openMemory.ReadBuffer),
+		WriteBuffer: atomic.LoadInt64(&openMemory.WriteBuffer),
+		Queued:      atomic.LoadInt64(&openMemory.Queued),
+	}
+}
+
+// MemoryUsage returns the memory held by the connection for buffers and
+// queues. MemoryUsage can be called concurrently with all other methods.
+func (c *Conn) MemoryUsage() MemoryUsage {
+	c.auditMu.Lock()
+	defer c.auditMu.Unlock()
+	return c.memoryUsage()
+}
+
+// memoryUsage returns the memory held by the connection. The caller must hold
+// auditMu or own the connection.
+func (c *Conn) memoryUsage() MemoryUsage {
+	return MemoryUsage{
+		Conns:       1,
+		ReadBuffer:  int64(c.readBufSize),
+		WriteBuffer: int64(c.writeBufSize),
+		Queued:      int64(c.queued),
+	}
+}
+
+// addQueued adds n bytes to the size of the connection's queues.
+func (c *Conn) addQueued(n int) {
+	if n == 0 {
+		return
+	}
+	c.auditMu.Lock()
+	c.queued += n
+	if !c.closed {
+		openMemory.add(MemoryUsage{Queued: int64(n)}, 1)
+	}
+	c.auditMu.Unlock()
+}
@@ -15,31 +15,61 @@
 package websocket
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
+// ErrBadHandshake is returned when the server response to the opening
+// handshake is invalid.
+var ErrBadHandshake = errors.New("websocket: bad handshake")
+
 // NewClient creates a new client connection using the given net connection.
 // The URL u specifies the host and request URI. Use requestHeader to sepcify
 // the origin (Origin), subprotocols (Set-WebSocket-Protocol) and cookies
 // (Cookie). Use the response.Header to get the selected subprotocol
 // (Sec-WebSocket-Protocol) and cookies (Set-Cookie).
+//
+// If the server response is not a valid handshake response, then NewClient
+// returns the response and ErrBadHandshake so that the application can
+// examine the status and headers of the response.
 func NewClient(netConn net.Conn, u *url.URL, requestHeader http.Header, readBufSize, writeBufSize int) (c *Conn, response *http.Response, err error) {
+	return newClient(netConn, u, requestHeader, readBufSize, writeBufSize, true, nil)
+}
+
+// newClient creates a client connection. If strict is false, then the client
+// tolerates common deviations from the protocol by servers. See the Dialer
+// Lenient field for details. If prepare is not nil, then prepare is called
+// with the handshake request before the request is sent.
+func newClient(netConn net.Conn, u *url.URL, requestHeader http.Header, readBufSize, writeBufSize int, strict bool, prepare func(*http.Request) error) (c *Conn, response *http.Response, err error) {
 	challengeKey, err := generateChallengeKey()
 	if err != nil {
 		return nil, nil, err
 	}
 	acceptKey := computeAcceptKey(challengeKey)
 
+	requestURI, host := u.RequestURI(), u.Host
+	if prepare != nil {
+		req, err := prepareRequest(prepare, u, requestHeader, challengeKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		requestURI, host, requestHeader = req.URL.RequestURI(), req.Host, req.Header
+	}
+
 	c = newConn(netConn, false, readBufSize, writeBufSize)
 	p := c.writeBuf[:0]
 	p = append(p, "GET "...)
-	p = append(p, u.RequestURI()...)
+	p = append(p, requestURI...)
 	p = append(p, " HTTP/1.1\r\nHost: "...)
-	p = append(p, u.Host...)
+	p = append(p, host...)
 	p = append(p, "\r\nUpgrade: websocket\r\nConnection: upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: "...)
 	p = append(p, challengeKey...)
 	p = append(p, "\r\n"...)
@@ -54,18 +84,365 @@ func NewClient(netConn net.Conn, u *url.URL, requestHeader http.Header, readBufS
 	p = append(p, "\r\n"...)
 
 	if _, err := netConn.Write(p); err != nil {
+		c.abandon()
 		return nil, nil, err
 	}
 
 	resp, err := http.ReadResponse(c.br, &http.Request{Method: "GET", URL: u})
 	if err != nil {
+		c.abandon()
 		return nil, nil, err
 	}
+	accept := resp.Header.Get("Sec-Websocket-Accept")
+	if !strict {
+		accept = strings.TrimSpace(accept)
+	}
 	if resp.StatusCode != 101 ||
-		!strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") ||
-		!strings.EqualFold(resp.Header.Get("Connection"), "upgrade") ||
-		resp.Header.Get("Sec-Websocket-Accept") != acceptKey {
-		return nil, nil, errors.New("websocket: bad handshake")
+		!tokenListContainsValue(resp.Header, "Upgrade", "websocket") ||
+		!tokenListContainsValue(resp.Header, "Connection", "upgrade") ||
+		(accept != acceptKey && (strict || !strings.EqualFold(accept, acceptKey))) {
+		c.abandon()
+		return nil, resp, ErrBadHandshake
 	}
+	c.allowMasked = !strict
+	c.extensions = parseExtensions(resp.Header)
+	// Count the bytes read after the handshake response.
+	atomic.StoreInt64(&c.bytesRead, int64(c.br.Buffered()))
 	return c, resp, nil
 }
+
+// handshakeHeaders are the request headers written by newClient.
+var handshakeHeaders = []string{"Upgrade", "Connection", "Sec-Websocket-Version", "Sec-Websocket-Key"}
+
+// prepareRequest calls prepare with the handshake request for u. The
+// returned request header does not include the handshake headers.
+func prepareRequest(prepare func(*http.Request) error, u *url.URL, requestHeader http.Header, challengeKey string) (*http.Request, error) {
+	reqURL := *u
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &reqURL,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header, len(requestHeader)+len(handshakeHeaders)),
+		Host:       u.Host,
+	}
+	for k, vs := range requestHeader {
+		req.Header[k] = append([]string(nil), vs...)
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", challengeKey)
+	if err := prepare(req); err != nil {
+		return nil, err
+	}
+	for _, k := range handshakeHeaders {
+		req.Header.Del(k)
+	}
+	return req, nil
+}
+
+// A Dialer contains options for connecting to a WebSocket server.
+type Dialer struct {
+	// NetDial specifies the dial function for creating TCP connections. If
+	// NetDial is nil, then net.Dial is used.
+	NetDial func(network, addr string) (net.Conn, error)
+
+	// Host specifies the value of the Host header sent to the server. If
+	// Host is empty, then the host from the URL is used. The connection is
+	// made to the host in the URL. Use Host with an IP address in the URL to
+	// reach a virtual host at a specific address. The TLS server name is set
+	// independently with the ServerName field of TLSClientConfig and
+	// defaults to the host in the URL.
+	Host string
+
+	// LookupHost specifies the function for resolving the host in the URL to
+	// addresses. If LookupHost is nil, then NetDial resolves the host. If
+	// LookupHost is set, then Dial passes each of the returned addresses to
+	// NetDial in order until a connection is established. Use the LookupHost
+	// method of a net.Resolver to resolve names with a specific resolver.
+	LookupHost func(ctx context.Context, host string) (addrs []string, err error)
+
+	// TLSClientConfig specifies the TLS configuration to use with tls.Client.
+	// If nil, the default configuration is used. If NextProtos is empty, then
+	// Dial offers the http/1.1 application protocol. Dial fails if the
+	// server selects a protocol other than http/1.1. The negotiated protocol
+	// is available in the TLS field of the response returned from Dial.
+	TLSClientConfig *tls.Config
+
+	// HandshakeTimeout specifies the duration for the TLS and WebSocket
+	// handshakes to complete. If HandshakeTimeout is zero, then the
+	// handshakes do not time out.
+	HandshakeTimeout time.Duration
+
+	// ReadBufferSize and WriteBufferSize specify I/O buffer sizes. If a buffer
+	// size is zero, then a default value of 4096 is used.
+	ReadBufferSize, WriteBufferSize int
+
+	// MaskKeySource specifies the source of the masking keys for frames
+	// written to the server. If MaskKeySource is nil, then crypto/rand.Reader
+	// is used. See the Conn SetMaskKeySource method for details.
+	MaskKeySource io.Reader
+
+	// MaskInPlace specifies whether connections mask large payloads in the
+	// application's buffer. See the Conn SetMaskInPlace method for details.
+	MaskInPlace bool
+
+	// HTTP2Transport specifies a transport for connecting over an HTTP/2
+	// stream with an extended CONNECT request (RFC 8441). The transport must
+	// send the :protocol pseudo-header from the request header, as the
+	// golang.org/x/net/http2 Transport does. If HTTP2Transport is nil, then
+	// Dial connects with HTTP/1.1. The NetDial and TLSClientConfig fields are
+	// not used with HTTP2Transport. The stream is aborted when a deadline
+	// expires.
+	HTTP2Transport http.RoundTripper
+
+	// HTTP3Transport specifies a transport for connecting over an HTTP/3
+	// stream with an extended CONNECT request (RFC 9220). The transport must
+	// send the request Proto field as the :protocol pseudo-header, as the
+	// github.com/quic-go/quic-go/http3 Transport does. HTTP3Transport takes
+	// precedence over HTTP2Transport. Support for HTTP/3 is experimental.
+	HTTP3Transport http.RoundTripper
+
+	// Proxy specifies a function to return the HTTP proxy for a connection.
+	// The function is called with a request for the http or https URL
+	// corresponding to the ws or wss URL. If Proxy is nil or returns a nil
+	// URL, then no proxy is used. Set Proxy to http.ProxyFromEnvironment to
+	// use the proxy specified by the environment. The connection is tunneled
+	// through the proxy with a CONNECT request. User information in the
+	// proxy URL is sent to the proxy with the Basic authentication scheme.
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// ProxyAuth specifies the function for answering a 407 (Proxy
+	// Authentication Required) challenge from the proxy. The function
+	// returns the value of the Proxy-Authorization header for the next
+	// CONNECT request or an empty string to give up. The function can be
+	// called more than once for schemes that take several rounds. The
+	// BasicProxyAuth function returns a ProxyAuth function for the Basic
+	// scheme.
+	ProxyAuth func(proxyURL *url.URL, resp *http.Response) (string, error)
+
+	// Lenient specifies whether the client tolerates servers that deviate
+	// from the protocol. If Lenient is true, then the client accepts
+	// Sec-WebSocket-Accept values that differ from the expected value in
+	// case or surrounding white space and accepts masked frames from the
+	// server, including masked echoes of the client's close message. RFC
+	// 6455 requires clients to reject these servers. Set Lenient to true
+	// only to interoperate with a known nonconforming server.
+	Lenient bool
+
+	// Retry specifies the policy for retrying handshakes rejected by the
+	// server with status 429 (Too Many Requests) or 503 (Service
+	// Unavailable). If Retry is nil, then Dial does not retry.
+	Retry *RetryPolicy
+
+	// PrepareRequest specifies a function that is called with the handshake
+	// request before the request is sent. Use PrepareRequest to sign the
+	// request or to add headers computed at dial time. The request includes
+	// the WebSocket handshake headers so that they can be covered by a
+	// signature. PrepareRequest can modify the URL, Host and Header fields
+	// of the request, but must not modify the handshake headers. If
+	// PrepareRequest returns an error, then Dial returns the error. The
+	// function is not called for connections created with the WebSocket API
+	// of a browser.
+	PrepareRequest func(req *http.Request) error
+}
+
+// DefaultDialer is a dialer with all fields set to the default zero values.
+var DefaultDialer = &Dialer{}
+
+var errMalformedURL = errors.New("websocket: malformed ws or wss URL")
+
+// platformDial creates a connection with a WebSocket provided by the
+// platform. The function is set by the js/wasm build to use the browser's
+// WebSocket API.
+var platformDial func(d *Dialer, u *url.URL, requestHeader http.Header, readBufSize, writeBufSize int) (*Conn, *http.Response, error)
+
+// hostPortNoPort returns the host with the default port for the scheme added
+// and the host without the port.
+func hostPortNoPort(u *url.URL) (hostPort, hostNoPort string) {
+	hostPort = u.Host
+	hostNoPort = u.Host
+	if i := strings.LastIndex(u.Host, ":"); i > strings.LastIndex(u.Host, "]") {
+		hostNoPort = hostNoPort[:i]
+	} else if u.Scheme == "wss" {
+		hostPort += ":443"
+	} else {
+		hostPort += ":80"
+	}
+	return hostPort, strings.Trim(hostNoPort, "[]")
+}
+
+// dialNet connects to hostPort using netDial. The host is resolved using the
+// dialer's LookupHost function if set.
+func (d *Dialer) dialNet(netDial func(network, addr string) (net.Conn, error), hostPort string, deadline time.Time) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil || d.LookupHost == nil || net.ParseIP(host) != nil {
+		return netDial("tcp", hostPort)
+	}
+
+	ctx := context.Background()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	addrs, err := d.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	for _, addr := range addrs {
+		var conn net.Conn
+		conn, err = netDial("tcp", net.JoinHostPort(addr, port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// Dial creates a new client connection to the WebSocket server at urlStr. The
+// URL scheme must be "ws" or "wss". Use requestHeader to specify the origin
+// (Origin), subprotocols (Sec-WebSocket-Protocol) and cookies (Cookie). Use
+// the response.Header to get the selected subprotocol
+// (Sec-WebSocket-Protocol) and cookies (Set-Cookie).
+//
+// If the WebSocket handshake fails, then Dial returns ErrBadHandshake and the
+// server response.
+//
+// When compiled for GOOS=js GOARCH=wasm, Dial connects using the browser's
+// WebSocket API. The browser handles the handshake, ping and pong messages.
+// Only the subprotocols are used from requestHeader and the other Dialer
+// fields except HandshakeTimeout and the buffer sizes are ignored. Messages
+// written with NextWriter are sent when the writer is closed.
+func (d *Dialer) Dial(urlStr string, requestHeader http.Header) (*Conn, *http.Response, error) {
+	if d.Retry != nil {
+		return d.Retry.dial(d, urlStr, requestHeader)
+	}
+	return d.dial(urlStr, requestHeader)
+}
+
+func (d *Dialer) dial(urlStr string, requestHeader http.Header) (*Conn, *http.Response, error) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" || u.User != nil {
+		return nil, nil, errMalformedURL
+	}
+
+	readBufSize := d.ReadBufferSize
+	if readBufSize == 0 {
+		readBufSize = defaultBufferSize
+	}
+	writeBufSize := d.WriteBufferSize
+	if writeBufSize == 0 {
+		writeBufSize = defaultBufferSize
+	}
+
+	if platformDial != nil || d.HTTP3Transport != nil || d.HTTP2Transport != nil {
+		var conn *Conn
+		var resp *http.Response
+		if platformDial != nil {
+			conn, resp, err = platformDial(d, u, requestHeader, readBufSize, writeBufSize)
+		} else if d.HTTP3Transport != nil {
+			conn, resp, err = d.dialStream(d.HTTP3Transport, true, u, requestHeader, readBufSize, writeBufSize)
+		} else {
+			conn, resp, err = d.dialStream(d.HTTP2Transport, false, u, requestHeader, readBufSize, writeBufSize)
+		}
+		if err != nil {
+			return nil, resp, err
+		}
+		conn.SetMaskKeySource(d.MaskKeySource)
+		conn.SetMaskInPlace(d.MaskInPlace)
+		conn.extensions = parseExtensions(resp.Header)
+		return conn, resp, nil
+	}
+
+	hostPort, hostNoPort := hostPortNoPort(u)
+
+	netDial := d.NetDial
+	if netDial == nil {
+		netDial = net.Dial
+	}
+
+	var deadline time.Time
+	if d.HandshakeTimeout != 0 {
+		deadline = time.Now().Add(d.HandshakeTimeout)
+	}
+
+	proxyURL, err := d.proxyURL(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	var netConn net.Conn
+	if proxyURL != nil {
+		netConn, err = d.dialProxy(netDial, proxyURL, hostPort, deadline)
+	} else {
+		netConn, err = d.dialNet(netDial, hostPort, deadline)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if netConn != nil {
+			netConn.Close()
+		}
+	}()
+
+	if err := netConn.SetDeadline(deadline); err != nil {
+		return nil, nil, err
+	}
+
+	var tlsState *tls.ConnectionState
+	if u.Scheme == "wss" {
+		cfg := d.TLSClientConfig
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		if cfg.ServerName == "" || len(cfg.NextProtos) == 0 {
+			cfg = cfg.Clone()
+			if cfg.ServerName == "" {
+				cfg.ServerName = hostNoPort
+			}
+			if len(cfg.NextProtos) == 0 {
+				// The WebSocket handshake is an HTTP/1.1 request.
+				cfg.NextProtos = []string{"http/1.1"}
+			}
+		}
+		tlsConn := tls.Client(netConn, cfg)
+		netConn = tlsConn
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, nil, err
+		}
+		state := tlsConn.ConnectionState()
+		if p := state.NegotiatedProtocol; p != "" && p != "http/1.1" {
+			return nil, nil, errors.New("websocket: server selected unsupported application protocol " + p)
+		}
+		tlsState = &state
+	}
+
+	reqURL := u
+	if d.Host != "" {
+		reqURL = new(url.URL)
+		*reqURL = *u
+		reqURL.Host = d.Host
+	}
+	conn, resp, err := newClient(netConn, reqURL, requestHeader, readBufSize, writeBufSize, !d.Lenient, d.PrepareRequest)
+	if resp != nil {
+		resp.TLS = tlsState
+	}
+	if err != nil {
+		return nil, resp, err
+	}
+	conn.SetMaskKeySource(d.MaskKeySource)
+	conn.SetMaskInPlace(d.MaskInPlace)
+
+	netConn.SetDeadline(time.Time{})
+	netConn = nil // to avoid close in defer.
+	return conn, resp, nil
+}
@@ -0,0 +1,160 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+//go:build js && wasm
+
+package websocket
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall/js"
+	"time"
+)
+
+func init() {
+	platformDial = dialBrowser
+}
+
+// browserSocket is a messageSocket for the browser WebSocket object.
+type browserSocket struct {
+	ws js.Value
+}
+
+func (s browserSocket) Send(opCode MessageType, p []byte) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = errors.New("websocket: browser send failed")
+		}
+	}()
+	if opCode == OpText {
+		s.ws.Call("send", string(p))
+		return nil
+	}
+	a := js.Global().Get("Uint8Array").New(len(p))
+	js.CopyBytesToJS(a, p)
+	s.ws.Call("send", a)
+	return nil
+}
+
+func (s browserSocket) Close(closeCode int, text string) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = errors.New("websocket: browser close failed")
+		}
+	}()
+	// The browser allows the normal closure code and the codes reserved for
+	// applications only.
+	if closeCode == CloseNormalClosure || (closeCode >= 3000 && closeCode <= 4999) {
+		s.ws.Call("close", closeCode, text)
+	} else {
+		s.ws.Call("close")
+	}
+	return nil
+}
+
+// dialBrowser creates a client connection with the browser WebSocket API.
+// The browser sets the request headers. Only the subprotocols in the
+// Sec-WebSocket-Protocol request header are used.
+func dialBrowser(d *Dialer, u *url.URL, requestHeader http.Header, readBufSize, writeBufSize int) (*Conn, *http.Response, error) {
+	var protocols []interface{}
+	for _, v := range requestHeader["Sec-Websocket-Protocol"] {
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				protocols = append(protocols, p)
+			}
+		}
+	}
+
+	ws := js.Global().Get("WebSocket").New(u.String(), protocols)
+	ws.Set("binaryType", "arraybuffer")
+	sc := newSocketConn(browserSocket{ws}, stringAddr(u.Host))
+
+	opened := make(chan bool, 1)
+	var onOpen, onMessage, onError, onClose js.Func
+	onOpen = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		opened <- true
+		return nil
+	})
+	onMessage = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		data := args[0].Get("data")
+		if data.Type() == js.TypeString {
+			sc.deliver(OpText, []byte(data.String()))
+		} else {
+			a := js.Global().Get("Uint8Array").New(data)
+			p := make([]byte, a.Get("length").Int())
+			js.CopyBytesToGo(p, a)
+			sc.deliver(OpBinary, p)
+		}
+		return nil
+	})
+	onError = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		select {
+		case opened <- false:
+		default:
+		}
+		return nil
+	})
+	onClose = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		e := args[0]
+		sc.deliverClose(e.Get("code").Int(), e.Get("reason").String())
+		select {
+		case opened <- false:
+		default:
+		}
+		onOpen.Release()
+		onMessage.Release()
+		onError.Release()
+		onClose.Release()
+		return nil
+	})
+	ws.Set("onopen", onOpen)
+	ws.Set("onmessage", onMessage)
+	ws.Set("onerror", onError)
+	ws.Set("onclose", onClose)
+
+	var timeout <-chan time.Time
+	if d.HandshakeTimeout != 0 {
+		timer := time.NewTimer(d.HandshakeTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case ok := <-opened:
+		if !ok {
+			return nil, nil, ErrBadHandshake
+		}
+	case <-timeout:
+		ws.Call("close")
+		return nil, nil, errors.New("websocket: handshake timeout")
+	}
+
+	resp := &http.Response{
+		Status:     "101 Switching Protocols",
+		StatusCode: http.StatusSwitchingProtocols,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+	}
+	if p := ws.Get("protocol").String(); p != "" {
+		resp.Header.Set("Sec-WebSocket-Protocol", p)
+	}
+	if e := ws.Get("extensions").String(); e != "" {
+		resp.Header.Set("Sec-WebSocket-Extensions", e)
+	}
+	return newConn(sc, false, readBufSize, writeBufSize), resp, nil
+}
@@ -15,12 +15,17 @@
 package websocket_test
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -55,7 +60,7 @@ func (t wsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	for {
 		op, r, err := ws.NextReader()
 		if err != nil {
-			if err != io.EOF {
+			if !websocket.IsCloseError(err) {
 				t.Logf("NextReader: %v", err)
 			}
 			return
@@ -122,3 +127,547 @@ func TestClientServer(t *testing.T) {
 		t.Fatalf("message=%s, want %s", b, "HELLO")
 	}
 }
+
+func TestUpgraderOrigin(t *testing.T) {
+	upgrader := websocket.Upgrader{CheckOrigin: (&websocket.OriginPolicy{Hosts: []string{"example.com"}}).Check}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		ws.Close()
+	}))
+	defer s.Close()
+	u, _ := url.Parse(s.URL)
+
+	for _, tt := range []struct {
+		origin string
+		ok     bool
+	}{
+		{"http://example.com", true},
+		{s.URL, false},
+	} {
+		c, err := net.Dial("tcp", u.Host)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		ws, _, err := websocket.NewClient(c, u, http.Header{"Origin": {tt.origin}}, 1024, 1024)
+		if (err == nil) != tt.ok {
+			t.Errorf("origin %s: NewClient returned error %v, want ok=%v", tt.origin, err, tt.ok)
+		}
+		if ws != nil {
+			ws.Close()
+		}
+		c.Close()
+	}
+}
+
+func TestUpgraderAuthenticate(t *testing.T) {
+	principals := make(chan interface{}, 1)
+	upgrader := websocket.Upgrader{
+		Authenticate: func(r *http.Request) (interface{}, error) {
+			if r.URL.Query().Get("user") == "" {
+				return nil, errors.New("user required")
+			}
+			return r.URL.Query().Get("user"), nil
+		},
+	}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		principals <- ws.Value()
+		ws.Close()
+	}))
+	defer s.Close()
+
+	for _, tt := range []struct {
+		query string
+		ok    bool
+	}{
+		{"user=gopher", true},
+		{"", false},
+	} {
+		u, _ := url.Parse(s.URL + "/?" + tt.query)
+		c, err := net.Dial("tcp", u.Host)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		ws, _, err := websocket.NewClient(c, u, nil, 1024, 1024)
+		if (err == nil) != tt.ok {
+			t.Errorf("query %q: NewClient returned error %v, want ok=%v", tt.query, err, tt.ok)
+		}
+		if ws != nil {
+			if p := <-principals; p != "gopher" {
+				t.Errorf("Value() = %v, want gopher", p)
+			}
+			ws.Close()
+		}
+		c.Close()
+	}
+}
+
+func TestUpgraderOnClose(t *testing.T) {
+	records := make(chan *websocket.ConnRecord, 1)
+	upgrader := websocket.Upgrader{OnClose: func(r *websocket.ConnRecord) { records <- r }}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			if _, _, err := ws.NextReader(); err != nil {
+				return
+			}
+		}
+	}))
+	defer s.Close()
+	u, _ := url.Parse(s.URL)
+	c, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	ws, _, err := websocket.NewClient(c, u, nil, 1024, 1024)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer ws.Close()
+	ws.WriteMessage(websocket.OpText, []byte("hello"))
+	ws.WriteControl(websocket.OpClose, websocket.FormatCloseMessage(websocket.CloseGoingAway, "bye"), time.Now().Add(time.Second))
+
+	r := <-records
+	if r.CloseCode != websocket.CloseGoingAway || r.CloseText != "bye" || !r.ClosedByPeer {
+		t.Errorf("close = %d %q %v, want %d bye true", r.CloseCode, r.CloseText, r.ClosedByPeer, websocket.CloseGoingAway)
+	}
+	if r.BytesRead == 0 || r.BytesWritten == 0 {
+		t.Errorf("bytes read, written = %d, %d, want > 0", r.BytesRead, r.BytesWritten)
+	}
+	if r.RemoteAddr == nil || r.Duration() < 0 {
+		t.Errorf("record = %+v", r)
+	}
+	if r.ID == "" || r.ID == ws.ID() {
+		t.Errorf("record ID = %q, client ID = %q, want distinct IDs", r.ID, ws.ID())
+	}
+}
+
+func TestRegistryDrainAll(t *testing.T) {
+	var registry websocket.Registry
+	upgrader := websocket.Upgrader{Registry: &registry}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			if _, _, err := ws.NextReader(); err != nil {
+				return
+			}
+		}
+	}))
+	defer s.Close()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	// The first client reads and replies to the close message. The second
+	// client does not read.
+	clean, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer clean.Close()
+	stuck, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer stuck.Close()
+	for i := 0; registry.Len() != 2; i++ {
+		if i > 100 {
+			t.Fatalf("registry.Len() = %d, want 2", registry.Len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	go func() {
+		clean.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			if _, _, err := clean.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	result := registry.DrainAll(ctx, websocket.CloseGoingAway, "draining")
+	if result != (websocket.DrainResult{Closed: 1, CutOff: 1}) {
+		t.Errorf("DrainAll() = %+v, want 1 closed and 1 cut off", result)
+	}
+	if n := registry.Len(); n != 0 {
+		t.Errorf("registry.Len() = %d after drain, want 0", n)
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != websocket.ErrBadHandshake || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Dial after drain returned %v, want bad handshake with status 503", err)
+	}
+}
+
+func TestUpgraderMaxLifetime(t *testing.T) {
+	hint := func(c *websocket.Conn) { c.WriteMessage(websocket.OpText, []byte("reconnect")) }
+	for _, onMaxLifetime := range []func(*websocket.Conn){nil, hint} {
+		upgrader := websocket.Upgrader{
+			MaxLifetime:       50 * time.Millisecond,
+			MaxLifetimeJitter: 50 * time.Millisecond,
+			OnMaxLifetime:     onMaxLifetime,
+		}
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ws, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer ws.Close()
+			for {
+				if _, _, err := ws.NextReader(); err != nil {
+					return
+				}
+			}
+		}))
+		ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+		if err != nil {
+			s.Close()
+			t.Fatalf("Dial: %v", err)
+		}
+		start := time.Now()
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		op, p, err := ws.ReadMessage()
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("lifetime expired after %v, want about 50-100ms", d)
+		}
+		if onMaxLifetime == nil {
+			if !websocket.IsCloseError(err, websocket.CloseServiceRestart) {
+				t.Errorf("ReadMessage() returned %v, want service restart close", err)
+			}
+		} else if err != nil || op != websocket.OpText || string(p) != "reconnect" {
+			t.Errorf("ReadMessage() = %v, %q, %v, want reconnect hint", op, p, err)
+		}
+		ws.Close()
+		s.Close()
+	}
+}
+
+func TestRegistryTenants(t *testing.T) {
+	registry := websocket.Registry{
+		Tenant:         func(r *http.Request) string { return r.URL.Query().Get("tenant") },
+		MaxTenantConns: 2,
+	}
+	upgrader := websocket.Upgrader{Registry: &registry}
+	tenants := make(chan string, 10)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		tenants <- ws.Tenant()
+		for {
+			op, p, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			ws.WriteMessage(op, p)
+		}
+	}))
+	defer s.Close()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "?tenant="
+
+	for _, key := range []string{"a", "a", "b"} {
+		ws, _, err := websocket.DefaultDialer.Dial(wsURL+key, nil)
+		if err != nil {
+			t.Fatalf("Dial %s: %v", key, err)
+		}
+		defer ws.Close()
+		if got := <-tenants; got != key {
+			t.Errorf("Tenant() = %q, want %q", got, key)
+		}
+		sendRecv(t, ws)
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL+"a", nil)
+	if err != websocket.ErrBadHandshake || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Dial over limit returned %v, want bad handshake with status 429", err)
+	}
+
+	stats := registry.Tenants()
+	if len(stats) != 2 || stats["a"].Conns != 2 || stats["b"].Conns != 1 {
+		t.Fatalf("Tenants() = %+v, want 2 connections for a and 1 for b", stats)
+	}
+	if s := stats["a"]; s.BytesRead == 0 || s.BytesWritten == 0 {
+		t.Errorf("Tenants()[a] = %+v, want bytes read and written", s)
+	}
+}
+
+func TestRegistryTenantBandwidth(t *testing.T) {
+	const bandwidth = 16 * 1024
+	registry := websocket.Registry{
+		Tenant:             func(r *http.Request) string { return "t" },
+		MaxTenantBandwidth: bandwidth,
+	}
+	upgrader := websocket.Upgrader{Registry: &registry}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		p := make([]byte, bandwidth)
+		for i := 0; i < 4; i++ {
+			if err := ws.WriteMessage(websocket.OpBinary, p); err != nil {
+				return
+			}
+		}
+		ws.ReadMessage()
+	}))
+	defer s.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+
+	// The first second of bandwidth is a burst. A write is delayed after
+	// the bytes are written, so the fourth message is written after a delay
+	// of two seconds.
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			t.Fatalf("ReadMessage: %v", err)
+		}
+	}
+	if d := time.Since(start); d < 1500*time.Millisecond {
+		t.Errorf("read 4 seconds of bandwidth in %v, want delay", d)
+	}
+}
+
+func TestRegistryDrainOver(t *testing.T) {
+	var registry websocket.Registry
+	upgrader := websocket.Upgrader{Registry: &registry}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			if _, _, err := ws.NextReader(); err != nil {
+				return
+			}
+		}
+	}))
+	defer s.Close()
+
+	const n = 4
+	const period = 400 * time.Millisecond
+	closed := make(chan time.Duration, n)
+	for i := 0; i < n; i++ {
+		ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		defer ws.Close()
+		go func(ws *websocket.Conn) {
+			for {
+				if _, _, err := ws.ReadMessage(); err != nil {
+					closed <- 0
+					return
+				}
+			}
+		}(ws)
+	}
+	for i := 0; registry.Len() != n; i++ {
+		if i > 100 {
+			t.Fatalf("registry.Len() = %d, want %d", registry.Len(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	go func() {
+		for i := 0; i < n; i++ {
+			<-closed
+		}
+		closed <- time.Since(start)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result := registry.DrainOver(ctx, period, websocket.CloseServiceRestart, "")
+	if result != (websocket.DrainResult{Closed: n}) {
+		t.Errorf("DrainOver() = %+v, want %d closed", result, n)
+	}
+	if d := <-closed; d < period*(n-1)/n {
+		t.Errorf("clients closed in %v, want at least %v", d, period*(n-1)/n)
+	}
+}
+
+func TestRegistryResumeToken(t *testing.T) {
+	registry := websocket.Registry{ResumeToken: func(c *websocket.Conn) string { return "token-" + c.ID() }}
+	upgrader := websocket.Upgrader{Registry: &registry}
+	ids := make(chan string, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		ids <- ws.ID()
+		for {
+			if _, _, err := ws.NextReader(); err != nil {
+				return
+			}
+		}
+	}))
+	defer s.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+	id := <-ids
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		registry.DrainAll(ctx, websocket.CloseGoingAway, "draining")
+	}()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = ws.ReadMessage()
+	if token := websocket.ResumeToken(err); token != "token-"+id {
+		t.Errorf("ResumeToken(%v) = %q, want %q", err, token, "token-"+id)
+	}
+}
+
+func sendRecv(t *testing.T, ws *websocket.Conn) {
+	const message = "Hello World!"
+	if err := ws.WriteMessage(websocket.OpText, []byte(message)); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	_, r, err := ws.NextReader()
+	if err != nil {
+		t.Fatalf("NextReader: %v", err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(b) != message {
+		t.Fatalf("message=%s, want %s", b, message)
+	}
+}
+
+func TestDial(t *testing.T) {
+	s := httptest.NewServer(wsHandler{t})
+	defer s.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), http.Header{"Origin": {s.URL}})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+	sendRecv(t, ws)
+}
+
+func TestDialPrepareRequest(t *testing.T) {
+	sign := func(r *http.Request) string {
+		return r.Host + r.URL.Path + "?" + r.URL.Query().Get("ts") + ":" + r.Header.Get("Sec-Websocket-Key")
+	}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Signature") != sign(r) || r.Header.Get("Origin") != "http://"+r.Host {
+			http.Error(w, "bad signature", http.StatusForbidden)
+			return
+		}
+		wsHandler{t}.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	requestHeader := http.Header{"Origin": {s.URL}}
+	d := websocket.Dialer{PrepareRequest: func(r *http.Request) error {
+		q := r.URL.Query()
+		q.Set("ts", "12345")
+		r.URL.RawQuery = q.Encode()
+		r.Header.Set("Signature", sign(r))
+		return nil
+	}}
+	ws, _, err := d.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/path", requestHeader)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+	sendRecv(t, ws)
+	if len(requestHeader) != 1 {
+		t.Errorf("PrepareRequest modified the application's header: %v", requestHeader)
+	}
+
+	errSign := errors.New("no credentials")
+	d.PrepareRequest = func(r *http.Request) error { return errSign }
+	if _, _, err := d.Dial("ws"+strings.TrimPrefix(s.URL, "http"), requestHeader); err != errSign {
+		t.Fatalf("Dial returned %v, want %v", err, errSign)
+	}
+}
+
+func TestDialTLS(t *testing.T) {
+	s := httptest.NewTLSServer(wsHandler{t})
+	defer s.Close()
+	certs := x509.NewCertPool()
+	certs.AddCert(s.Certificate())
+	u, _ := url.Parse(s.URL)
+	d := websocket.Dialer{
+		NetDial:         func(network, addr string) (net.Conn, error) { return net.Dial("tcp", u.Host) },
+		TLSClientConfig: &tls.Config{RootCAs: certs},
+	}
+	ws, _, err := d.Dial("wss://example.com/", http.Header{"Origin": {"http://example.com"}})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+	sendRecv(t, ws)
+}
+
+func TestDialTLSALPN(t *testing.T) {
+	s := httptest.NewUnstartedServer(wsHandler{t})
+	s.TLS = &tls.Config{NextProtos: []string{"h2", "http/1.1"}}
+	s.StartTLS()
+	defer s.Close()
+	certs := x509.NewCertPool()
+	certs.AddCert(s.Certificate())
+	u, _ := url.Parse(s.URL)
+	d := websocket.Dialer{
+		NetDial:         func(network, addr string) (net.Conn, error) { return net.Dial("tcp", u.Host) },
+		TLSClientConfig: &tls.Config{RootCAs: certs},
+	}
+	ws, resp, err := d.Dial("wss://example.com/", http.Header{"Origin": {"http://example.com"}})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+	if resp.TLS == nil || resp.TLS.NegotiatedProtocol != "http/1.1" {
+		t.Fatalf("negotiated protocol not http/1.1")
+	}
+
+	d.TLSClientConfig = &tls.Config{RootCAs: certs, NextProtos: []string{"h2"}}
+	if _, _, err := d.Dial("wss://example.com/", http.Header{"Origin": {"http://example.com"}}); err == nil {
+		t.Fatal("Dial with h2 did not return an error")
+	}
+}
+
+func TestDialBadHandshake(t *testing.T) {
+	s := httptest.NewServer(wsHandler{t})
+	defer s.Close()
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), http.Header{"Origin": {"http://other.example.com"}})
+	if err != websocket.ErrBadHandshake {
+		t.Fatalf("Dial returned %v, want %v", err, websocket.ErrBadHandshake)
+	}
+	if resp == nil || resp.StatusCode != 403 {
+		t.Fatalf("resp=%v, want status 403", resp)
+	}
+}
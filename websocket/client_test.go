@@ -0,0 +1,169 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveQuirky accepts one connection on l and responds to the handshake with
+// a lower case Sec-WebSocket-Accept value. The server then sends a masked
+// text message.
+func serveQuirky(t *testing.T, l net.Listener) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		t.Errorf("ReadRequest() returned %v", err)
+		return
+	}
+	accept := strings.ToLower(computeAcceptKey(req.Header.Get("Sec-Websocket-Key")))
+	conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: WebSocket\r\nConnection: Upgrade, Keep-Alive\r\nSec-WebSocket-Accept: " + accept + " \r\n\r\n"))
+
+	p := EncodeFrameHeader(nil, FrameHeader{Final: true, OpCode: OpText, Masked: true, MaskKey: [4]byte{1, 2, 3, 4}, Length: 5})
+	payload := []byte("hello")
+	maskBytes([4]byte{1, 2, 3, 4}, 0, payload)
+	conn.Write(append(p, payload...))
+	conn.Read(make([]byte, 100))
+}
+
+func TestDialLenient(t *testing.T) {
+	for _, lenient := range []bool{false, true} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go serveQuirky(t, l)
+
+		d := Dialer{Lenient: lenient}
+		c, _, err := d.Dial("ws://"+l.Addr().String()+"/", nil)
+		if !lenient {
+			if err != ErrBadHandshake {
+				t.Errorf("strict: Dial() returned %v, want %v", err, ErrBadHandshake)
+			}
+			l.Close()
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Dial() returned %v", err)
+		}
+		op, p, err := c.ReadMessage()
+		if err != nil || op != OpText || string(p) != "hello" {
+			t.Errorf("ReadMessage() returned %v, %q, %v", op, p, err)
+		}
+		c.Close()
+		l.Close()
+	}
+}
+
+func TestRejectedDialMemoryUsage(t *testing.T) {
+	u := Upgrader{CheckOrigin: func(r *http.Request) bool { return false }}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.Upgrade(w, r, nil)
+	}))
+	defer s.Close()
+
+	before := TotalMemoryUsage()
+	for i := 0; i < 5; i++ {
+		_, resp, err := DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+		if err != ErrBadHandshake || resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("Dial() returned %v, want bad handshake", err)
+		}
+	}
+	// Connections from earlier tests may close while the test runs, so the
+	// totals can decrease.
+	if after := TotalMemoryUsage(); after.Conns > before.Conns || after.Total() > before.Total() {
+		t.Errorf("TotalMemoryUsage() after rejected dials = %+v, want at most %+v", after, before)
+	}
+}
+
+func TestDialLookupHost(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveQuirky(t, l)
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	var hosts []string
+	// The quirky server requires a lenient client.
+	d := Dialer{Lenient: true, LookupHost: func(ctx context.Context, host string) ([]string, error) {
+		hosts = append(hosts, host)
+		// The first address refuses connections.
+		return []string{"127.0.0.2", "127.0.0.1"}, nil
+	}}
+	var dialed []string
+	d.NetDial = func(network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		if strings.HasPrefix(addr, "127.0.0.2:") {
+			return nil, errors.New("connection refused")
+		}
+		return net.Dial(network, addr)
+	}
+	c, _, err := d.Dial("ws://example.invalid:"+port+"/", nil)
+	if err != nil {
+		t.Fatalf("Dial() returned %v", err)
+	}
+	c.Close()
+	if len(hosts) != 1 || hosts[0] != "example.invalid" {
+		t.Errorf("looked up %v, want [example.invalid]", hosts)
+	}
+	if len(dialed) != 2 || dialed[1] != "127.0.0.1:"+port {
+		t.Errorf("dialed %v", dialed)
+	}
+}
+
+func TestDialHost(t *testing.T) {
+	hosts := make(chan string, 1)
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts <- r.Host + " " + r.TLS.ServerName
+		var u Upgrader
+		u.CheckOrigin = func(r *http.Request) bool { return true }
+		if c, err := u.Upgrade(w, r, nil); err == nil {
+			c.Close()
+		}
+	}))
+	defer s.Close()
+
+	certs := x509.NewCertPool()
+	certs.AddCert(s.Certificate())
+	d := Dialer{
+		Host:            "www.example.com",
+		TLSClientConfig: &tls.Config{RootCAs: certs, ServerName: "example.com"},
+	}
+	c, _, err := d.Dial(strings.Replace(s.URL, "https", "wss", 1), nil)
+	if err != nil {
+		t.Fatalf("Dial() returned %v", err)
+	}
+	c.Close()
+	if h := <-hosts; h != "www.example.com example.com" {
+		t.Errorf("host and server name = %q, want %q", h, "www.example.com example.com")
+	}
+}
@@ -52,27 +52,45 @@
 // Concurrency
 //
 // A Conn supports a single concurrent caller to the write methods (NextWriter,
-// SetWriteDeadline, WriteMessage) and a single concurrent caller to the read
-// methods (NextReader, SetReadDeadline). The Close and WriteControl methods
-// can be called concurrently with all other methods.
+// SetWriteDeadline, WriteMessage, WriteTextMessage, WriteMessages,
+// WritePreparedMessage) and a single concurrent caller to the read methods
+// (NextReader, ReadMessage, ReadTextMessage, ReadMessageBuffer,
+// ReadMessageSpooled, DiscardMessage, SetReadDeadline).
+// The Close, CloseHandshake and WriteControl methods can be called
+// concurrently with all other methods.
+//
+// A typical server runs a goroutine that reads from the connection and a
+// goroutine that writes messages from a channel to the connection. To use
+// one goroutine per connection, use the Send method to write messages. Send
+// queues messages for a write goroutine owned by the connection. The write
+// goroutine is started lazily by the first call to Send, so a connection
+// that only receives messages uses only the application's read goroutine.
 //
 // Text
 //
 // Text messages in the WebSocket protocol are transmitted as UTF-8. It is the
 // application's responsibility to ensure that text messages are valid UTF-8.
+// Use the SetValidateUTF8 method to validate text messages received from the
+// peer.
 package websocket
 
 import (
 	"bufio"
 	"bytes"
+	crand "crypto/rand"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
+	"net/url"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 // Close codes defined in RFC 6455, section 11.7.
@@ -91,19 +109,126 @@ const (
 	CloseTLSHandshake            = 1015
 )
 
+var closeCodeText = map[int]string{
+	CloseNormalClosure:           "normal closure",
+	CloseGoingAway:               "going away",
+	CloseProtocolError:           "protocol error",
+	CloseUnsupportedData:         "unsupported data",
+	CloseNoStatusReceived:        "no status received",
+	CloseAbnormalClosure:         "abnormal closure",
+	CloseInvalidFramePayloadData: "invalid frame payload data",
+	ClosePolicyViolation:         "policy violation",
+	CloseMessageTooBig:           "message too big",
+	CloseMandatoryExtension:      "mandatory extension",
+	CloseInternalServerErr:       "internal server error",
+	CloseTLSHandshake:            "TLS handshake",
+}
+
+// CloseCodeText returns the name of a close code defined in RFC 6455. It
+// returns the empty string if the code is unknown.
+func CloseCodeText(code int) string {
+	return closeCodeText[code]
+}
+
+// CloseError is the error returned from the read methods when the peer sends
+// a close message. Use errors.As to get the close code and text from the
+// error or use IsCloseError to check for specific close codes.
+type CloseError struct {
+	// Code is the close code from the peer. Code is CloseNoStatusReceived if
+	// the close message does not contain a close code.
+	Code int
+
+	// Text is the text from the peer's close message.
+	Text string
+
+	eof bool // true if the error matches io.EOF.
+}
+
+func (e *CloseError) Error() string {
+	s := "websocket: close " + formatCloseCode(e.Code)
+	if e.Text != "" {
+		s += ": " + e.Text
+	}
+	return s
+}
+
+// Is returns true if target is io.EOF and the connection is configured to
+// report normal closure as io.EOF. See the Conn SetCloseEOF method.
+func (e *CloseError) Is(target error) bool {
+	return target == io.EOF && e.eof
+}
+
+// normal returns true if the peer closed the connection normally.
+func (e *CloseError) normal() bool {
+	return e.Code == CloseNormalClosure || e.Code == CloseGoingAway || e.Code == CloseNoStatusReceived
+}
+
+// IsCloseError returns true if err is a *CloseError with one of the specified
+// codes. If no codes are specified, then IsCloseError returns true for the
+// codes that indicate normal closure: CloseNormalClosure, CloseGoingAway and
+// CloseNoStatusReceived.
+func IsCloseError(err error, codes ...int) bool {
+	var e *CloseError
+	if !errors.As(err, &e) {
+		return false
+	}
+	if len(codes) == 0 {
+		return e.normal()
+	}
+	for _, code := range codes {
+		if e.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// formatCloseCode returns the close code followed by the name of the code,
+// if known.
+func formatCloseCode(code int) string {
+	if text := CloseCodeText(code); text != "" {
+		return strconv.Itoa(code) + " " + text
+	}
+	return strconv.Itoa(code)
+}
+
+// MessageType is a WebSocket frame opcode. The underlying type is int so that
+// applications can convert between MessageType and the integer value of the
+// opcode.
+type MessageType int
+
 // Opcodes defined in RFC 6455, section 11.8.
 const (
-	OpContinuation = 0
-	OpText         = 1
-	OpBinary       = 2
-	OpClose        = 8
-	OpPing         = 9
-	OpPong         = 10
+	OpContinuation MessageType = 0
+	OpText         MessageType = 1
+	OpBinary       MessageType = 2
+	OpClose        MessageType = 8
+	OpPing         MessageType = 9
+	OpPong         MessageType = 10
 )
 
+var messageTypeNames = map[MessageType]string{
+	OpContinuation: "continuation",
+	OpText:         "text",
+	OpBinary:       "binary",
+	OpClose:        "close",
+	OpPing:         "ping",
+	OpPong:         "pong",
+}
+
+// String returns the name of the opcode, or "opcode n" for opcodes not
+// defined in RFC 6455.
+func (t MessageType) String() string {
+	if name, ok := messageTypeNames[t]; ok {
+		return name
+	}
+	return "opcode " + strconv.Itoa(int(t))
+}
+
 var (
-	ErrCloseSent = errors.New("websocket: close sent")
-	ErrReadLimit = errors.New("websocket: read limit exceeded")
+	ErrCloseSent   = errors.New("websocket: close sent")
+	ErrReadLimit   = errors.New("websocket: read limit exceeded")
+	ErrInvalidUTF8 = errors.New("websocket: invalid UTF-8 in text message")
 )
 
 var (
@@ -111,6 +236,7 @@ var (
 	errWriteTimeout        = errors.New("websocket: write timeout")
 	errWriteClosed         = errors.New("websocket: write closed")
 	errInvalidControlFrame = errors.New("websocket: invalid control frame")
+	errNotText             = errors.New("websocket: message is not text")
 )
 
 const (
@@ -119,72 +245,268 @@ const (
 	finalBit                   = 1 << 7
 	maskBit                    = 1 << 7
 	writeWait                  = time.Second
+	defaultControlQueueLimit   = 16
 )
 
-func maskBytes(key [4]byte, pos int, b []byte) int {
-	for i := range b {
-		b[i] ^= key[pos&3]
-		pos += 1
+// newMaskKey returns a masking key read from the connection's mask key
+// source. The key is read to a buffer in the connection so that the buffer
+// does not escape to the heap on each call.
+func (c *Conn) newMaskKey() [4]byte {
+	c.maskMu.Lock()
+	defer c.maskMu.Unlock()
+	if _, err := io.ReadFull(c.maskRand, c.maskBuf[:]); err != nil {
+		// Fall back to the pseudo-random generator if the source fails.
+		n := rand.Uint32()
+		c.maskBuf = [4]byte{byte(n), byte(n >> 8), byte(n >> 16), byte(n >> 24)}
 	}
-	return pos & 3
+	return c.maskBuf
 }
 
-func newMaskKey() [4]byte {
-	n := rand.Uint32()
-	return [4]byte{byte(n), byte(n >> 8), byte(n >> 16), byte(n >> 32)}
+// MessageConn is the message-level subset of the Conn methods. Applications
+// that depend on MessageConn instead of *Conn can be unit tested with a fake
+// connection such as the one in the wstest package.
+type MessageConn interface {
+	ReadMessage() (opCode MessageType, p []byte, err error)
+	WriteMessage(opCode MessageType, data []byte) error
+	Close() error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
 }
 
+var _ MessageConn = (*Conn)(nil)
+
 // Conn represents a WebSocket connection.
 type Conn struct {
 	conn     net.Conn
 	isServer bool
+	id       string
 
 	// Write fields
 	mu        chan bool // used as mutex to protect write to conn and closeSent
 	closeSent bool      // true if close message was sent
 
 	// Message writer fields.
-	writeErr      error
-	writeBuf      []byte // frame is constructed in this buffer.
-	writePos      int    // end of data in writeBuf.
-	writeOpCode   int    // op code for the current frame.
-	writeSeq      int    // incremented to invalidate message writers.
+	writeErr error
+	unusable int32  // 1 if writes can no longer succeed, accessed atomically.
+	writeBuf []byte // frame is constructed in this buffer.
+	writePos int    // end of data in writeBuf.
+	msgLen   int    // bytes written in the current message.
+
+	// Adaptive write buffer fields. See SetWriteBufferRange.
+	adaptMin      int         // minimum payload size of writeBuf, zero if disabled.
+	adaptMax      int         // maximum payload size of writeBuf.
+	adaptPeak     int         // largest message in the current window.
+	adaptCount    int         // number of messages in the current window.
+	writeOpCode   MessageType // op code for the current frame.
+	writeSeq      int         // incremented to invalidate message writers.
 	writeDeadline time.Time
+	writeTimeout  time.Duration // time allowed to write each message.
+	msgDeadline   time.Time     // writeTimeout from the start of the current message.
+	msgOpCode     MessageType   // op code of the current message.
+	maskRand      io.Reader     // source of masking keys for client connections.
+	maskMu        sync.Mutex    // protects maskRand reads and maskBuf.
+	maskBuf       [4]byte
+	maskInPlace   bool // true if large payloads are masked in the caller's buffer.
+	parallelMask  bool // true if multi-megabyte payloads are masked concurrently.
+
+	// Write coalescing fields, protected by mu.
+	coalesceDelay    time.Duration
+	coalesceSize     int
+	coalesceBuf      []byte
+	coalesceDeadline time.Time
+	coalesceTimer    *time.Timer
+	coalescePending  bool // true if coalesceTimer is armed.
+	coalesceErr      error
+
+	// Control frames queued by the reader while another goroutine holds mu,
+	// protected by controlMu.
+	controlMu    sync.Mutex
+	controlQueue []byte // encoded frames.
+	controlCount int    // number of frames in controlQueue.
+	controlLimit int    // maximum number of frames in controlQueue.
 
 	// Read fields
-	readErr       error
-	br            *bufio.Reader
-	readRemaining int64 // bytes remaining in current frame.
-	readFinal     bool  // true the current message has more frames.
-	readSeq       int   // incremented to invalidate message readers.
-	readLength    int64 // Message size.
-	readLimit     int64 // Maximum message size.
-	readMaskPos   int
-	readMaskKey   [4]byte
-	savedPong     []byte
+	readErr         error
+	br              *bufio.Reader
+	readRemaining   int64         // bytes remaining in current frame.
+	readFinal       bool          // true the current message has more frames.
+	readSeq         int           // incremented to invalidate message readers.
+	readLength      int64         // Message size.
+	readLimit       int64         // Maximum message size.
+	readTimeout     time.Duration // time allowed to read each message.
+	readMsgDeadline time.Time     // readTimeout from the start of the current message or zero.
+	readDeadline    time.Time     // deadline set with SetReadDeadline.
+	readFirstTime   time.Time     // arrival of the first frame of the current message.
+	readLastTime    time.Time     // arrival of the final frame or zero.
+	readTimeSeq     int           // readSeq of the message with the arrival times.
+	readMaskPos     int
+	readMaskKey     [4]byte
+	allowMasked     bool   // true if a client accepts masked frames from the server.
+	savedPong       []byte // slice of pongBuf, nil if no pong is saved.
+	pongMismatch    bool   // true if savedPong does not match a ping.
+	pongBuf         [maxControlFramePayloadSize]byte
+	pongReader      bytes.Reader // reader for the last pong message.
+	messageFilter   func(opCode MessageType, p []byte) error
+	validateUTF8    bool
+	closeEOF        bool        // true if normal closure errors match io.EOF.
+	zeroCopy        bool        // true if ReadMessage aliases connection memory.
+	zeroCopyBuf     []byte      // buffer for zero-copy reads of fragmented messages.
+	pongWait        int64       // read deadline extension in nanoseconds, accessed atomically.
+	limits          *LimitSet   // runtime-tunable limits or nil.
+	extensions      []Extension // extensions agreed in the handshake.
+	readText        bool        // true if the current message is a text message.
+	readUTF8        UTF8Validator
+	readScratch     [maxControlFramePayloadSize]byte // frame header and control payload.
+	poolReader      messageReader                    // reader used by ReadMessageBuffer.
+
+	// Pong verification. See the SetVerifyPong method.
+	pingMu     sync.Mutex
+	verifyPong bool
+	pings      [][]byte // payloads of outstanding pings.
+
+	// Message size observation. See the SetSizeObserver method.
+	observeSize SizeObserver
+	readOpCode  MessageType // op code of the message being read.
+
+	// Async send mode. See the Send method.
+	sendMu    sync.Mutex
+	sendQueue *SendQueue
+	sendSize  int
+	sendWait  time.Duration
+
+	valueMu    sync.Mutex
+	value      interface{}                 // principal from Upgrader.Authenticate.
+	attributes map[interface{}]interface{} // application data set with SetAttribute.
+	query      url.Values                  // query parameters from the upgrade request.
+
+	// Audit fields. The byte counts are accessed atomically. The other fields
+	// are protected by auditMu.
+	bytesRead       int64
+	bytesWritten    int64
+	writeCalls      int64 // writes to the network connection.
+	messagesWritten int64
+	opened          time.Time
+	auditMu         sync.Mutex
+	closeRecorded   bool
+	closeCode       int
+	closeText       string
+	closedByPeer    bool
+	closeHook       func(*ConnRecord)
+	closed          bool
+	registry        *Registry // registry tracking the connection or nil.
+	tenant          *tenant   // tenant of the connection or nil.
+	lifetimeTimer   *time.Timer
+	readBufSize     int // size of the read buffer.
+	writeBufSize    int // size of the write buffer.
+	queued          int // capacity of the coalescing buffer and control queue.
 }
 
 func newConn(conn net.Conn, isServer bool, readBufSize, writeBufSize int) *Conn {
+	return newConnBufio(conn, isServer, nil, readBufSize, writeBufSize)
+}
+
+// newConnBufio returns a connection that reads through br. The reader is
+// reset to read from conn. If br is nil, then a new reader with size
+// readBufSize is allocated.
+func newConnBufio(conn net.Conn, isServer bool, br *bufio.Reader, readBufSize, writeBufSize int) *Conn {
 	mu := make(chan bool, 1)
 	mu <- true
 
-	return &Conn{
+	c := &Conn{
 		isServer:    isServer,
-		br:          bufio.NewReaderSize(conn, readBufSize),
 		conn:        conn,
+		id:          newConnID(),
 		mu:          mu,
 		readFinal:   true,
 		writeBuf:    make([]byte, writeBufSize+maxFrameHeaderSize),
 		writeOpCode: -1,
 		writePos:    maxFrameHeaderSize,
+		opened:      time.Now(),
+		maskRand:    crand.Reader,
+
+		controlLimit: defaultControlQueueLimit,
+	}
+	if br != nil {
+		br.Reset(countingReader{c})
+		c.br = br
+	} else {
+		c.br = bufio.NewReaderSize(countingReader{c}, readBufSize)
 	}
+	c.readBufSize = c.br.Size()
+	c.writeBufSize = len(c.writeBuf)
+	openMemory.add(c.memoryUsage(), 1)
+	return c
 }
 
-// Close closes the underlying network connection without sending or waiting for a close frame.
+// abandon releases the memory usage counted for a connection that failed the
+// handshake. The network connection is not closed.
+func (c *Conn) abandon() {
+	c.auditMu.Lock()
+	if !c.closed {
+		c.closed = true
+		openMemory.add(c.memoryUsage(), -1)
+	}
+	c.auditMu.Unlock()
+}
+
+// Close closes the underlying network connection without sending or waiting
+// for a close frame. Close can be called more than once and concurrently with
+// all other methods. Calls after the first return nil. Reads and writes
+// blocked on the connection return with an error when the connection is
+// closed.
 func (c *Conn) Close() error {
+	c.auditMu.Lock()
+	if c.closed {
+		c.auditMu.Unlock()
+		return nil
+	}
+	c.closed = true
+	openMemory.add(c.memoryUsage(), -1)
+	if c.lifetimeTimer != nil {
+		c.lifetimeTimer.Stop()
+		c.lifetimeTimer = nil
+	}
+	var r *ConnRecord
+	hook := c.closeHook
+	if hook != nil {
+		r = c.record()
+	}
+	c.auditMu.Unlock()
+	if r != nil {
+		hook(r)
+	}
+	if c.registry != nil {
+		c.registry.remove(c)
+	}
+	c.closeSendQueue()
 	return c.conn.Close()
 }
 
+// isClosed returns true if the application called Close.
+func (c *Conn) isClosed() bool {
+	c.auditMu.Lock()
+	defer c.auditMu.Unlock()
+	return c.closed
+}
+
+// CloseHandshake starts the closing handshake by sending a close message
+// with the given close code and text. CloseHandshake also sets the read
+// deadline to deadline. The goroutine reading from the connection receives
+// the peer's close message or a timeout error and should then call Close.
+//
+// CloseHandshake returns ErrCloseSent if a close message was already sent or
+// if the application called Close. CloseHandshake can be called concurrently
+// with all other methods.
+func (c *Conn) CloseHandshake(closeCode int, text string, deadline time.Time) error {
+	if c.isClosed() {
+		return ErrCloseSent
+	}
+	atomic.StoreInt64(&c.pongWait, -1)
+	err := c.WriteControl(OpClose, FormatCloseMessage(closeCode, text), deadline)
+	c.conn.SetReadDeadline(deadline)
+	return err
+}
+
 // LocalAddr returns the local network address.
 func (c *Conn) LocalAddr() net.Addr {
 	return c.conn.LocalAddr()
@@ -195,25 +517,119 @@ func (c *Conn) RemoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
 }
 
+// Value returns the principal returned from the Upgrader Authenticate
+// function or nil if the connection was not authenticated. Value can be
+// called concurrently with all other methods.
+func (c *Conn) Value() interface{} {
+	c.valueMu.Lock()
+	defer c.valueMu.Unlock()
+	return c.value
+}
+
+func (c *Conn) setValue(v interface{}) {
+	c.valueMu.Lock()
+	c.value = v
+	c.valueMu.Unlock()
+}
+
+// SetAttribute associates value with key on the connection. Middleware such
+// as authentication hooks, rate limiters and hubs use attributes to attach
+// data to the connection. As with context.Context, the key must be
+// comparable and should be of an unexported type defined by the package
+// setting the attribute to avoid collisions. A nil value removes the
+// attribute. SetAttribute can be called concurrently with all other methods.
+func (c *Conn) SetAttribute(key, value interface{}) {
+	c.valueMu.Lock()
+	defer c.valueMu.Unlock()
+	if value == nil {
+		delete(c.attributes, key)
+		return
+	}
+	if c.attributes == nil {
+		c.attributes = make(map[interface{}]interface{})
+	}
+	c.attributes[key] = value
+}
+
+// Attribute returns the value associated with key by SetAttribute or nil if
+// there is no value for key. Attribute can be called concurrently with all
+// other methods.
+func (c *Conn) Attribute(key interface{}) interface{} {
+	c.valueMu.Lock()
+	defer c.valueMu.Unlock()
+	return c.attributes[key]
+}
+
 // Write methods
 
-func (c *Conn) write(opCode int, deadline time.Time, bufs ...[]byte) error {
+func (c *Conn) write(opCode MessageType, deadline time.Time, bufs ...[]byte) error {
 	<-c.mu
-	defer func() { c.mu <- true }()
+	defer c.releaseWrite()
 
 	if c.closeSent {
 		return ErrCloseSent
 	} else if opCode == OpClose {
 		c.closeSent = true
+		atomic.StoreInt32(&c.unusable, 1)
 	}
 
+	if c.coalesceDelay > 0 {
+		if c.coalesceErr != nil {
+			return c.coalesceErr
+		}
+		n := cap(c.coalesceBuf)
+		for _, buf := range bufs {
+			c.coalesceBuf = append(c.coalesceBuf, buf...)
+		}
+		c.addQueued(cap(c.coalesceBuf) - n)
+		c.coalesceDeadline = deadline
+		if opCode == OpClose || len(c.coalesceBuf) >= c.coalesceSize {
+			return c.flushCoalesced()
+		}
+		if !c.coalescePending {
+			c.coalescePending = true
+			if c.coalesceTimer == nil {
+				c.coalesceTimer = time.AfterFunc(c.coalesceDelay, c.coalesceTimeout)
+			} else {
+				c.coalesceTimer.Reset(c.coalesceDelay)
+			}
+		}
+		return nil
+	}
+
+	return c.writeBufs(deadline, bufs...)
+}
+
+// writeBufs writes bufs to the network connection. The caller must hold mu.
+func (c *Conn) writeBufs(deadline time.Time, bufs ...[]byte) error {
 	c.conn.SetWriteDeadline(deadline)
+	total, nonEmpty := 0, 0
+	for _, buf := range bufs {
+		if len(buf) > 0 {
+			total += len(buf)
+			nonEmpty++
+		}
+	}
+	if nonEmpty > 1 {
+		// Use a single vectored write if supported by the connection.
+		// Copy the slice so that bufs does not escape to the heap on the
+		// common path with a single buffer.
+		bb := append(net.Buffers(nil), bufs...)
+		n, err := bb.WriteTo(c.conn)
+		c.countWrite(n)
+		if int(n) != total {
+			c.writeFailed(int(n), err)
+		}
+		return err
+	}
+	written := 0
 	for _, buf := range bufs {
 		if len(buf) > 0 {
 			n, err := c.conn.Write(buf)
+			c.countWrite(int64(n))
+			written += n
 			if n != len(buf) {
-				// Close on partial write.
-				c.conn.Close()
+				c.writeFailed(written, err)
 			}
 			if err != nil {
 				return err
@@ -223,158 +639,470 @@ func (c *Conn) write(opCode int, deadline time.Time, bufs ...[]byte) error {
 	return nil
 }
 
-// WriteControl writes a control message with the given deadline. The allowed
-// opCodes are OpClose, OpPing and OpPong.
-func (c *Conn) WriteControl(opCode int, data []byte, deadline time.Time) error {
-	if opCode != OpClose && opCode != OpPing && opCode != OpPong {
-		return errBadWriteOpCode
+// writeFailed handles a write of n bytes to the network connection that did
+// not write all data. A timeout before any data is written leaves the
+// connection usable, except for TLS connections, where a timeout corrupts
+// the connection state. Otherwise, the network connection is closed and
+// marked unusable.
+func (c *Conn) writeFailed(n int, err error) {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && n == 0 {
+		if _, ok := c.conn.(*tls.Conn); !ok {
+			return
+		}
 	}
-	if len(data) > maxControlFramePayloadSize {
-		return errInvalidControlFrame
+	atomic.StoreInt32(&c.unusable, 1)
+	c.conn.Close()
+}
+
+// recoverWrite makes c.writeErr non-sticky if the error leaves the
+// connection usable. A failed write of part of a message always leaves the
+// connection unusable because the peer cannot parse the next message. The
+// caller must hold mu.
+func (c *Conn) recoverWrite(complete bool) {
+	if c.writeErr == nil {
+		return
+	}
+	if !complete {
+		atomic.StoreInt32(&c.unusable, 1)
+	} else if atomic.LoadInt32(&c.unusable) == 0 {
+		c.writeErr = nil
 	}
+}
 
-	b0 := byte(opCode) | finalBit
-	b1 := byte(len(data))
-	if !c.isServer {
-		b1 |= maskBit
+// Usable returns false if a write error, a close message or Close ended the
+// connection for writing. After an error from a write method, the
+// application retries the message if Usable returns true and tears down the
+// session otherwise. A write that times out before sending data, for example
+// because of SetWriteTimeout or an expired write deadline, leaves the
+// connection usable. A broken pipe, a partial write or a timeout in the middle
+// of a fragmented message does not. Usable can be called concurrently with
+// all other methods.
+func (c *Conn) Usable() bool {
+	return atomic.LoadInt32(&c.unusable) == 0 && !c.isClosed()
+}
+
+// flushCoalesced writes the data buffered for coalescing to the network
+// connection. The caller must hold mu.
+func (c *Conn) flushCoalesced() error {
+	if c.coalescePending {
+		c.coalesceTimer.Stop()
+		c.coalescePending = false
 	}
+	if c.coalesceErr == nil && len(c.coalesceBuf) > 0 {
+		c.coalesceErr = c.writeBufs(c.coalesceDeadline, c.coalesceBuf)
+		if c.coalesceErr != nil {
+			// The buffered data is discarded.
+			atomic.StoreInt32(&c.unusable, 1)
+		}
+	}
+	c.coalesceBuf = c.coalesceBuf[:0]
+	return c.coalesceErr
+}
 
-	buf := make([]byte, 0, maxFrameHeaderSize+maxControlFramePayloadSize)
-	buf = append(buf, b0, b1)
+func (c *Conn) coalesceTimeout() {
+	<-c.mu
+	defer c.releaseWrite()
+	if c.coalescePending {
+		c.coalescePending = false
+		c.flushCoalesced()
+	}
+}
 
-	if c.isServer {
-		buf = append(buf, data...)
-	} else {
-		key := newMaskKey()
-		buf = append(buf, key[:]...)
-		buf = append(buf, data...)
-		maskBytes(key, 0, buf[6:])
+// SetWriteCoalescing enables coalescing of frames written to the connection.
+// When coalescing is enabled, frames are buffered and written to the network
+// when delay has elapsed since the first buffered frame or when size bytes
+// are buffered, whichever comes first. Control frames are written
+// immediately along with any buffered data. A zero delay disables coalescing
+// and flushes buffered data to the network.
+//
+// Errors from writing buffered data are returned from the next call to a
+// write method. Close does not flush buffered data.
+func (c *Conn) SetWriteCoalescing(delay time.Duration, size int) error {
+	<-c.mu
+	defer c.releaseWrite()
+	var err error
+	if delay <= 0 {
+		delay = 0
+		err = c.flushCoalesced()
 	}
+	c.coalesceDelay = delay
+	c.coalesceSize = size
+	return err
+}
 
-	d := time.Hour * 1000
-	if !deadline.IsZero() {
-		d = deadline.Sub(time.Now())
-		if d < 0 {
-			return errWriteTimeout
+// adaptWindow is the number of messages observed before the write buffer is
+// shrunk.
+const adaptWindow = 64
+
+// SetWriteBufferRange enables adaptive sizing of the connection's write
+// buffer. The payload space in the buffer grows to fit the messages written
+// to the connection, up to max bytes, and shrinks when the recent messages
+// use less than a quarter of the buffer, down to min bytes. Servers with
+// mixed workloads use adaptive sizing so that connections sending small
+// messages do not hold large buffers and connections sending large messages
+// do not split the messages into many frames. A min of zero disables
+// adaptive sizing and leaves the buffer at its current size.
+func (c *Conn) SetWriteBufferRange(min, max int) {
+	if max < min {
+		max = min
+	}
+	c.adaptMin, c.adaptMax = min, max
+	c.adaptPeak, c.adaptCount = 0, 0
+}
+
+// adaptWriteBuf adjusts the size of the write buffer after a message of n
+// bytes. The buffer must not contain data.
+func (c *Conn) adaptWriteBuf(n int) {
+	size := len(c.writeBuf) - maxFrameHeaderSize
+	if n > c.adaptPeak {
+		c.adaptPeak = n
+	}
+	c.adaptCount++
+	switch {
+	case n > size && size < c.adaptMax:
+		c.resizeWriteBuf(roundBufferSize(n, c.adaptMin, c.adaptMax))
+		c.adaptPeak, c.adaptCount = 0, 0
+	case c.adaptCount >= adaptWindow:
+		if c.adaptPeak < size/4 && size > c.adaptMin {
+			c.resizeWriteBuf(roundBufferSize(2*c.adaptPeak, c.adaptMin, c.adaptMax))
 		}
+		c.adaptPeak, c.adaptCount = 0, 0
+	}
+}
+
+// roundBufferSize returns the smallest power of two greater than or equal to
+// n, clamped to the range min to max.
+func roundBufferSize(n, min, max int) int {
+	size := 1
+	for size < n && size < max {
+		size <<= 1
+	}
+	if size < min {
+		size = min
+	}
+	if size > max {
+		size = max
 	}
+	return size
+}
+
+// resizeWriteBuf replaces the write buffer with a buffer for size bytes of
+// payload.
+func (c *Conn) resizeWriteBuf(size int) {
+	n := size + maxFrameHeaderSize
+	if n == len(c.writeBuf) {
+		return
+	}
+	delta := n - len(c.writeBuf)
+	c.writeBuf = make([]byte, n)
+	c.auditMu.Lock()
+	c.writeBufSize = n
+	if !c.closed {
+		openMemory.add(MemoryUsage{WriteBuffer: int64(delta)}, 1)
+	}
+	c.auditMu.Unlock()
+}
+
+// checkControlPayload returns an error if data is not a valid payload for a
+// control frame. Control frame payloads are limited to 125 bytes. A close
+// payload is empty or starts with a two byte close code.
+func checkControlPayload(opCode MessageType, data []byte) error {
+	if len(data) > maxControlFramePayloadSize || (opCode == OpClose && len(data) == 1) {
+		return errInvalidControlFrame
+	}
+	return nil
+}
+
+// WriteControl writes a control message with the given deadline. The allowed
+// opCodes are OpClose, OpPing and OpPong.
+func (c *Conn) WriteControl(opCode MessageType, data []byte, deadline time.Time) error {
+	if opCode != OpClose && opCode != OpPing && opCode != OpPong {
+		return errBadWriteOpCode
+	}
+	if err := checkControlPayload(opCode, data); err != nil {
+		return err
+	}
+
+	cb := controlFramePool.Get().(*controlFrameBuffer)
+	defer controlFramePool.Put(cb)
+	buf := c.appendFrame(cb[:0], true, opCode, data)
 
-	timer := time.NewTimer(d)
 	select {
 	case <-c.mu:
-		timer.Stop()
-	case <-timer.C:
-		return errWriteTimeout
+	default:
+		// Another goroutine holds the lock. Wait with a timer.
+		d := time.Hour * 1000
+		if !deadline.IsZero() {
+			d = deadline.Sub(time.Now())
+			if d < 0 {
+				return errWriteTimeout
+			}
+		}
+
+		timer := getTimer(d)
+		select {
+		case <-c.mu:
+			putTimer(timer)
+		case <-timer.C:
+			putTimer(timer)
+			return errWriteTimeout
+		}
 	}
-	defer func() { c.mu <- true }()
+	defer c.releaseWrite()
 
 	if c.closeSent {
 		return ErrCloseSent
 	} else if opCode == OpClose {
 		c.closeSent = true
+		atomic.StoreInt32(&c.unusable, 1)
+		c.recordClose(data, false)
+	}
+
+	atomic.AddInt64(&c.messagesWritten, 1)
+	err := c.writeControlFrames(buf, deadline)
+	c.observeWrite(opCode, len(data), err)
+	return err
+}
+
+// writeControlFrames writes encoded control frames to the network
+// connection along with any data buffered for coalescing. The caller must
+// hold mu.
+func (c *Conn) writeControlFrames(buf []byte, deadline time.Time) error {
+	if len(c.coalesceBuf) > 0 {
+		// Write the control frames after the buffered data.
+		n := cap(c.coalesceBuf)
+		c.coalesceBuf = append(c.coalesceBuf, buf...)
+		c.addQueued(cap(c.coalesceBuf) - n)
+		c.coalesceDeadline = deadline
+		return c.flushCoalesced()
 	}
 
 	c.conn.SetWriteDeadline(deadline)
 	n, err := c.conn.Write(buf)
-	if n != 0 && n != len(buf) {
-		c.conn.Close()
+	c.countWrite(int64(n))
+	if n != len(buf) {
+		c.writeFailed(n, err)
 	}
 	return err
 }
 
+// queueControl writes a control frame from the reading goroutine. If another
+// goroutine holds mu, then the frame is queued and written by that goroutine
+// when it releases mu. The frame is dropped if the queue is full.
+func (c *Conn) queueControl(opCode MessageType, data []byte) {
+	cb := controlFramePool.Get().(*controlFrameBuffer)
+	defer controlFramePool.Put(cb)
+	frame := c.appendFrame(cb[:0], true, opCode, data)
+	c.controlMu.Lock()
+	select {
+	case <-c.mu:
+		c.controlMu.Unlock()
+		if !c.closeSent {
+			atomic.AddInt64(&c.messagesWritten, 1)
+			err := c.writeControlFrames(frame, time.Now().Add(writeWait))
+			c.observeWrite(opCode, len(data), err)
+		}
+		c.releaseWrite()
+	default:
+		if c.controlCount < c.controlLimit {
+			n := cap(c.controlQueue)
+			c.controlQueue = append(c.controlQueue, frame...)
+			c.addQueued(cap(c.controlQueue) - n)
+			c.controlCount++
+			c.observeWrite(opCode, len(data), nil)
+		}
+		c.controlMu.Unlock()
+	}
+}
+
+// releaseWrite writes the queued control frames and releases mu. The caller
+// must hold mu.
+func (c *Conn) releaseWrite() {
+	for {
+		c.controlMu.Lock()
+		if c.controlCount == 0 {
+			// Release mu while holding controlMu so that queueControl does
+			// not queue a frame after the last check of the queue.
+			c.mu <- true
+			c.controlMu.Unlock()
+			return
+		}
+		frames := c.controlQueue
+		count := c.controlCount
+		c.controlQueue = nil
+		c.addQueued(-cap(frames))
+		c.controlCount = 0
+		c.controlMu.Unlock()
+		if !c.closeSent {
+			atomic.AddInt64(&c.messagesWritten, int64(count))
+			c.writeControlFrames(frames, time.Now().Add(writeWait))
+		}
+	}
+}
+
+// SetControlQueueLimit sets the maximum number of control frames queued for
+// writing while another goroutine is writing to the connection. The
+// connection queues pong replies to the peer's pings. Pongs are dropped when
+// the queue is full. A limit of zero drops all pongs that cannot be written
+// immediately. The default limit is 16.
+func (c *Conn) SetControlQueueLimit(limit int) {
+	c.controlMu.Lock()
+	c.controlLimit = limit
+	c.controlMu.Unlock()
+}
+
 // NextWriter returns a writer for the next message to send. The allowed
-// opCodes are OpText, OpBinary, OpClose and OpPing. The writer's Close method
-// flushes the complete message to the network.
+// opCodes are OpText, OpBinary, OpClose, OpPing and OpPong. The writer's
+// Close method flushes the complete message to the network.
+//
+// There can be at most one open writer for a text or binary message on a
+// connection. NextWriter closes the previous text or binary writer if the
+// application has not already done so.
 //
-// There can be at most one open writer on a connection. NextWriter closes the
-// previous writer if the application has not already done so.
+// Control messages (OpClose, OpPing and OpPong) are sent with WriteControl
+// when the writer is closed, using the deadline set with SetWriteDeadline.
+// The payload of a control message is limited to 125 bytes. Writes past the
+// limit fail with an error. A control message can be sent between the frames
+// of an open text or binary message.
 //
 // The NextWriter method and the writers returned from the method cannot be
 // accessed by more than one goroutine at a time.
-func (c *Conn) NextWriter(opCode int) (io.WriteCloser, error) {
+func (c *Conn) NextWriter(opCode MessageType) (io.WriteCloser, error) {
+	switch opCode {
+	case OpClose, OpPing, OpPong:
+		return &controlWriter{c: c, opCode: opCode}, nil
+	}
+	w, err := c.beginMessage(opCode)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// beginMessage starts a new text or binary message and returns the writer
+// for the message.
+func (c *Conn) beginMessage(opCode MessageType) (messageWriter, error) {
 	if c.writeErr != nil {
-		return nil, c.writeErr
+		return messageWriter{}, c.writeErr
 	}
 
 	if c.writeOpCode != -1 {
 		if err := c.flushFrame(true, nil); err != nil {
-			return nil, err
+			return messageWriter{}, err
 		}
 	}
 
-	if opCode != OpText && opCode != OpBinary && opCode != OpClose && opCode != OpPing {
-		return nil, errBadWriteOpCode
+	if opCode != OpText && opCode != OpBinary {
+		return messageWriter{}, errBadWriteOpCode
 	}
 
 	c.writeOpCode = opCode
+	c.startMessage(opCode)
 	return messageWriter{c, c.writeSeq}, nil
 }
 
-func (c *Conn) flushFrame(final bool, extra []byte) error {
-	length := c.writePos - maxFrameHeaderSize + len(extra)
+// startMessage starts the write timeout for a message.
+func (c *Conn) startMessage(opCode MessageType) {
+	c.msgOpCode = opCode
+	if c.limits != nil {
+		c.writeTimeout = c.limits.Load().WriteTimeout
+	}
+	if c.writeTimeout > 0 {
+		c.msgDeadline = time.Now().Add(c.writeTimeout)
+	}
+}
 
-	// Check for invalid control frames.
-	if (c.writeOpCode == OpClose || c.writeOpCode == OpPing) &&
-		(!final || length > maxControlFramePayloadSize) {
-		c.writeSeq += 1
-		c.writeOpCode = -1
-		c.writePos = maxFrameHeaderSize
-		return errInvalidControlFrame
+// writeMessage writes frames for the current message to the connection. The
+// write uses the earlier of the write deadline and the message deadline. A
+// timeout caused by the message deadline is reported as a WriteTimeoutError.
+func (c *Conn) writeMessage(opCode MessageType, bufs ...[]byte) error {
+	deadline := c.writeDeadline
+	byMessage := c.writeTimeout > 0 && (deadline.IsZero() || c.msgDeadline.Before(deadline))
+	if byMessage {
+		deadline = c.msgDeadline
+	}
+	err := c.write(opCode, deadline, bufs...)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && byMessage {
+		err = &WriteTimeoutError{OpCode: c.msgOpCode, Duration: c.writeTimeout, Err: err}
 	}
+	return err
+}
 
-	b0 := byte(c.writeOpCode)
-	if final {
-		b0 |= finalBit
+// controlWriter buffers a control message for WriteControl.
+type controlWriter struct {
+	c      *Conn
+	opCode MessageType
+	buf    [maxControlFramePayloadSize]byte
+	n      int
+	closed bool
+}
+
+func (w *controlWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errWriteClosed
 	}
-	b1 := byte(0)
-	if !c.isServer {
-		b1 |= maskBit
+	if len(p) > len(w.buf)-w.n {
+		return 0, errInvalidControlFrame
 	}
+	w.n += copy(w.buf[w.n:], p)
+	return len(p), nil
+}
 
-	// Assume that the frame starts at beginning of c.writeBuf.
-	framePos := 0
-	if c.isServer {
-		// Adjust up if mask not included in the header.
-		framePos = 4
+func (w *controlWriter) Close() error {
+	if w.closed {
+		return errWriteClosed
 	}
+	w.closed = true
+	return w.c.WriteControl(w.opCode, w.buf[:w.n], w.c.writeDeadline)
+}
 
-	switch {
-	case length >= 65536:
-		c.writeBuf[framePos] = b0
-		c.writeBuf[framePos+1] = b1 | 127
-		binary.BigEndian.PutUint64(c.writeBuf[framePos+2:], uint64(length))
-	case length > 125:
-		framePos += 6
-		c.writeBuf[framePos] = b0
-		c.writeBuf[framePos+1] = b1 | 126
-		binary.BigEndian.PutUint16(c.writeBuf[framePos+2:], uint16(length))
-	default:
-		framePos += 8
-		c.writeBuf[framePos] = b0
-		c.writeBuf[framePos+1] = b1 | byte(length)
+func (c *Conn) flushFrame(final bool, extra []byte) error {
+	length := c.writePos - maxFrameHeaderSize + len(extra)
+
+	if !c.isServer && !c.maskInPlace && len(extra) > 0 {
+		c.writeErr = errors.New("websocket: internal error, extra used in client mode")
+		return c.writeErr
 	}
 
+	h := FrameHeader{Final: final, OpCode: c.writeOpCode, Length: int64(length)}
 	if !c.isServer {
-		key := newMaskKey()
-		copy(c.writeBuf[maxFrameHeaderSize-4:], key[:])
-		maskBytes(key, 0, c.writeBuf[maxFrameHeaderSize:c.writePos])
-		if len(extra) > 0 {
-			c.writeErr = errors.New("websocket: internal error, extra used in client mode")
-			return c.writeErr
-		}
+		h.Masked = true
+		h.MaskKey = c.newMaskKey()
+	}
+
+	// The payload starts at maxFrameHeaderSize. Build the header immediately
+	// before the payload.
+	var hb [maxFrameHeaderSize]byte
+	header := EncodeFrameHeader(hb[:0], h)
+	framePos := maxFrameHeaderSize - len(header)
+	copy(c.writeBuf[framePos:], header)
+
+	if h.Masked {
+		pos := c.maskBytes(h.MaskKey, 0, c.writeBuf[maxFrameHeaderSize:c.writePos])
+		c.maskBytes(h.MaskKey, pos, extra)
 	}
 
 	// Write the buffers to the connection.
-	c.writeErr = c.write(c.writeOpCode, c.writeDeadline, c.writeBuf[framePos:c.writePos], extra)
+	complete := final && c.msgLen == 0
+	c.writeErr = c.writeMessage(c.writeOpCode, c.writeBuf[framePos:c.writePos], extra)
+	err := c.writeErr
 
 	// Setup for next frame.
 	c.writePos = maxFrameHeaderSize
 	c.writeOpCode = OpContinuation
+	c.msgLen += length
 	if final {
 		c.writeSeq += 1
 		c.writeOpCode = -1
+		atomic.AddInt64(&c.messagesWritten, 1)
+		c.observeWrite(c.msgOpCode, c.msgLen, c.writeErr)
+		if c.adaptMin > 0 && c.writeErr == nil {
+			c.adaptWriteBuf(c.msgLen)
+		}
+		c.msgLen = 0
 	}
-	return c.writeErr
+	c.recoverWrite(complete)
+	return err
 }
 
 type messageWriter struct {
@@ -412,7 +1140,7 @@ func (w messageWriter) write(final bool, p []byte) (int, error) {
 		return 0, err
 	}
 
-	if len(p) > 2*len(w.c.writeBuf) && w.c.isServer {
+	if len(p) > 2*len(w.c.writeBuf) && (w.c.isServer || w.c.maskInPlace) {
 		// Don't buffer large messages.
 		err := w.c.flushFrame(final, p)
 		if err != nil {
@@ -490,12 +1218,15 @@ func (w messageWriter) Close() error {
 
 // WriteMessage is a helper method for getting a writer using NextWriter,
 // writing the message and closing the writer.
-func (c *Conn) WriteMessage(opCode int, data []byte) error {
-	wr, err := c.NextWriter(opCode)
+func (c *Conn) WriteMessage(opCode MessageType, data []byte) error {
+	switch opCode {
+	case OpClose, OpPing, OpPong:
+		return c.WriteControl(opCode, data, c.writeDeadline)
+	}
+	w, err := c.beginMessage(opCode)
 	if err != nil {
 		return err
 	}
-	w := wr.(messageWriter)
 	if _, err := w.write(true, data); err != nil {
 		return err
 	}
@@ -507,11 +1238,183 @@ func (c *Conn) WriteMessage(opCode int, data []byte) error {
 	return nil
 }
 
-// SetWriteDeadline sets the deadline for future calls to NextWriter and the
-// io.WriteCloser returned from NextWriter. If the deadline is reached, the
-// call will fail with a timeout instead of blocking. A zero value for t means
-// Write will not time out. Even if Write times out, it may return n > 0,
-// indicating that some of the data was successfully written.
+// WriteTextMessage writes s as a text message. WriteTextMessage copies s
+// directly to the connection's write buffer, avoiding the conversion from
+// string to []byte required by WriteMessage.
+func (c *Conn) WriteTextMessage(s string) error {
+	w, err := c.beginMessage(OpText)
+	if err != nil {
+		return err
+	}
+	if _, err := w.WriteString(s); err != nil {
+		return err
+	}
+	return c.flushFrame(true, nil)
+}
+
+// Message is a message for use with the WriteMessages method.
+type Message struct {
+	OpCode MessageType
+	Data   []byte
+}
+
+// appendFrame appends a single frame with the given opCode and payload to p.
+func (c *Conn) appendFrame(p []byte, final bool, opCode MessageType, data []byte) []byte {
+	h := FrameHeader{Final: final, OpCode: opCode, Length: int64(len(data))}
+	if !c.isServer {
+		h.Masked = true
+		h.MaskKey = c.newMaskKey()
+	}
+	p = EncodeFrameHeader(p, h)
+	pos := len(p)
+	p = append(p, data...)
+	if h.Masked {
+		c.maskBytes(h.MaskKey, 0, p[pos:])
+	}
+	return p
+}
+
+// WriteMessages writes a batch of messages to the connection using a single
+// write to the network. Applications that send bursts of small messages can
+// use WriteMessages to reduce the number of system calls. The allowed opCodes
+// are the same as for NextWriter. A close message must be the last message in
+// the batch.
+func (c *Conn) WriteMessages(msgs []Message) error {
+	if c.writeErr != nil {
+		return c.writeErr
+	}
+
+	if c.writeOpCode != -1 {
+		if err := c.flushFrame(true, nil); err != nil {
+			return err
+		}
+	}
+
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	n := 0
+	for i, m := range msgs {
+		switch m.OpCode {
+		case OpText, OpBinary:
+		case OpClose, OpPing, OpPong:
+			if err := checkControlPayload(m.OpCode, m.Data); err != nil {
+				return err
+			}
+			if m.OpCode == OpClose && i != len(msgs)-1 {
+				return errors.New("websocket: close message not last in batch")
+			}
+		default:
+			return errBadWriteOpCode
+		}
+		n += maxFrameHeaderSize + len(m.Data)
+	}
+
+	var p []byte
+	if n <= len(c.writeBuf) {
+		p = c.writeBuf[:0]
+	} else {
+		p = make([]byte, 0, n)
+	}
+	for _, m := range msgs {
+		if m.OpCode == OpClose {
+			c.recordClose(m.Data, false)
+		}
+		p = c.appendFrame(p, true, m.OpCode, m.Data)
+	}
+
+	c.startMessage(msgs[0].OpCode)
+	atomic.AddInt64(&c.messagesWritten, int64(len(msgs)))
+	c.writeErr = c.writeMessage(msgs[len(msgs)-1].OpCode, p)
+	for _, m := range msgs {
+		c.observeWrite(m.OpCode, len(m.Data), c.writeErr)
+	}
+	err := c.writeErr
+	c.recoverWrite(true)
+	return err
+}
+
+// SetMaskKeySource sets the source of the masking keys for frames written by
+// a client connection. The default source is crypto/rand.Reader. A
+// deterministic source such as a math/rand.Rand is useful for benchmarks and
+// tests, but a predictable source defeats the purpose of masking and should
+// not be used in production.
+func (c *Conn) SetMaskKeySource(r io.Reader) {
+	if r == nil {
+		r = crand.Reader
+	}
+	c.maskMu.Lock()
+	c.maskRand = r
+	c.maskMu.Unlock()
+}
+
+// SetMaskInPlace specifies whether a client connection masks large payloads
+// in the application's buffer. When enabled, the data passed to WriteMessage
+// and to the Write method of writers returned by NextWriter is written to the
+// network directly instead of copied through the connection's write buffer.
+// This avoids a copy for large messages, but the masking overwrites the
+// application's data. The application must not use the contents of the
+// buffer after the write. SetMaskInPlace has no effect on server
+// connections.
+func (c *Conn) SetMaskInPlace(enable bool) {
+	c.maskInPlace = enable
+}
+
+// SetParallelMasking specifies whether payloads of several megabytes are
+// split into blocks that are masked and unmasked by concurrent goroutines.
+// Parallel masking can increase throughput for applications that transfer
+// bulk binary data on machines with idle CPUs, but it competes with the
+// application's other goroutines for those CPUs. Parallel masking is
+// disabled by default.
+func (c *Conn) SetParallelMasking(enable bool) {
+	c.parallelMask = enable
+}
+
+// WriteTimeoutError is the error returned when a message is not written within
+// the time set with SetWriteTimeout.
+type WriteTimeoutError struct {
+	// OpCode is the op code of the message. For WriteMessages, OpCode is the
+	// op code of the first message in the batch.
+	OpCode MessageType
+
+	// Duration is the time allowed to write the message.
+	Duration time.Duration
+
+	// Err is the error from the network connection.
+	Err error
+}
+
+func (e *WriteTimeoutError) Error() string {
+	return "websocket: write of " + e.OpCode.String() + " message timed out after " + e.Duration.String()
+}
+
+// Timeout returns true. WriteTimeoutError implements the net.Error interface.
+func (e *WriteTimeoutError) Timeout() bool { return true }
+
+// Temporary returns false. Use the connection's Usable method to determine
+// whether the message can be retried.
+func (e *WriteTimeoutError) Temporary() bool { return false }
+
+// Unwrap returns the error from the network connection.
+func (e *WriteTimeoutError) Unwrap() error { return e.Err }
+
+// SetWriteTimeout sets the time allowed to write each message. The time starts
+// when the application begins the message with NextWriter, WriteMessage,
+// WriteTextMessage, WriteMessages or WritePreparedMessage and includes all
+// frames of the message. A message that is not written in time fails with a
+// *WriteTimeoutError. If the deadline set with SetWriteDeadline is earlier,
+// then the deadline applies instead. A zero d means messages do not time out.
+func (c *Conn) SetWriteTimeout(d time.Duration) {
+	c.writeTimeout = d
+}
+
+// SetWriteDeadline sets the deadline for future calls to NextWriter,
+// WriteMessages and the io.WriteCloser returned from NextWriter. If the
+// deadline is reached, the call will fail with a timeout instead of blocking.
+// A zero value for t means Write will not time out. Even if Write times out,
+// it may return n > 0, indicating that some of the data was successfully
+// written.
 func (c *Conn) SetWriteDeadline(t time.Time) error {
 	c.writeDeadline = t
 	return nil
@@ -519,25 +1422,34 @@ func (c *Conn) SetWriteDeadline(t time.Time) error {
 
 // Read methods
 
-func (c *Conn) advanceFrame() (int, error) {
+func (c *Conn) advanceFrame() (MessageType, error) {
 
 	// 1. Skip remainder of previous frame.
 
 	if c.readRemaining > 0 {
-		if _, err := io.CopyN(ioutil.Discard, c.br, c.readRemaining); err != nil {
+		if err := c.discard(c.readRemaining); err != nil {
 			return -1, err
 		}
 	}
 
-	// 2. Read and parse first two bytes of frame header.
+	// 2. Read and parse first two bytes of frame header. All checks that
+	// depend on these bytes are made before reading the rest of the header
+	// so that invalid frames are rejected without further work.
 
-	var b [8]byte
+	b := c.readScratch[:8]
 	if err := c.read(b[:2]); err != nil {
 		return -1, err
 	}
 
+	if c.limits != nil {
+		c.loadReadLimits()
+	}
+	if d := atomic.LoadInt64(&c.pongWait); d > 0 {
+		c.conn.SetReadDeadline(c.messageReadDeadline(time.Now().Add(time.Duration(d))))
+	}
+
 	final := b[0]&finalBit != 0
-	opCode := int(b[0] & 0xf)
+	opCode := MessageType(b[0] & 0xf)
 	reserved := int((b[0] >> 4) & 0x7)
 	mask := b[1]&maskBit != 0
 	c.readRemaining = int64(b[1] & 0x7f)
@@ -558,14 +1470,30 @@ func (c *Conn) advanceFrame() (int, error) {
 		if !c.readFinal {
 			return -1, c.handleProtocolError("message start before final message frame")
 		}
-		c.readFinal = final
 	case OpContinuation:
 		if c.readFinal {
 			return -1, c.handleProtocolError("continuation after final message frame")
 		}
-		c.readFinal = final
 	default:
-		return -1, c.handleProtocolError("unknown opcode " + strconv.Itoa(opCode))
+		return -1, c.handleProtocolError("unknown opcode " + strconv.Itoa(int(opCode)))
+	}
+
+	if mask != c.isServer && !(mask && c.allowMasked) {
+		return -1, c.handleProtocolError("incorrect mask flag")
+	}
+
+	if opCode == OpContinuation || opCode == OpText || opCode == OpBinary {
+		c.readFinal = final
+		if opCode != OpContinuation {
+			c.readOpCode = opCode
+			c.readFirstTime = time.Now()
+			c.readLastTime = time.Time{}
+			if final {
+				c.readLastTime = c.readFirstTime
+			}
+		} else if final {
+			c.readLastTime = time.Now()
+		}
 	}
 
 	// 3. Read and parse frame length.
@@ -581,65 +1509,74 @@ func (c *Conn) advanceFrame() (int, error) {
 			return -1, err
 		}
 		c.readRemaining = int64(binary.BigEndian.Uint64(b[:8]))
+		if c.readRemaining < 0 {
+			// RFC 6455 requires the most significant bit to be zero.
+			return -1, c.handleProtocolError("frame length has most significant bit set")
+		}
 	}
 
-	// 4. Handle frame masking.
-
-	if mask != c.isServer {
-		return -1, c.handleProtocolError("incorrect mask flag")
+	if opCode == OpContinuation || opCode == OpText || opCode == OpBinary {
+		// Enforce the read limit before the payload is read. A negative sum
+		// is an overflow and exceeds any limit.
+		c.readLength += c.readRemaining
+		if c.readLimit > 0 && (c.readLength > c.readLimit || c.readLength < 0) {
+			c.WriteControl(OpClose, FormatCloseMessage(CloseMessageTooBig, ""), time.Now().Add(writeWait))
+			return -1, ErrReadLimit
+		}
+		if final && c.observeSize != nil {
+			c.observeSize(true, c.readOpCode, int(c.readLength))
+		}
 	}
 
+	// 4. Read the masking key.
+
+	c.readMaskPos = 0
 	if mask {
-		c.readMaskPos = 0
 		if err := c.read(c.readMaskKey[:]); err != nil {
 			return -1, err
 		}
+	} else {
+		c.readMaskKey = [4]byte{}
 	}
 
-	// 5. For text and binary messages, enforce read limit and return.
+	// 5. For text and binary messages, return.
 
 	if opCode == OpContinuation || opCode == OpText || opCode == OpBinary {
-
-		c.readLength += c.readRemaining
-		if c.readLimit > 0 && c.readLength > c.readLimit {
-			c.WriteControl(OpClose, FormatCloseMessage(CloseMessageTooBig, ""), time.Now().Add(writeWait))
-			return -1, ErrReadLimit
-		}
-
 		return opCode, nil
 	}
 
 	// 6. Read control frame payload.
 
-	payload := make([]byte, c.readRemaining)
+	// The payload is read to the scratch buffer. The ping and close handling
+	// below copy the data they keep.
+	payload := c.readScratch[:c.readRemaining]
 	c.readRemaining = 0
 	if err := c.read(payload); err != nil {
 		return -1, err
 	}
-	maskBytes(c.readMaskKey, 0, payload)
+	c.maskBytes(c.readMaskKey, 0, payload)
+	if c.observeSize != nil {
+		c.observeSize(true, opCode, len(payload))
+	}
 
 	// 7. Process control frame payload.
 
 	switch opCode {
 	case OpPong:
-		c.savedPong = payload
+		c.savedPong = c.pongBuf[:copy(c.pongBuf[:], payload)]
+		c.pongMismatch = !c.checkPong(payload)
 	case OpPing:
-		c.WriteControl(OpPong, payload, time.Now().Add(writeWait))
+		c.queueControl(OpPong, payload)
 	case OpClose:
+		c.recordClose(payload, true)
 		c.WriteControl(OpClose, []byte{}, time.Now().Add(writeWait))
-		if len(payload) < 2 {
-			return -1, io.EOF
-		} else {
-			closeCode := binary.BigEndian.Uint16(payload)
-			switch closeCode {
-			case CloseNormalClosure, CloseGoingAway:
-				return -1, io.EOF
-			default:
-				return -1, errors.New("websocket: close " +
-					strconv.Itoa(int(closeCode)) + " " +
-					string(payload[2:]))
-			}
+		e := &CloseError{Code: CloseNoStatusReceived}
+		if len(payload) >= 2 {
+			e.Code = int(binary.BigEndian.Uint16(payload))
+			e.Text = string(payload[2:])
 		}
+		e.eof = c.closeEOF && e.normal()
+		return -1, e
 	}
 
 	return opCode, nil
@@ -647,7 +1584,45 @@ func (c *Conn) advanceFrame() (int, error) {
 
 func (c *Conn) handleProtocolError(message string) error {
 	c.WriteControl(OpClose, FormatCloseMessage(CloseProtocolError, message), time.Now().Add(writeWait))
-	return errors.New("websocket: " + message)
+	return errors.New("websocket: " + formatCloseCode(CloseProtocolError) + ": " + message)
+}
+
+func (c *Conn) handleInvalidUTF8() error {
+	c.WriteControl(OpClose, FormatCloseMessage(CloseInvalidFramePayloadData, ""), time.Now().Add(writeWait))
+	return ErrInvalidUTF8
+}
+
+// nextFrameBuffered returns true if the header of the next frame is in the
+// read buffer. For control frames, the payload must also be buffered.
+func (c *Conn) nextFrameBuffered() bool {
+	if c.br.Buffered() < 2 {
+		return false
+	}
+	p, _ := c.br.Peek(2)
+	n := frameHeaderSize(p[1])
+	if MessageType(p[0]&0xf) >= OpClose {
+		n += int(p[1] & 0x7f)
+	}
+	return c.br.Buffered() >= n
+}
+
+// discard skips n bytes of input without copying the data.
+func (c *Conn) discard(n int64) error {
+	for n > 0 {
+		m := n
+		if m > 1<<30 {
+			m = 1 << 30
+		}
+		k, err := c.br.Discard(int(m))
+		n -= int64(k)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return c.readTimeoutError(err)
+		}
+	}
+	return nil
 }
 
 func (c *Conn) read(buf []byte) error {
@@ -664,45 +1639,230 @@ func (c *Conn) read(buf []byte) error {
 			err = io.ErrUnexpectedEOF
 		}
 	}
+	if err != nil {
+		err = c.readTimeoutError(err)
+	}
 	return err
 }
 
 // NextReader returns the next message received from the peer. The returned
 // opCode is one of OpText, OpBinary or OpPong. The connection automatically
-// handles ping messages received from the peer. NextReader returns an error
-// upon receiving a close message from the peer.
+// handles ping messages received from the peer. NextReader returns a
+// *CloseError upon receiving a close message from the peer.
 //
 // There can be at most one open reader on a connection. NextReader discards
 // the previous message if the application has not already consumed it.
 //
+// The reader for a text or binary message has a Remaining method that
+// reports the progress of the message:
+//
+//  type remainer interface {
+//      Remaining() (frame int64, more bool)
+//  }
+//
+// The reader also has an ArrivalTimes method that reports when the first and
+// final frames of the message arrived:
+//
+//  type arrivalTimer interface {
+//      ArrivalTimes() (first, last time.Time)
+//  }
+//
+// The readers for pong messages and for messages checked by a message filter
+// do not have the methods.
+//
 // The NextReader method and the readers returned from the method cannot be
 // accessed by more than one goroutine at a time.
-func (c *Conn) NextReader() (opCode int, r io.Reader, err error) {
+func (c *Conn) NextReader() (opCode MessageType, r io.Reader, err error) {
+	opCode, err = c.nextMessage()
+	switch {
+	case err != nil:
+		return -1, nil, err
+	case opCode == OpPong:
+		return OpPong, c.pongMessageReader(), nil
+	case c.messageFilter != nil:
+		return c.filterMessage(opCode)
+	}
+	return opCode, messageReader{c, c.readSeq}, nil
+}
 
+// pongMessageReader returns a reader for the saved pong message. The reader
+// and payload buffer are reused for each pong to avoid allocations on idle
+// connections.
+func (c *Conn) pongMessageReader() io.Reader {
+	c.pongReader.Reset(c.savedPong)
+	c.savedPong = nil
+	return &c.pongReader
+}
+
+// nextMessage advances the connection to the start of the next text or
+// binary message or to a saved pong message. The pong payload is in
+// c.savedPong.
+func (c *Conn) nextMessage() (MessageType, error) {
 	c.readSeq += 1
 	c.readLength = 0
+	if !c.readMsgDeadline.IsZero() {
+		c.endReadTimeout()
+	}
 
 	if c.savedPong != nil {
-		r := bytes.NewReader(c.savedPong)
-		c.savedPong = nil
-		return OpPong, r, nil
+		return c.pongMessage()
 	}
 
 	for c.readErr == nil {
-		var opCode int
+		var opCode MessageType
 		opCode, c.readErr = c.advanceFrame()
 		switch opCode {
 		case OpText, OpBinary:
-			return opCode, messageReader{c, c.readSeq}, nil
+			c.readText = opCode == OpText
+			c.readUTF8.Reset()
+			c.readTimeSeq = c.readSeq
+			if c.readTimeout > 0 && !(c.readFinal && c.readRemaining <= int64(c.br.Buffered())) {
+				c.startReadTimeout()
+			}
+			return opCode, nil
 		case OpPong:
-			r := bytes.NewReader(c.savedPong)
-			c.savedPong = nil
-			return OpPong, r, nil
+			return c.pongMessage()
 		case OpContinuation:
 			// do nothing
 		}
 	}
-	return -1, nil, c.readErr
+	return -1, c.readErr
+}
+
+// pongMessage returns the saved pong message or ErrPongMismatch if the pong
+// does not match a ping.
+func (c *Conn) pongMessage() (MessageType, error) {
+	if c.pongMismatch {
+		c.pongMismatch = false
+		c.savedPong = nil
+		return -1, ErrPongMismatch
+	}
+	return OpPong, nil
+}
+
+// ReadMessage is a helper method for getting a reader using NextReader and
+// reading from that reader to a buffer. If zero-copy reads are enabled with
+// SetZeroCopyRead, then the returned payload aliases memory owned by the
+// connection.
+func (c *Conn) ReadMessage() (opCode MessageType, p []byte, err error) {
+	if c.zeroCopy {
+		return c.readMessageZeroCopy()
+	}
+	opCode, r, err := c.NextReader()
+	if err != nil {
+		return opCode, nil, err
+	}
+	p, err = ioutil.ReadAll(r)
+	return opCode, p, err
+}
+
+// SetZeroCopyRead specifies whether ReadMessage returns payloads that alias
+// memory owned by the connection. When enabled, a message that is a single
+// frame in the read buffer is returned as a slice of the read buffer and
+// other messages are read to a buffer that the connection reuses for each
+// message. This avoids copying the payload, for example when a server
+// broadcasts the messages it receives.
+//
+// The payload is valid only until the next call to a read method. The
+// application must not modify the payload and must copy any part of the
+// payload that it uses after the next read, including strings converted from
+// the payload with the unsafe package.
+func (c *Conn) SetZeroCopyRead(enable bool) {
+	c.zeroCopy = enable
+}
+
+// readMessageZeroCopy reads the next message without copying the payload to
+// a new slice.
+func (c *Conn) readMessageZeroCopy() (MessageType, []byte, error) {
+	opCode, err := c.nextMessage()
+	switch {
+	case err != nil:
+		return -1, nil, err
+	case opCode == OpPong:
+		p := c.savedPong
+		c.savedPong = nil
+		return OpPong, p, nil
+	case c.messageFilter != nil:
+		_, r, err := c.filterMessage(opCode)
+		if err != nil {
+			return -1, nil, err
+		}
+		p, err := ioutil.ReadAll(r)
+		return opCode, p, err
+	}
+
+	if n := c.readRemaining; c.readFinal && n <= int64(c.br.Buffered()) {
+		// The message is a single frame in the read buffer. Unmask the
+		// payload in place.
+		p, _ := c.br.Peek(int(n))
+		c.maskBytes(c.readMaskKey, c.readMaskPos, p)
+		c.br.Discard(len(p))
+		c.readRemaining = 0
+		if c.validateUTF8 && c.readText && !utf8.Valid(p) {
+			c.readErr = c.handleInvalidUTF8()
+			return -1, nil, c.readErr
+		}
+		c.readSeq += 1
+		return opCode, p, nil
+	}
+
+	r := messageReader{c, c.readSeq}
+	p := c.zeroCopyBuf[:0]
+	for {
+		if len(p) == cap(p) {
+			p = append(p, 0)[:len(p)]
+		}
+		n, err := r.Read(p[len(p):cap(p)])
+		p = p[:len(p)+n]
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return -1, nil, err
+		}
+	}
+	if cap(p) <= maxPooledBufferSize {
+		c.zeroCopyBuf = p
+	}
+	return opCode, p, nil
+}
+
+// ReadTextMessage reads the next text message and returns the message as a
+// string. Pong messages are skipped. ReadTextMessage returns an error if the
+// next message is a binary message. The message is read through a pooled
+// buffer so that the string is the only allocation for the message.
+func (c *Conn) ReadTextMessage() (string, error) {
+	for {
+		opCode, b, err := c.ReadMessageBuffer()
+		if err != nil {
+			return "", err
+		}
+		var s string
+		if opCode == OpText {
+			s = b.String()
+		}
+		ReleaseMessageBuffer(b)
+		switch opCode {
+		case OpText:
+			return s, nil
+		case OpBinary:
+			return "", errNotText
+		}
+	}
+}
+
+// filterMessage reads the current message and applies the message filter to
+// the message.
+func (c *Conn) filterMessage(opCode MessageType) (MessageType, io.Reader, error) {
+	p, err := ioutil.ReadAll(messageReader{c, c.readSeq})
+	if err != nil {
+		return -1, nil, err
+	}
+	if err := c.messageFilter(opCode, p); err != nil {
+		c.WriteControl(OpClose, FormatCloseMessage(ClosePolicyViolation, err.Error()), time.Now().Add(writeWait))
+		c.readErr = err
+		return -1, nil, err
+	}
+	return opCode, bytes.NewReader(p), nil
 }
 
 type messageReader struct {
@@ -710,6 +1870,32 @@ type messageReader struct {
 	seq int
 }
 
+// Remaining returns the number of unread payload bytes in the current frame
+// of the message and whether more frames of the message follow the current
+// frame. Streaming parsers use the frame size to allocate buffers and
+// applications use it to report progress on large transfers. Remaining
+// returns 0, false after the message is read or discarded.
+func (r messageReader) Remaining() (frame int64, more bool) {
+	if r.seq != r.c.readSeq {
+		return 0, false
+	}
+	return r.c.readRemaining, !r.c.readFinal
+}
+
+// ArrivalTimes returns the times at which the first and the final frame of
+// the message arrived from the network. The final time is zero if the final
+// frame has not arrived. The times are recorded when the frame headers are
+// read and have monotonic clock readings. Applications measuring latency use
+// the times to separate network time from time spent waiting for the
+// application to read the message. ArrivalTimes returns zero times after
+// NextReader is called again.
+func (r messageReader) ArrivalTimes() (first, last time.Time) {
+	if r.seq != r.c.readTimeSeq {
+		return time.Time{}, time.Time{}
+	}
+	return r.c.readFirstTime, r.c.readLastTime
+}
+
 func (r messageReader) Read(b []byte) (n int, err error) {
 
 	if r.seq != r.c.readSeq {
@@ -719,28 +1905,71 @@ func (r messageReader) Read(b []byte) (n int, err error) {
 	for r.c.readErr == nil {
 
 		if r.c.readRemaining > 0 {
-			if int64(len(b)) > r.c.readRemaining {
-				b = b[:r.c.readRemaining]
+			p := b[n:]
+			if int64(len(p)) > r.c.readRemaining {
+				p = p[:r.c.readRemaining]
 			}
-			r.c.readErr = r.c.read(b)
-			r.c.readMaskPos = maskBytes(r.c.readMaskKey, r.c.readMaskPos, b)
-			r.c.readRemaining -= int64(len(b))
-			return len(b), r.c.readErr
+			r.c.readErr = r.c.read(p)
+			r.c.readMaskPos = r.c.maskBytes(r.c.readMaskKey, r.c.readMaskPos, p)
+			r.c.readRemaining -= int64(len(p))
+			n += len(p)
+			if r.c.validateUTF8 && r.c.readText && !r.c.readUTF8.Validate(p) {
+				r.c.readErr = r.c.handleInvalidUTF8()
+			}
+			if r.c.readErr != nil || r.c.readRemaining > 0 {
+				return n, r.c.readErr
+			}
+			// The frame is consumed. Continue with the next frame if the
+			// message is complete or if the next frame is already
+			// buffered. Otherwise, return the data read so far without
+			// waiting for the network.
+			if !r.c.readFinal && (n == len(b) || !r.c.nextFrameBuffered()) {
+				return n, nil
+			}
+			continue
 		}
 
 		if r.c.readFinal {
+			if r.c.validateUTF8 && r.c.readText && !r.c.readUTF8.Complete() {
+				r.c.readErr = r.c.handleInvalidUTF8()
+				break
+			}
 			r.c.readSeq += 1
-			return 0, io.EOF
+			return n, io.EOF
 		}
 
-		var opCode int
+		var opCode MessageType
 		opCode, r.c.readErr = r.c.advanceFrame()
 
 		if opCode == OpText || opCode == OpBinary {
 			r.c.readErr = errors.New("websocket: internal error, unexpected text or binary in Reader")
 		}
 	}
-	return 0, r.c.readErr
+	return n, r.c.readErr
+}
+
+// DiscardMessage discards the unread remainder of the current message
+// returned from NextReader. The reader for the message returns io.EOF after
+// the call. NextReader also discards the unread remainder of the previous
+// message. Use DiscardMessage to skip a message explicitly.
+func (c *Conn) DiscardMessage() error {
+	c.readSeq += 1
+	for c.readErr == nil {
+		if c.readRemaining > 0 {
+			c.readErr = c.discard(c.readRemaining)
+			c.readRemaining = 0
+			continue
+		}
+		if c.readFinal {
+			return nil
+		}
+		var opCode MessageType
+		opCode, c.readErr = c.advanceFrame()
+		if opCode == OpText || opCode == OpBinary {
+			c.readErr = errors.New("websocket: internal error, unexpected text or binary in Reader")
+		}
+	}
+	return c.readErr
 }
 
 // SetReadDeadline sets the deadline for future calls to NextReader and the
@@ -748,7 +1977,119 @@ func (r messageReader) Read(b []byte) (n int, err error) {
 // will fail with a timeout instead of blocking. A zero value for t means that
 // the methods will not time out.
 func (c *Conn) SetReadDeadline(t time.Time) error {
-	return c.conn.SetReadDeadline(t)
+	c.readDeadline = t
+	return c.conn.SetReadDeadline(c.messageReadDeadline(t))
+}
+
+// ReadTimeoutError is the error returned when a message is not read within
+// the time set with SetReadTimeout.
+type ReadTimeoutError struct {
+	// Duration is the time allowed to read the message.
+	Duration time.Duration
+
+	// Err is the error from the network connection.
+	Err error
+}
+
+func (e *ReadTimeoutError) Error() string {
+	return "websocket: read of message timed out after " + e.Duration.String()
+}
+
+// Timeout returns true. ReadTimeoutError implements the net.Error interface.
+func (e *ReadTimeoutError) Timeout() bool { return true }
+
+// Temporary returns false. The connection cannot be used after a read times
+// out.
+func (e *ReadTimeoutError) Temporary() bool { return false }
+
+// Unwrap returns the error from the network connection.
+func (e *ReadTimeoutError) Unwrap() error { return e.Err }
+
+// SetReadTimeout sets the time allowed to read each message. The time starts
+// when NextReader or a read helper receives the first frame of a message and
+// covers all frames of the message. A message that is not read in time fails
+// with a *ReadTimeoutError. Unlike the read deadline, the timeout is not
+// extended by each frame, so a peer that trickles a message one small frame
+// at a time cannot hold the reading goroutine indefinitely. If the deadline
+// set with SetReadDeadline or SetPongWait is earlier, then that deadline
+// applies instead. Messages received in a single read from the network
+// connection do not start the timeout. The timeout does not apply during the
+// closing handshake. A zero d means messages do not time out.
+func (c *Conn) SetReadTimeout(d time.Duration) {
+	c.readTimeout = d
+}
+
+// ArrivalTimes returns the times at which the first and the final frame of
+// the most recent text or binary message arrived from the network. Use
+// ArrivalTimes with ReadMessage and the other read helpers. See the reader
+// returned from NextReader for details.
+func (c *Conn) ArrivalTimes() (first, last time.Time) {
+	return c.readFirstTime, c.readLastTime
+}
+
+// startReadTimeout sets the read deadline for the current message.
+func (c *Conn) startReadTimeout() {
+	d := atomic.LoadInt64(&c.pongWait)
+	if d < 0 {
+		// CloseHandshake set the read deadline.
+		return
+	}
+	now := time.Now()
+	c.readMsgDeadline = now.Add(c.readTimeout)
+	deadline := c.readDeadline
+	if d > 0 {
+		deadline = now.Add(time.Duration(d))
+	}
+	c.conn.SetReadDeadline(c.messageReadDeadline(deadline))
+}
+
+// endReadTimeout restores the read deadline after a message read with a
+// timeout.
+func (c *Conn) endReadTimeout() {
+	c.readMsgDeadline = time.Time{}
+	switch d := atomic.LoadInt64(&c.pongWait); {
+	case d > 0:
+		c.conn.SetReadDeadline(time.Now().Add(time.Duration(d)))
+	case d == 0:
+		c.conn.SetReadDeadline(c.readDeadline)
+	}
+}
+
+// messageReadDeadline returns the earlier of t and the deadline for the
+// current message. A zero t is later than all other times.
+func (c *Conn) messageReadDeadline(t time.Time) time.Time {
+	if !c.readMsgDeadline.IsZero() && (t.IsZero() || c.readMsgDeadline.Before(t)) {
+		return c.readMsgDeadline
+	}
+	return t
+}
+
+// readTimeoutError returns a *ReadTimeoutError if err is a timeout caused by
+// the deadline for the current message. Otherwise, err is returned.
+func (c *Conn) readTimeoutError(err error) error {
+	if c.readMsgDeadline.IsZero() || time.Now().Before(c.readMsgDeadline) {
+		return err
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return &ReadTimeoutError{Duration: c.readTimeout, Err: err}
+	}
+	return err
+}
+
+// SetPongWait sets the read deadline to d from now and extends the deadline
+// by d whenever a frame is received from the peer. Applications that send
+// pings with a period less than d use SetPongWait to detect a dead peer
+// without updating the read deadline on each pong or message. A zero d stops
+// extending the deadline. CloseHandshake stops extending the deadline so that
+// the peer cannot delay the end of the closing handshake by sending data.
+func (c *Conn) SetPongWait(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	atomic.StoreInt64(&c.pongWait, int64(d))
+	if d > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(d))
+	}
 }
 
 // SetReadLimit sets the maximum size for a message read from the peer. If a
@@ -758,8 +2099,48 @@ func (c *Conn) SetReadLimit(limit int64) {
 	c.readLimit = limit
 }
 
+// SetValidateUTF8 specifies whether the connection validates that text
+// messages from the peer are valid UTF-8. If a text message is not valid
+// UTF-8, then the connection sends a close message with the
+// CloseInvalidFramePayloadData code to the peer and the message reader
+// returns ErrInvalidUTF8 to the application.
+func (c *Conn) SetValidateUTF8(validate bool) {
+	c.validateUTF8 = validate
+}
+
+// SetCloseEOF specifies whether the error returned from the read methods for
+// a normal closure by the peer matches io.EOF with errors.Is. Earlier versions
+// of the package returned io.EOF when the peer closed the connection with
+// CloseNormalClosure, CloseGoingAway or no close code. The read methods now
+// return a *CloseError for all close messages from the peer so that a clean
+// closure can be distinguished from an unexpected end of the stream.
+// SetCloseEOF is provided for migrating applications that test for io.EOF
+// and will be removed in a future version. Applications should use
+// IsCloseError instead.
+func (c *Conn) SetCloseEOF(enable bool) {
+	c.closeEOF = enable
+}
+
+// SetMessageFilter sets a function that NextReader applies to each text and
+// binary message received from the peer. When a filter is set, NextReader
+// reads the entire message before returning. If the filter returns an error,
+// then the connection sends a close message with the ClosePolicyViolation
+// code to the peer and NextReader returns the error to the application.
+func (c *Conn) SetMessageFilter(f func(opCode MessageType, p []byte) error) {
+	c.messageFilter = f
+}
+
 // FormatCloseMessage formats closeCode and text as a WebSocket close message.
+// If text does not fit in a control frame, then FormatCloseMessage truncates
+// text to 123 bytes at a UTF-8 character boundary.
 func FormatCloseMessage(closeCode int, text string) []byte {
+	if max := maxControlFramePayloadSize - 2; len(text) > max {
+		n := max
+		for n > 0 && !utf8.RuneStart(text[n]) {
+			n--
+		}
+		text = text[:n]
+	}
 	buf := make([]byte, 2+len(text))
 	binary.BigEndian.PutUint16(buf, uint16(closeCode))
 	copy(buf[2:], text)
@@ -16,13 +16,20 @@ package websocket
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"testing/iotest"
 	"time"
+	"unicode/utf8"
 )
 
 type fakeNetConn struct {
@@ -115,6 +122,78 @@ func TestFraming(t *testing.T) {
 	}
 }
 
+func TestFlushFrameHeader(t *testing.T) {
+	for _, isServer := range []bool{true, false} {
+		for _, n := range []int{0, 1, 125, 126, 127, 65535, 65536, 70000} {
+			var connBuf bytes.Buffer
+			wc := newConn(fakeNetConn{Reader: nil, Writer: &connBuf}, isServer, 1024, 100000)
+			data := make([]byte, n)
+			for i := range data {
+				data[i] = byte(i)
+			}
+			w, _ := wc.NextWriter(OpBinary)
+			w.Write(data)
+			w.Close()
+
+			p := connBuf.Bytes()
+			h, hn, err := DecodeFrameHeader(p)
+			if err != nil {
+				t.Fatalf("s:%v, n:%d: DecodeFrameHeader() returned %v", isServer, n, err)
+			}
+			var want int
+			switch {
+			case n >= 65536:
+				want = 10
+			case n > 125:
+				want = 4
+			default:
+				want = 2
+			}
+			if !isServer {
+				want += 4
+			}
+			if hn != want || h.Length != int64(n) || h.Masked == isServer || !h.Final || h.OpCode != OpBinary {
+				t.Fatalf("s:%v, n:%d: header %+v, size %d, want size %d", isServer, n, h, hn, want)
+			}
+			payload := p[hn:]
+			if h.Masked {
+				maskBytes(h.MaskKey, 0, payload)
+			}
+			if !bytes.Equal(payload, data) {
+				t.Fatalf("s:%v, n:%d: payload does not match", isServer, n)
+			}
+		}
+	}
+}
+
+func TestMaskInPlace(t *testing.T) {
+	const n = 10000
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	orig := append([]byte(nil), data...)
+
+	var connBuf bytes.Buffer
+	wc := newConn(fakeNetConn{Reader: nil, Writer: &connBuf}, false, 1024, 1024)
+	wc.SetMaskInPlace(true)
+	if err := wc.WriteMessage(OpBinary, data); err != nil {
+		t.Fatalf("WriteMessage() returned %v", err)
+	}
+	if bytes.Equal(data, orig) {
+		t.Fatal("data not masked in place")
+	}
+
+	rc := newConn(fakeNetConn{Reader: &connBuf, Writer: nil}, true, 1024, 1024)
+	op, p, err := rc.ReadMessage()
+	if err != nil || op != OpBinary {
+		t.Fatalf("ReadMessage() returned %v, %v", op, err)
+	}
+	if !bytes.Equal(p, orig) {
+		t.Fatal("message does not match")
+	}
+}
+
 func TestReadLimit(t *testing.T) {
 
 	const readLimit = 512
@@ -152,3 +231,1341 @@ func TestReadLimit(t *testing.T) {
 		t.Fatalf("io.Copy() returned %v", err)
 	}
 }
+
+func TestLimitSet(t *testing.T) {
+	message := make([]byte, 100)
+
+	var b1, b2 bytes.Buffer
+	wc := newConn(fakeNetConn{Reader: nil, Writer: &b1}, false, 1024, 1024)
+	rc := newConn(fakeNetConn{Reader: &b1, Writer: &b2}, true, 1024, 1024)
+	limits := NewLimitSet(Limits{ReadLimit: 1000, WriteTimeout: time.Minute})
+	rc.SetReadLimit(10) // overridden by the limit set
+	rc.SetLimits(limits)
+	wc.SetLimits(limits)
+
+	wc.WriteMessage(OpBinary, message)
+	if wc.writeTimeout != time.Minute {
+		t.Errorf("write timeout = %v, want %v", wc.writeTimeout, time.Minute)
+	}
+	wc.WriteMessage(OpBinary, message)
+
+	if _, _, err := rc.ReadMessage(); err != nil {
+		t.Fatalf("1: ReadMessage() returned %v", err)
+	}
+
+	// Lower the limit while the connection is in use.
+	limits.Store(Limits{ReadLimit: 10})
+	if _, _, err := rc.ReadMessage(); err != ErrReadLimit {
+		t.Fatalf("2: ReadMessage() returned %v, want %v", err, ErrReadLimit)
+	}
+	if got := limits.Load(); got != (Limits{ReadLimit: 10}) {
+		t.Errorf("Load() = %+v", got)
+	}
+}
+
+func TestFrameLength(t *testing.T) {
+	tests := []struct {
+		frame []byte
+		limit int64
+		code  int
+	}{
+		// Most significant bit set in the 64-bit length.
+		{[]byte{0x82, 0xff, 0x80, 0, 0, 0, 0, 0, 0, 0}, 0, CloseProtocolError},
+		// Length exceeds the read limit. The payload is not sent.
+		{[]byte{0x82, 0xff, 0, 0, 0, 1, 0, 0, 0, 0}, 1024, CloseMessageTooBig},
+		{[]byte{0x82, 0xff, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, 1024, CloseMessageTooBig},
+	}
+	for i, tt := range tests {
+		var b bytes.Buffer
+		// Append a mask key for the server connection.
+		frame := append(tt.frame, 1, 2, 3, 4)
+		rc := newConn(fakeNetConn{Reader: bytes.NewReader(frame), Writer: &b}, true, 1024, 1024)
+		rc.SetReadLimit(tt.limit)
+		if _, _, err := rc.NextReader(); err == nil {
+			t.Fatalf("%d: NextReader() did not return an error", i)
+		}
+		cc := newConn(fakeNetConn{Reader: &b, Writer: ioutil.Discard}, false, 1024, 1024)
+		_, _, err := cc.NextReader()
+		if err == nil || !strings.Contains(err.Error(), strconv.Itoa(tt.code)) {
+			t.Fatalf("%d: peer NextReader() returned %v, want close %d", i, err, tt.code)
+		}
+	}
+}
+
+func TestEarlyFrameValidation(t *testing.T) {
+	// Each frame is rejected from the first two header bytes. The extended
+	// length and mask key are not sent, so a read past the first two bytes
+	// fails with an unexpected EOF instead of a protocol error.
+	frames := [][]byte{
+		{0x82, 0x7f}, // unmasked client frame with 64-bit length
+		{0x83, 0xff}, // unknown opcode
+		{0xc2, 0xff}, // reserved bit
+		{0x89, 0xfe}, // control frame with extended length
+		{0x09, 0x80}, // fragmented control frame
+		{0x80, 0xff}, // continuation without a message
+	}
+	for i, frame := range frames {
+		var b bytes.Buffer
+		rc := newConn(fakeNetConn{Reader: bytes.NewReader(frame), Writer: &b}, true, 1024, 1024)
+		if _, _, err := rc.NextReader(); err == nil || err == io.ErrUnexpectedEOF {
+			t.Errorf("%d: NextReader() returned %v, want protocol error", i, err)
+		}
+		cc := newConn(fakeNetConn{Reader: &b, Writer: ioutil.Discard}, false, 1024, 1024)
+		_, _, err := cc.NextReader()
+		if err == nil || !strings.Contains(err.Error(), strconv.Itoa(CloseProtocolError)) {
+			t.Errorf("%d: peer NextReader() returned %v, want close %d", i, err, CloseProtocolError)
+		}
+	}
+}
+
+func TestWriteMessages(t *testing.T) {
+	for _, isServer := range []bool{true, false} {
+		var connBuf bytes.Buffer
+		wc := newConn(fakeNetConn{Reader: nil, Writer: &connBuf}, isServer, 1024, 1024)
+		rc := newConn(fakeNetConn{Reader: &connBuf, Writer: nil}, !isServer, 1024, 1024)
+
+		msgs := []Message{
+			{OpText, []byte("hello")},
+			{OpBinary, make([]byte, 200)},
+			{OpText, make([]byte, 2048)},
+			{OpBinary, nil},
+		}
+		if err := wc.WriteMessages(msgs); err != nil {
+			t.Fatalf("s:%v: WriteMessages() returned %v", isServer, err)
+		}
+
+		for i, m := range msgs {
+			op, r, err := rc.NextReader()
+			if err != nil || op != m.OpCode {
+				t.Fatalf("s:%v, m:%d: NextReader() returned %d, %v", isServer, i, op, err)
+			}
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("s:%v, m:%d: ReadAll() returned %v", isServer, i, err)
+			}
+			if !bytes.Equal(b, m.Data) {
+				t.Fatalf("s:%v, m:%d: message does not match", isServer, i)
+			}
+		}
+	}
+}
+
+func TestWriteStats(t *testing.T) {
+	var connBuf bytes.Buffer
+	c := newConn(fakeNetConn{Reader: nil, Writer: &connBuf}, true, 1024, 1024)
+	msgs := []Message{
+		{OpText, []byte("hello")},
+		{OpBinary, make([]byte, 200)},
+		{OpText, []byte("world")},
+		{OpBinary, nil},
+	}
+	for _, m := range msgs {
+		c.WriteMessage(m.OpCode, m.Data)
+	}
+	s := c.WriteStats()
+	if s.Messages != 4 || s.Writes != 4 || s.Bytes != int64(connBuf.Len()) {
+		t.Fatalf("WriteStats() after WriteMessage = %+v, want 4 messages, 4 writes, %d bytes", s, connBuf.Len())
+	}
+
+	c.WriteMessages(msgs)
+	c.WriteControl(OpPing, nil, time.Time{})
+	s = c.WriteStats()
+	if s.Messages != 9 || s.Writes != 6 || s.Bytes != int64(connBuf.Len()) {
+		t.Fatalf("WriteStats() after WriteMessages = %+v, want 9 messages, 6 writes, %d bytes", s, connBuf.Len())
+	}
+	if got := s.WritesPerMessage(); got != 6.0/9.0 {
+		t.Errorf("WritesPerMessage() = %v, want %v", got, 6.0/9.0)
+	}
+	if got := s.BytesPerWrite(); got != float64(connBuf.Len())/6 {
+		t.Errorf("BytesPerWrite() = %v, want %v", got, float64(connBuf.Len())/6)
+	}
+}
+
+func TestPreparedMessage(t *testing.T) {
+	data := make([]byte, 300)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	pm, err := NewPreparedMessage(OpBinary, data)
+	if err != nil {
+		t.Fatalf("NewPreparedMessage() returned %v", err)
+	}
+	for _, isServer := range []bool{true, false} {
+		var connBuf bytes.Buffer
+		wc := newConn(fakeNetConn{Reader: nil, Writer: &connBuf}, isServer, 1024, 1024)
+		rc := newConn(fakeNetConn{Reader: &connBuf, Writer: nil}, !isServer, 1024, 1024)
+
+		for i := 0; i < 2; i++ {
+			if err := wc.WritePreparedMessage(pm); err != nil {
+				t.Fatalf("s:%v: WritePreparedMessage() returned %v", isServer, err)
+			}
+		}
+		for i := 0; i < 2; i++ {
+			op, r, err := rc.NextReader()
+			if err != nil || op != OpBinary {
+				t.Fatalf("s:%v, m:%d: NextReader() returned %d, %v", isServer, i, op, err)
+			}
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("s:%v, m:%d: ReadAll() returned %v", isServer, i, err)
+			}
+			if !bytes.Equal(b, data) {
+				t.Fatalf("s:%v, m:%d: message does not match", isServer, i)
+			}
+		}
+	}
+	if _, err := NewPreparedMessage(OpClose, nil); err == nil {
+		t.Fatal("NewPreparedMessage(OpClose) did not return an error")
+	}
+}
+
+func TestSharedMessage(t *testing.T) {
+	data := []byte("hello, world")
+	m, err := NewSharedMessage(OpText, data)
+	if err != nil {
+		t.Fatalf("NewSharedMessage() returned %v", err)
+	}
+	var bufs [2]bytes.Buffer
+	var queues [2]*SendQueue
+	for i, isServer := range []bool{true, false} {
+		wc := newConn(fakeNetConn{Reader: nil, Writer: &bufs[i]}, isServer, 1024, 1024)
+		queues[i] = NewSendQueue(wc, 1, time.Second)
+		if err := queues[i].SendShared(m); err != nil {
+			t.Fatalf("s:%v: SendShared() returned %v", isServer, err)
+		}
+	}
+	m.Release()
+	for i, isServer := range []bool{true, false} {
+		queues[i].Close()
+		<-queues[i].Done()
+		rc := newConn(fakeNetConn{Reader: &bufs[i], Writer: nil}, !isServer, 1024, 1024)
+		op, p, err := rc.ReadMessage()
+		if err != nil || op != OpText || !bytes.Equal(p, data) {
+			t.Fatalf("s:%v: ReadMessage() returned %v, %q, %v", isServer, op, p, err)
+		}
+	}
+	if m.refs != 0 || m.buf != nil {
+		t.Fatalf("refs = %d after all holders released, want 0", m.refs)
+	}
+	if _, err := NewSharedMessage(OpPing, nil); err == nil {
+		t.Fatal("NewSharedMessage(OpPing) did not return an error")
+	}
+}
+
+func TestReadMessageBuffer(t *testing.T) {
+	var connBuf bytes.Buffer
+	wc := newConn(fakeNetConn{Reader: nil, Writer: &connBuf}, true, 1024, 1024)
+	rc := newConn(fakeNetConn{Reader: &connBuf, Writer: nil}, false, 1024, 1024)
+
+	wc.WriteMessage(OpText, []byte("hello"))
+	wc.WriteMessage(OpBinary, []byte("world"))
+
+	op, p, err := rc.ReadMessage()
+	if err != nil || op != OpText || string(p) != "hello" {
+		t.Fatalf("ReadMessage() returned %d, %q, %v", op, p, err)
+	}
+	op, b, err := rc.ReadMessageBuffer()
+	if err != nil || op != OpBinary || b.String() != "world" {
+		t.Fatalf("ReadMessageBuffer() returned %d, %v", op, err)
+	}
+	ReleaseMessageBuffer(b)
+	if _, b, err := rc.ReadMessageBuffer(); err == nil || b != nil {
+		t.Fatalf("ReadMessageBuffer() at EOF returned %v, %v", b, err)
+	}
+}
+
+func TestTextMessage(t *testing.T) {
+	var connBuf bytes.Buffer
+	wc := newConn(fakeNetConn{Reader: nil, Writer: &connBuf}, false, 1024, 1024)
+	rc := newConn(fakeNetConn{Reader: &connBuf, Writer: ioutil.Discard}, true, 1024, 1024)
+
+	long := strings.Repeat("x", 3000)
+	wc.WriteTextMessage("hello")
+	wc.WriteControl(OpPong, []byte("pong"), time.Time{})
+	wc.WriteTextMessage(long)
+	wc.WriteMessage(OpBinary, []byte("world"))
+
+	if s, err := rc.ReadTextMessage(); err != nil || s != "hello" {
+		t.Fatalf("ReadTextMessage() returned %q, %v", s, err)
+	}
+	if s, err := rc.ReadTextMessage(); err != nil || s != long {
+		t.Fatalf("ReadTextMessage() returned %d bytes, %v", len(s), err)
+	}
+	if _, err := rc.ReadTextMessage(); err != errNotText {
+		t.Fatalf("ReadTextMessage() for binary message returned %v, want %v", err, errNotText)
+	}
+}
+
+func TestAttribute(t *testing.T) {
+	type key int
+	c := newConn(fakeNetConn{}, true, 1024, 1024)
+	if v := c.Attribute(key(1)); v != nil {
+		t.Fatalf("Attribute() before set returned %v", v)
+	}
+	c.SetAttribute(key(1), "one")
+	c.SetAttribute(1, "int")
+	if v := c.Attribute(key(1)); v != "one" {
+		t.Errorf("Attribute(key(1)) returned %v, want one", v)
+	}
+	if v := c.Attribute(1); v != "int" {
+		t.Errorf("Attribute(1) returned %v, want int", v)
+	}
+	c.SetAttribute(key(1), nil)
+	if v := c.Attribute(key(1)); v != nil {
+		t.Errorf("Attribute() after delete returned %v", v)
+	}
+}
+
+func TestReaderRemaining(t *testing.T) {
+	var b bytes.Buffer
+	wc := newConn(fakeNetConn{Reader: nil, Writer: &b}, true, 1024, 1024)
+	w, _ := wc.NextWriter(OpBinary)
+	w.Write(make([]byte, 1500))
+	w.Close()
+
+	rc := newConn(fakeNetConn{Reader: &b, Writer: ioutil.Discard}, false, 1024, 1024)
+	_, r, err := rc.NextReader()
+	if err != nil {
+		t.Fatalf("NextReader() returned %v", err)
+	}
+	rr := r.(interface {
+		Remaining() (int64, bool)
+	})
+	if n, more := rr.Remaining(); n != 1024 || !more {
+		t.Errorf("Remaining() at start = %d, %v, want 1024, true", n, more)
+	}
+	io.ReadFull(r, make([]byte, 1000))
+	if n, more := rr.Remaining(); n != 24 || !more {
+		t.Errorf("Remaining() in first frame = %d, %v, want 24, true", n, more)
+	}
+	io.ReadFull(r, make([]byte, 100))
+	if n, more := rr.Remaining(); n != 400 || more {
+		t.Errorf("Remaining() in last frame = %d, %v, want 400, false", n, more)
+	}
+	ioutil.ReadAll(r)
+	if n, more := rr.Remaining(); n != 0 || more {
+		t.Errorf("Remaining() at end = %d, %v, want 0, false", n, more)
+	}
+}
+
+type closeCountingConn struct {
+	fakeNetConn
+	n *int32
+}
+
+func (c closeCountingConn) Close() error {
+	if atomic.AddInt32(c.n, 1) > 1 {
+		return errors.New("closed twice")
+	}
+	return nil
+}
+
+func TestCloseIdempotent(t *testing.T) {
+	var closes, hooks int32
+	c := newConn(closeCountingConn{fakeNetConn{Writer: ioutil.Discard}, &closes}, true, 1024, 1024)
+	c.SetCloseHook(func(*ConnRecord) { atomic.AddInt32(&hooks, 1) })
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Close(); err != nil {
+				t.Errorf("Close() returned %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if closes != 1 || hooks != 1 {
+		t.Errorf("network closes, hooks = %d, %d, want 1, 1", closes, hooks)
+	}
+	if err := c.CloseHandshake(CloseNormalClosure, "", time.Time{}); err != ErrCloseSent {
+		t.Errorf("CloseHandshake() after Close returned %v, want %v", err, ErrCloseSent)
+	}
+}
+
+func TestPongWait(t *testing.T) {
+	sc, cc := net.Pipe()
+	defer sc.Close()
+	defer cc.Close()
+	rc := newConn(sc, true, 1024, 1024)
+	wc := newConn(cc, false, 1024, 1024)
+	go func() {
+		for i := 0; i < 5; i++ {
+			time.Sleep(20 * time.Millisecond)
+			if err := wc.WriteControl(OpPong, nil, time.Time{}); err != nil {
+				return
+			}
+		}
+	}()
+
+	rc.SetPongWait(50 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		if op, _, err := rc.NextReader(); err != nil || op != OpPong {
+			t.Fatalf("%d: NextReader() returned %v, %v, want pong", i, op, err)
+		}
+	}
+	_, _, err := rc.NextReader()
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Fatalf("NextReader() after pongs stop returned %v, want timeout", err)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	sc, cc := net.Pipe()
+	defer sc.Close()
+	defer cc.Close()
+	c := newConn(sc, true, 1024, 1024)
+	c.SetWriteTimeout(20 * time.Millisecond)
+
+	// The peer does not read, so the write blocks until the timeout.
+	err := c.WriteMessage(OpBinary, []byte("hello"))
+	e, ok := err.(*WriteTimeoutError)
+	if !ok || e.OpCode != OpBinary || e.Duration != 20*time.Millisecond {
+		t.Fatalf("WriteMessage() returned %v, want write timeout", err)
+	}
+	if ne, ok := e.Err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("WriteTimeoutError.Err = %v, want timeout", e.Err)
+	}
+}
+
+func TestUsable(t *testing.T) {
+	sc, cc := net.Pipe()
+	defer sc.Close()
+	c := newConn(sc, true, 1024, 1024)
+	c.SetWriteTimeout(20 * time.Millisecond)
+
+	// The peer does not read, so the write times out before sending data.
+	if _, ok := c.WriteMessage(OpBinary, []byte("hello")).(*WriteTimeoutError); !ok {
+		t.Fatal("WriteMessage() did not time out")
+	}
+	if !c.Usable() {
+		t.Fatal("Usable() after timeout returned false, want true")
+	}
+
+	// The retry succeeds when the peer reads.
+	done := make(chan []byte)
+	go func() {
+		rc := newConn(cc, false, 1024, 1024)
+		_, p, _ := rc.ReadMessage()
+		done <- p
+	}()
+	c.SetWriteTimeout(0)
+	if err := c.WriteMessage(OpBinary, []byte("hello")); err != nil {
+		t.Fatalf("WriteMessage() retry returned %v", err)
+	}
+	if p := <-done; string(p) != "hello" {
+		t.Fatalf("peer read %q, want hello", p)
+	}
+
+	cc.Close()
+	if err := c.WriteMessage(OpBinary, []byte("hello")); err == nil {
+		t.Fatal("WriteMessage() to closed peer returned nil error")
+	}
+	if c.Usable() {
+		t.Error("Usable() after write to closed peer returned true, want false")
+	}
+	if err := c.WriteMessage(OpBinary, []byte("hello")); err == nil {
+		t.Error("WriteMessage() after unusable error returned nil error")
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	sc, cc := net.Pipe()
+	defer sc.Close()
+	defer cc.Close()
+	c := newConn(sc, true, 1024, 1024)
+	c.SetReadTimeout(50 * time.Millisecond)
+
+	// frame returns a masked frame with a zero mask key.
+	frame := func(b0 byte, payload string) []byte {
+		return append([]byte{b0, maskBit | byte(len(payload)), 0, 0, 0, 0}, payload...)
+	}
+	go func() {
+		// A fragmented message followed by an idle period longer than the
+		// timeout.
+		cc.Write(append(frame(byte(OpText), "a"), frame(finalBit, "b")...))
+		time.Sleep(100 * time.Millisecond)
+		// A message trickled one frame at a time.
+		cc.Write(frame(byte(OpText), "c"))
+		for i := 0; i < 10; i++ {
+			time.Sleep(20 * time.Millisecond)
+			if _, err := cc.Write(frame(0, "d")); err != nil {
+				return
+			}
+		}
+	}()
+
+	if op, p, err := c.ReadMessage(); err != nil || op != OpText || string(p) != "ab" {
+		t.Fatalf("ReadMessage() returned %v, %q, %v, want text ab", op, p, err)
+	}
+	_, _, err := c.ReadMessage()
+	e, ok := err.(*ReadTimeoutError)
+	if !ok || e.Duration != 50*time.Millisecond {
+		t.Fatalf("ReadMessage() for trickled message returned %v, want read timeout", err)
+	}
+	if ne, ok := e.Err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("ReadTimeoutError.Err = %v, want timeout", e.Err)
+	}
+}
+
+func TestArrivalTimes(t *testing.T) {
+	sc, cc := net.Pipe()
+	defer sc.Close()
+	defer cc.Close()
+	c := newConn(sc, true, 1024, 1024)
+
+	frame := func(b0 byte, payload string) []byte {
+		return append([]byte{b0, maskBit | byte(len(payload)), 0, 0, 0, 0}, payload...)
+	}
+	go func() {
+		cc.Write(frame(byte(OpText), "a"))
+		time.Sleep(50 * time.Millisecond)
+		cc.Write(frame(finalBit, "b"))
+		cc.Write(frame(finalBit|byte(OpText), "c"))
+	}()
+
+	type arrivalTimer interface {
+		ArrivalTimes() (first, last time.Time)
+	}
+	start := time.Now()
+	_, r, err := c.NextReader()
+	if err != nil {
+		t.Fatalf("NextReader() returned %v", err)
+	}
+	at := r.(arrivalTimer)
+	if first, last := at.ArrivalTimes(); first.Before(start) || !last.IsZero() {
+		t.Errorf("ArrivalTimes() before final frame = %v, %v", first, last)
+	}
+	ioutil.ReadAll(r)
+	first, last := at.ArrivalTimes()
+	if last.Sub(first) < 40*time.Millisecond {
+		t.Errorf("ArrivalTimes() after read = %v, %v, want final frame at least 40ms after first", first, last)
+	}
+	if cf, cl := c.ArrivalTimes(); cf != first || cl != last {
+		t.Errorf("Conn ArrivalTimes() = %v, %v, want %v, %v", cf, cl, first, last)
+	}
+
+	c.NextReader()
+	if first, last := at.ArrivalTimes(); !first.IsZero() || !last.IsZero() {
+		t.Errorf("ArrivalTimes() after next message = %v, %v, want zero", first, last)
+	}
+	if first, last := c.ArrivalTimes(); first != last {
+		t.Errorf("Conn ArrivalTimes() for single frame message = %v, %v, want equal", first, last)
+	}
+}
+
+func TestMemoryUsage(t *testing.T) {
+	c := newConn(fakeNetConn{Writer: ioutil.Discard}, true, 1024, 2048)
+	m := c.MemoryUsage()
+	if m.Conns != 1 || m.ReadBuffer != 1024 || m.WriteBuffer != 2048+maxFrameHeaderSize || m.Queued != 0 {
+		t.Fatalf("MemoryUsage() = %+v", m)
+	}
+	if total := TotalMemoryUsage(); total.Conns < 1 || total.Total() < m.Total() {
+		t.Errorf("TotalMemoryUsage() = %+v, want at least %+v", total, m)
+	}
+
+	c.SetWriteCoalescing(time.Hour, 1<<20)
+	c.WriteMessage(OpBinary, make([]byte, 5000))
+	if m := c.MemoryUsage(); m.Queued < 5000 {
+		t.Errorf("MemoryUsage().Queued with coalesced message = %d, want >= 5000", m.Queued)
+	}
+	c.SetWriteCoalescing(0, 0)
+	c.Close()
+}
+
+func TestWriteBufferRange(t *testing.T) {
+	var b bytes.Buffer
+	c := newConn(fakeNetConn{Writer: &b}, false, 1024, 1024)
+	c.SetWriteBufferRange(512, 8192)
+	size := func() int { return len(c.writeBuf) - maxFrameHeaderSize }
+
+	c.WriteMessage(OpBinary, make([]byte, 5000))
+	if n := size(); n != 8192 {
+		t.Fatalf("buffer size after large message = %d, want 8192", n)
+	}
+	c.WriteMessage(OpBinary, make([]byte, 20000))
+	if n := size(); n != 8192 {
+		t.Fatalf("buffer size after message larger than max = %d, want 8192", n)
+	}
+	// The buffer shrinks after a full window of small messages.
+	for i := 0; i < 2*adaptWindow; i++ {
+		c.WriteMessage(OpText, []byte("hello"))
+	}
+	if n := size(); n != 512 {
+		t.Fatalf("buffer size after small messages = %d, want 512", n)
+	}
+	if m := c.MemoryUsage(); m.WriteBuffer != 512+maxFrameHeaderSize {
+		t.Errorf("MemoryUsage().WriteBuffer = %d, want %d", m.WriteBuffer, 512+maxFrameHeaderSize)
+	}
+
+	rc := newConn(fakeNetConn{Reader: &b}, true, 1024, 1024)
+	for _, want := range []int{5000, 20000, 5, 5} {
+		if _, p, err := rc.ReadMessage(); err != nil || len(p) != want {
+			t.Fatalf("ReadMessage() returned %d bytes, %v, want %d bytes", len(p), err, want)
+		}
+	}
+}
+
+func TestZeroCopyRead(t *testing.T) {
+	var b bytes.Buffer
+	wc := newConn(fakeNetConn{Writer: &b}, false, 1024, 1024)
+	wc.WriteMessage(OpText, []byte("hello"))
+	large := make([]byte, 3000)
+	for i := range large {
+		large[i] = byte(i)
+	}
+	wc.WriteMessage(OpBinary, large)
+	wc.WriteControl(OpPong, []byte("pong"), time.Time{})
+	wc.WriteMessage(OpText, []byte{0xff})
+
+	rc := newConn(fakeNetConn{Reader: &b, Writer: ioutil.Discard}, true, 1024, 1024)
+	rc.SetZeroCopyRead(true)
+	rc.SetValidateUTF8(true)
+
+	// The first message is a single buffered frame. The payload is a slice
+	// of the read buffer.
+	op, p, err := rc.ReadMessage()
+	if err != nil || op != OpText || string(p) != "hello" {
+		t.Fatalf("ReadMessage() returned %v, %q, %v", op, p, err)
+	}
+	if buf, _ := rc.br.Peek(0); cap(buf) == 0 || &p[:cap(p)][cap(p)-1] != &buf[:cap(buf)][cap(buf)-1] {
+		t.Error("payload of buffered frame does not alias the read buffer")
+	}
+	op, p, err = rc.ReadMessage()
+	if err != nil || op != OpBinary || !bytes.Equal(p, large) {
+		t.Fatalf("ReadMessage() returned %v, %d bytes, %v", op, len(p), err)
+	}
+	op, p, err = rc.ReadMessage()
+	if err != nil || op != OpPong || string(p) != "pong" {
+		t.Fatalf("ReadMessage() returned %v, %q, %v, want pong", op, p, err)
+	}
+	if _, _, err := rc.ReadMessage(); err != ErrInvalidUTF8 {
+		t.Fatalf("ReadMessage() of invalid text returned %v, want %v", err, ErrInvalidUTF8)
+	}
+}
+
+func TestWriteCoalescing(t *testing.T) {
+	var connBuf bytes.Buffer
+	wc := newConn(fakeNetConn{Reader: nil, Writer: &connBuf}, true, 1024, 1024)
+	rc := newConn(fakeNetConn{Reader: &connBuf, Writer: nil}, false, 1024, 1024)
+
+	wc.SetWriteCoalescing(time.Hour, 64)
+	wc.WriteMessage(OpText, []byte("hello"))
+	wc.WriteMessage(OpText, []byte("world"))
+	if connBuf.Len() != 0 {
+		t.Fatalf("%d bytes written before coalescing limit", connBuf.Len())
+	}
+	wc.WriteMessage(OpBinary, make([]byte, 64))
+	if connBuf.Len() == 0 {
+		t.Fatal("no bytes written after coalescing limit")
+	}
+	n := connBuf.Len()
+	wc.WriteMessage(OpText, []byte("ping"))
+	wc.WriteControl(OpPing, nil, time.Now().Add(time.Second))
+	if connBuf.Len() == n {
+		t.Fatal("buffered data not written with control frame")
+	}
+
+	for i, want := range []MessageType{OpText, OpText, OpBinary, OpText} {
+		op, r, err := rc.NextReader()
+		if err != nil || op != want {
+			t.Fatalf("%d: NextReader() returned %d, %v", i, op, err)
+		}
+		io.Copy(ioutil.Discard, r)
+	}
+	if err := wc.SetWriteCoalescing(0, 0); err != nil {
+		t.Fatalf("SetWriteCoalescing(0, 0) returned %v", err)
+	}
+}
+
+func TestSendQueue(t *testing.T) {
+	var connBuf bytes.Buffer
+	wc := newConn(fakeNetConn{Reader: nil, Writer: &connBuf}, true, 1024, 1024)
+	rc := newConn(fakeNetConn{Reader: &connBuf, Writer: nil}, false, 1024, 1024)
+
+	q := NewSendQueue(wc, 2, time.Second)
+	results := make(chan error, 2)
+	done := func(err error) { results <- err }
+	if err := q.SendNotify(OpText, []byte("hello"), done); err != nil {
+		t.Fatalf("SendNotify() returned %v", err)
+	}
+	if err := q.SendNotify(OpBinary, []byte("world"), done); err != nil {
+		t.Fatalf("SendNotify() returned %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Fatalf("%d: done called with %v", i, err)
+		}
+	}
+	q.Close()
+	<-q.Done()
+	if err := q.Send(OpText, []byte("closed")); err != ErrQueueClosed {
+		t.Fatalf("Send() after Close returned %v, want %v", err, ErrQueueClosed)
+	}
+
+	for _, want := range []string{"hello", "world"} {
+		_, r, err := rc.NextReader()
+		if err != nil {
+			t.Fatalf("NextReader() returned %v", err)
+		}
+		b, _ := ioutil.ReadAll(r)
+		if string(b) != want {
+			t.Fatalf("message = %q, want %q", b, want)
+		}
+	}
+}
+
+func TestConnSend(t *testing.T) {
+	var connBuf bytes.Buffer
+	wc := newConn(fakeNetConn{Reader: nil, Writer: &connBuf}, true, 1024, 1024)
+	rc := newConn(fakeNetConn{Reader: &connBuf, Writer: nil}, false, 1024, 1024)
+
+	if wc.sendQueue != nil {
+		t.Fatal("send queue started before Send")
+	}
+	wc.SetSendQueue(4, time.Second)
+	for _, p := range []string{"hello", "world"} {
+		if err := wc.Send(OpText, []byte(p)); err != nil {
+			t.Fatalf("Send() returned %v", err)
+		}
+	}
+	q := wc.sendQueue
+	if cap(q.ch) != 4 {
+		t.Errorf("queue size = %d, want 4", cap(q.ch))
+	}
+	wc.Close()
+	<-q.Done()
+	if err := wc.Send(OpText, []byte("closed")); err != ErrQueueClosed {
+		t.Fatalf("Send() after Close returned %v, want %v", err, ErrQueueClosed)
+	}
+
+	for _, want := range []string{"hello", "world"} {
+		_, p, err := rc.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage() returned %v", err)
+		}
+		if string(p) != want {
+			t.Fatalf("message = %q, want %q", p, want)
+		}
+	}
+}
+
+// blockingWriter blocks writes until unblock is closed.
+type blockingWriter struct {
+	unblock chan bool
+}
+
+func (w blockingWriter) Write(p []byte) (int, error) {
+	<-w.unblock
+	return len(p), nil
+}
+
+func TestSendQueueByteLimit(t *testing.T) {
+	unblock := make(chan bool)
+	defer close(unblock)
+	wc := newConn(fakeNetConn{Reader: nil, Writer: blockingWriter{unblock}}, true, 1024, 1024)
+
+	// The first message is taken by the queue goroutine and blocks in the
+	// write. Wait for the queue to be empty.
+	q := NewSendQueue(wc, 10, 0)
+	defer q.Close()
+	q.Send(OpBinary, make([]byte, 10))
+	for q.Bytes() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	q.SetByteLimit(100, OverflowReject)
+	if err := q.Send(OpBinary, make([]byte, 101)); err != ErrQueueFull {
+		t.Fatalf("Send() of message larger than limit returned %v", err)
+	}
+	var dropped []int
+	for i := 0; i < 2; i++ {
+		i := i
+		done := func(err error) {
+			if err == ErrMessageDropped {
+				dropped = append(dropped, i)
+			}
+		}
+		if err := q.SendNotify(OpBinary, make([]byte, 40), done); err != nil {
+			t.Fatalf("%d: Send() returned %v", i, err)
+		}
+	}
+	if err := q.Send(OpBinary, make([]byte, 40)); err != ErrQueueFull {
+		t.Fatalf("Send() past limit returned %v, want %v", err, ErrQueueFull)
+	}
+	if n := q.Bytes(); n != 80 {
+		t.Fatalf("Bytes() = %d, want 80", n)
+	}
+
+	q.SetByteLimit(100, OverflowDropOldest)
+	if err := q.Send(OpBinary, make([]byte, 40)); err != nil {
+		t.Fatalf("Send() with drop oldest returned %v", err)
+	}
+	if len(dropped) != 1 || dropped[0] != 0 || q.Bytes() != 80 {
+		t.Fatalf("dropped = %v, bytes = %d, want [0], 80", dropped, q.Bytes())
+	}
+
+	q.SetByteLimit(100, OverflowClose)
+	if err := q.Send(OpBinary, make([]byte, 40)); err != ErrQueueFull {
+		t.Fatalf("Send() with close returned %v", err)
+	}
+	if err := q.Send(OpBinary, nil); err != ErrQueueClosed {
+		t.Fatalf("Send() after overflow close returned %v, want %v", err, ErrQueueClosed)
+	}
+}
+
+func TestSendQueueOverflowCloseHook(t *testing.T) {
+	unblock := make(chan bool)
+	defer close(unblock)
+	wc := newConn(fakeNetConn{Reader: nil, Writer: blockingWriter{unblock}}, true, 1024, 1024)
+
+	q := NewSendQueue(wc, 10, 0)
+	q.Send(OpBinary, make([]byte, 10))
+	for q.Bytes() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	hookBytes := int64(-1)
+	wc.SetCloseHook(func(r *ConnRecord) { hookBytes = q.Bytes() })
+
+	q.SetByteLimit(100, OverflowClose)
+	q.Send(OpBinary, make([]byte, 60))
+	done := make(chan error, 1)
+	go func() { done <- q.Send(OpBinary, make([]byte, 60)) }()
+	select {
+	case err := <-done:
+		if err != ErrQueueFull {
+			t.Fatalf("Send() with close returned %v, want %v", err, ErrQueueFull)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Send() did not return, the close hook deadlocked")
+	}
+	if hookBytes != 60 {
+		t.Errorf("close hook Bytes() = %d, want 60", hookBytes)
+	}
+}
+
+func TestDiscardMessage(t *testing.T) {
+	var connBuf bytes.Buffer
+	wc := newConn(fakeNetConn{Reader: nil, Writer: &connBuf}, false, 1024, 128)
+	rc := newConn(fakeNetConn{Reader: &connBuf, Writer: ioutil.Discard}, true, 1024, 1024)
+
+	// Write a message with several frames and a ping in the middle.
+	w, _ := wc.NextWriter(OpBinary)
+	w.Write(make([]byte, 300))
+	wc.WriteControl(OpPing, nil, time.Now().Add(time.Second))
+	w.Write(make([]byte, 300))
+	w.Close()
+	wc.WriteMessage(OpText, []byte("next"))
+
+	op, r, err := rc.NextReader()
+	if err != nil || op != OpBinary {
+		t.Fatalf("NextReader() returned %d, %v", op, err)
+	}
+	if _, err := io.ReadFull(r, make([]byte, 10)); err != nil {
+		t.Fatalf("ReadFull() returned %v", err)
+	}
+	if err := rc.DiscardMessage(); err != nil {
+		t.Fatalf("DiscardMessage() returned %v", err)
+	}
+	if n, err := r.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Fatalf("Read() after DiscardMessage returned %d, %v", n, err)
+	}
+	op, r, err = rc.NextReader()
+	if err != nil || op != OpText {
+		t.Fatalf("NextReader() returned %d, %v", op, err)
+	}
+	if p, _ := ioutil.ReadAll(r); string(p) != "next" {
+		t.Fatalf("message = %q, want next", p)
+	}
+	if err := rc.DiscardMessage(); err != nil {
+		t.Fatalf("DiscardMessage() after complete message returned %v", err)
+	}
+}
+
+func TestReadAhead(t *testing.T) {
+	var connBuf bytes.Buffer
+	wc := newConn(fakeNetConn{Reader: nil, Writer: &connBuf}, false, 1024, 128)
+	rc := newConn(fakeNetConn{Reader: &connBuf, Writer: ioutil.Discard}, true, 4096, 1024)
+
+	w, _ := wc.NextWriter(OpBinary)
+	w.Write(make([]byte, 600))
+	w.Close()
+
+	_, r, err := rc.NextReader()
+	if err != nil {
+		t.Fatalf("NextReader() returned %v", err)
+	}
+	// All frames are buffered. A single read returns the message and EOF.
+	n, err := r.Read(make([]byte, 1000))
+	if n != 600 || err != io.EOF {
+		t.Fatalf("Read() returned %d, %v, want 600, EOF", n, err)
+	}
+}
+
+func TestVerifyPong(t *testing.T) {
+	var b1, b2 bytes.Buffer
+	wc := newConn(fakeNetConn{Reader: nil, Writer: &b1}, false, 1024, 1024)
+	rc := newConn(fakeNetConn{Reader: &b1, Writer: &b2}, true, 1024, 1024)
+	rc.SetVerifyPong(true)
+	deadline := time.Now().Add(time.Second)
+
+	rc.PingWithPayload([]byte("a"), deadline)
+	rc.PingWithPayload([]byte("b"), deadline)
+	wc.WriteControl(OpPong, []byte("b"), deadline) // response to the most recent ping
+	rc.PingWithPayload([]byte("c"), deadline)
+	wc.WriteControl(OpPong, []byte("x"), deadline) // regenerated by an intermediary
+	wc.WriteMessage(OpText, []byte("hello"))
+	wc.WriteControl(OpPong, []byte("c"), deadline)
+	wc.WriteControl(OpPong, []byte("z"), deadline) // unsolicited
+
+	for i, want := range []struct {
+		op  MessageType
+		p   string
+		err error
+	}{
+		{OpPong, "b", nil},
+		{-1, "", ErrPongMismatch},
+		{OpText, "hello", nil},
+		{OpPong, "c", nil},
+		{OpPong, "z", nil},
+	} {
+		op, p, err := rc.ReadMessage()
+		if op != want.op || string(p) != want.p || err != want.err {
+			t.Errorf("%d: ReadMessage() = %v, %q, %v, want %v, %q, %v", i, op, p, err, want.op, want.p, want.err)
+		}
+	}
+
+	if b2.Len() != 3*(2+1) {
+		t.Errorf("wrote %d bytes of pings, want 9", b2.Len())
+	}
+}
+
+type sizeObservation struct {
+	read   bool
+	opCode MessageType
+	size   int
+}
+
+func TestSizeObserver(t *testing.T) {
+	var b1, b2 bytes.Buffer
+	var got []sizeObservation
+	observe := func(read bool, opCode MessageType, size int) {
+		got = append(got, sizeObservation{read, opCode, size})
+	}
+	wc := newConn(fakeNetConn{Reader: nil, Writer: &b1}, false, 1024, 1024)
+	wc.SetSizeObserver(observe)
+	rc := newConn(fakeNetConn{Reader: &b1, Writer: &b2}, true, 1024, 1024)
+	rc.SetSizeObserver(observe)
+
+	w, _ := wc.NextWriter(OpText)
+	w.Write(make([]byte, 1100))
+	w.Close()
+	wc.WriteMessage(OpBinary, []byte("abc"))
+	wc.WriteControl(OpPing, []byte("ping"), time.Now().Add(time.Second))
+	for i := 0; i < 3; i++ {
+		rc.ReadMessage()
+	}
+
+	want := []sizeObservation{
+		{false, OpText, 1100},
+		{false, OpBinary, 3},
+		{false, OpPing, 4},
+		{true, OpText, 1100},
+		{true, OpBinary, 3},
+		{true, OpPing, 4},
+		{false, OpPong, 4},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("observed %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("observation %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestControlQueue(t *testing.T) {
+	var b1, b2 bytes.Buffer
+	wc := newConn(fakeNetConn{Reader: nil, Writer: &b1}, false, 1024, 1024)
+	rc := newConn(fakeNetConn{Reader: &b1, Writer: &b2}, true, 1024, 1024)
+	rc.SetControlQueueLimit(3)
+
+	for i := 0; i < 10; i++ {
+		wc.WriteControl(OpPing, []byte(strconv.Itoa(i)), time.Now().Add(time.Second))
+	}
+	wc.WriteMessage(OpText, []byte("hello"))
+
+	// Hold the write lock to force the reader to queue the pongs.
+	<-rc.mu
+	if _, _, err := rc.NextReader(); err != nil {
+		t.Fatalf("NextReader() returned %v", err)
+	}
+	if b2.Len() != 0 {
+		t.Fatalf("%d bytes written while write lock held", b2.Len())
+	}
+	rc.releaseWrite()
+
+	cc := newConn(fakeNetConn{Reader: &b2, Writer: ioutil.Discard}, false, 1024, 1024)
+	for i := 0; i < 3; i++ {
+		op, r, err := cc.NextReader()
+		if err != nil || op != OpPong {
+			t.Fatalf("%d: NextReader() returned %d, %v", i, op, err)
+		}
+		if p, _ := ioutil.ReadAll(r); string(p) != strconv.Itoa(i) {
+			t.Fatalf("%d: pong payload = %q", i, p)
+		}
+	}
+	if b2.Len() != 0 {
+		t.Fatalf("%d bytes written after queue limit", b2.Len())
+	}
+}
+
+func TestMessageFilter(t *testing.T) {
+	var b1, b2 bytes.Buffer
+	wc := newConn(fakeNetConn{Reader: nil, Writer: &b1}, false, 1024, 1024)
+	rc := newConn(fakeNetConn{Reader: &b1, Writer: &b2}, true, 1024, 1024)
+	errBad := errors.New("bad message")
+	rc.SetMessageFilter(func(opCode MessageType, p []byte) error {
+		if string(p) == "bad" {
+			return errBad
+		}
+		return nil
+	})
+
+	wc.WriteMessage(OpText, []byte("good"))
+	wc.WriteMessage(OpText, []byte("bad"))
+
+	op, r, err := rc.NextReader()
+	if op != OpText || err != nil {
+		t.Fatalf("NextReader() returned %d, %v", op, err)
+	}
+	if b, _ := ioutil.ReadAll(r); string(b) != "good" {
+		t.Fatalf("message = %q, want good", b)
+	}
+	if _, _, err := rc.NextReader(); err != errBad {
+		t.Fatalf("NextReader() returned %v, want %v", err, errBad)
+	}
+
+	cc := newConn(fakeNetConn{Reader: &b2, Writer: ioutil.Discard}, false, 1024, 1024)
+	_, _, err = cc.NextReader()
+	if err == nil || !strings.Contains(err.Error(), strconv.Itoa(ClosePolicyViolation)) {
+		t.Fatalf("peer NextReader() returned %v, want close %d", err, ClosePolicyViolation)
+	}
+}
+
+func TestMessageFilterLongReason(t *testing.T) {
+	var b1, b2 bytes.Buffer
+	wc := newConn(fakeNetConn{Reader: nil, Writer: &b1}, false, 1024, 1024)
+	rc := newConn(fakeNetConn{Reader: &b1, Writer: &b2}, true, 1024, 1024)
+	// The multi-byte rune straddles the limit on the close reason.
+	reason := strings.Repeat("x", maxControlFramePayloadSize-3) + "世"
+	rc.SetMessageFilter(func(opCode MessageType, p []byte) error {
+		return errors.New(reason)
+	})
+	wc.WriteMessage(OpText, []byte("bad"))
+	rc.NextReader()
+
+	cc := newConn(fakeNetConn{Reader: &b2, Writer: ioutil.Discard}, false, 1024, 1024)
+	_, _, err := cc.NextReader()
+	e, ok := err.(*CloseError)
+	if !ok || e.Code != ClosePolicyViolation {
+		t.Fatalf("peer NextReader() returned %v, want close %d", err, ClosePolicyViolation)
+	}
+	if !utf8.ValidString(e.Text) || e.Text != reason[:maxControlFramePayloadSize-3] {
+		t.Errorf("close text = %q, want reason truncated before the rune", e.Text)
+	}
+}
+
+func TestValidateUTF8(t *testing.T) {
+	var b1, b2 bytes.Buffer
+	wc := newConn(fakeNetConn{Reader: nil, Writer: &b1}, false, 1024, 1024)
+	rc := newConn(fakeNetConn{Reader: &b1, Writer: &b2}, true, 1024, 1024)
+	rc.SetValidateUTF8(true)
+
+	wc.WriteMessage(OpText, []byte("héllo, 世界"))
+	wc.WriteMessage(OpBinary, []byte{0xff})
+	// Valid sequence split across frames.
+	w, _ := wc.NextWriter(OpText)
+	w.Write([]byte{0xe4})
+	wc.flushFrame(false, nil)
+	w.Write([]byte{0xb8, 0x96})
+	w.Close()
+	// Truncated sequence.
+	wc.WriteMessage(OpText, []byte{'a', 0xe4, 0xb8})
+
+	for i := 0; i < 3; i++ {
+		_, r, err := rc.NextReader()
+		if err != nil {
+			t.Fatalf("%d: NextReader() returned %v", i, err)
+		}
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			t.Fatalf("%d: Copy() returned %v", i, err)
+		}
+	}
+	_, r, err := rc.NextReader()
+	if err != nil {
+		t.Fatalf("NextReader() returned %v", err)
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != ErrInvalidUTF8 {
+		t.Fatalf("Copy() returned %v, want %v", err, ErrInvalidUTF8)
+	}
+	if b2.Len() == 0 {
+		t.Fatal("close message not sent")
+	}
+}
+
+func TestMessageTypeString(t *testing.T) {
+	for _, tt := range []struct {
+		t    MessageType
+		want string
+	}{
+		{OpText, "text"},
+		{OpBinary, "binary"},
+		{OpPong, "pong"},
+		{MessageType(3), "opcode 3"},
+	} {
+		if s := tt.t.String(); s != tt.want {
+			t.Errorf("MessageType(%d).String() = %q, want %q", int(tt.t), s, tt.want)
+		}
+	}
+}
+
+func TestCloseCodeText(t *testing.T) {
+	if s := CloseCodeText(CloseMessageTooBig); s != "message too big" {
+		t.Errorf("CloseCodeText(%d) = %q", CloseMessageTooBig, s)
+	}
+	if s := CloseCodeText(4000); s != "" {
+		t.Errorf("CloseCodeText(4000) = %q, want empty", s)
+	}
+
+	var b bytes.Buffer
+	wc := newConn(fakeNetConn{Reader: nil, Writer: &b}, true, 1024, 1024)
+	wc.WriteControl(OpClose, FormatCloseMessage(CloseMessageTooBig, "too long"), time.Time{})
+	rc := newConn(fakeNetConn{Reader: &b, Writer: ioutil.Discard}, false, 1024, 1024)
+	_, _, err := rc.NextReader()
+	if want := "websocket: close 1009 message too big: too long"; err == nil || err.Error() != want {
+		t.Errorf("NextReader() returned %v, want %s", err, want)
+	}
+}
+
+func TestCloseError(t *testing.T) {
+	for _, closeEOF := range []bool{false, true} {
+		for _, code := range []int{CloseNormalClosure, CloseGoingAway, CloseNoStatusReceived, CloseProtocolError} {
+			var b bytes.Buffer
+			wc := newConn(fakeNetConn{Reader: nil, Writer: &b}, true, 1024, 1024)
+			var p []byte
+			if code != CloseNoStatusReceived {
+				p = FormatCloseMessage(code, "bye")
+			}
+			wc.WriteControl(OpClose, p, time.Time{})
+			rc := newConn(fakeNetConn{Reader: &b, Writer: ioutil.Discard}, false, 1024, 1024)
+			rc.SetCloseEOF(closeEOF)
+			_, _, err := rc.NextReader()
+
+			var e *CloseError
+			if !errors.As(err, &e) || e.Code != code {
+				t.Errorf("eof:%v, code:%d: NextReader() returned %v", closeEOF, code, err)
+				continue
+			}
+			normal := code != CloseProtocolError
+			if IsCloseError(err) != normal {
+				t.Errorf("eof:%v, code:%d: IsCloseError() = %v, want %v", closeEOF, code, !normal, normal)
+			}
+			if errors.Is(err, io.EOF) != (closeEOF && normal) {
+				t.Errorf("eof:%v, code:%d: errors.Is(err, io.EOF) = %v", closeEOF, code, !(closeEOF && normal))
+			}
+		}
+	}
+	if IsCloseError(io.EOF) {
+		t.Error("IsCloseError(io.EOF) = true")
+	}
+}
+
+func TestControlPayloadLimits(t *testing.T) {
+	text := strings.Repeat("é", 100)
+	p := FormatCloseMessage(CloseNormalClosure, text)
+	if len(p) > maxControlFramePayloadSize {
+		t.Fatalf("FormatCloseMessage() returned %d bytes", len(p))
+	}
+	if !utf8.Valid(p[2:]) || !strings.HasPrefix(text, string(p[2:])) {
+		t.Fatalf("FormatCloseMessage() truncated text to %q", p[2:])
+	}
+
+	c := newConn(fakeNetConn{Reader: nil, Writer: ioutil.Discard}, true, 1024, 1024)
+	deadline := time.Now().Add(time.Second)
+	if err := c.WriteControl(OpPing, make([]byte, 126), deadline); err != errInvalidControlFrame {
+		t.Errorf("WriteControl(ping, 126 bytes) returned %v", err)
+	}
+	if err := c.WriteControl(OpPong, make([]byte, 125), deadline); err != nil {
+		t.Errorf("WriteControl(pong, 125 bytes) returned %v", err)
+	}
+	if err := c.WriteControl(OpClose, []byte{1}, deadline); err != errInvalidControlFrame {
+		t.Errorf("WriteControl(close, 1 byte) returned %v", err)
+	}
+	if err := c.WriteMessages([]Message{{OpClose, []byte{1}}}); err != errInvalidControlFrame {
+		t.Errorf("WriteMessages(close, 1 byte) returned %v", err)
+	}
+}
+
+func TestControlWriter(t *testing.T) {
+	var b bytes.Buffer
+	wc := newConn(fakeNetConn{Reader: nil, Writer: &b}, true, 1024, 1024)
+	if _, err := wc.NextWriter(OpContinuation); err != errBadWriteOpCode {
+		t.Fatalf("NextWriter(continuation) returned %v", err)
+	}
+
+	// Send a pong between the frames of a text message.
+	w, _ := wc.NextWriter(OpText)
+	w.Write(make([]byte, 1100))
+	pw, err := wc.NextWriter(OpPong)
+	if err != nil {
+		t.Fatalf("NextWriter(pong) returned %v", err)
+	}
+	io.WriteString(pw, "pong")
+	if _, err := pw.Write(make([]byte, 122)); err != errInvalidControlFrame {
+		t.Fatalf("control writer Write() past limit returned %v", err)
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatalf("control writer Close() returned %v", err)
+	}
+	if _, err := pw.Write([]byte("x")); err != errWriteClosed {
+		t.Fatalf("control writer Write() after Close returned %v", err)
+	}
+	w.Write([]byte("hello"))
+	w.Close()
+	wc.WriteMessage(OpPing, []byte("ping"))
+
+	// The pong received between the frames of the text message is returned
+	// after the text message.
+	rc := newConn(fakeNetConn{Reader: &b, Writer: ioutil.Discard}, false, 1024, 1024)
+	op, p, err := rc.ReadMessage()
+	if err != nil || op != OpText || len(p) != 1105 {
+		t.Fatalf("ReadMessage() returned %v, %d bytes, %v, want text", op, len(p), err)
+	}
+	op, p, err = rc.ReadMessage()
+	if err != nil || op != OpPong || string(p) != "pong" {
+		t.Fatalf("ReadMessage() returned %v, %q, %v, want pong", op, p, err)
+	}
+}
+
+func TestMaskKeySource(t *testing.T) {
+	var frames [2]bytes.Buffer
+	for i := range frames {
+		c := newConn(fakeNetConn{Reader: nil, Writer: &frames[i]}, false, 1024, 1024)
+		c.SetMaskKeySource(rand.New(rand.NewSource(1)))
+		c.WriteMessage(OpText, []byte("hello"))
+		c.WriteControl(OpPing, []byte("ping"), time.Now().Add(time.Second))
+	}
+	if !bytes.Equal(frames[0].Bytes(), frames[1].Bytes()) {
+		t.Fatal("frames written with the same mask key source are not equal")
+	}
+}
+
+// loopReader returns the contents of p repeatedly.
+type loopReader struct {
+	p   []byte
+	pos int
+}
+
+func (r *loopReader) Read(b []byte) (int, error) {
+	n := copy(b, r.p[r.pos:])
+	r.pos = (r.pos + n) % len(r.p)
+	return n, nil
+}
+
+// newEchoConn returns a server connection that reads a masked text message
+// followed by a masked ping repeatedly and discards the data written to the
+// connection.
+func newEchoConn() *Conn {
+	var frames bytes.Buffer
+	cc := newConn(fakeNetConn{Reader: nil, Writer: &frames}, false, 1024, 1024)
+	cc.SetMaskKeySource(rand.New(rand.NewSource(1)))
+	cc.WriteMessage(OpText, []byte("hello, world"))
+	cc.WriteControl(OpPing, []byte("ping"), time.Time{})
+	return newConn(fakeNetConn{Reader: &loopReader{p: frames.Bytes()}, Writer: ioutil.Discard}, true, 1024, 1024)
+}
+
+// echo reads a message from c and writes the message back to c.
+func echo(c *Conn) error {
+	op, b, err := c.ReadMessageBuffer()
+	if err != nil {
+		return err
+	}
+	defer ReleaseMessageBuffer(b)
+	return c.WriteMessage(op, b.Bytes())
+}
+
+func TestEchoAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items when the race detector is enabled")
+	}
+	c := newEchoConn()
+	n := testing.AllocsPerRun(1000, func() {
+		if err := echo(c); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if n != 0 {
+		t.Errorf("echo allocates %v times per message, want 0", n)
+	}
+}
+
+// newKeepaliveConn returns a connection that repeatedly reads a ping and a
+// pong from the peer and discards the data written to the connection.
+func newKeepaliveConn(isServer bool) *Conn {
+	var frames bytes.Buffer
+	pc := newConn(fakeNetConn{Reader: nil, Writer: &frames}, !isServer, 1024, 1024)
+	pc.SetMaskKeySource(rand.New(rand.NewSource(1)))
+	pc.WriteControl(OpPing, []byte("ping"), time.Time{})
+	pc.WriteControl(OpPong, []byte("pong"), time.Time{})
+	return newConn(fakeNetConn{Reader: &loopReader{p: frames.Bytes()}, Writer: ioutil.Discard}, isServer, 1024, 1024)
+}
+
+// keepalive sends a ping to the peer and reads the peer's ping and pong to p.
+func keepalive(c *Conn, p []byte) error {
+	if err := c.WriteControl(OpPing, []byte("ping"), time.Now().Add(time.Second)); err != nil {
+		return err
+	}
+	op, r, err := c.NextReader()
+	if err != nil {
+		return err
+	}
+	if op != OpPong {
+		return fmt.Errorf("NextReader() returned %v, want pong", op)
+	}
+	if n, _ := r.Read(p); string(p[:n]) != "pong" {
+		return fmt.Errorf("pong payload is %q", p[:n])
+	}
+	return nil
+}
+
+func TestKeepaliveAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items when the race detector is enabled")
+	}
+	for _, isServer := range []bool{true, false} {
+		c := newKeepaliveConn(isServer)
+		c.SetPongWait(time.Minute)
+		p := make([]byte, 8)
+		n := testing.AllocsPerRun(1000, func() {
+			if err := keepalive(c, p); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if n != 0 {
+			t.Errorf("server %v: keepalive allocates %v times per cycle, want 0", isServer, n)
+		}
+	}
+}
+
+func BenchmarkEcho(b *testing.B) {
+	c := newEchoConn()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := echo(c); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
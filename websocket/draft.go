@@ -0,0 +1,284 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Support for legacy clients. The hybi-07 and hybi-08 drafts use the framing
+// and handshake of RFC 6455 with different version numbers. The hixie-76
+// draft uses a different handshake and framing. Hixie-76 connections run on
+// a socketConn that translates between the hixie-76 framing and RFC 6455
+// frames.
+
+// isDraftVersion returns true if v is a supported draft protocol version.
+func isDraftVersion(v string) bool {
+	return v == "7" || v == "8"
+}
+
+// isHixie76 returns true if r is a hixie-76 handshake request.
+func isHixie76(r *http.Request) bool {
+	return r.Header.Get("Sec-Websocket-Version") == "" &&
+		r.Header.Get("Sec-Websocket-Key1") != "" &&
+		r.Header.Get("Sec-Websocket-Key2") != ""
+}
+
+var errBadHixie76Key = HandshakeError{"websocket: bad Sec-WebSocket-Key1 or Sec-WebSocket-Key2"}
+
+// hixie76KeyNumber returns the number encoded in a hixie-76 key: the digits
+// of the key divided by the number of spaces in the key.
+func hixie76KeyNumber(key string) (uint32, error) {
+	var n uint64
+	spaces := 0
+	for i := 0; i < len(key); i++ {
+		switch b := key[i]; {
+		case b >= '0' && b <= '9':
+			if n > 1<<60 {
+				return 0, errBadHixie76Key
+			}
+			n = n*10 + uint64(b-'0')
+		case b == ' ':
+			spaces++
+		}
+	}
+	if spaces == 0 || n%uint64(spaces) != 0 || n/uint64(spaces) > 1<<32-1 {
+		return 0, errBadHixie76Key
+	}
+	return uint32(n / uint64(spaces)), nil
+}
+
+// hixie76Response computes the handshake response body from the request
+// keys.
+func hixie76Response(key1, key2 string, key3 []byte) ([]byte, error) {
+	n1, err := hixie76KeyNumber(key1)
+	if err != nil {
+		return nil, err
+	}
+	n2, err := hixie76KeyNumber(key2)
+	if err != nil {
+		return nil, err
+	}
+	var challenge [16]byte
+	binary.BigEndian.PutUint32(challenge[0:], n1)
+	binary.BigEndian.PutUint32(challenge[4:], n2)
+	copy(challenge[8:], key3)
+	sum := md5.Sum(challenge[:])
+	return sum[:], nil
+}
+
+// upgradeHixie76 completes the hixie-76 handshake and returns a connection
+// using the hixie-76 framing. The size of text frames is limited to readLimit
+// if readLimit is greater than zero.
+func upgradeHixie76(w http.ResponseWriter, r *http.Request, responseHeader http.Header, handshakeTimeout time.Duration, readLimit int64) (*Conn, error) {
+	if _, err := hixie76Response(r.Header.Get("Sec-Websocket-Key1"), r.Header.Get("Sec-Websocket-Key2"), nil); err != nil {
+		return nil, err
+	}
+
+	h, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("websocket: response does not support Hijack")
+	}
+	netConn, rw, err := h.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	if handshakeTimeout > 0 {
+		netConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	}
+
+	// The third key is sent as the request body.
+	key3 := make([]byte, 8)
+	if _, err := io.ReadFull(rw.Reader, key3); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	sum, _ := hixie76Response(r.Header.Get("Sec-Websocket-Key1"), r.Header.Get("Sec-Websocket-Key2"), key3)
+
+	scheme := "ws"
+	if r.TLS != nil {
+		scheme = "wss"
+	}
+	p := []byte("HTTP/1.1 101 WebSocket Protocol Handshake\r\nUpgrade: WebSocket\r\nConnection: Upgrade\r\nSec-WebSocket-Origin: ")
+	p = append(p, r.Header.Get("Origin")...)
+	p = append(p, "\r\nSec-WebSocket-Location: "...)
+	p = append(p, scheme+"://"+r.Host+r.URL.RequestURI()...)
+	p = append(p, "\r\n"...)
+	for k, vs := range responseHeader {
+		for _, v := range vs {
+			p = append(p, k...)
+			p = append(p, ": "...)
+			for i := 0; i < len(v); i++ {
+				b := v[i]
+				if b <= 31 {
+					// prevent response splitting.
+					b = ' '
+				}
+				p = append(p, b)
+			}
+			p = append(p, "\r\n"...)
+		}
+	}
+	p = append(p, "\r\n"...)
+	p = append(p, sum...)
+	if _, err := netConn.Write(p); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	netConn.SetDeadline(time.Time{})
+
+	hs := &hixie76Socket{conn: netConn, readLimit: readLimit}
+	sc := newSocketConn(hs, netConn.RemoteAddr())
+	sc.maskReads = true
+	sc.closeConn = netConn.Close
+	sc.setWriteDeadline = netConn.SetWriteDeadline
+	go hs.readLoop(rw.Reader, sc)
+	return newConn(sc, true, defaultBufferSize, defaultBufferSize), nil
+}
+
+var errHixie76Binary = errors.New("websocket: binary messages not supported by hixie-76 protocol")
+
+// hixie76Socket is a messageSocket using the hixie-76 framing.
+type hixie76Socket struct {
+	conn      net.Conn
+	readLimit int64 // maximum size of a text frame, zero for the default.
+
+	mu          sync.Mutex // protects closeSent and writes to conn.
+	closeSent   bool
+	writeBuffer []byte
+}
+
+func (s *hixie76Socket) Send(opCode MessageType, p []byte) error {
+	if opCode != OpText {
+		return errHixie76Binary
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closeSent {
+		return ErrCloseSent
+	}
+	s.writeBuffer = append(append(append(s.writeBuffer[:0], 0x00), p...), 0xff)
+	_, err := s.conn.Write(s.writeBuffer)
+	return err
+}
+
+// Close sends the closing frame. The hixie-76 closing frame does not have a
+// close code or text.
+func (s *hixie76Socket) Close(closeCode int, text string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closeSent {
+		return nil
+	}
+	s.closeSent = true
+	_, err := s.conn.Write([]byte{0xff, 0x00})
+	return err
+}
+
+// readLoop reads frames from br and delivers the messages to sc.
+func (s *hixie76Socket) readLoop(br *bufio.Reader, sc *socketConn) {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			sc.fail(err)
+			return
+		}
+		if b&0x80 == 0 {
+			// Text frame terminated by 0xff.
+			limit := s.readLimit
+			if limit <= 0 {
+				limit = defaultHixie76FrameSize
+			} else if limit > maxHixie76FrameSize {
+				limit = maxHixie76FrameSize
+			}
+			p, err := br.ReadSlice(0xff)
+			if err == bufio.ErrBufferFull {
+				// Accumulate large messages.
+				buf := append([]byte(nil), p...)
+				for err == bufio.ErrBufferFull {
+					if int64(len(buf)) > limit {
+						sc.fail(errFrameTooLarge)
+						return
+					}
+					p, err = br.ReadSlice(0xff)
+					buf = append(buf, p...)
+				}
+				p = buf
+			}
+			if err == nil && int64(len(p)-1) > limit {
+				sc.fail(errFrameTooLarge)
+				return
+			}
+			if err != nil {
+				sc.fail(err)
+				return
+			}
+			if b == 0x00 {
+				// Stop reading from the network until the application reads
+				// the previous message.
+				if !sc.waitDrained() {
+					return
+				}
+				sc.deliver(OpText, p[:len(p)-1])
+			}
+			continue
+		}
+
+		// Length prefixed frame. The length is encoded in base 128 with the
+		// high bit set in all bytes except the last.
+		var n int64
+		for {
+			c, err := br.ReadByte()
+			if err != nil {
+				sc.fail(err)
+				return
+			}
+			n = n<<7 | int64(c&0x7f)
+			if n > maxHixie76FrameSize {
+				sc.fail(errFrameTooLarge)
+				return
+			}
+			if c&0x80 == 0 {
+				break
+			}
+		}
+		if b == 0xff && n == 0 {
+			sc.deliverClose(CloseNoStatusReceived, "")
+			return
+		}
+		if _, err := br.Discard(int(n)); err != nil {
+			sc.fail(err)
+			return
+		}
+	}
+}
+
+const (
+	// maxHixie76FrameSize is the maximum size of a frame.
+	maxHixie76FrameSize = 1 << 30
+
+	// defaultHixie76FrameSize is the maximum size of a text frame when the
+	// application does not set a read limit.
+	defaultHixie76FrameSize = 1 << 20
+)
@@ -0,0 +1,232 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHixie76Response(t *testing.T) {
+	// Example from draft-hixie-thewebsocketprotocol-76 section 1.3.
+	sum, err := hixie76Response("4 @1  46546xW%0l 1 5", "12998 5 Y3 1  .P00", []byte("^n:ds[4U"))
+	if err != nil {
+		t.Fatalf("hixie76Response() returned %v", err)
+	}
+	if string(sum) != "8jKS'y:G*Co,Wxa-" {
+		t.Errorf("hixie76Response() = %q, want %q", sum, "8jKS'y:G*Co,Wxa-")
+	}
+	if _, err := hixie76Response("12345", "1 2", nil); err == nil {
+		t.Error("hixie76Response() did not return an error for a key without spaces")
+	}
+}
+
+func newDraftServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := Upgrader{AllowDraftProtocols: true}
+		c, err := u.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			op, p, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := c.WriteMessage(op, p); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+func TestHixie76(t *testing.T) {
+	s := newDraftServer(t)
+	defer s.Close()
+	host := strings.TrimPrefix(s.URL, "http://")
+
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	io.WriteString(conn, "GET /demo HTTP/1.1\r\n"+
+		"Host: "+host+"\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Upgrade: WebSocket\r\n"+
+		"Origin: http://"+host+"\r\n"+
+		"Sec-WebSocket-Key1: 4 @1  46546xW%0l 1 5\r\n"+
+		"Sec-WebSocket-Key2: 12998 5 Y3 1  .P00\r\n"+
+		"\r\n"+
+		"^n:ds[4U")
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("ReadResponse() returned %v", err)
+	}
+	if resp.StatusCode != 101 || resp.Header.Get("Sec-Websocket-Location") != "ws://"+host+"/demo" {
+		t.Fatalf("bad response %d, %v", resp.StatusCode, resp.Header)
+	}
+	sum := make([]byte, 16)
+	if _, err := io.ReadFull(br, sum); err != nil || string(sum) != "8jKS'y:G*Co,Wxa-" {
+		t.Fatalf("response body %q, %v", sum, err)
+	}
+
+	conn.Write([]byte("\x00hello\xff"))
+	p := make([]byte, 7)
+	if _, err := io.ReadFull(br, p); err != nil || string(p) != "\x00hello\xff" {
+		t.Fatalf("message %q, %v", p, err)
+	}
+
+	conn.Write([]byte{0xff, 0x00})
+	p = make([]byte, 2)
+	if _, err := io.ReadFull(br, p); err != nil || !bytes.Equal(p, []byte{0xff, 0x00}) {
+		t.Fatalf("closing frame %q, %v", p, err)
+	}
+}
+
+func TestHixie76TextFrameLimit(t *testing.T) {
+	for _, tt := range []struct {
+		readLimit int64
+		frame     string
+		err       error
+	}{
+		{0, "\x00" + strings.Repeat("x", 100) + "\xff", nil},
+		{0, "\x00" + strings.Repeat("x", defaultHixie76FrameSize+1) + "\xff", errFrameTooLarge},
+		{50, "\x00" + strings.Repeat("x", 50) + "\xff", nil},
+		{50, "\x00" + strings.Repeat("x", 51) + "\xff", errFrameTooLarge},
+		// An unterminated frame larger than the read buffer.
+		{50, "\x00" + strings.Repeat("x", 1000), errFrameTooLarge},
+	} {
+		hs := &hixie76Socket{readLimit: tt.readLimit}
+		sc := newSocketConn(hs, stringAddr(""))
+		hs.readLoop(bufio.NewReaderSize(strings.NewReader(tt.frame), 16), sc)
+		if _, err := ioutil.ReadAll(sc); err != tt.err {
+			t.Errorf("limit %d, frame size %d: read returned %v, want %v", tt.readLimit, len(tt.frame), err, tt.err)
+		}
+	}
+}
+
+func TestHixie76ReadWaitsForApplication(t *testing.T) {
+	hs := &hixie76Socket{}
+	sc := newSocketConn(hs, stringAddr(""))
+	sc.maskReads = true
+	done := make(chan struct{})
+	go func() {
+		hs.readLoop(bufio.NewReader(strings.NewReader("\x00one\xff\x00two\xff")), sc)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("readLoop returned before the application read the first message")
+	case <-time.After(50 * time.Millisecond):
+	}
+	sc.mu.Lock()
+	n := len(sc.rbuf)
+	sc.mu.Unlock()
+	if want := len("one") + 6; n != want {
+		t.Errorf("queued %d bytes, want %d", n, want)
+	}
+
+	c := newConn(sc, true, 1024, 1024)
+	for _, want := range []string{"one", "two"} {
+		_, p, err := c.ReadMessage()
+		if err != nil || string(p) != want {
+			t.Fatalf("ReadMessage() returned %q, %v, want %q", p, err, want)
+		}
+	}
+	<-done
+}
+
+func TestHixie76WriteDeadline(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	// The peer does not read, so writes to c1 block.
+	hs := &hixie76Socket{conn: c1}
+	sc := newSocketConn(hs, stringAddr(""))
+	sc.maskReads = true
+	sc.setWriteDeadline = c1.SetWriteDeadline
+	c := newConn(sc, true, 1024, 1024)
+	c.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	err := c.WriteMessage(OpText, []byte("hello"))
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Errorf("WriteMessage() returned %v, want timeout", err)
+	}
+}
+
+func TestHybi08(t *testing.T) {
+	s := newDraftServer(t)
+	defer s.Close()
+	host := strings.TrimPrefix(s.URL, "http://")
+
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	io.WriteString(conn, "GET / HTTP/1.1\r\n"+
+		"Host: "+host+"\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Sec-WebSocket-Origin: http://"+host+"\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 8\r\n"+
+		"\r\n")
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("ReadResponse() returned %v", err)
+	}
+	if resp.StatusCode != 101 || resp.Header.Get("Sec-Websocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("bad response %d, %v", resp.StatusCode, resp.Header)
+	}
+}
+
+func TestDraftNotAllowed(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var u Upgrader
+		u.Upgrade(w, r, nil)
+	}))
+	defer s.Close()
+	req, _ := http.NewRequest("GET", s.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "8")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// handshakeErrorCodes maps the handshake errors returned by upgrade to the
+// codes in JSON error responses.
+var handshakeErrorCodes = map[HandshakeError]string{
+	errBadVersion:    "bad_websocket_version",
+	errBadConnection: "bad_connection_header",
+	errBadUpgrade:    "bad_upgrade_header",
+	errBadKey:        "bad_websocket_key",
+	errBadProtocol:   "bad_protocol",
+	errBadHixie76Key: "bad_websocket_key",
+}
+
+// supportedVersions is the list of versions reported in the response to a
+// request with an unsupported version.
+var supportedVersions = []int{13}
+
+func handshakeErrorCode(e HandshakeError) string {
+	if code, ok := handshakeErrorCodes[e]; ok {
+		return code
+	}
+	return "bad_handshake"
+}
+
+// jsonError is the body of a JSON error response.
+type jsonError struct {
+	Error     string `json:"error"`
+	Supported []int  `json:"supported,omitempty"`
+}
+
+// writeJSONError replies to the request with status and a JSON body holding
+// code.
+func writeJSONError(w http.ResponseWriter, status int, code string) {
+	body := jsonError{Error: code}
+	if code == "bad_websocket_version" {
+		body.Supported = supportedVersions
+		w.Header().Set("Sec-Websocket-Version", "13")
+	}
+	p, _ := json.Marshal(body)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(p)
+}
@@ -0,0 +1,75 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"strings"
+)
+
+// Extension is an extension agreed in the opening handshake.
+type Extension struct {
+	// Name is the extension token, for example "permessage-deflate".
+	Name string
+
+	// Params are the extension parameters. A parameter without a value has
+	// an empty string value.
+	Params map[string]string
+}
+
+// Extensions returns the extensions agreed in the opening handshake in the
+// order listed in the Sec-WebSocket-Extensions response header. The package
+// does not implement any extensions. A server application that agrees to an
+// extension by setting the Sec-WebSocket-Extensions response header and
+// implements the extension using a FrameConn finds the extension here.
+// Applications and middleware use Extensions to adapt their behavior, for
+// example to skip application level compression when the connection is
+// compressed.
+func (c *Conn) Extensions() []Extension {
+	return c.extensions
+}
+
+// parseExtensions parses the Sec-WebSocket-Extensions header as specified in
+// RFC 6455, section 9.1. The header name is matched without regard to case
+// so that response headers created by the application with non-canonical
+// keys are found.
+func parseExtensions(header map[string][]string) []Extension {
+	var extensions []Extension
+	for k, vs := range header {
+		if !strings.EqualFold(k, "Sec-Websocket-Extensions") {
+			continue
+		}
+		for _, v := range vs {
+			for _, s := range strings.Split(v, ",") {
+				parts := strings.Split(s, ";")
+				name := strings.TrimSpace(parts[0])
+				if name == "" {
+					continue
+				}
+				e := Extension{Name: name, Params: make(map[string]string)}
+				for _, p := range parts[1:] {
+					k, v := p, ""
+					if i := strings.Index(p, "="); i >= 0 {
+						k, v = p[:i], strings.Trim(strings.TrimSpace(p[i+1:]), `"`)
+					}
+					if k = strings.TrimSpace(k); k != "" {
+						e.Params[k] = v
+					}
+				}
+				extensions = append(extensions, e)
+			}
+		}
+	}
+	return extensions
+}
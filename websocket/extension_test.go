@@ -0,0 +1,74 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var parseExtensionsTests = []struct {
+	header map[string][]string
+	want   []Extension
+}{
+	{nil, nil},
+	{map[string][]string{"Sec-Websocket-Extensions": {"foo"}}, []Extension{{"foo", map[string]string{}}}},
+	{
+		map[string][]string{"Sec-WebSocket-Extensions": {`permessage-deflate; client_max_window_bits; server_max_window_bits="10", x-bar;a=1`}},
+		[]Extension{
+			{"permessage-deflate", map[string]string{"client_max_window_bits": "", "server_max_window_bits": "10"}},
+			{"x-bar", map[string]string{"a": "1"}},
+		},
+	},
+	{map[string][]string{"Sec-Websocket-Extensions": {" , ;a=1"}}, nil},
+}
+
+func TestParseExtensions(t *testing.T) {
+	for _, tt := range parseExtensionsTests {
+		if got := parseExtensions(tt.header); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseExtensions(%v) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	want := []Extension{{"x-test", map[string]string{"level": "2"}}}
+	extensions := make(chan []Extension, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var u Upgrader
+		c, err := u.Upgrade(w, r, http.Header{"Sec-WebSocket-Extensions": {"x-test; level=2"}})
+		if err != nil {
+			extensions <- nil
+			return
+		}
+		defer c.Close()
+		extensions <- c.Extensions()
+	}))
+	defer s.Close()
+	c, _, err := DefaultDialer.Dial(strings.Replace(s.URL, "http", "ws", 1), nil)
+	if err != nil {
+		t.Fatalf("Dial() returned %v", err)
+	}
+	defer c.Close()
+	if got := c.Extensions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("client Extensions() = %v, want %v", got, want)
+	}
+	if got := <-extensions; !reflect.DeepEqual(got, want) {
+		t.Errorf("server Extensions() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var errFrameTooLarge = errors.New("websocket: frame length too large")
+
+// FrameHeader is the header of a WebSocket frame.
+type FrameHeader struct {
+	// Final is true if the frame is the final fragment of a message.
+	Final bool
+
+	// RSV is the value of the three reserved bits. RSV1 is the most
+	// significant bit.
+	RSV int
+
+	// OpCode is the frame opcode.
+	OpCode MessageType
+
+	// Masked is true if the payload is masked with MaskKey.
+	Masked bool
+
+	// Length is the payload length.
+	Length int64
+
+	// MaskKey is the masking key.
+	MaskKey [4]byte
+}
+
+// frameHeaderSize returns the size of a header given the second byte of the
+// header.
+func frameHeaderSize(b1 byte) int {
+	n := 2
+	switch b1 & 0x7f {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if b1&maskBit != 0 {
+		n += 4
+	}
+	return n
+}
+
+// EncodeFrameHeader appends the wire encoding of h to p and returns the
+// extended buffer. The length is encoded using the smallest representation
+// allowed by the protocol.
+func EncodeFrameHeader(p []byte, h FrameHeader) []byte {
+	b0 := byte(h.OpCode&0xf) | byte(h.RSV&0x7)<<4
+	if h.Final {
+		b0 |= finalBit
+	}
+	b1 := byte(0)
+	if h.Masked {
+		b1 |= maskBit
+	}
+
+	switch {
+	case h.Length >= 65536:
+		p = append(p, b0, b1|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(p[len(p)-8:], uint64(h.Length))
+	case h.Length > 125:
+		p = append(p, b0, b1|126, 0, 0)
+		binary.BigEndian.PutUint16(p[len(p)-2:], uint16(h.Length))
+	default:
+		p = append(p, b0, b1|byte(h.Length))
+	}
+
+	if h.Masked {
+		p = append(p, h.MaskKey[:]...)
+	}
+	return p
+}
+
+// DecodeFrameHeader decodes the frame header at the start of p. It returns
+// the header and the number of bytes used by the header. DecodeFrameHeader
+// returns io.ErrUnexpectedEOF if p does not contain a complete header.
+func DecodeFrameHeader(p []byte) (FrameHeader, int, error) {
+	var h FrameHeader
+	if len(p) < 2 {
+		return h, 0, io.ErrUnexpectedEOF
+	}
+	n := frameHeaderSize(p[1])
+	if len(p) < n {
+		return h, 0, io.ErrUnexpectedEOF
+	}
+
+	h.Final = p[0]&finalBit != 0
+	h.RSV = int((p[0] >> 4) & 0x7)
+	h.OpCode = MessageType(p[0] & 0xf)
+	h.Masked = p[1]&maskBit != 0
+	h.Length = int64(p[1] & 0x7f)
+
+	i := 2
+	switch h.Length {
+	case 126:
+		h.Length = int64(binary.BigEndian.Uint16(p[i:]))
+		i += 2
+	case 127:
+		h.Length = int64(binary.BigEndian.Uint64(p[i:]))
+		if h.Length < 0 {
+			return h, 0, errFrameTooLarge
+		}
+		i += 8
+	}
+
+	if h.Masked {
+		copy(h.MaskKey[:], p[i:])
+	}
+	return h, n, nil
+}
+
+// FrameConn reads and writes individual frames on a connection. FrameConn
+// does not check the protocol rules for fragmentation, control frames,
+// reserved bits or masking. Proxies, recorders and extensions use FrameConn
+// to operate below the message abstraction.
+type FrameConn struct {
+	c *Conn
+
+	// Payload remaining in the current frame.
+	remaining int64
+	maskKey   [4]byte
+	maskPos   int
+	masked    bool
+	seq       int
+}
+
+// NewFrameConn returns a FrameConn for c. The application must not call the
+// read or write methods of c after calling NewFrameConn. The Close,
+// CloseHandshake, WriteControl and deadline methods of c can be used with the
+// FrameConn.
+func NewFrameConn(c *Conn) *FrameConn {
+	return &FrameConn{c: c}
+}
+
+// ReadFrame reads the next frame header from the connection and returns a
+// reader for the frame payload. The payload is unmasked by the reader. The
+// reader is valid until the next call to ReadFrame. ReadFrame discards the
+// unread payload of the previous frame.
+func (fc *FrameConn) ReadFrame() (FrameHeader, io.Reader, error) {
+	var h FrameHeader
+	c := fc.c
+
+	if fc.remaining > 0 {
+		if err := c.discard(fc.remaining); err != nil {
+			return h, nil, err
+		}
+		fc.remaining = 0
+	}
+	fc.seq++
+
+	var b [maxFrameHeaderSize]byte
+	if err := c.read(b[:2]); err != nil {
+		return h, nil, err
+	}
+	n := frameHeaderSize(b[1])
+	if err := c.read(b[2:n]); err != nil {
+		return h, nil, err
+	}
+	h, _, err := DecodeFrameHeader(b[:n])
+	if err != nil {
+		return h, nil, err
+	}
+
+	fc.remaining = h.Length
+	fc.masked = h.Masked
+	fc.maskKey = h.MaskKey
+	fc.maskPos = 0
+	return h, frameReader{fc, fc.seq}, nil
+}
+
+type frameReader struct {
+	fc  *FrameConn
+	seq int
+}
+
+func (r frameReader) Read(p []byte) (int, error) {
+	fc := r.fc
+	if r.seq != fc.seq || fc.remaining == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > fc.remaining {
+		p = p[:fc.remaining]
+	}
+	n, err := fc.c.br.Read(p)
+	fc.remaining -= int64(n)
+	if fc.masked {
+		fc.maskPos = maskBytes(fc.maskKey, fc.maskPos, p[:n])
+	}
+	if err == io.EOF && fc.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// WriteFrame writes a frame with the given header and payload to the
+// connection. The payload length is taken from payload; h.Length is ignored.
+// If h.Masked is true, then the payload is masked with h.MaskKey. WriteFrame
+// does not modify payload.
+func (fc *FrameConn) WriteFrame(h FrameHeader, payload []byte) error {
+	var b [maxFrameHeaderSize]byte
+	h.Length = int64(len(payload))
+	p := EncodeFrameHeader(b[:0], h)
+
+	if h.Masked {
+		masked := make([]byte, len(payload))
+		copy(masked, payload)
+		maskBytes(h.MaskKey, 0, masked)
+		payload = masked
+	}
+
+	return fc.c.write(h.OpCode, fc.c.writeDeadline, p, payload)
+}
@@ -0,0 +1,119 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestFrameConnRead(t *testing.T) {
+	var connBuf bytes.Buffer
+	wc := newConn(fakeNetConn{Reader: nil, Writer: &connBuf}, false, 1024, 100000)
+	fc := NewFrameConn(newConn(fakeNetConn{Reader: &connBuf, Writer: nil}, true, 1024, 1024))
+
+	sizes := []int{0, 10, 200, 70000}
+	for _, n := range sizes {
+		if err := wc.WriteMessage(OpBinary, bytes.Repeat([]byte{'x'}, n)); err != nil {
+			t.Fatalf("WriteMessage(%d) returned %v", n, err)
+		}
+	}
+	wc.WriteMessage(OpText, []byte("skipped"))
+	wc.WriteMessage(OpText, []byte("last"))
+
+	for _, n := range sizes {
+		h, r, err := fc.ReadFrame()
+		if err != nil {
+			t.Fatalf("ReadFrame() returned %v", err)
+		}
+		if !h.Final || h.OpCode != OpBinary || !h.Masked || h.Length != int64(n) {
+			t.Fatalf("ReadFrame() returned header %+v, want length %d", h, n)
+		}
+		p, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(p, bytes.Repeat([]byte{'x'}, n)) {
+			t.Fatalf("ReadAll() returned %d bytes, %v, want %d bytes", len(p), err, n)
+		}
+	}
+
+	// Read the next frame without reading the payload.
+	if _, _, err := fc.ReadFrame(); err != nil {
+		t.Fatalf("ReadFrame() returned %v", err)
+	}
+	_, r, err := fc.ReadFrame()
+	if err != nil {
+		t.Fatalf("ReadFrame() returned %v", err)
+	}
+	if p, _ := ioutil.ReadAll(r); string(p) != "last" {
+		t.Fatalf("payload = %q, want last", p)
+	}
+}
+
+func TestFrameConnWrite(t *testing.T) {
+	for _, masked := range []bool{false, true} {
+		var connBuf bytes.Buffer
+		fc := NewFrameConn(newConn(fakeNetConn{Reader: nil, Writer: &connBuf}, !masked, 1024, 1024))
+		rc := newConn(fakeNetConn{Reader: &connBuf, Writer: nil}, masked, 1024, 1024)
+
+		key := [4]byte{1, 2, 3, 4}
+		payload := []byte("hello world")
+		fc.WriteFrame(FrameHeader{OpCode: OpText, Masked: masked, MaskKey: key}, payload[:5])
+		fc.WriteFrame(FrameHeader{OpCode: OpContinuation, Masked: masked, MaskKey: key}, payload[5:8])
+		fc.WriteFrame(FrameHeader{Final: true, OpCode: OpContinuation, Masked: masked, MaskKey: key}, payload[8:])
+
+		if string(payload) != "hello world" {
+			t.Fatal("WriteFrame modified the payload")
+		}
+
+		op, r, err := rc.NextReader()
+		if err != nil || op != OpText {
+			t.Fatalf("m:%v: NextReader() returned %d, %v", masked, op, err)
+		}
+		p, err := ioutil.ReadAll(r)
+		if err != nil || string(p) != "hello world" {
+			t.Fatalf("m:%v: ReadAll() returned %q, %v", masked, p, err)
+		}
+	}
+}
+
+var frameHeaderTests = []FrameHeader{
+	{Final: true, OpCode: OpText, Length: 0},
+	{Final: false, RSV: 4, OpCode: OpBinary, Length: 125},
+	{Final: true, OpCode: OpContinuation, Length: 126, Masked: true, MaskKey: [4]byte{1, 2, 3, 4}},
+	{Final: true, RSV: 7, OpCode: OpPing, Length: 65535},
+	{Final: true, OpCode: OpBinary, Length: 65536, Masked: true, MaskKey: [4]byte{5, 6, 7, 8}},
+	{Final: true, OpCode: 0xf, Length: 1 << 40},
+}
+
+func TestFrameHeaderEncoding(t *testing.T) {
+	for _, h := range frameHeaderTests {
+		p := EncodeFrameHeader([]byte{0xff}, h)
+		if p[0] != 0xff {
+			t.Fatalf("EncodeFrameHeader(%+v) did not append", h)
+		}
+		p = p[1:]
+		got, n, err := DecodeFrameHeader(append(p, 'x'))
+		if err != nil {
+			t.Fatalf("DecodeFrameHeader(%+v) returned %v", h, err)
+		}
+		if got != h || n != len(p) {
+			t.Fatalf("DecodeFrameHeader() = %+v, %d, want %+v, %d", got, n, h, len(p))
+		}
+		if _, _, err := DecodeFrameHeader(p[:len(p)-1]); err != io.ErrUnexpectedEOF {
+			t.Fatalf("DecodeFrameHeader(short %+v) returned %v", h, err)
+		}
+	}
+}
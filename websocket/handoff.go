@@ -0,0 +1,85 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// ListenerFDEnv is the environment variable used by StartHandoff to pass the
+// file descriptor of the listener to the new process.
+const ListenerFDEnv = "WEBSOCKET_LISTENER_FD"
+
+// StartHandoff starts cmd with an inherited copy of the listener l. The new
+// process gets the listener by calling InheritListener. The listener must
+// be a *net.TCPListener or *net.UnixListener. Handoff is not supported on
+// Windows.
+//
+// WebSocket connections cannot be passed to the new process. After the new
+// process is accepting connections, the old process closes l and drains its
+// connections with the Registry DrainOver method. The clients reconnect to
+// the new process over the drain period:
+//
+//  cmd := exec.Command(os.Args[0], os.Args[1:]...)
+//  if err := websocket.StartHandoff(listener, cmd); err != nil {
+//      ...
+//  }
+//  listener.Close()
+//  registry.DrainOver(ctx, time.Minute, websocket.CloseServiceRestart, "")
+func StartHandoff(l net.Listener, cmd *exec.Cmd) error {
+	fl, ok := l.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return errors.New("websocket: listener does not support handoff")
+	}
+	f, err := fl.File()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// File descriptors 0, 1 and 2 are stdin, stdout and stderr.
+	cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+	fd := 2 + len(cmd.ExtraFiles)
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, ListenerFDEnv+"="+strconv.Itoa(fd))
+	return cmd.Start()
+}
+
+// InheritListener returns the listener passed to the process by
+// StartHandoff. InheritListener returns nil and no error if the process was
+// not started by StartHandoff. InheritListener clears ListenerFDEnv so that
+// the listener is not inherited again by child processes.
+func InheritListener() (net.Listener, error) {
+	s := os.Getenv(ListenerFDEnv)
+	if s == "" {
+		return nil, nil
+	}
+	os.Unsetenv(ListenerFDEnv)
+	fd, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, errors.New("websocket: invalid " + ListenerFDEnv)
+	}
+	f := os.NewFile(uintptr(fd), "listener")
+	defer f.Close()
+	return net.FileListener(f)
+}
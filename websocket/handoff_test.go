@@ -0,0 +1,82 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+)
+
+// TestHandoffHelper is the new process started by TestHandoff. The helper
+// serves WebSocket echo connections on the inherited listener.
+func TestHandoffHelper(t *testing.T) {
+	if os.Getenv("WEBSOCKET_HANDOFF_HELPER") == "" {
+		return
+	}
+	l, err := InheritListener()
+	if err != nil || l == nil {
+		os.Exit(1)
+	}
+	http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var u Upgrader
+		c, err := u.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		op, p, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+		c.WriteMessage(op, append([]byte("new:"), p...))
+	}))
+}
+
+func TestHandoff(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "js" {
+		t.Skip("handoff not supported on " + runtime.GOOS)
+	}
+	if l, err := InheritListener(); l != nil || err != nil {
+		t.Fatalf("InheritListener() = %v, %v, want nil, nil", l, err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHandoffHelper$")
+	cmd.Env = append(os.Environ(), "WEBSOCKET_HANDOFF_HELPER=1")
+	if err := StartHandoff(l, cmd); err != nil {
+		t.Fatalf("StartHandoff: %v", err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	l.Close()
+
+	c, _, err := DefaultDialer.Dial("ws://"+addr+"/", nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	c.WriteMessage(OpText, []byte("hello"))
+	if _, p, err := c.ReadMessage(); err != nil || string(p) != "new:hello" {
+		t.Fatalf("ReadMessage() = %q, %v, want new:hello", p, err)
+	}
+}
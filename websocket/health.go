@@ -0,0 +1,156 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// healthCounters are the package-wide counters reported by HealthHandler.
+// The fields are accessed atomically.
+var healthCounters struct {
+	handshakes      int64 // upgrades started by Upgrader.Upgrade.
+	handshakeErrors int64 // upgrades that failed.
+	queued          int64 // messages in send queues.
+	queueCapacity   int64 // capacity of running send queues.
+	queueOverflows  int64 // messages rejected with ErrQueueFull or dropped.
+}
+
+// HealthStats is a snapshot of the WebSocket subsystem of the process.
+type HealthStats struct {
+	// Conns is the number of connections that the application has not
+	// closed.
+	Conns int64 `json:"conns"`
+
+	// Handshakes and HandshakeErrors are the number of upgrades started and
+	// failed by Upgrader.Upgrade since the process started.
+	Handshakes      int64 `json:"handshakes"`
+	HandshakeErrors int64 `json:"handshake_errors"`
+
+	// QueuedMessages is the number of messages in send queues.
+	// QueueCapacity is the total capacity of the running send queues.
+	QueuedMessages int64 `json:"queued_messages"`
+	QueueCapacity  int64 `json:"queue_capacity"`
+
+	// QueueOverflows is the number of messages rejected or dropped by send
+	// queues since the process started.
+	QueueOverflows int64 `json:"queue_overflows"`
+
+	// Goroutines is the number of goroutines in the process.
+	Goroutines int `json:"goroutines"`
+}
+
+// ReadHealthStats returns a snapshot of the WebSocket subsystem.
+func ReadHealthStats() HealthStats {
+	return HealthStats{
+		Conns:           TotalMemoryUsage().Conns,
+		Handshakes:      atomic.LoadInt64(&healthCounters.handshakes),
+		HandshakeErrors: atomic.LoadInt64(&healthCounters.handshakeErrors),
+		QueuedMessages:  atomic.LoadInt64(&healthCounters.queued),
+		QueueCapacity:   atomic.LoadInt64(&healthCounters.queueCapacity),
+		QueueOverflows:  atomic.LoadInt64(&healthCounters.queueOverflows),
+		Goroutines:      runtime.NumGoroutine(),
+	}
+}
+
+// QueueSaturation returns the fraction of the send queue capacity in use.
+func (s HealthStats) QueueSaturation() float64 {
+	if s.QueueCapacity == 0 {
+		return 0
+	}
+	return float64(s.QueuedMessages) / float64(s.QueueCapacity)
+}
+
+// HealthHandler is an http.Handler that reports the health of the WebSocket
+// subsystem as JSON. Use the handler for load balancer health checks and
+// Kubernetes probes:
+//
+//  http.Handle("/healthz", &websocket.HealthHandler{MaxConns: 50000})
+//
+// The handler responds with HTTP status 200 when the subsystem is healthy
+// and with HTTP status 503 when a limit is exceeded. The response body
+// contains the HealthStats fields, the handshake error rate, the queue
+// saturation, a "healthy" flag and a list of the exceeded limits.
+//
+// A zero limit is not checked.
+type HealthHandler struct {
+	// MaxConns is the maximum number of open connections.
+	MaxConns int64
+
+	// MaxHandshakeErrorRate is the maximum fraction of handshakes that
+	// failed since the previous health check.
+	MaxHandshakeErrorRate float64
+
+	// MaxQueueSaturation is the maximum fraction of the send queue capacity
+	// in use.
+	MaxQueueSaturation float64
+
+	// MaxGoroutines is the maximum number of goroutines in the process.
+	MaxGoroutines int
+
+	mu   sync.Mutex
+	last HealthStats
+}
+
+type healthReport struct {
+	HealthStats
+	HandshakeErrorRate float64  `json:"handshake_error_rate"`
+	QueueSaturation    float64  `json:"queue_saturation"`
+	Healthy            bool     `json:"healthy"`
+	Problems           []string `json:"problems"`
+}
+
+// ServeHTTP writes the health report.
+func (h *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s := ReadHealthStats()
+	h.mu.Lock()
+	last := h.last
+	h.last = s
+	h.mu.Unlock()
+
+	report := healthReport{
+		HealthStats:     s,
+		QueueSaturation: s.QueueSaturation(),
+		Problems:        []string{},
+	}
+	if n := s.Handshakes - last.Handshakes; n > 0 {
+		report.HandshakeErrorRate = float64(s.HandshakeErrors-last.HandshakeErrors) / float64(n)
+	}
+	if h.MaxConns > 0 && s.Conns > h.MaxConns {
+		report.Problems = append(report.Problems, fmt.Sprintf("%d connections exceeds limit %d", s.Conns, h.MaxConns))
+	}
+	if h.MaxHandshakeErrorRate > 0 && report.HandshakeErrorRate > h.MaxHandshakeErrorRate {
+		report.Problems = append(report.Problems, fmt.Sprintf("handshake error rate %.2f exceeds limit %.2f", report.HandshakeErrorRate, h.MaxHandshakeErrorRate))
+	}
+	if h.MaxQueueSaturation > 0 && report.QueueSaturation > h.MaxQueueSaturation {
+		report.Problems = append(report.Problems, fmt.Sprintf("queue saturation %.2f exceeds limit %.2f", report.QueueSaturation, h.MaxQueueSaturation))
+	}
+	if h.MaxGoroutines > 0 && s.Goroutines > h.MaxGoroutines {
+		report.Problems = append(report.Problems, fmt.Sprintf("%d goroutines exceeds limit %d", s.Goroutines, h.MaxGoroutines))
+	}
+	report.Healthy = len(report.Problems) == 0
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !report.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(&report)
+}
@@ -0,0 +1,76 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func checkHealth(t *testing.T, h *HealthHandler, wantStatus int) healthReport {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != wantStatus {
+		t.Errorf("status = %d, want %d, body %s", w.Code, wantStatus, w.Body)
+	}
+	var report healthReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("body %q: %v", w.Body, err)
+	}
+	if report.Healthy != (wantStatus == http.StatusOK) {
+		t.Errorf("healthy = %v, want %v", report.Healthy, wantStatus == http.StatusOK)
+	}
+	return report
+}
+
+func TestHealthHandler(t *testing.T) {
+	h := &HealthHandler{MaxHandshakeErrorRate: 0.5}
+	// The first check includes the failed handshakes from earlier tests.
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/healthz", nil))
+	if report := checkHealth(t, h, http.StatusOK); report.Goroutines == 0 || len(report.Problems) != 0 {
+		t.Errorf("report = %+v, want goroutines and no problems", report)
+	}
+
+	// A failed handshake since the previous check exceeds the error rate.
+	var u Upgrader
+	u.Upgrade(httptest.NewRecorder(), httptest.NewRequest("POST", "/ws", nil), nil)
+	if report := checkHealth(t, h, http.StatusServiceUnavailable); report.HandshakeErrorRate != 1 || len(report.Problems) != 1 {
+		t.Errorf("report = %+v, want error rate 1 and one problem", report)
+	}
+	checkHealth(t, h, http.StatusOK)
+
+	// Send queue accounting.
+	before := ReadHealthStats()
+	c := newConn(fakeNetConn{Writer: ioutil.Discard}, true, 1024, 1024)
+	defer c.Close()
+	q := NewSendQueue(c, 4, 0)
+	if s := ReadHealthStats(); s.QueueCapacity-before.QueueCapacity != 4 {
+		t.Errorf("queue capacity increased by %d, want 4", s.QueueCapacity-before.QueueCapacity)
+	}
+	q.Send(OpText, []byte("hello"))
+	q.Close()
+	<-q.Done()
+	if s := ReadHealthStats(); s.QueueCapacity != before.QueueCapacity || s.QueuedMessages != before.QueuedMessages {
+		t.Errorf("stats after close = %+v, want %+v", s, before)
+	}
+
+	if got := (HealthStats{QueuedMessages: 3, QueueCapacity: 4}).QueueSaturation(); got != 0.75 {
+		t.Errorf("QueueSaturation() = %v, want 0.75", got)
+	}
+}
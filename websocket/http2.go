@@ -0,0 +1,310 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// WebSocket over HTTP/2 (RFC 8441). The connection is bootstrapped with an
+// extended CONNECT request on an HTTP/2 stream. The request has the
+// :protocol pseudo-header set to "websocket" and the stream carries the
+// WebSocket frames after a 200 response.
+//
+// The net/http package enables extended CONNECT with the environment
+// variable GODEBUG=http2xconnect=1.
+//
+// WebSocket over HTTP/3 (RFC 9220) uses the same extended CONNECT request on
+// an HTTP/3 stream.
+
+var errBadProtocol = HandshakeError{"websocket: :protocol != websocket"}
+
+// isHTTP2Upgrade returns true if r is an HTTP/2 extended CONNECT request.
+func isHTTP2Upgrade(r *http.Request) bool {
+	return r.ProtoMajor == 2 && r.Method == "CONNECT"
+}
+
+// stringAddr is a net.Addr for an address known only in string form.
+type stringAddr string
+
+func (a stringAddr) Network() string { return "tcp" }
+func (a stringAddr) String() string  { return string(a) }
+
+// streamConn adapts an HTTP/2 stream to the net.Conn interface.
+type streamConn struct {
+	r io.ReadCloser
+	w io.Writer
+
+	// flush flushes data written to w to the peer. The function is nil if
+	// w does not buffer.
+	flush func() error
+
+	// cancel aborts the stream. The function is nil if the stream is
+	// closed by closing r.
+	cancel func()
+
+	setReadDeadline  func(time.Time) error
+	setWriteDeadline func(time.Time) error
+
+	// readTimer and writeTimer emulate deadlines for streams that do not
+	// support deadlines. The timers are nil for other streams.
+	readTimer, writeTimer *streamDeadline
+
+	localAddr, remoteAddr net.Addr
+
+	mu     sync.Mutex // protects closed
+	closed bool
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	if c.readTimer != nil {
+		c.readTimer.start()
+		defer c.readTimer.stop()
+	}
+	return c.r.Read(p)
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+	if c.writeTimer != nil {
+		c.writeTimer.start()
+		defer c.writeTimer.stop()
+	}
+	n, err := c.w.Write(p)
+	if err == nil && c.flush != nil {
+		err = c.flush()
+	}
+	return n, err
+}
+
+func (c *streamConn) Close() error {
+	c.mu.Lock()
+	closed := c.closed
+	c.closed = true
+	c.mu.Unlock()
+	if closed {
+		return nil
+	}
+	if w, ok := c.w.(io.Closer); ok {
+		w.Close()
+	}
+	err := c.r.Close()
+	if c.cancel != nil {
+		c.cancel()
+	}
+	return err
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.localAddr }
+func (c *streamConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return c.setReadDeadline(t) }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return c.setWriteDeadline(t) }
+
+// streamDeadline emulates a deadline for a stream that does not support
+// deadlines. The stream is aborted if the deadline passes while a read or
+// write is in progress. A deadline that passes while the stream is idle has
+// no effect until the next read or write, which then fails.
+type streamDeadline struct {
+	cancel func()
+
+	mu     sync.Mutex
+	t      time.Time
+	active bool
+	timer  *time.Timer
+}
+
+func (d *streamDeadline) set(t time.Time) error {
+	d.mu.Lock()
+	d.t = t
+	if d.active {
+		d.arm()
+	}
+	d.mu.Unlock()
+	return nil
+}
+
+// start arms the timer for an operation on the stream.
+func (d *streamDeadline) start() {
+	d.mu.Lock()
+	d.active = true
+	d.arm()
+	d.mu.Unlock()
+}
+
+// stop disarms the timer when the operation returns.
+func (d *streamDeadline) stop() {
+	d.mu.Lock()
+	d.active = false
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.mu.Unlock()
+}
+
+// arm starts the timer for the deadline. The caller must hold mu.
+func (d *streamDeadline) arm() {
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	if d.t.IsZero() {
+		return
+	}
+	if d.timer == nil {
+		d.timer = time.AfterFunc(time.Until(d.t), d.cancel)
+	} else {
+		d.timer.Reset(time.Until(d.t))
+	}
+}
+
+// upgradeHTTP2 completes the WebSocket handshake for an HTTP/2 extended
+// CONNECT request. Unlike a hijacked HTTP/1.1 connection, the stream is
+// closed when the handler returns.
+func upgradeHTTP2(w http.ResponseWriter, r *http.Request, responseHeader http.Header, readBufSize, writeBufSize int, handshakeTimeout time.Duration) (*Conn, error) {
+	if r.Header.Get(":protocol") != "websocket" {
+		return nil, errBadProtocol
+	}
+
+	if values := r.Header["Sec-Websocket-Version"]; len(values) == 0 || values[0] != "13" {
+		return nil, errBadVersion
+	}
+
+	h := w.Header()
+	for k, vs := range responseHeader {
+		for _, v := range vs {
+			h.Add(k, v)
+		}
+	}
+
+	rc := http.NewResponseController(w)
+	if handshakeTimeout > 0 {
+		rc.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return nil, err
+	}
+	rc.SetWriteDeadline(time.Time{})
+
+	sc := &streamConn{
+		r:                r.Body,
+		w:                w,
+		flush:            rc.Flush,
+		setReadDeadline:  rc.SetReadDeadline,
+		setWriteDeadline: rc.SetWriteDeadline,
+		remoteAddr:       stringAddr(r.RemoteAddr),
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		sc.localAddr = addr
+	}
+
+	if readBufSize == 0 {
+		readBufSize = defaultBufferSize
+	}
+	c := newConn(sc, true, readBufSize, writeBufSize)
+	c.extensions = parseExtensions(responseHeader)
+	return c, nil
+}
+
+// dialStream creates a client connection on an HTTP/2 or HTTP/3 stream with
+// an extended CONNECT request sent through rt.
+func (d *Dialer) dialStream(rt http.RoundTripper, http3 bool, u *url.URL, requestHeader http.Header, readBufSize, writeBufSize int) (*Conn, *http.Response, error) {
+	hu := *u
+	if u.Scheme == "wss" {
+		hu.Scheme = "https"
+	} else {
+		hu.Scheme = "http"
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pr, pw := io.Pipe()
+	req, err := http.NewRequestWithContext(ctx, "CONNECT", hu.String(), pr)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	for k, vs := range requestHeader {
+		req.Header[k] = vs
+	}
+	if http3 {
+		// HTTP/3 transports send the :protocol pseudo-header from the
+		// request Proto field.
+		req.Proto = "websocket"
+	} else {
+		req.Header.Set(":protocol", "websocket")
+	}
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.ContentLength = -1
+	if d.Host != "" {
+		req.Host = d.Host
+	}
+	if d.PrepareRequest != nil {
+		if err := d.PrepareRequest(req); err != nil {
+			cancel()
+			return nil, nil, err
+		}
+	}
+
+	if d.HandshakeTimeout != 0 {
+		timer := time.AfterFunc(d.HandshakeTimeout, cancel)
+		defer timer.Stop()
+	}
+
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, resp, ErrBadHandshake
+	}
+
+	// The stream does not support deadlines. A deadline that passes during
+	// a read or write aborts the stream as the connection is not usable
+	// after a timeout.
+	rd, wd := &streamDeadline{cancel: cancel}, &streamDeadline{cancel: cancel}
+	sc := &streamConn{
+		r:                resp.Body,
+		w:                pw,
+		cancel:           cancel,
+		setReadDeadline:  rd.set,
+		setWriteDeadline: wd.set,
+		readTimer:        rd,
+		writeTimer:       wd,
+		localAddr:        stringAddr(""),
+		remoteAddr:       stringAddr(hu.Host),
+	}
+	return newConn(sc, false, readBufSize, writeBufSize), resp, nil
+}
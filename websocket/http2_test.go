@@ -0,0 +1,236 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// h2ResponseWriter is the response writer for an in-process HTTP/2 stream.
+type h2ResponseWriter struct {
+	header http.Header
+	w      io.Writer
+	status chan int
+}
+
+func (w *h2ResponseWriter) Header() http.Header { return w.header }
+
+func (w *h2ResponseWriter) WriteHeader(status int) {
+	select {
+	case w.status <- status:
+	default:
+	}
+}
+
+func (w *h2ResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.w.Write(p)
+}
+
+func (w *h2ResponseWriter) Flush() {}
+
+// h2Transport is a round tripper that sends extended CONNECT requests to an
+// in-process handler as HTTP/2 requests. If http3 is true, then the protocol
+// is taken from the request Proto field as an HTTP/3 transport does.
+type h2Transport struct {
+	h     http.Handler
+	http3 bool
+}
+
+func (t h2Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	sr := req.Clone(req.Context())
+	if t.http3 {
+		if req.Header.Get(":protocol") != "" {
+			return nil, errors.New("unexpected :protocol header")
+		}
+		sr.Header.Set(":protocol", req.Proto)
+	}
+	if req.Method != "CONNECT" || sr.Header.Get(":protocol") == "" {
+		return nil, errors.New("not an extended CONNECT request")
+	}
+	sr.Proto, sr.ProtoMajor, sr.ProtoMinor = "HTTP/2.0", 2, 0
+	sr.RemoteAddr = "127.0.0.1:1234"
+	sr.Host = req.URL.Host
+
+	pr, pw := io.Pipe()
+	w := &h2ResponseWriter{header: make(http.Header), w: pw, status: make(chan int, 1)}
+	go func() {
+		t.h.ServeHTTP(w, sr)
+		w.WriteHeader(http.StatusOK)
+		pw.Close()
+	}()
+	go func() {
+		// Abort the stream when the request is canceled.
+		<-req.Context().Done()
+		pr.CloseWithError(req.Context().Err())
+	}()
+	return &http.Response{
+		StatusCode: <-w.status,
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header:     w.header,
+		Body:       pr,
+		Request:    req,
+	}, nil
+}
+
+func TestHTTP2(t *testing.T) {
+	testStream(t, false)
+}
+
+func TestHTTP3(t *testing.T) {
+	testStream(t, true)
+}
+
+func testStream(t *testing.T, http3 bool) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var u Upgrader
+		c, err := u.Upgrade(w, r, http.Header{"Set-Cookie": {"sessionId=1234"}})
+		if err != nil {
+			t.Errorf("Upgrade() returned %v", err)
+			return
+		}
+		defer c.Close()
+		if addr := c.RemoteAddr().String(); addr != "127.0.0.1:1234" {
+			t.Errorf("RemoteAddr() = %q", addr)
+		}
+		for {
+			op, p, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := c.WriteMessage(op, p); err != nil {
+				return
+			}
+		}
+	})
+
+	var d Dialer
+	if http3 {
+		d.HTTP3Transport = h2Transport{h: h, http3: true}
+	} else {
+		d.HTTP2Transport = h2Transport{h: h}
+	}
+	c, resp, err := d.Dial("ws://example.com/ws", http.Header{"Origin": {"http://example.com"}})
+	if err != nil {
+		t.Fatalf("Dial() returned %v", err)
+	}
+	defer c.Close()
+	if resp.Header.Get("Set-Cookie") != "sessionId=1234" {
+		t.Error("Set-Cookie not received from the server")
+	}
+
+	for _, msg := range []string{"hello", strings.Repeat("x", 10000)} {
+		if err := c.WriteMessage(OpText, []byte(msg)); err != nil {
+			t.Fatalf("WriteMessage() returned %v", err)
+		}
+		op, p, err := c.ReadMessage()
+		if err != nil || op != OpText || string(p) != msg {
+			t.Fatalf("ReadMessage() returned %v, %d bytes, %v", op, len(p), err)
+		}
+	}
+}
+
+func TestHTTP2Ping(t *testing.T) {
+	testStreamPing(t, false)
+}
+
+func TestHTTP3Ping(t *testing.T) {
+	testStreamPing(t, true)
+}
+
+// testStreamPing checks that the deadline set for the automatic pong does not
+// abort the idle stream after the pong is written.
+func testStreamPing(t *testing.T, http3 bool) {
+	pong := make(chan bool, 1)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var u Upgrader
+		c, err := u.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.WriteControl(OpPing, []byte("ping"), time.Now().Add(time.Second))
+		for {
+			op, p, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if op == OpPong {
+				pong <- true
+			} else if err := c.WriteMessage(op, p); err != nil {
+				return
+			}
+		}
+	})
+
+	var d Dialer
+	if http3 {
+		d.HTTP3Transport = h2Transport{h: h, http3: true}
+	} else {
+		d.HTTP2Transport = h2Transport{h: h}
+	}
+	c, _, err := d.Dial("ws://example.com/ws", nil)
+	if err != nil {
+		t.Fatalf("Dial() returned %v", err)
+	}
+	defer c.Close()
+
+	// The reading goroutine replies to the ping.
+	messages := make(chan string)
+	go func() {
+		defer close(messages)
+		for {
+			_, p, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			messages <- string(p)
+		}
+	}()
+	<-pong
+	time.Sleep(writeWait + 500*time.Millisecond)
+	if err := c.WriteMessage(OpText, []byte("hello")); err != nil {
+		t.Fatalf("WriteMessage() after idle returned %v", err)
+	}
+	if p := <-messages; p != "hello" {
+		t.Fatalf("ReadMessage() after idle returned %q", p)
+	}
+}
+
+func TestHTTP2BadProtocol(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var u Upgrader
+		if _, err := u.Upgrade(w, r, nil); err == nil {
+			t.Error("Upgrade() did not return an error")
+		}
+	})
+	req, _ := http.NewRequest("CONNECT", "http://example.com/ws", nil)
+	req.Header.Set(":protocol", "webtransport")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	resp, err := h2Transport{h: h}.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() returned %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
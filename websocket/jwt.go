@@ -0,0 +1,270 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	errJWTMissing   = errors.New("token missing")
+	errJWTMalformed = errors.New("token malformed")
+	errJWTKey       = errors.New("token key not found")
+	errJWTAlgorithm = errors.New("token algorithm not supported")
+	errJWTSignature = errors.New("token signature invalid")
+	errJWTExpired   = errors.New("token expired")
+	errJWTNotValid  = errors.New("token not valid yet")
+	errJWTIssuer    = errors.New("token issuer not allowed")
+	errJWTAudience  = errors.New("token audience not allowed")
+)
+
+// JWTAuthenticator authenticates WebSocket handshake requests using JSON Web
+// Tokens (RFC 7519) signed with HMAC (HS256, HS384, HS512), RSA (RS256,
+// RS384, RS512) or ECDSA (ES256, ES384, ES512). Use the Authenticate method
+// as the Upgrader Authenticate function:
+//
+//  auth := &websocket.JWTAuthenticator{QueryParam: "token", Keys: keys}
+//  upgrader := websocket.Upgrader{Authenticate: auth.Authenticate}
+//
+// The principal for an authenticated connection is the token's claims set
+// decoded to a map[string]interface{}.
+//
+// Browsers do not allow applications to set the Authorization header on a
+// WebSocket handshake. The authenticator finds the token in the query
+// parameter, cookie or subprotocol specified by the application.
+type JWTAuthenticator struct {
+	// QueryParam is the name of the query parameter containing the token.
+	QueryParam string
+
+	// Cookie is the name of the cookie containing the token.
+	Cookie string
+
+	// ProtocolPrefix is the prefix of the Sec-WebSocket-Protocol value
+	// containing the token. The token follows the prefix. The application
+	// must select a different protocol in the handshake response because
+	// browsers require the server to select one of the requested protocols.
+	ProtocolPrefix string
+
+	// Keys maps key IDs (the "kid" header parameter) to verification keys.
+	// The key with ID "" is used for tokens without a key ID. Keys must have
+	// type []byte for HMAC, *rsa.PublicKey for RSA and *ecdsa.PublicKey for
+	// ECDSA. A token is rejected if its algorithm does not match its key type.
+	Keys map[string]interface{}
+
+	// If Issuer is not empty, then the token "iss" claim must equal Issuer.
+	Issuer string
+
+	// If Audience is not empty, then the token "aud" claim must contain
+	// Audience.
+	Audience string
+
+	// Leeway is the allowed clock skew when checking the "exp" and "nbf"
+	// claims.
+	Leeway time.Duration
+}
+
+// Authenticate returns the claims from a valid token in the request.
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (interface{}, error) {
+	token := a.token(r)
+	if token == "" {
+		return nil, errJWTMissing
+	}
+	return a.verify(token, time.Now())
+}
+
+// Validate validates token and returns the token's claims and expiration
+// time. The expiration time is zero if the token does not have an "exp"
+// claim. Use the Validate method as the TokenRefresher Validate function.
+func (a *JWTAuthenticator) Validate(token string) (interface{}, time.Time, error) {
+	claims, err := a.verify(token, time.Now())
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var expires time.Time
+	if exp, ok := claims["exp"].(float64); ok {
+		expires = time.Unix(int64(exp), 0).Add(a.Leeway)
+	}
+	return claims, expires, nil
+}
+
+func (a *JWTAuthenticator) token(r *http.Request) string {
+	if a.QueryParam != "" {
+		if t := r.URL.Query().Get(a.QueryParam); t != "" {
+			return t
+		}
+	}
+	if a.Cookie != "" {
+		if c, err := r.Cookie(a.Cookie); err == nil && c.Value != "" {
+			return c.Value
+		}
+	}
+	if a.ProtocolPrefix != "" {
+		for _, v := range r.Header["Sec-Websocket-Protocol"] {
+			for _, p := range strings.Split(v, ",") {
+				p = strings.TrimSpace(p)
+				if strings.HasPrefix(p, a.ProtocolPrefix) {
+					return p[len(a.ProtocolPrefix):]
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func (a *JWTAuthenticator) verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errJWTMalformed
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errJWTMalformed
+	}
+	key, ok := a.Keys[header.Kid]
+	if !ok {
+		return nil, errJWTKey
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(a.Leeway)) {
+		return nil, errJWTExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(a.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errJWTNotValid
+	}
+	if a.Issuer != "" && claims["iss"] != a.Issuer {
+		return nil, errJWTIssuer
+	}
+	if a.Audience != "" && !jwtAudienceContains(claims["aud"], a.Audience) {
+		return nil, errJWTAudience
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(s string, v interface{}) error {
+	p, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return errJWTMalformed
+	}
+	if err := json.Unmarshal(p, v); err != nil {
+		return errJWTMalformed
+	}
+	return nil
+}
+
+func jwtAudienceContains(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func verifyJWTSignature(alg string, key interface{}, signed string, sig []byte) error {
+	if len(alg) != 5 {
+		return errJWTAlgorithm
+	}
+
+	var (
+		h        crypto.Hash
+		newHash  func() hash.Hash
+		keyBytes int
+	)
+	switch alg[2:] {
+	case "256":
+		h, newHash, keyBytes = crypto.SHA256, sha256.New, 32
+	case "384":
+		h, newHash, keyBytes = crypto.SHA384, sha512.New384, 48
+	case "512":
+		h, newHash, keyBytes = crypto.SHA512, sha512.New, 66
+	default:
+		return errJWTAlgorithm
+	}
+
+	switch alg[:2] {
+	case "HS":
+		k, ok := key.([]byte)
+		if !ok {
+			return errJWTAlgorithm
+		}
+		m := hmac.New(newHash, k)
+		m.Write([]byte(signed))
+		if !hmac.Equal(sig, m.Sum(nil)) {
+			return errJWTSignature
+		}
+		return nil
+	case "RS":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errJWTAlgorithm
+		}
+		d := newHash()
+		d.Write([]byte(signed))
+		if rsa.VerifyPKCS1v15(k, h, d.Sum(nil), sig) != nil {
+			return errJWTSignature
+		}
+		return nil
+	case "ES":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok || (k.Curve.Params().BitSize+7)/8 != keyBytes {
+			return errJWTAlgorithm
+		}
+		if len(sig) != 2*keyBytes {
+			return errJWTSignature
+		}
+		d := newHash()
+		d.Write([]byte(signed))
+		r := new(big.Int).SetBytes(sig[:keyBytes])
+		s := new(big.Int).SetBytes(sig[keyBytes:])
+		if !ecdsa.Verify(k, d.Sum(nil), r, s) {
+			return errJWTSignature
+		}
+		return nil
+	}
+	return errJWTAlgorithm
+}
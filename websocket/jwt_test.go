@@ -0,0 +1,104 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func signJWT(alg string, key interface{}, claims map[string]interface{}) string {
+	h, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	c, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	d := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		m := hmac.New(sha256.New, k)
+		m.Write([]byte(signed))
+		sig = m.Sum(nil)
+	case *ecdsa.PrivateKey:
+		r, s, _ := ecdsa.Sign(rand.Reader, k, d[:])
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	secret := []byte("secret")
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	now := time.Now().Unix()
+	valid := map[string]interface{}{"sub": "gopher", "exp": now + 60, "aud": []string{"chat"}}
+
+	tests := []struct {
+		name  string
+		keys  map[string]interface{}
+		token string
+		ok    bool
+	}{
+		{"hs256", map[string]interface{}{"": secret}, signJWT("HS256", secret, valid), true},
+		{"es256", map[string]interface{}{"": &ecKey.PublicKey}, signJWT("ES256", ecKey, valid), true},
+		{"bad secret", map[string]interface{}{"": []byte("other")}, signJWT("HS256", secret, valid), false},
+		{"alg confusion", map[string]interface{}{"": &ecKey.PublicKey}, signJWT("HS256", secret, valid), false},
+		{"none", map[string]interface{}{"": secret}, "eyJhbGciOiJub25lIn0.e30.", false},
+		{"expired", map[string]interface{}{"": secret}, signJWT("HS256", secret, map[string]interface{}{"exp": now - 60, "aud": "chat"}), false},
+		{"audience", map[string]interface{}{"": secret}, signJWT("HS256", secret, map[string]interface{}{"aud": "other"}), false},
+	}
+
+	for _, tt := range tests {
+		a := &JWTAuthenticator{QueryParam: "token", Keys: tt.keys, Audience: "chat"}
+		r := &http.Request{URL: &url.URL{RawQuery: "token=" + url.QueryEscape(tt.token)}, Header: http.Header{}}
+		p, err := a.Authenticate(r)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: Authenticate() returned %v, want ok=%v", tt.name, err, tt.ok)
+			continue
+		}
+		if tt.ok && p.(map[string]interface{})["sub"] != "gopher" {
+			t.Errorf("%s: principal = %v", tt.name, p)
+		}
+	}
+}
+
+func TestJWTAuthenticatorSources(t *testing.T) {
+	secret := []byte("secret")
+	token := signJWT("HS256", secret, map[string]interface{}{"sub": "gopher"})
+	a := &JWTAuthenticator{QueryParam: "token", Cookie: "jwt", ProtocolPrefix: "access_token.", Keys: map[string]interface{}{"": secret}}
+
+	requests := []*http.Request{
+		{URL: &url.URL{RawQuery: "token=" + token}, Header: http.Header{}},
+		{URL: &url.URL{}, Header: http.Header{"Cookie": {"jwt=" + token}}},
+		{URL: &url.URL{}, Header: http.Header{"Sec-Websocket-Protocol": {"chat, access_token." + token}}},
+	}
+	for i, r := range requests {
+		if _, err := a.Authenticate(r); err != nil {
+			t.Errorf("%d: Authenticate() returned %v", i, err)
+		}
+	}
+	if _, err := a.Authenticate(&http.Request{URL: &url.URL{}, Header: http.Header{}}); err != errJWTMissing {
+		t.Errorf("Authenticate() without token returned %v, want %v", err, errJWTMissing)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"math/rand"
+	"time"
+)
+
+// CloseServiceRestart is the close code sent when a connection reaches its
+// maximum lifetime. The code is registered with IANA as "Service Restart"
+// and tells the client to reconnect after a randomized delay.
+const CloseServiceRestart = 1012
+
+// SetMaxLifetime schedules f to be called when the connection has been open
+// for d. If f is nil, then the connection starts the closing handshake with
+// the CloseServiceRestart close code. Applications that send a reconnect
+// hint message to the client instead of closing the connection should
+// specify f.
+//
+// Use a maximum lifetime to rebalance long-lived connections across servers
+// after the servers are scaled. A value of zero for d cancels a previously
+// scheduled call. SetMaxLifetime can be called concurrently with all other
+// methods.
+func (c *Conn) SetMaxLifetime(d time.Duration, f func(c *Conn)) {
+	c.auditMu.Lock()
+	defer c.auditMu.Unlock()
+	if c.lifetimeTimer != nil {
+		c.lifetimeTimer.Stop()
+		c.lifetimeTimer = nil
+	}
+	if d <= 0 || c.closed {
+		return
+	}
+	if f == nil {
+		f = expireLifetime
+	}
+	c.lifetimeTimer = time.AfterFunc(c.opened.Add(d).Sub(time.Now()), func() { f(c) })
+}
+
+func expireLifetime(c *Conn) {
+	c.CloseHandshake(CloseServiceRestart, c.closeReason("max lifetime"), time.Now().Add(writeWait))
+}
+
+// lifetime returns d plus a random duration in the range [0, jitter).
+func lifetime(d, jitter time.Duration) time.Duration {
+	if d <= 0 || jitter <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Int63n(int64(jitter)))
+}
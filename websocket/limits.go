@@ -0,0 +1,83 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Limits is a snapshot of the limits applied to connections. See the Conn
+// SetReadLimit, SetPongWait and SetWriteTimeout methods for a description of
+// the limits. A zero value disables the limit.
+type Limits struct {
+	ReadLimit    int64
+	PongWait     time.Duration
+	WriteTimeout time.Duration
+}
+
+// LimitSet holds the current limits for a group of connections. The limits
+// can be replaced while the connections are in use. Use a LimitSet to adjust
+// limits from an admin control plane without restarting servers or
+// disconnecting clients.
+//
+// A connection using a LimitSet loads the read limit and pong wait when it
+// reads a frame from the peer and loads the write timeout when the
+// application starts a message. The limits in the set override the values
+// set with the connection's SetReadLimit, SetPongWait and SetWriteTimeout
+// methods.
+type LimitSet struct {
+	v atomic.Value
+}
+
+// NewLimitSet returns a limit set holding l.
+func NewLimitSet(l Limits) *LimitSet {
+	s := &LimitSet{}
+	s.v.Store(l)
+	return s
+}
+
+// Load returns the current limits. Load can be called concurrently with all
+// other methods.
+func (s *LimitSet) Load() Limits {
+	l, _ := s.v.Load().(Limits)
+	return l
+}
+
+// Store replaces the current limits. Store can be called concurrently with
+// all other methods.
+func (s *LimitSet) Store(l Limits) {
+	s.v.Store(l)
+}
+
+// SetLimits specifies a limit set for the connection. A nil s stops using a
+// limit set. The limits in effect when SetLimits is called remain in effect
+// until the next frame is read or the next message is started. SetLimits
+// must not be called concurrently with the read and write methods.
+func (c *Conn) SetLimits(s *LimitSet) {
+	c.limits = s
+}
+
+// loadReadLimits updates the read limit and the pong wait from the limit
+// set.
+func (c *Conn) loadReadLimits() {
+	l := c.limits.Load()
+	c.readLimit = l.ReadLimit
+	// A negative pong wait means that CloseHandshake stopped extending the
+	// read deadline.
+	if d := atomic.LoadInt64(&c.pongWait); d >= 0 {
+		atomic.CompareAndSwapInt64(&c.pongWait, d, int64(l.PongWait))
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"encoding/binary"
+	"runtime"
+	"sync"
+)
+
+const (
+	// Buffers at least this size are masked in parallel when enabled with
+	// SetParallelMasking.
+	parallelMaskSize = 4 << 20
+
+	// Size of the blocks masked by each goroutine in the parallel path.
+	// The size is a multiple of 8 so that every block starts at the same
+	// key phase relative to its offset.
+	maskBlockSize = 1 << 20
+)
+
+// maskBytes masks b with key starting at position pos in the key and returns
+// the position following the last byte. Small buffers are masked a byte at a
+// time, larger buffers a word at a time.
+func maskBytes(key [4]byte, pos int, b []byte) int {
+	return maskBytesWords(key, pos, b)
+}
+
+// useParallelMask returns true if a buffer of n bytes is split into blocks
+// that are masked concurrently.
+func (c *Conn) useParallelMask(n int) bool {
+	return c.parallelMask && n >= parallelMaskSize && runtime.GOMAXPROCS(0) > 1
+}
+
+// maskBytes masks b like the maskBytes function, using the parallel path for
+// multi-megabyte buffers when enabled with SetParallelMasking.
+func (c *Conn) maskBytes(key [4]byte, pos int, b []byte) int {
+	if c.useParallelMask(len(b)) {
+		return maskBytesParallel(key, pos, b)
+	}
+	return maskBytesWords(key, pos, b)
+}
+
+func maskBytesWords(key [4]byte, pos int, b []byte) int {
+	if len(b) < 16 {
+		for i := range b {
+			b[i] ^= key[pos&3]
+			pos++
+		}
+		return pos & 3
+	}
+
+	var k [8]byte
+	for i := range k {
+		k[i] = key[(pos+i)&3]
+	}
+	kw := binary.LittleEndian.Uint64(k[:])
+
+	// A multiple of 8 bytes leaves the key phase unchanged.
+	n := len(b) &^ 7
+	for i := 0; i < n; i += 8 {
+		binary.LittleEndian.PutUint64(b[i:], binary.LittleEndian.Uint64(b[i:])^kw)
+	}
+	for i := n; i < len(b); i++ {
+		b[i] ^= key[(pos+i)&3]
+	}
+	return (pos + len(b)) & 3
+}
+
+func maskBytesParallel(key [4]byte, pos int, b []byte) int {
+	var wg sync.WaitGroup
+	for off := 0; off < len(b); off += maskBlockSize {
+		end := off + maskBlockSize
+		if end > len(b) {
+			end = len(b)
+		}
+		wg.Add(1)
+		go func(p []byte) {
+			maskBytesWords(key, pos, p)
+			wg.Done()
+		}(b[off:end])
+	}
+	wg.Wait()
+	return (pos + len(b)) & 3
+}
@@ -0,0 +1,95 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"bytes"
+	"runtime"
+	"testing"
+)
+
+func maskBytesByByte(key [4]byte, pos int, b []byte) int {
+	for i := range b {
+		b[i] ^= key[pos&3]
+		pos += 1
+	}
+	return pos & 3
+}
+
+func TestMaskBytes(t *testing.T) {
+	key := [4]byte{1, 2, 3, 4}
+	for _, size := range []int{0, 1, 7, 15, 16, 17, 100, 1000, parallelMaskSize + 13} {
+		for pos := 0; pos < 4; pos++ {
+			b := make([]byte, size)
+			for i := range b {
+				b[i] = byte(i)
+			}
+			want := append([]byte(nil), b...)
+			wantPos := maskBytesByByte(key, pos, want)
+			p := append([]byte(nil), b...)
+			gotPos := maskBytes(key, pos, b)
+			if gotPos != wantPos || !bytes.Equal(b, want) {
+				t.Fatalf("size:%d, pos:%d: maskBytes() = %d, want %d, equal=%v", size, pos, gotPos, wantPos, bytes.Equal(b, want))
+			}
+			gotPos = maskBytesParallel(key, pos, p)
+			if gotPos != wantPos || !bytes.Equal(p, want) {
+				t.Fatalf("size:%d, pos:%d: maskBytesParallel() = %d, want %d, equal=%v", size, pos, gotPos, wantPos, bytes.Equal(p, want))
+			}
+		}
+	}
+}
+
+func TestParallelMasking(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(2))
+	for _, parallel := range []bool{false, true} {
+		var connBuf bytes.Buffer
+		wc := newConn(fakeNetConn{Reader: nil, Writer: &connBuf}, false, 1024, 1024)
+		rc := newConn(fakeNetConn{Reader: &connBuf, Writer: nil}, true, 1024, 1024)
+		wc.SetParallelMasking(parallel)
+		rc.SetParallelMasking(parallel)
+		rc.SetReadLimit(2 * parallelMaskSize)
+
+		if wc.useParallelMask(parallelMaskSize) != parallel {
+			t.Errorf("parallel:%v: useParallelMask() = %v", parallel, !parallel)
+		}
+
+		data := make([]byte, parallelMaskSize+13)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		if err := wc.WriteMessage(OpBinary, data); err != nil {
+			t.Fatalf("parallel:%v: WriteMessage() returned %v", parallel, err)
+		}
+		op, p, err := rc.ReadMessage()
+		if err != nil || op != OpBinary {
+			t.Fatalf("parallel:%v: ReadMessage() returned %v, %v", parallel, op, err)
+		}
+		if !bytes.Equal(p, data) {
+			t.Errorf("parallel:%v: message does not match", parallel)
+		}
+	}
+}
+
+func benchmarkMaskBytes(b *testing.B, size int) {
+	key := [4]byte{1, 2, 3, 4}
+	p := make([]byte, size)
+	b.SetBytes(int64(size))
+	for i := 0; i < b.N; i++ {
+		maskBytes(key, 1, p)
+	}
+}
+
+func BenchmarkMaskBytes1K(b *testing.B) { benchmarkMaskBytes(b, 1<<10) }
+func BenchmarkMaskBytes8M(b *testing.B) { benchmarkMaskBytes(b, 8<<20) }
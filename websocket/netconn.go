@@ -0,0 +1,137 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// NetConn returns a net.Conn that reads and writes the data messages on c as
+// a stream of bytes. Each call to Write sends one message with the given
+// opCode. Read returns the payload of the received text and binary messages
+// in order, without regard to message boundaries. Control messages are
+// handled by the connection and are not returned from Read.
+//
+// The returned net.Conn supports concurrent calls to Read and Write as
+// required by the net.Conn interface. The application must not call the read
+// or write methods of c directly after calling NetConn.
+func NetConn(c *Conn, opCode MessageType) net.Conn {
+	return &netConn{c: c, opCode: opCode}
+}
+
+// NetConnDetect is like NetConn, but each call to Write sends a text message
+// if the data is valid UTF-8 and a binary message otherwise. Bridges that
+// forward data from protocols without a text and binary distinction use
+// NetConnDetect so that text is delivered to browsers as strings. Use
+// NetConn to override the detection with a fixed message type.
+//
+// A write that splits a multibyte UTF-8 encoding is sent as a binary
+// message.
+func NetConnDetect(c *Conn) net.Conn {
+	return &netConn{c: c, detect: true}
+}
+
+// DetectMessageType returns OpText if p is valid UTF-8 and OpBinary
+// otherwise.
+func DetectMessageType(p []byte) MessageType {
+	if utf8.Valid(p) {
+		return OpText
+	}
+	return OpBinary
+}
+
+type netConn struct {
+	c      *Conn
+	opCode MessageType
+	detect bool // choose the message type with DetectMessageType.
+
+	// r is the reader for the current message. The field is accessed by the
+	// reading goroutine only.
+	r io.Reader
+
+	// wmu serializes calls to the write methods of c.
+	wmu sync.Mutex
+}
+
+func (nc *netConn) Read(p []byte) (int, error) {
+	for {
+		if nc.r == nil {
+			op, r, err := nc.c.NextReader()
+			if IsCloseError(err) {
+				// Report normal closure as the end of the stream.
+				err = io.EOF
+			}
+			if err != nil {
+				return 0, err
+			}
+			if op != OpText && op != OpBinary {
+				continue
+			}
+			nc.r = r
+		}
+		n, err := nc.r.Read(p)
+		if err == io.EOF {
+			nc.r = nil
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (nc *netConn) Write(p []byte) (int, error) {
+	nc.wmu.Lock()
+	defer nc.wmu.Unlock()
+	opCode := nc.opCode
+	if nc.detect {
+		opCode = DetectMessageType(p)
+	}
+	if err := nc.c.WriteMessage(opCode, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close sends a close message to the peer and closes the underlying network
+// connection.
+func (nc *netConn) Close() error {
+	nc.c.WriteControl(OpClose, FormatCloseMessage(CloseNormalClosure, ""), time.Now().Add(writeWait))
+	return nc.c.Close()
+}
+
+func (nc *netConn) LocalAddr() net.Addr  { return nc.c.LocalAddr() }
+func (nc *netConn) RemoteAddr() net.Addr { return nc.c.RemoteAddr() }
+
+func (nc *netConn) SetDeadline(t time.Time) error {
+	if err := nc.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return nc.SetWriteDeadline(t)
+}
+
+func (nc *netConn) SetReadDeadline(t time.Time) error {
+	return nc.c.SetReadDeadline(t)
+}
+
+func (nc *netConn) SetWriteDeadline(t time.Time) error {
+	nc.wmu.Lock()
+	defer nc.wmu.Unlock()
+	return nc.c.SetWriteDeadline(t)
+}
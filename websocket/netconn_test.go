@@ -0,0 +1,107 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestNetConn(t *testing.T) {
+	p1, p2 := net.Pipe()
+	sc := NetConn(newConn(p1, true, 1024, 1024), OpBinary)
+	cc := newConn(p2, false, 1024, 1024)
+	defer sc.Close()
+	defer cc.Close()
+
+	sent := make([]byte, 5000)
+	for i := range sent {
+		sent[i] = byte(i)
+	}
+
+	// Read the pongs and close message sent by the server.
+	go func() {
+		for {
+			if _, _, err := cc.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		for i := 0; i < len(sent); i += 1000 {
+			cc.WriteMessage(OpBinary, sent[i:i+1000])
+			cc.WriteMessage(OpPing, []byte("ping"))
+		}
+		cc.WriteMessage(OpClose, FormatCloseMessage(CloseNormalClosure, ""))
+	}()
+
+	received, err := ioutil.ReadAll(sc)
+	if err != nil {
+		t.Fatalf("ReadAll() returned %v", err)
+	}
+	if !bytes.Equal(received, sent) {
+		t.Fatalf("received %d bytes, want %d", len(received), len(sent))
+	}
+}
+
+func TestNetConnWrite(t *testing.T) {
+	p1, p2 := net.Pipe()
+	sc := NetConn(newConn(p1, true, 1024, 1024), OpText)
+	cc := newConn(p2, false, 1024, 1024)
+	defer sc.Close()
+	defer cc.Close()
+
+	go sc.Write([]byte("hello"))
+	op, r, err := cc.NextReader()
+	if err != nil || op != OpText {
+		t.Fatalf("NextReader() returned %d, %v", op, err)
+	}
+	p, err := ioutil.ReadAll(r)
+	if err != nil || string(p) != "hello" {
+		t.Fatalf("ReadAll() returned %q, %v", p, err)
+	}
+}
+
+func TestNetConnDetect(t *testing.T) {
+	p1, p2 := net.Pipe()
+	sc := NetConnDetect(newConn(p1, true, 1024, 1024))
+	cc := newConn(p2, false, 1024, 1024)
+	defer sc.Close()
+	defer cc.Close()
+
+	messages := []struct {
+		p  string
+		op MessageType
+	}{
+		{"hello", OpText},
+		{"h\xc3\xa9llo", OpText},
+		{"\xff\xfe", OpBinary},
+		{"h\xc3", OpBinary}, // split encoding
+		{"", OpText},
+	}
+	go func() {
+		for _, m := range messages {
+			sc.Write([]byte(m.p))
+		}
+	}()
+	for _, m := range messages {
+		op, p, err := cc.ReadMessage()
+		if err != nil || op != m.op || string(p) != m.p {
+			t.Errorf("ReadMessage() = %v, %q, %v, want %v, %q", op, p, err, m.op, m.p)
+		}
+	}
+}
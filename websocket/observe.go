@@ -0,0 +1,45 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+// SizeObserver is called with the payload size of each message read from or
+// written to the connection. The read argument is true for messages read
+// from the peer. The op code of a fragmented message is the op code of the
+// first frame.
+//
+// Use a size observer to record message sizes in a histogram. The
+// distribution helps operators detect growth in payload sizes and choose
+// buffer sizes. The observer is called concurrently from the reading and
+// writing goroutines and must not block.
+type SizeObserver func(read bool, opCode MessageType, size int)
+
+// SetSizeObserver specifies a function that observes the size of each
+// message. A message read from the peer is observed when the header of its
+// final frame is read, including messages that the application discards. A
+// message written to the peer is observed after it is successfully written
+// to the network connection or, for pongs sent in reply to pings, when the
+// pong is queued. A nil f stops observing message sizes.
+// SetSizeObserver must not be called concurrently with the read and write
+// methods.
+func (c *Conn) SetSizeObserver(f SizeObserver) {
+	c.observeSize = f
+}
+
+// observeWrite observes a message written to the peer.
+func (c *Conn) observeWrite(opCode MessageType, size int, err error) {
+	if c.observeSize != nil && err == nil {
+		c.observeSize(false, opCode, size)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// OriginPolicy specifies the origins allowed to connect to a server. Use the
+// Check method as the Upgrader CheckOrigin function:
+//
+//  policy := &websocket.OriginPolicy{Hosts: []string{"example.com", "*.example.com"}}
+//  upgrader := websocket.Upgrader{CheckOrigin: policy.Check}
+type OriginPolicy struct {
+	// Hosts is the list of allowed origin hosts. Hosts are compared with the
+	// origin host without regard to case. A host of the form "*.example.com"
+	// matches all subdomains of example.com, but not example.com itself. A
+	// host without a port matches origins that use the default port for the
+	// scheme.
+	Hosts []string
+
+	// SameHost allows origins with a host equal to the request Host.
+	SameHost bool
+
+	// Schemes is the list of allowed origin schemes. If Schemes is empty,
+	// then the schemes "http" and "https" are allowed.
+	Schemes []string
+
+	// AllowNull allows the "null" origin sent by browsers from sandboxed
+	// frames and file URLs.
+	AllowNull bool
+
+	// AllowMissing allows requests without an Origin header. Browsers always
+	// send the Origin header in the WebSocket handshake.
+	AllowMissing bool
+}
+
+// Check returns true if the request origin is allowed by the policy.
+func (p *OriginPolicy) Check(r *http.Request) bool {
+	values := r.Header["Origin"]
+	if len(values) == 0 {
+		return p.AllowMissing
+	}
+	if len(values) > 1 {
+		return false
+	}
+	origin := values[0]
+	if origin == "null" {
+		return p.AllowNull
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" || u.User != nil || u.Opaque != "" ||
+		(u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return false
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	if !p.checkScheme(scheme) {
+		return false
+	}
+
+	host := strings.ToLower(u.Host)
+	if p.SameHost && host == strings.ToLower(r.Host) {
+		return true
+	}
+	host = trimDefaultPort(scheme, host)
+	for _, pattern := range p.Hosts {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			suffix := pattern[1:]
+			if len(host) > len(suffix) && strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *OriginPolicy) checkScheme(scheme string) bool {
+	if len(p.Schemes) == 0 {
+		return scheme == "http" || scheme == "https"
+	}
+	for _, s := range p.Schemes {
+		if strings.EqualFold(s, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// trimDefaultPort removes the port from host if the port is the default for
+// scheme.
+func trimDefaultPort(scheme, host string) string {
+	var port string
+	switch scheme {
+	case "http", "ws":
+		port = ":80"
+	case "https", "wss":
+		port = ":443"
+	default:
+		return host
+	}
+	return strings.TrimSuffix(host, port)
+}
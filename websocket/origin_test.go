@@ -0,0 +1,101 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"net/http"
+	"testing"
+)
+
+var originPolicyTests = []struct {
+	origin string
+	ok     bool
+}{
+	{"http://example.com", true},
+	{"https://EXAMPLE.com", true},
+	{"https://example.com:443", true},
+	{"https://example.com:8443", false},
+	{"https://www.example.com", true},
+	{"https://a.b.example.com", true},
+	{"https://evilexample.com", false},
+	{"https://example.com.evil.com", false},
+	{"ftp://example.com", false},
+	{"https://user@example.com", false},
+	{"https://example.com/path", false},
+	{"http://localhost:8080", true},
+	{"null", false},
+	{"", false},
+}
+
+func TestOriginPolicy(t *testing.T) {
+	p := &OriginPolicy{Hosts: []string{"example.com", "*.example.com"}, SameHost: true}
+	for _, tt := range originPolicyTests {
+		r := &http.Request{Host: "localhost:8080", Header: http.Header{"Origin": {tt.origin}}}
+		if ok := p.Check(r); ok != tt.ok {
+			t.Errorf("Check(%q) = %v, want %v", tt.origin, ok, tt.ok)
+		}
+	}
+
+	r := &http.Request{Host: "localhost:8080", Header: http.Header{}}
+	if p.Check(r) {
+		t.Error("missing origin allowed")
+	}
+	p.AllowMissing = true
+	if !p.Check(r) {
+		t.Error("missing origin not allowed")
+	}
+	r.Header.Set("Origin", "null")
+	p.AllowNull = true
+	if !p.Check(r) {
+		t.Error("null origin not allowed")
+	}
+}
+
+var addressPolicyTests = []struct {
+	remoteAddr string
+	forwarded  []string
+	ok         bool
+}{
+	{"10.1.2.3:1234", nil, true},
+	{"10.9.9.9:1234", nil, false},
+	{"192.168.1.1:1234", nil, false},
+	{"[fd00::1]:1234", nil, true},
+	{"172.16.0.1:1234", []string{"10.1.2.3"}, true},
+	{"172.16.0.1:1234", []string{"192.168.1.1, 10.1.2.3"}, true},
+	{"172.16.0.1:1234", []string{"10.1.2.3, 192.168.1.1"}, false},
+	{"172.16.0.1:1234", []string{"10.1.2.3", "172.16.0.2"}, true},
+	{"172.16.0.1:1234", []string{"garbage, 10.1.2.3"}, true},
+	{"172.16.0.1:1234", []string{"10.1.2.3, garbage"}, false},
+	{"192.168.1.1:1234", []string{"10.1.2.3"}, false},
+}
+
+func TestAddressPolicy(t *testing.T) {
+	allow, err := ParseCIDRs("10.0.0.0/8", "fd00::/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deny, _ := ParseCIDRs("10.9.9.9")
+	proxies, _ := ParseCIDRs("172.16.0.0/12")
+	p := &AddressPolicy{Allow: allow, Deny: deny, TrustedProxies: proxies}
+	for _, tt := range addressPolicyTests {
+		r := &http.Request{RemoteAddr: tt.remoteAddr, Header: http.Header{}}
+		if tt.forwarded != nil {
+			r.Header["X-Forwarded-For"] = tt.forwarded
+		}
+		if ok := p.Check(r); ok != tt.ok {
+			t.Errorf("Check(%s, %q) = %v, want %v", tt.remoteAddr, tt.forwarded, ok, tt.ok)
+		}
+	}
+}
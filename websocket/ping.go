@@ -0,0 +1,80 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"time"
+)
+
+// ErrPongMismatch is returned from the read methods in place of a pong
+// message when pong verification is enabled and the pong payload does not
+// match an outstanding ping. The error does not end the connection. The
+// application can continue reading.
+var ErrPongMismatch = errors.New("websocket: pong does not match ping")
+
+// maxOutstandingPings is the number of ping payloads kept for verification.
+const maxOutstandingPings = 16
+
+// PingWithPayload writes a ping message with payload p. If pong verification
+// is enabled with SetVerifyPong, then the connection checks that a pong with
+// the payload is received. The payload is limited to 125 bytes.
+// PingWithPayload can be called concurrently with all other methods.
+func (c *Conn) PingWithPayload(p []byte, deadline time.Time) error {
+	c.pingMu.Lock()
+	if c.verifyPong && len(p) <= maxControlFramePayloadSize {
+		if len(c.pings) == maxOutstandingPings {
+			c.pings = c.pings[1:]
+		}
+		c.pings = append(c.pings, append([]byte(nil), p...))
+	}
+	c.pingMu.Unlock()
+	return c.WriteControl(OpPing, p, deadline)
+}
+
+// SetVerifyPong specifies whether the connection verifies that the payload
+// of each pong from the peer matches a ping sent with PingWithPayload. A
+// peer can respond to the most recent of several pings only, so a pong
+// matches any outstanding ping and the pings sent before the matched ping
+// are no longer outstanding. A pong received when no pings are outstanding
+// is an unsolicited heartbeat and is not checked.
+//
+// When a pong does not match, the read methods return ErrPongMismatch in
+// place of the pong message. Use pong verification to detect intermediaries
+// that regenerate control frames instead of forwarding them.
+func (c *Conn) SetVerifyPong(enable bool) {
+	c.pingMu.Lock()
+	c.verifyPong = enable
+	c.pings = nil
+	c.pingMu.Unlock()
+}
+
+// checkPong returns false if pong verification is enabled and p does not
+// match an outstanding ping.
+func (c *Conn) checkPong(p []byte) bool {
+	c.pingMu.Lock()
+	defer c.pingMu.Unlock()
+	if !c.verifyPong || len(c.pings) == 0 {
+		return true
+	}
+	for i, ping := range c.pings {
+		if bytes.Equal(ping, p) {
+			c.pings = c.pings[i+1:]
+			return true
+		}
+	}
+	return false
+}
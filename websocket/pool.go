@@ -0,0 +1,108 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+// maxPooledBufferSize is the capacity of the largest buffer returned to the
+// pool. Larger buffers are left to the garbage collector so that a single
+// large message does not pin memory in the pool.
+const maxPooledBufferSize = 1 << 20
+
+var messageBufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// controlFrameBuffer is scratch space for encoding a control frame.
+type controlFrameBuffer [maxFrameHeaderSize + maxControlFramePayloadSize]byte
+
+var controlFramePool = sync.Pool{
+	New: func() interface{} { return new(controlFrameBuffer) },
+}
+
+var timerPool sync.Pool
+
+// getTimer returns a timer from the pool that expires after d. WriteControl
+// uses pooled timers so that pings sent while the writer is busy do not
+// allocate.
+func getTimer(d time.Duration) *time.Timer {
+	if t, _ := timerPool.Get().(*time.Timer); t != nil {
+		t.Reset(d)
+		return t
+	}
+	return time.NewTimer(d)
+}
+
+// putTimer stops t and returns it to the pool.
+func putTimer(t *time.Timer) {
+	if !t.Stop() {
+		// Drain the channel for versions of Go where a stopped timer
+		// can hold a stale value.
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	timerPool.Put(t)
+}
+
+// ReadMessageBuffer reads the next message into a buffer from a shared pool.
+// The application must call ReleaseMessageBuffer when it is done with the
+// buffer. Servers that buffer complete messages at a high rate use
+// ReadMessageBuffer to avoid allocating a new slice for each message. Reading
+// a text or binary message with ReadMessageBuffer does not allocate once the
+// pool is warm.
+func (c *Conn) ReadMessageBuffer() (MessageType, *bytes.Buffer, error) {
+	opCode, err := c.nextMessage()
+	if err != nil {
+		return opCode, nil, err
+	}
+	var r io.Reader
+	switch {
+	case opCode == OpPong:
+		r = c.pongMessageReader()
+	case c.messageFilter != nil:
+		if _, r, err = c.filterMessage(opCode); err != nil {
+			return -1, nil, err
+		}
+	default:
+		// The connection's reader is used instead of a new messageReader to
+		// avoid allocating an interface value for each message.
+		c.poolReader = messageReader{c, c.readSeq}
+		r = &c.poolReader
+	}
+	b := messageBufferPool.Get().(*bytes.Buffer)
+	if _, err := b.ReadFrom(r); err != nil {
+		ReleaseMessageBuffer(b)
+		return opCode, nil, err
+	}
+	return opCode, b, nil
+}
+
+// ReleaseMessageBuffer returns a buffer obtained from ReadMessageBuffer to
+// the pool. The application must not use the buffer or slices of the buffer
+// contents after calling ReleaseMessageBuffer.
+func ReleaseMessageBuffer(b *bytes.Buffer) {
+	if b == nil || b.Cap() > maxPooledBufferSize {
+		return
+	}
+	b.Reset()
+	messageBufferPool.Put(b)
+}
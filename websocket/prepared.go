@@ -0,0 +1,178 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// PreparedMessage caches the wire representation of a message. Applications
+// that broadcast the same message to many connections use a prepared message
+// to encode the frame once instead of once per connection.
+//
+// A PreparedMessage is safe for concurrent use by multiple goroutines.
+type PreparedMessage struct {
+	opCode MessageType
+	data   []byte
+
+	once  sync.Once
+	frame []byte
+}
+
+// NewPreparedMessage returns a prepared message for the given opCode and
+// payload. The allowed opCodes are OpText and OpBinary. The application must
+// not modify data after calling NewPreparedMessage.
+func NewPreparedMessage(opCode MessageType, data []byte) (*PreparedMessage, error) {
+	if opCode != OpText && opCode != OpBinary {
+		return nil, errBadWriteOpCode
+	}
+	return &PreparedMessage{opCode: opCode, data: data}, nil
+}
+
+// serverFrame returns the unmasked frame for the message.
+func (pm *PreparedMessage) serverFrame(c *Conn) []byte {
+	pm.once.Do(func() {
+		pm.frame = c.appendFrame(make([]byte, 0, maxFrameHeaderSize+len(pm.data)), true, pm.opCode, pm.data)
+	})
+	return pm.frame
+}
+
+// WritePreparedMessage writes a prepared message to the connection. Server
+// connections write the cached frame. Client connections mask the payload
+// with a new key on each call as required by the protocol.
+func (c *Conn) WritePreparedMessage(pm *PreparedMessage) error {
+	var frame []byte
+	if c.isServer {
+		frame = pm.serverFrame(c)
+	}
+	return c.writeEncoded(pm.opCode, frame, pm.data)
+}
+
+// writeEncoded writes a complete message. Server connections write frame, the
+// encoded unmasked frame. Client connections encode a masked frame for data.
+func (c *Conn) writeEncoded(opCode MessageType, frame, data []byte) error {
+	if c.writeErr != nil {
+		return c.writeErr
+	}
+
+	if c.writeOpCode != -1 {
+		if err := c.flushFrame(true, nil); err != nil {
+			return err
+		}
+	}
+
+	p := frame
+	if !c.isServer {
+		n := maxFrameHeaderSize + len(data)
+		if n <= len(c.writeBuf) {
+			p = c.writeBuf[:0]
+		} else {
+			p = make([]byte, 0, n)
+		}
+		p = c.appendFrame(p, true, opCode, data)
+	}
+
+	c.startMessage(opCode)
+	atomic.AddInt64(&c.messagesWritten, 1)
+	c.writeErr = c.writeMessage(opCode, p)
+	c.observeWrite(opCode, len(data), c.writeErr)
+	if c.adaptMin > 0 && c.writeErr == nil {
+		c.adaptWriteBuf(len(data))
+	}
+	err := c.writeErr
+	c.recoverWrite(true)
+	return err
+}
+
+// SharedMessage is an immutable message shared by the connections that a
+// message is broadcast to. The message is encoded once in a buffer from a
+// pool. The buffer is returned to the pool when the last reference to the
+// message is released.
+//
+// NewSharedMessage returns a message with one reference. Call Retain for each
+// additional holder of the message, such as each recipient's send queue, and
+// call Release when a holder is done with the message. The SendQueue
+// SendShared method retains the message until it is written. The
+// application must not use the message after releasing its last reference.
+//
+// The methods of SharedMessage are safe for concurrent use by multiple
+// goroutines.
+type SharedMessage struct {
+	opCode MessageType
+	refs   int32
+	buf    []byte // header space followed by the payload.
+	frame  []byte // encoded unmasked frame in buf.
+}
+
+var sharedBufferPool sync.Pool
+
+// NewSharedMessage returns a shared message for the given opCode and payload.
+// The allowed opCodes are OpText and OpBinary. The payload is copied to a
+// buffer from a pool.
+func NewSharedMessage(opCode MessageType, data []byte) (*SharedMessage, error) {
+	if opCode != OpText && opCode != OpBinary {
+		return nil, errBadWriteOpCode
+	}
+	n := maxFrameHeaderSize + len(data)
+	var buf []byte
+	if p, _ := sharedBufferPool.Get().(*[]byte); p != nil && cap(*p) >= n {
+		buf = (*p)[:n]
+	} else {
+		buf = make([]byte, n)
+	}
+	copy(buf[maxFrameHeaderSize:], data)
+
+	// Build the header immediately before the payload.
+	var hb [maxFrameHeaderSize]byte
+	header := EncodeFrameHeader(hb[:0], FrameHeader{Final: true, OpCode: opCode, Length: int64(len(data))})
+	pos := maxFrameHeaderSize - len(header)
+	copy(buf[pos:], header)
+
+	return &SharedMessage{opCode: opCode, refs: 1, buf: buf, frame: buf[pos:]}, nil
+}
+
+// payload returns the message payload.
+func (m *SharedMessage) payload() []byte {
+	return m.buf[maxFrameHeaderSize:]
+}
+
+// Retain adds a reference to the message and returns the message.
+func (m *SharedMessage) Retain() *SharedMessage {
+	if atomic.AddInt32(&m.refs, 1) <= 1 {
+		panic("websocket: retain of released shared message")
+	}
+	return m
+}
+
+// Release removes a reference to the message. The buffer is returned to the
+// pool when the last reference is released.
+func (m *SharedMessage) Release() {
+	switch refs := atomic.AddInt32(&m.refs, -1); {
+	case refs < 0:
+		panic("websocket: release of released shared message")
+	case refs == 0 && cap(m.buf) <= maxPooledBufferSize:
+		buf := m.buf[:0]
+		m.buf, m.frame = nil, nil
+		sharedBufferPool.Put(&buf)
+	}
+}
+
+// WriteSharedMessage writes a shared message to the connection. Server
+// connections write the encoded frame without copying the payload. The
+// caller must hold a reference to the message for the duration of the call.
+func (c *Conn) WriteSharedMessage(m *SharedMessage) error {
+	return c.writeEncoded(m.opCode, m.frame, m.payload())
+}
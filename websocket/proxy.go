@@ -0,0 +1,143 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// maxProxyAuthRounds is the maximum number of 407 challenges answered when
+// establishing a tunnel.
+const maxProxyAuthRounds = 3
+
+// BasicProxyAuth returns a ProxyAuth function that answers challenges with
+// the given user name and password using the Basic scheme.
+func BasicProxyAuth(username, password string) func(proxyURL *url.URL, resp *http.Response) (string, error) {
+	v := basicAuth(username, password)
+	return func(proxyURL *url.URL, resp *http.Response) (string, error) {
+		return v, nil
+	}
+}
+
+func basicAuth(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+// proxyURL returns the proxy for the connection to u or nil if the
+// connection is not proxied.
+func (d *Dialer) proxyURL(u *url.URL) (*url.URL, error) {
+	if d.Proxy == nil {
+		return nil, nil
+	}
+	pu := *u
+	if u.Scheme == "wss" {
+		pu.Scheme = "https"
+	} else {
+		pu.Scheme = "http"
+	}
+	return d.Proxy(&http.Request{Method: "GET", URL: &pu, Header: make(http.Header), Host: u.Host})
+}
+
+// dialProxy connects to hostPort through a tunnel established by an HTTP
+// CONNECT request to the proxy.
+func (d *Dialer) dialProxy(netDial func(network, addr string) (net.Conn, error), proxyURL *url.URL, hostPort string, deadline time.Time) (net.Conn, error) {
+	if proxyURL.Scheme != "http" {
+		return nil, errors.New("websocket: unsupported proxy scheme " + proxyURL.Scheme)
+	}
+	proxyHostPort := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyHostPort = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+
+	// Send the credentials from the proxy URL without waiting for a
+	// challenge.
+	var auth string
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth = basicAuth(proxyURL.User.Username(), password)
+	}
+
+	var (
+		conn net.Conn
+		br   *bufio.Reader
+	)
+	for round := 0; ; round++ {
+		if conn == nil {
+			var err error
+			conn, err = d.dialNet(netDial, proxyHostPort, deadline)
+			if err != nil {
+				return nil, err
+			}
+			conn.SetDeadline(deadline)
+			br = bufio.NewReader(conn)
+		}
+
+		req := &http.Request{
+			Method: "CONNECT",
+			URL:    &url.URL{Opaque: hostPort},
+			Host:   hostPort,
+			Header: make(http.Header),
+		}
+		if auth != "" {
+			req.Header.Set("Proxy-Authorization", auth)
+		}
+		if err := req.Write(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK {
+			if br.Buffered() > 0 {
+				conn.Close()
+				return nil, errors.New("websocket: proxy sent data before tunnel established")
+			}
+			conn.SetDeadline(time.Time{})
+			return conn, nil
+		}
+
+		if resp.StatusCode != http.StatusProxyAuthRequired || d.ProxyAuth == nil || round >= maxProxyAuthRounds {
+			conn.Close()
+			return nil, errors.New("websocket: proxy CONNECT failed: " + resp.Status)
+		}
+		auth, err = d.ProxyAuth(proxyURL, resp)
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if err != nil || auth == "" {
+			conn.Close()
+			if err == nil {
+				err = errors.New("websocket: proxy CONNECT failed: " + resp.Status)
+			}
+			return nil, err
+		}
+		if resp.Close {
+			// The proxy closes the connection after the challenge.
+			conn.Close()
+			conn = nil
+		}
+	}
+}
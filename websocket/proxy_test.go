@@ -0,0 +1,138 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// proxyServer is an HTTP proxy that supports CONNECT with Basic
+// authentication. The proxy closes the connection after each challenge if
+// closeOnChallenge is set.
+type proxyServer struct {
+	l                net.Listener
+	auth             string
+	closeOnChallenge bool
+}
+
+func newProxyServer(t *testing.T, username, password string, closeOnChallenge bool) *proxyServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &proxyServer{l: l, auth: basicAuth(username, password), closeOnChallenge: closeOnChallenge}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *proxyServer) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Method != "CONNECT" {
+			return
+		}
+		if req.Header.Get("Proxy-Authorization") != p.auth {
+			h := "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"test\"\r\nContent-Length: 4\r\n"
+			if p.closeOnChallenge {
+				h += "Connection: close\r\n"
+			}
+			io.WriteString(conn, h+"\r\ndeny")
+			if p.closeOnChallenge {
+				return
+			}
+			continue
+		}
+		target, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		defer target.Close()
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go io.Copy(target, br)
+		io.Copy(conn, target)
+		return
+	}
+}
+
+func TestDialProxy(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var u Upgrader
+		c, err := u.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		op, p, err := c.ReadMessage()
+		if err == nil {
+			c.WriteMessage(op, p)
+		}
+	}))
+	defer s.Close()
+	wsURL := strings.Replace(s.URL, "http", "ws", 1)
+
+	for _, tt := range []struct {
+		name             string
+		userInfo         *url.Userinfo
+		auth             func(*url.URL, *http.Response) (string, error)
+		closeOnChallenge bool
+		ok               bool
+	}{
+		{"url credentials", url.UserPassword("user", "pass"), nil, false, true},
+		{"challenge", nil, BasicProxyAuth("user", "pass"), false, true},
+		{"challenge with close", nil, BasicProxyAuth("user", "pass"), true, true},
+		{"bad credentials", nil, BasicProxyAuth("user", "wrong"), false, false},
+		{"no credentials", nil, nil, false, false},
+	} {
+		p := newProxyServer(t, "user", "pass", tt.closeOnChallenge)
+		proxyURL := &url.URL{Scheme: "http", Host: p.l.Addr().String(), User: tt.userInfo}
+		d := Dialer{Proxy: http.ProxyURL(proxyURL), ProxyAuth: tt.auth}
+		c, _, err := d.Dial(wsURL, nil)
+		p.l.Close()
+		if !tt.ok {
+			if err == nil {
+				c.Close()
+				t.Errorf("%s: Dial() did not return an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Dial() returned %v", tt.name, err)
+			continue
+		}
+		c.WriteMessage(OpText, []byte("hello"))
+		if _, p, err := c.ReadMessage(); err != nil || string(p) != "hello" {
+			t.Errorf("%s: ReadMessage() returned %q, %v", tt.name, p, err)
+		}
+		c.Close()
+	}
+}
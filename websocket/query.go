@@ -0,0 +1,101 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+)
+
+// QueryParam describes a query parameter expected in the upgrade request.
+// Clients often pass the protocol version, a client identifier or a token in
+// the query string of the WebSocket URL because the browser WebSocket API
+// does not support request headers.
+type QueryParam struct {
+	// Name is the name of the parameter.
+	Name string
+
+	// Required specifies whether the parameter must be present. If a required
+	// parameter is missing, then the upgrade fails with HTTP status 400.
+	Required bool
+
+	// Validate checks the value of the parameter when the parameter is
+	// present. If Validate returns an error, then the upgrade fails with
+	// HTTP status 400.
+	Validate func(value string) error
+}
+
+// IntParam returns a validation function for QueryParam that accepts
+// decimal integers in the range [min, max].
+func IntParam(min, max int64) func(value string) error {
+	return func(value string) error {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		if n < min || n > max {
+			return errors.New("value " + value + " out of range")
+		}
+		return nil
+	}
+}
+
+// checkQuery validates query against params. The returned string describes
+// the first problem found or is empty if the query is valid.
+func checkQuery(query url.Values, params []QueryParam) string {
+	for _, p := range params {
+		values, ok := query[p.Name]
+		if !ok || len(values) == 0 {
+			if p.Required {
+				return "websocket: missing query parameter " + p.Name
+			}
+			continue
+		}
+		if p.Validate != nil {
+			if err := p.Validate(values[0]); err != nil {
+				return "websocket: invalid query parameter " + p.Name + ": " + err.Error()
+			}
+		}
+	}
+	return ""
+}
+
+// Query returns the first value of the named query parameter in the upgrade
+// request or the empty string if the parameter is not present. Query returns
+// the empty string for client connections. Query can be called concurrently
+// with all other methods.
+func (c *Conn) Query(name string) string {
+	return c.query.Get(name)
+}
+
+// QueryInt returns the first value of the named query parameter parsed as a
+// decimal integer. QueryInt returns an error if the parameter is not present
+// or is not an integer. Use IntParam with the Upgrader QueryParams field to
+// reject invalid values before the connection is upgraded.
+func (c *Conn) QueryInt(name string) (int64, error) {
+	return strconv.ParseInt(c.query.Get(name), 10, 64)
+}
+
+// QueryBool returns the first value of the named query parameter parsed with
+// strconv.ParseBool. QueryBool returns false and no error if the parameter is
+// not present.
+func (c *Conn) QueryBool(name string) (bool, error) {
+	v := c.query.Get(name)
+	if v == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(v)
+}
@@ -0,0 +1,127 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+// CloseTokenExpired is the close code sent by a TokenSession when the
+// connection's credentials expire. The code is in the range reserved by RFC
+// 6455 for private use.
+const CloseTokenExpired = 4001
+
+// TokenRefresher refreshes the credentials of open connections. A client
+// refreshes its credentials by sending a text message containing Prefix
+// followed by a new token. If the client does not refresh the credentials
+// before they expire, then the server closes the connection with the
+// CloseTokenExpired close code.
+//
+// Use TokenRefresher with an authenticator that reports the token expiration
+// time:
+//
+//  auth := &websocket.JWTAuthenticator{QueryParam: "token", Keys: keys}
+//  refresher := &websocket.TokenRefresher{Validate: auth.Validate}
+//
+//  _, expires, err := auth.Validate(r.URL.Query().Get("token"))
+//  ...
+//  session := refresher.Start(conn, expires)
+//  defer session.Stop()
+//  for {
+//      op, r, err := conn.NextReader()
+//      ...
+//      p, err := ioutil.ReadAll(r)
+//      ...
+//      if ok, _ := session.HandleMessage(op, p); ok {
+//          continue
+//      }
+//      ...
+//  }
+type TokenRefresher struct {
+	// Prefix identifies refresh messages. If Prefix is empty, then
+	// "refresh:" is used.
+	Prefix string
+
+	// Validate validates a refresh token and returns the principal and
+	// expiration time for the token. A zero expiration time means that the
+	// credentials do not expire.
+	Validate func(token string) (principal interface{}, expires time.Time, err error)
+}
+
+func (tr *TokenRefresher) prefix() string {
+	if tr.Prefix == "" {
+		return "refresh:"
+	}
+	return tr.Prefix
+}
+
+// TokenSession tracks the expiration of a connection's credentials.
+type TokenSession struct {
+	tr *TokenRefresher
+	c  *Conn
+
+	mu    sync.Mutex
+	timer *time.Timer
+}
+
+// Start starts tracking the credentials expiration for c. A zero expiration
+// time means that the credentials do not expire.
+func (tr *TokenRefresher) Start(c *Conn, expires time.Time) *TokenSession {
+	s := &TokenSession{tr: tr, c: c}
+	s.reset(expires)
+	return s
+}
+
+func (s *TokenSession) reset(expires time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if !expires.IsZero() {
+		s.timer = time.AfterFunc(expires.Sub(time.Now()), s.expire)
+	}
+}
+
+func (s *TokenSession) expire() {
+	s.c.CloseHandshake(CloseTokenExpired, "token expired", time.Now().Add(writeWait))
+}
+
+// HandleMessage returns true if the message is a refresh message. If the
+// token in the refresh message is valid, then HandleMessage updates the
+// connection's principal and expiration time. Otherwise, HandleMessage
+// returns the error from the Validate function and the previous expiration
+// time remains in effect.
+func (s *TokenSession) HandleMessage(opCode MessageType, p []byte) (bool, error) {
+	prefix := s.tr.prefix()
+	if opCode != OpText || !bytes.HasPrefix(p, []byte(prefix)) {
+		return false, nil
+	}
+	principal, expires, err := s.tr.Validate(string(p[len(prefix):]))
+	if err != nil {
+		return true, err
+	}
+	s.c.setValue(principal)
+	s.reset(expires)
+	return true, nil
+}
+
+// Stop stops tracking the credentials expiration.
+func (s *TokenSession) Stop() {
+	s.reset(time.Time{})
+}
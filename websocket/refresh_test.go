@@ -0,0 +1,62 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenSession(t *testing.T) {
+	p1, p2 := net.Pipe()
+	sc := newConn(p1, true, 1024, 1024)
+	cc := newConn(p2, false, 1024, 1024)
+	defer sc.Close()
+	defer cc.Close()
+
+	tr := &TokenRefresher{Validate: func(token string) (interface{}, time.Time, error) {
+		if token != "good" {
+			return nil, time.Time{}, errors.New("bad token")
+		}
+		return "refreshed", time.Now().Add(20 * time.Millisecond), nil
+	}}
+	s := tr.Start(sc, time.Now().Add(time.Hour))
+	defer s.Stop()
+
+	if ok, err := s.HandleMessage(OpText, []byte("hello")); ok || err != nil {
+		t.Fatalf("HandleMessage(hello) returned %v, %v", ok, err)
+	}
+	if ok, err := s.HandleMessage(OpText, []byte("refresh:bad")); !ok || err == nil {
+		t.Fatalf("HandleMessage(refresh:bad) returned %v, %v", ok, err)
+	}
+	if ok, err := s.HandleMessage(OpText, []byte("refresh:good")); !ok || err != nil {
+		t.Fatalf("HandleMessage(refresh:good) returned %v, %v", ok, err)
+	}
+	if v := sc.Value(); v != "refreshed" {
+		t.Fatalf("Value() = %v, want refreshed", v)
+	}
+
+	go io.Copy(ioutil.Discard, p1)
+	_, _, err := cc.NextReader()
+	if err == nil || !strings.Contains(err.Error(), strconv.Itoa(CloseTokenExpired)) {
+		t.Fatalf("NextReader() returned %v, want close %d", err, CloseTokenExpired)
+	}
+}
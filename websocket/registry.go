@@ -0,0 +1,328 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errDraining    = errors.New("websocket: server draining")
+	errTenantLimit = errors.New("websocket: tenant connection limit exceeded")
+)
+
+// Registry tracks the open connections created by one or more upgraders.
+// Set the Upgrader Registry field to track the connections created by the
+// upgrader. A connection is removed from the registry when the application
+// calls Close. The zero value is an empty registry ready to use.
+//
+// A registry can group connections by tenant and enforce per-tenant quotas.
+// Set the registry fields before using the registry with an upgrader.
+type Registry struct {
+	// Tenant returns the tenant key for a request. If Tenant is nil, then the
+	// connections do not belong to a tenant and the tenant quotas do not
+	// apply.
+	Tenant func(r *http.Request) string
+
+	// MaxTenantConns is the maximum number of open connections for a tenant.
+	// If a tenant has MaxTenantConns open connections, then the upgrade fails
+	// with HTTP status 429. If MaxTenantConns is zero, then the number of
+	// connections is not limited.
+	MaxTenantConns int
+
+	// MaxTenantBandwidth is the maximum number of bytes per second read and
+	// written by the connections of a tenant. Reads and writes are delayed
+	// when a tenant exceeds the limit. Bursts of up to one second of
+	// bandwidth are allowed. If MaxTenantBandwidth is zero, then the
+	// bandwidth is not limited. Use SetMaxTenantBandwidth to change the
+	// limit while the registry is in use.
+	MaxTenantBandwidth int64
+
+	// ResumeToken returns an opaque token that the client presents on
+	// reconnect to restore the state of its session. If ResumeToken is not
+	// nil, then the close messages sent by DrainAll, DrainOver and the
+	// maximum lifetime expiration include the token. The token must not
+	// contain spaces and should be short. A token longer than 116 bytes does
+	// not fit in a close message and is not sent. See the ResumeToken
+	// function for the client side.
+	ResumeToken func(c *Conn) string
+
+	mu       sync.Mutex
+	conns    map[*Conn]bool
+	tenants  map[string]*tenant
+	draining bool
+	empty    chan struct{} // closed when conns is empty while draining.
+}
+
+// TenantStats describes the connections of a tenant.
+type TenantStats struct {
+	// Conns is the number of open connections.
+	Conns int
+
+	// BytesRead and BytesWritten are the number of bytes read and written by
+	// the connections since the tenant last had no open connections.
+	BytesRead, BytesWritten int64
+}
+
+// tenant tracks the connections of a tenant. The bandwidth and byte counts
+// are accessed atomically.
+type tenant struct {
+	key          string
+	bandwidth    int64
+	bytesRead    int64
+	bytesWritten int64
+	conns        int // open and reserved connections, protected by Registry.mu.
+
+	mu   sync.Mutex
+	next time.Time // time when the bytes transferred so far are paid for.
+}
+
+// transfer records a transfer of n bytes and delays the caller if the
+// tenant exceeds its bandwidth limit.
+func (t *tenant) transfer(counter *int64, n int) {
+	atomic.AddInt64(counter, int64(n))
+	bandwidth := atomic.LoadInt64(&t.bandwidth)
+	if bandwidth <= 0 || n <= 0 {
+		return
+	}
+	t.mu.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	t.next = t.next.Add(time.Duration(int64(n) * int64(time.Second) / bandwidth))
+	wait := t.next.Sub(now) - time.Second
+	t.mu.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// SetMaxTenantBandwidth sets the MaxTenantBandwidth field and applies the
+// limit to the open connections. SetMaxTenantBandwidth can be called
+// concurrently with all other methods.
+func (r *Registry) SetMaxTenantBandwidth(bandwidth int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.MaxTenantBandwidth = bandwidth
+	for _, t := range r.tenants {
+		atomic.StoreInt64(&t.bandwidth, bandwidth)
+	}
+}
+
+// Tenant returns the tenant key for the connection or "" if the connection
+// does not belong to a tenant.
+func (c *Conn) Tenant() string {
+	if c.tenant == nil {
+		return ""
+	}
+	return c.tenant.key
+}
+
+// Tenants returns statistics for the tenants with open connections.
+func (r *Registry) Tenants() map[string]TenantStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m := make(map[string]TenantStats, len(r.tenants))
+	for key, t := range r.tenants {
+		m[key] = TenantStats{
+			Conns:        t.conns,
+			BytesRead:    atomic.LoadInt64(&t.bytesRead),
+			BytesWritten: atomic.LoadInt64(&t.bytesWritten),
+		}
+	}
+	return m
+}
+
+// reserve reserves a connection for the tenant of the request. The
+// reservation is released with release or transferred to a connection with
+// add.
+func (r *Registry) reserve(req *http.Request) (*tenant, error) {
+	if r.Tenant == nil {
+		return nil, nil
+	}
+	key := r.Tenant(req)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := r.tenants[key]
+	if t == nil {
+		t = &tenant{key: key, bandwidth: r.MaxTenantBandwidth}
+		if r.tenants == nil {
+			r.tenants = make(map[string]*tenant)
+		}
+		r.tenants[key] = t
+	}
+	if r.MaxTenantConns > 0 && t.conns >= r.MaxTenantConns {
+		return nil, errTenantLimit
+	}
+	t.conns++
+	return t, nil
+}
+
+// cancel releases a reservation for a failed handshake.
+func (r *Registry) cancel(t *tenant) {
+	r.mu.Lock()
+	r.release(t)
+	r.mu.Unlock()
+}
+
+// release releases a reservation. The caller must hold r.mu.
+func (r *Registry) release(t *tenant) {
+	if t == nil {
+		return
+	}
+	t.conns--
+	if t.conns == 0 {
+		delete(r.tenants, t.key)
+	}
+}
+
+// Len returns the number of open connections in the registry.
+func (r *Registry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.conns)
+}
+
+// Draining returns true after DrainAll or DrainOver is called.
+func (r *Registry) Draining() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.draining
+}
+
+// add adds a connection with the tenant reservation t to the registry. It
+// returns false and releases the reservation if the registry is draining.
+func (r *Registry) add(c *Conn, t *tenant) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.draining {
+		r.release(t)
+		return false
+	}
+	if r.conns == nil {
+		r.conns = make(map[*Conn]bool)
+	}
+	r.conns[c] = true
+	c.registry = r
+	c.tenant = t
+	return true
+}
+
+func (r *Registry) remove(c *Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.conns[c] {
+		return
+	}
+	delete(r.conns, c)
+	r.release(c.tenant)
+	if r.draining && len(r.conns) == 0 && r.empty != nil {
+		close(r.empty)
+		r.empty = nil
+	}
+}
+
+// DrainResult reports the outcome of draining a registry.
+type DrainResult struct {
+	// Closed is the number of connections closed by the application before
+	// the drain deadline.
+	Closed int
+
+	// CutOff is the number of connections closed by DrainAll at the drain
+	// deadline.
+	CutOff int
+}
+
+// DrainAll drains the connections in the registry. DrainAll stops upgraders
+// using the registry from creating connections, sends a close message with
+// the given code and reason to every connection in the registry and waits
+// for the application to close the connections. Applications typically close
+// a connection when the read methods return the peer's close message. When
+// ctx is done, DrainAll closes the remaining connections.
+//
+// Upgrade fails with HTTP status 503 while and after the registry is
+// draining.
+func (r *Registry) DrainAll(ctx context.Context, code int, reason string) DrainResult {
+	return r.drain(ctx, 0, code, reason)
+}
+
+// DrainOver is like DrainAll, but spreads the close messages evenly over
+// period. Use DrainOver during a deploy so that the clients do not reconnect
+// to the new servers at the same time. The close messages not sent before
+// ctx is done are not sent.
+func (r *Registry) DrainOver(ctx context.Context, period time.Duration, code int, reason string) DrainResult {
+	return r.drain(ctx, period, code, reason)
+}
+
+func (r *Registry) drain(ctx context.Context, period time.Duration, code int, reason string) DrainResult {
+	r.mu.Lock()
+	r.draining = true
+	conns := make([]*Conn, 0, len(r.conns))
+	for c := range r.conns {
+		conns = append(conns, c)
+	}
+	empty := r.empty
+	if len(conns) > 0 && empty == nil {
+		empty = make(chan struct{})
+		r.empty = empty
+	}
+	r.mu.Unlock()
+
+	if len(conns) == 0 {
+		return DrainResult{}
+	}
+
+	// Send the close messages concurrently so that a slow peer does not
+	// delay the other connections. The writes are unblocked by Close if the
+	// context is done first.
+	for i, c := range conns {
+		delay := period * time.Duration(i) / time.Duration(len(conns))
+		go func(c *Conn, delay time.Duration) {
+			if delay > 0 {
+				t := time.NewTimer(delay)
+				select {
+				case <-t.C:
+				case <-ctx.Done():
+					t.Stop()
+					return
+				}
+			}
+			c.WriteControl(OpClose, FormatCloseMessage(code, c.closeReason(reason)), time.Time{})
+		}(c, delay)
+	}
+
+	select {
+	case <-empty:
+		return DrainResult{Closed: len(conns)}
+	case <-ctx.Done():
+	}
+
+	r.mu.Lock()
+	remaining := make([]*Conn, 0, len(r.conns))
+	for c := range r.conns {
+		remaining = append(remaining, c)
+	}
+	r.mu.Unlock()
+	for _, c := range remaining {
+		c.Close()
+	}
+	return DrainResult{Closed: len(conns) - len(remaining), CutOff: len(remaining)}
+}
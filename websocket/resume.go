@@ -0,0 +1,89 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ResumeHeader is the request header used by a client to present a resume
+// token to the server.
+const ResumeHeader = "Websocket-Resume-Token"
+
+const resumePrefix = "resume="
+
+// resumeReason returns the close text for reason and the resume token. The
+// token is placed at the end of the text. If the text does not fit in a
+// close message, then reason is dropped. If the token does not fit, then
+// the token is dropped.
+func resumeReason(reason, token string) string {
+	const max = maxControlFramePayloadSize - 2
+	if token == "" || len(resumePrefix)+len(token) > max || strings.ContainsAny(token, " ") {
+		return reason
+	}
+	if reason == "" || len(reason)+1+len(resumePrefix)+len(token) > max {
+		return resumePrefix + token
+	}
+	return reason + " " + resumePrefix + token
+}
+
+// closeReason returns the close text for a connection closed by the server
+// for an operational reason such as a drain or the end of the connection's
+// lifetime. The text includes a resume token if the registry issues tokens.
+func (c *Conn) closeReason(reason string) string {
+	if c.registry == nil || c.registry.ResumeToken == nil {
+		return reason
+	}
+	return resumeReason(reason, c.registry.ResumeToken(c))
+}
+
+// ResumeToken returns the resume token in the close message from the
+// server. The server includes a resume token in the close message when it
+// closes the connection for an operational reason and the Registry
+// ResumeToken function is set. The client presents the token on reconnect
+// in the ResumeHeader request header:
+//
+//  _, _, err := conn.ReadMessage()
+//  if token := websocket.ResumeToken(err); token != "" {
+//      requestHeader.Set(websocket.ResumeHeader, token)
+//  }
+//  conn, _, err = dialer.Dial(urlStr, requestHeader)
+//
+// ResumeToken returns "" if err is not a *CloseError or if the close
+// message does not contain a resume token.
+func ResumeToken(err error) string {
+	var e *CloseError
+	if !errors.As(err, &e) {
+		return ""
+	}
+	text := e.Text
+	if i := strings.LastIndex(text, " "+resumePrefix); i >= 0 {
+		return text[i+1+len(resumePrefix):]
+	}
+	if strings.HasPrefix(text, resumePrefix) {
+		return text[len(resumePrefix):]
+	}
+	return ""
+}
+
+// RequestResumeToken returns the resume token presented by the client in
+// the ResumeHeader request header or "" if the client did not present a
+// token. The application uses the token to restore the state of the
+// client's previous session.
+func RequestResumeToken(r *http.Request) string {
+	return r.Header.Get(ResumeHeader)
+}
@@ -0,0 +1,52 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var resumeTests = []struct {
+	reason, token string
+	text          string
+	want          string
+}{
+	{"", "", "", ""},
+	{"bye", "", "bye", ""},
+	{"", "abc", "resume=abc", "abc"},
+	{"draining", "abc", "draining resume=abc", "abc"},
+	{strings.Repeat("x", 120), "abc", "resume=abc", "abc"},
+	{"bye", strings.Repeat("t", 117), "bye", ""},
+	{"bye", "a b", "bye", ""},
+}
+
+func TestResumeToken(t *testing.T) {
+	for _, tt := range resumeTests {
+		text := resumeReason(tt.reason, tt.token)
+		if text != tt.text {
+			t.Errorf("resumeReason(%q, %q) = %q, want %q", tt.reason, tt.token, text, tt.text)
+		}
+		err := fmt.Errorf("read: %w", &CloseError{Code: CloseGoingAway, Text: text})
+		if got := ResumeToken(err); got != tt.want {
+			t.Errorf("ResumeToken(%q) = %q, want %q", text, got, tt.want)
+		}
+	}
+	if got := ResumeToken(errors.New("resume=abc")); got != "" {
+		t.Errorf("ResumeToken(non-close error) = %q, want empty", got)
+	}
+}
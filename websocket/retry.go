@@ -0,0 +1,102 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryPolicy specifies how a Dialer retries handshakes rejected by the
+// server with status 429 (Too Many Requests) or 503 (Service Unavailable).
+// The dialer waits for the time in the response's Retry-After header or, if
+// the header is missing, an exponentially increasing backoff. Both waits are
+// limited to MaxBackoff.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of handshake attempts including the
+	// first attempt. If MaxAttempts is zero, then a default of 3 is used.
+	MaxAttempts int
+
+	// InitialBackoff is the wait before the first retry when the response
+	// does not have a Retry-After header. The backoff doubles after each
+	// attempt. If InitialBackoff is zero, then a default of one second is
+	// used.
+	InitialBackoff time.Duration
+
+	// MaxBackoff is the maximum wait between attempts. If MaxBackoff is
+	// zero, then a default of 30 seconds is used.
+	MaxBackoff time.Duration
+}
+
+// retryAfter returns the wait specified by the Retry-After header in resp.
+// The header is a number of seconds or an HTTP date.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	v := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if v == "" {
+		return 0, false
+	}
+	if n, err := strconv.Atoi(v); err == nil {
+		if n < 0 {
+			return 0, false
+		}
+		return time.Duration(n) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := t.Sub(now)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+func (p *RetryPolicy) dial(d *Dialer, urlStr string, requestHeader http.Header) (*Conn, *http.Response, error) {
+	attempts := p.MaxAttempts
+	if attempts <= 0 {
+		attempts = 3
+	}
+	backoff := p.InitialBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	maxBackoff := p.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = 30 * time.Second
+	}
+
+	for i := 1; ; i++ {
+		c, resp, err := d.dial(urlStr, requestHeader)
+		if err != ErrBadHandshake || i >= attempts || resp == nil ||
+			(resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable) {
+			return c, resp, err
+		}
+
+		wait, ok := retryAfter(resp, time.Now())
+		if !ok {
+			wait = backoff
+			backoff *= 2
+		}
+		if wait > maxBackoff {
+			wait = maxBackoff
+		}
+		if resp.Body != nil {
+			resp.Body.Close()
+		}
+		time.Sleep(wait)
+	}
+}
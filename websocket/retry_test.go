@@ -0,0 +1,84 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2013, 10, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		header string
+		wait   time.Duration
+		ok     bool
+	}{
+		{"", 0, false},
+		{"2", 2 * time.Second, true},
+		{"-1", 0, false},
+		{"Tue, 01 Oct 2013 12:00:05 GMT", 5 * time.Second, true},
+		{"Tue, 01 Oct 2013 11:00:00 GMT", 0, true},
+		{"soon", 0, false},
+	} {
+		resp := &http.Response{Header: http.Header{"Retry-After": {tt.header}}}
+		wait, ok := retryAfter(resp, now)
+		if wait != tt.wait || ok != tt.ok {
+			t.Errorf("retryAfter(%q) = %v, %v, want %v, %v", tt.header, wait, ok, tt.wait, tt.ok)
+		}
+	}
+}
+
+func TestDialRetry(t *testing.T) {
+	attempts := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		switch attempts {
+		case 1:
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+		case 2:
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		default:
+			var u Upgrader
+			c, err := u.Upgrade(w, r, nil)
+			if err == nil {
+				c.Close()
+			}
+		}
+	}))
+	defer s.Close()
+	wsURL := strings.Replace(s.URL, "http", "ws", 1)
+
+	d := Dialer{Retry: &RetryPolicy{InitialBackoff: time.Millisecond}}
+	c, _, err := d.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Dial() returned %v", err)
+	}
+	c.Close()
+	if attempts != 3 {
+		t.Errorf("attempts = %d, want 3", attempts)
+	}
+
+	attempts = 0
+	d.Retry.MaxAttempts = 2
+	_, resp, err := d.Dial(wsURL, nil)
+	if err != ErrBadHandshake || resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Dial() returned %v, want %v", err, ErrBadHandshake)
+	}
+}
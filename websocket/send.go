@@ -0,0 +1,333 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrQueueFull      = errors.New("websocket: send queue full")
+	ErrQueueClosed    = errors.New("websocket: send queue closed")
+	ErrMessageDropped = errors.New("websocket: message dropped")
+)
+
+// OverflowPolicy specifies how a SendQueue handles a message that does not
+// fit in the queue.
+type OverflowPolicy int
+
+const (
+	// OverflowReject rejects the new message with ErrQueueFull.
+	OverflowReject OverflowPolicy = iota
+
+	// OverflowDropOldest drops the oldest queued messages to make room for
+	// the new message. The done functions for the dropped messages are
+	// called with ErrMessageDropped.
+	OverflowDropOldest
+
+	// OverflowClose closes the queue and the connection. Use OverflowClose
+	// for peers that do not read fast enough to be useful.
+	OverflowClose
+)
+
+type queuedMessage struct {
+	opCode MessageType
+	data   []byte
+	done   func(error)
+	shared *SharedMessage
+}
+
+// finish calls the message's done function with err and releases the shared
+// message, if any.
+func (m queuedMessage) finish(err error) {
+	if m.shared != nil {
+		m.shared.Release()
+	}
+	if m.done != nil {
+		m.done(err)
+	}
+}
+
+// SendQueue writes messages to a connection from a dedicated goroutine.
+//
+// The queue goroutine is the connection's single caller to the write
+// methods. The application must not call NextWriter, WriteMessage or
+// WriteMessages while the queue is running. WriteControl can be called
+// concurrently with the queue.
+type SendQueue struct {
+	c         *Conn
+	writeWait time.Duration
+	ch        chan queuedMessage
+	done      chan bool
+
+	mu       sync.Mutex
+	closed   bool
+	bytes    int64 // payload bytes in ch.
+	maxBytes int64
+	policy   OverflowPolicy
+}
+
+// NewSendQueue creates a queue holding up to size messages and starts the
+// goroutine that writes the messages to c. The writeWait argument specifies
+// the time allowed to write each message. A zero writeWait means that writes
+// do not time out.
+func NewSendQueue(c *Conn, size int, writeWait time.Duration) *SendQueue {
+	q := &SendQueue{
+		c:         c,
+		writeWait: writeWait,
+		ch:        make(chan queuedMessage, size),
+		done:      make(chan bool),
+	}
+	atomic.AddInt64(&healthCounters.queueCapacity, int64(size))
+	go q.run()
+	return q
+}
+
+func (q *SendQueue) run() {
+	defer close(q.done)
+	defer atomic.AddInt64(&healthCounters.queueCapacity, -int64(cap(q.ch)))
+	var err error
+	for m := range q.ch {
+		atomic.AddInt64(&healthCounters.queued, -1)
+		q.mu.Lock()
+		q.bytes -= int64(len(m.data))
+		q.mu.Unlock()
+		if err != nil {
+			m.finish(ErrMessageDropped)
+			continue
+		}
+		var deadline time.Time
+		if q.writeWait > 0 {
+			deadline = time.Now().Add(q.writeWait)
+		}
+		q.c.SetWriteDeadline(deadline)
+		if m.shared != nil {
+			err = q.c.WriteSharedMessage(m.shared)
+		} else {
+			err = q.c.WriteMessage(m.opCode, m.data)
+		}
+		m.finish(err)
+	}
+}
+
+// Send adds a message to the queue without blocking. Send returns
+// ErrQueueFull if the queue is full and ErrQueueClosed if the queue is
+// closed. The application must not modify data after calling Send.
+func (q *SendQueue) Send(opCode MessageType, data []byte) error {
+	return q.SendNotify(opCode, data, nil)
+}
+
+// SendNotify adds a message to the queue without blocking. If the message is
+// queued, the queue goroutine calls done with the result of writing the
+// message to the connection. The done function is called with
+// ErrMessageDropped if the message was not written because a previous write
+// failed or because the message was dropped by the OverflowDropOldest policy.
+// The function should not block.
+func (q *SendQueue) SendNotify(opCode MessageType, data []byte, done func(error)) error {
+	return q.enqueue(queuedMessage{opCode: opCode, data: data, done: done})
+}
+
+// SendShared adds a shared message to the queue without blocking. The queue
+// retains the message until the message is written or dropped. Use
+// SendShared to broadcast a message to many connections without copying the
+// payload for each connection.
+func (q *SendQueue) SendShared(m *SharedMessage) error {
+	err := q.enqueue(queuedMessage{opCode: m.opCode, data: m.payload(), shared: m.Retain()})
+	if err != nil {
+		m.Release()
+	}
+	return err
+}
+
+func (q *SendQueue) enqueue(m queuedMessage) error {
+	q.mu.Lock()
+	var dropped []queuedMessage
+	closeConn, err := q.send(m, &dropped)
+	q.mu.Unlock()
+	// Close the connection without holding mu. Close runs the close hooks,
+	// which can call the queue's methods.
+	if closeConn {
+		q.c.Close()
+	}
+	if err == ErrQueueFull {
+		atomic.AddInt64(&healthCounters.queueOverflows, 1)
+	}
+	atomic.AddInt64(&healthCounters.queueOverflows, int64(len(dropped)))
+	for _, m := range dropped {
+		m.finish(ErrMessageDropped)
+	}
+	return err
+}
+
+// send adds m to the queue. Messages dropped by the overflow policy are
+// appended to dropped. Send returns true if the overflow policy requires the
+// caller to close the connection. The caller must hold mu.
+func (q *SendQueue) send(m queuedMessage, dropped *[]queuedMessage) (bool, error) {
+	if q.closed {
+		return false, ErrQueueClosed
+	}
+	n := int64(len(m.data))
+	if q.maxBytes > 0 && n > q.maxBytes {
+		// The message does not fit in an empty queue.
+		return false, ErrQueueFull
+	}
+	for {
+		if q.maxBytes <= 0 || q.bytes+n <= q.maxBytes {
+			// Count the message before the queue goroutine can receive it.
+			atomic.AddInt64(&healthCounters.queued, 1)
+			select {
+			case q.ch <- m:
+				q.bytes += n
+				return false, nil
+			default:
+				atomic.AddInt64(&healthCounters.queued, -1)
+			}
+		}
+		switch q.policy {
+		case OverflowDropOldest:
+			select {
+			case old := <-q.ch:
+				atomic.AddInt64(&healthCounters.queued, -1)
+				q.bytes -= int64(len(old.data))
+				*dropped = append(*dropped, old)
+				continue
+			default:
+				// The queue goroutine took the queued messages.
+			}
+		case OverflowClose:
+			q.closed = true
+			close(q.ch)
+			return true, ErrQueueFull
+		}
+		return false, ErrQueueFull
+	}
+}
+
+// SetByteLimit limits the total size of the payloads of the queued messages
+// to limit bytes. A queue that limits only the number of messages can still
+// exhaust memory when the messages are large. The policy specifies how Send
+// handles a message that does not fit within the byte limit or the message
+// count given to NewSendQueue. A message larger than limit is always
+// rejected with ErrQueueFull. A zero limit removes the byte limit.
+func (q *SendQueue) SetByteLimit(limit int64, policy OverflowPolicy) {
+	q.mu.Lock()
+	q.maxBytes = limit
+	q.policy = policy
+	q.mu.Unlock()
+}
+
+// Bytes returns the total size of the payloads of the queued messages.
+func (q *SendQueue) Bytes() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.bytes
+}
+
+// Close closes the queue. Messages already in the queue are written to the
+// connection. Close does not close the connection.
+func (q *SendQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.ch)
+	}
+}
+
+// Done returns a channel that is closed when the queue goroutine exits after
+// the queue is closed.
+func (q *SendQueue) Done() <-chan bool {
+	return q.done
+}
+
+const (
+	defaultSendQueueSize = 16
+	defaultSendWriteWait = 10 * time.Second
+)
+
+// SetSendQueue sets the size of the queue used by Send and the time allowed
+// to write each message. Zero values select the defaults of 16 messages and
+// 10 seconds. SetSendQueue must be called before the first call to Send.
+func (c *Conn) SetSendQueue(size int, writeWait time.Duration) {
+	c.sendMu.Lock()
+	c.sendSize = size
+	c.sendWait = writeWait
+	c.sendMu.Unlock()
+}
+
+// Send adds a message to the connection's send queue without blocking. The
+// messages in the queue are written by a goroutine owned by the connection.
+// The goroutine is started by the first call to Send and exits after the
+// application calls Close. Send returns ErrQueueFull if the queue is full
+// and ErrQueueClosed if the application called Close. The application must
+// not modify data after calling Send.
+//
+// Send puts the connection in async send mode. In this mode, the
+// application owns only the goroutine reading from the connection and uses
+// Send, WriteControl and CloseHandshake to write. The application must not
+// call the other write methods. Async send mode uses one goroutine per
+// connection instead of the two used by applications that run their own
+// write loop.
+func (c *Conn) Send(opCode MessageType, data []byte) error {
+	q, err := c.asyncSendQueue()
+	if err != nil {
+		return err
+	}
+	return q.Send(opCode, data)
+}
+
+// SendShared is like Send, but adds a shared message to the queue. See the
+// SendQueue SendShared method for details.
+func (c *Conn) SendShared(m *SharedMessage) error {
+	q, err := c.asyncSendQueue()
+	if err != nil {
+		return err
+	}
+	return q.SendShared(m)
+}
+
+// asyncSendQueue returns the connection's send queue, starting the queue on
+// the first call.
+func (c *Conn) asyncSendQueue() (*SendQueue, error) {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if c.sendQueue == nil {
+		if c.isClosed() {
+			return nil, ErrQueueClosed
+		}
+		size, wait := c.sendSize, c.sendWait
+		if size <= 0 {
+			size = defaultSendQueueSize
+		}
+		if wait <= 0 {
+			wait = defaultSendWriteWait
+		}
+		c.sendQueue = NewSendQueue(c, size, wait)
+	}
+	return c.sendQueue, nil
+}
+
+// closeSendQueue closes the connection's send queue, if any.
+func (c *Conn) closeSendQueue() {
+	c.sendMu.Lock()
+	q := c.sendQueue
+	c.sendMu.Unlock()
+	if q != nil {
+		q.Close()
+	}
+}
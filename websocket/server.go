@@ -18,15 +18,28 @@ import (
 	"bufio"
 	"errors"
 	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
-// HandeshakeError describes an error with the handshake from the peer.
+// HandshakeError describes an error with the handshake from the peer.
 type HandshakeError struct {
 	Err string
 }
 
 func (e HandshakeError) Error() string { return e.Err }
 
+var (
+	errBadVersion    = HandshakeError{"websocket: version != 13"}
+	errBadConnection = HandshakeError{"websocket: connection header != upgrade"}
+	errBadUpgrade    = HandshakeError{"websocket: upgrade != websocket"}
+	errBadKey        = HandshakeError{"websocket: key missing or blank"}
+)
+
 // Upgrade upgrades the HTTP server connection to the WebSocket protocol. The
 // resp argument is any object that supports the http.Hijack interface
 // (http.ResponseWriter, Indigo web.Responder).
@@ -45,23 +58,30 @@ func (e HandshakeError) Error() string { return e.Err }
 //
 // Use the responseHeader to specify cookies (Set-Cookie) and the subprotocol
 // (Sec-WebSocket-Protocol).
+//
+// If readBufSize is zero, then the connection reuses the buffered reader
+// from the HTTP server.
 func Upgrade(resp interface{}, requestHeader, responseHeader map[string][]string, readBufSize, writeBufSize int) (*Conn, error) {
+	return upgrade(resp, requestHeader, responseHeader, readBufSize, writeBufSize, 0, false)
+}
+
+func upgrade(resp interface{}, requestHeader, responseHeader map[string][]string, readBufSize, writeBufSize int, handshakeTimeout time.Duration, allowDraft bool) (*Conn, error) {
 
-	if values := requestHeader["Sec-Websocket-Version"]; len(values) == 0 || values[0] != "13" {
-		return nil, HandshakeError{"websocket: version != 13"}
+	if values := requestHeader["Sec-Websocket-Version"]; len(values) == 0 || (values[0] != "13" && !(allowDraft && isDraftVersion(values[0]))) {
+		return nil, errBadVersion
 	}
 
 	if !tokenListContainsValue(requestHeader, "Connection", "upgrade") {
-		return nil, HandshakeError{"websocket: connection header != upgrade"}
+		return nil, errBadConnection
 	}
 
 	if !tokenListContainsValue(requestHeader, "Upgrade", "websocket") {
-		return nil, HandshakeError{"websocket: upgrade != websocket"}
+		return nil, errBadUpgrade
 	}
 
 	var challengeKey string
 	if values := requestHeader["Sec-Websocket-Key"]; len(values) == 0 || values[0] == "" {
-		return nil, HandshakeError{"websocket: key missing or blank"}
+		return nil, errBadKey
 	} else {
 		challengeKey = values[0]
 	}
@@ -87,13 +107,24 @@ func Upgrade(resp interface{}, requestHeader, responseHeader map[string][]string
 	} else {
 		return nil, errors.New("websocket: resp does not support Hijack")
 	}
+	if err != nil {
+		return nil, err
+	}
 
 	if br.Buffered() > 0 {
 		netConn.Close()
 		return nil, errors.New("websocket: client sent data before handshake complete")
 	}
 
-	c := newConn(netConn, true, readBufSize, writeBufSize)
+	var reuse *bufio.Reader
+	if readBufSize == 0 {
+		if br.Size() >= minReuseBufferSize {
+			reuse = br
+		} else {
+			readBufSize = defaultBufferSize
+		}
+	}
+	c := newConnBufio(netConn, true, reuse, readBufSize, writeBufSize)
 
 	p := c.writeBuf[:0]
 	p = append(p, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: "...)
@@ -116,10 +147,328 @@ func Upgrade(resp interface{}, requestHeader, responseHeader map[string][]string
 	}
 	p = append(p, "\r\n"...)
 
+	if handshakeTimeout > 0 {
+		netConn.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+	}
 	if _, err = netConn.Write(p); err != nil {
-		netConn.Close()
+		c.Close()
 		return nil, err
 	}
+	if handshakeTimeout > 0 {
+		netConn.SetWriteDeadline(time.Time{})
+	}
+
+	c.extensions = parseExtensions(responseHeader)
+	return c, nil
+}
+
+const (
+	defaultBufferSize = 4096
+
+	// Hijacked readers smaller than minReuseBufferSize are not reused.
+	minReuseBufferSize = 256
+)
+
+// Upgrader specifies parameters for upgrading an HTTP connection to a
+// WebSocket connection.
+type Upgrader struct {
+	// ReadBufferSize specifies the size of the connection's read buffer. If
+	// ReadBufferSize is zero, then the connection reuses the buffered reader
+	// from the HTTP server, 4096 bytes for the net/http server. Set
+	// ReadBufferSize to size the buffer for the application, for example
+	// 64KB for bulk transfers or 512 bytes for servers with many connections
+	// receiving small messages.
+	ReadBufferSize int
+
+	// WriteBufferSize specifies the size of the connection's write buffer. If
+	// WriteBufferSize is zero, then a default value of 4096 is used.
+	WriteBufferSize int
+
+	// ReadLimit is the maximum size of a message read from the peer. If
+	// ReadLimit is zero, then message size is not limited. See the Conn
+	// SetReadLimit method for details.
+	ReadLimit int64
+
+	// Limits specifies a limit set for connections created by the upgrader.
+	// The limits in the set override ReadLimit. See the Conn SetLimits method
+	// for details.
+	Limits *LimitSet
+
+	// HandshakeTimeout specifies the time allowed to write the handshake
+	// response to the client. If HandshakeTimeout is zero, then the write
+	// does not time out.
+	HandshakeTimeout time.Duration
+
+	// ControlQueueLimit specifies the maximum number of control frames queued
+	// for connections created by the upgrader. If ControlQueueLimit is zero,
+	// then the default limit is used. See the Conn SetControlQueueLimit
+	// method for details.
+	ControlQueueLimit int
+
+	// ValidateUTF8 specifies whether connections created by the upgrader
+	// validate that text messages from the peer are valid UTF-8. See the Conn
+	// SetValidateUTF8 method for details.
+	ValidateUTF8 bool
+
+	// AllowDraftProtocols specifies whether the upgrader accepts clients
+	// that use the draft protocol versions hybi-07 and hybi-08 or the older
+	// hixie-76 protocol. The version is selected from the request. Use this
+	// option for legacy clients only. Connections using hixie-76 support
+	// text messages only, do not support ping and pong messages and do not
+	// send a close code. If ReadLimit is zero, hixie-76 messages are limited
+	// to 1MB.
+	AllowDraftProtocols bool
+
+	// Admit returns true if the server has capacity for the connection. Admit
+	// is called before the handshake with the request and the memory usage of
+	// the open connections created by the package. The Conns field of the
+	// usage is the number of open connections. If Admit returns false, then
+	// the upgrade fails with HTTP status 503 and a Retry-After header set to
+	// retryAfter rounded up to a whole number of seconds. If retryAfter is
+	// zero, then the Retry-After header is omitted. Use Admit to shed load
+	// using the application's own load signals.
+	Admit func(r *http.Request, usage MemoryUsage) (ok bool, retryAfter time.Duration)
+
+	// CheckOrigin returns true if the request Origin header is acceptable. If
+	// CheckOrigin is nil, then the host in the Origin header must match the
+	// request Host or the request must not have an Origin header. The
+	// OriginPolicy type implements common origin checks.
+	CheckOrigin func(r *http.Request) bool
+
+	// CheckAddress returns true if the client address is acceptable. If
+	// CheckAddress is nil, then all addresses are accepted. The AddressPolicy
+	// type implements address checks.
+	CheckAddress func(r *http.Request) bool
+
+	// QueryParams specifies the query parameters expected in the request. If
+	// a required parameter is missing or a parameter fails validation, then
+	// the upgrade fails with HTTP status 400. The parameters are available
+	// to the application through the connection's Query, QueryInt and
+	// QueryBool methods.
+	QueryParams []QueryParam
+
+	// Authenticate authenticates the request before the connection is
+	// upgraded. If Authenticate returns an error, then the upgrade fails with
+	// HTTP status 401. The returned principal is available to the application
+	// through the connection's Value method.
+	Authenticate func(r *http.Request) (principal interface{}, err error)
+
+	// MessageFilter specifies a message filter for connections created by
+	// the upgrader. See the Conn SetMessageFilter method for details.
+	MessageFilter func(opCode MessageType, p []byte) error
+
+	// OnClose specifies a function that is called with the connection's
+	// lifecycle record when the application closes a connection created by
+	// the upgrader. Use OnClose to log connections for auditing.
+	OnClose func(r *ConnRecord)
+
+	// SizeObserver specifies a function that observes the size of messages
+	// on connections created by the upgrader. See the Conn SetSizeObserver
+	// method for details.
+	SizeObserver SizeObserver
+
+	// SendQueueSize and SendWriteWait specify the size of the send queue and
+	// the time allowed to write each queued message for connections created
+	// by the upgrader. See the Conn SetSendQueue and Send methods for
+	// details.
+	SendQueueSize int
+	SendWriteWait time.Duration
+
+	// MaxLifetime specifies the maximum lifetime of connections created by
+	// the upgrader. If MaxLifetime is zero, then the lifetime is not limited.
+	// The lifetime of each connection is extended by a random duration less
+	// than MaxLifetimeJitter so that clients do not reconnect at the same
+	// time. See the Conn SetMaxLifetime method for details.
+	MaxLifetime       time.Duration
+	MaxLifetimeJitter time.Duration
+
+	// OnMaxLifetime specifies the function called when a connection reaches
+	// its maximum lifetime. If OnMaxLifetime is nil, then the connection
+	// starts the closing handshake with the CloseServiceRestart close code.
+	OnMaxLifetime func(c *Conn)
+
+	// Registry specifies a registry for tracking the connections created by
+	// the upgrader. If Registry is draining, then the upgrade fails with HTTP
+	// status 503. If the tenant of the request is at its connection limit,
+	// then the upgrade fails with HTTP status 429. See the Registry type for
+	// details.
+	Registry *Registry
+
+	// Error specifies the function for generating HTTP error responses. If
+	// Error is nil, then http.Error is used to generate the HTTP response.
+	Error func(w http.ResponseWriter, r *http.Request, status int, reason error)
+
+	// JSONErrors specifies whether error responses have a JSON body when
+	// Error is nil. The body is an object with an error field holding a
+	// machine-readable error code, for example:
+	//
+	//  {"error":"bad_websocket_version","supported":[13]}
+	//
+	// The supported field lists the supported WebSocket versions and is
+	// present for the bad_websocket_version error only. Browser clients and
+	// SDKs use the code to explain the failure to the user.
+	JSONErrors bool
+}
+
+func (u *Upgrader) returnError(w http.ResponseWriter, r *http.Request, status int, code, reason string) (*Conn, error) {
+	atomic.AddInt64(&healthCounters.handshakeErrors, 1)
+	err := HandshakeError{reason}
+	if u.Error != nil {
+		u.Error(w, r, status, err)
+	} else if u.JSONErrors {
+		writeJSONError(w, status, code)
+	} else {
+		http.Error(w, http.StatusText(status), status)
+	}
+	return nil, err
+}
+
+// checkSameOrigin returns true if the origin is not set or is equal to the
+// request host.
+func checkSameOrigin(r *http.Request) bool {
+	origin := r.Header["Origin"]
+	if len(origin) == 0 {
+		return true
+	}
+	u, err := url.Parse(origin[0])
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// Upgrade upgrades the HTTP server connection to the WebSocket protocol.
+//
+// If the upgrade fails, then Upgrade replies to the client with an HTTP
+// error response and returns a HandshakeError.
+//
+// Use the responseHeader to specify cookies (Set-Cookie) and the subprotocol
+// (Sec-WebSocket-Protocol).
+//
+// Upgrade also accepts HTTP/2 extended CONNECT requests (RFC 8441). An HTTP/2
+// connection uses the request stream and is closed when the handler returns.
+// The handler must not return until the application is done with the
+// connection.
+func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request, responseHeader http.Header) (*Conn, error) {
+	atomic.AddInt64(&healthCounters.handshakes, 1)
+	if r.Method != "GET" && !isHTTP2Upgrade(r) {
+		return u.returnError(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "websocket: method not GET")
+	}
+
+	if u.Registry != nil && u.Registry.Draining() {
+		return u.returnError(w, r, http.StatusServiceUnavailable, "server_draining", errDraining.Error())
+	}
+
+	if u.Admit != nil {
+		if ok, retryAfter := u.Admit(r, TotalMemoryUsage()); !ok {
+			if retryAfter > 0 {
+				seconds := (retryAfter + time.Second - 1) / time.Second
+				w.Header().Set("Retry-After", strconv.FormatInt(int64(seconds), 10))
+			}
+			return u.returnError(w, r, http.StatusServiceUnavailable, "server_overloaded", "websocket: server overloaded")
+		}
+	}
+
+	if u.CheckAddress != nil && !u.CheckAddress(r) {
+		return u.returnError(w, r, http.StatusForbidden, "address_not_allowed", "websocket: address not allowed")
+	}
+
+	if u.AllowDraftProtocols && r.Header.Get("Origin") == "" {
+		// Draft versions 7 and 8 send the origin in Sec-WebSocket-Origin.
+		if origin := r.Header.Get("Sec-Websocket-Origin"); origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+	}
+
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = checkSameOrigin
+	}
+	if !checkOrigin(r) {
+		return u.returnError(w, r, http.StatusForbidden, "origin_not_allowed", "websocket: origin not allowed")
+	}
+
+	query := r.URL.Query()
+	if reason := checkQuery(query, u.QueryParams); reason != "" {
+		return u.returnError(w, r, http.StatusBadRequest, "bad_query_parameter", reason)
+	}
+
+	var principal interface{}
+	if u.Authenticate != nil {
+		var err error
+		principal, err = u.Authenticate(r)
+		if err != nil {
+			return u.returnError(w, r, http.StatusUnauthorized, "unauthorized", "websocket: "+err.Error())
+		}
+	}
 
+	var t *tenant
+	if u.Registry != nil {
+		var err error
+		if t, err = u.Registry.reserve(r); err != nil {
+			return u.returnError(w, r, http.StatusTooManyRequests, "tenant_limit", err.Error())
+		}
+	}
+
+	writeBufSize := u.WriteBufferSize
+	if writeBufSize == 0 {
+		writeBufSize = defaultBufferSize
+	}
+
+	var (
+		c   *Conn
+		err error
+	)
+	if u.AllowDraftProtocols && isHixie76(r) {
+		c, err = upgradeHixie76(w, r, responseHeader, u.HandshakeTimeout, u.ReadLimit)
+	} else if isHTTP2Upgrade(r) {
+		c, err = upgradeHTTP2(w, r, responseHeader, u.ReadBufferSize, writeBufSize, u.HandshakeTimeout)
+	} else {
+		c, err = upgrade(w, r.Header, responseHeader, u.ReadBufferSize, writeBufSize, u.HandshakeTimeout, u.AllowDraftProtocols)
+	}
+	if err != nil && u.Registry != nil {
+		u.Registry.cancel(t)
+	}
+	if e, ok := err.(HandshakeError); ok {
+		return u.returnError(w, r, http.StatusBadRequest, handshakeErrorCode(e), e.Err)
+	} else if err != nil {
+		atomic.AddInt64(&healthCounters.handshakeErrors, 1)
+		return nil, err
+	}
+	c.setValue(principal)
+	c.query = query
+	c.SetMessageFilter(u.MessageFilter)
+	c.SetCloseHook(u.OnClose)
+	c.SetSizeObserver(u.SizeObserver)
+	c.SetReadLimit(u.ReadLimit)
+	c.SetLimits(u.Limits)
+	c.SetValidateUTF8(u.ValidateUTF8)
+	if u.ControlQueueLimit > 0 {
+		c.SetControlQueueLimit(u.ControlQueueLimit)
+	}
+	if u.Registry != nil && !u.Registry.add(c, t) {
+		// The registry started draining after the check above.
+		c.WriteControl(OpClose, FormatCloseMessage(CloseGoingAway, ""), time.Now().Add(time.Second))
+		c.Close()
+		atomic.AddInt64(&healthCounters.handshakeErrors, 1)
+		return nil, errDraining
+	}
+	c.SetSendQueue(u.SendQueueSize, u.SendWriteWait)
+	c.SetMaxLifetime(lifetime(u.MaxLifetime, u.MaxLifetimeJitter), u.OnMaxLifetime)
 	return c, nil
 }
+
+// NewSecureUpgrader returns an upgrader with hardened settings: origins must
+// match the request host, messages are limited to 64KB, the handshake
+// response must be written within 10 seconds, text messages must be valid
+// UTF-8 and at most 4 control frames are queued. Applications can adjust the
+// returned upgrader before use.
+func NewSecureUpgrader() *Upgrader {
+	return &Upgrader{
+		ReadLimit:         64 * 1024,
+		HandshakeTimeout:  10 * time.Second,
+		ValidateUTF8:      true,
+		ControlQueueLimit: 4,
+		CheckOrigin:       (&OriginPolicy{SameHost: true, AllowMissing: true}).Check,
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpgradeReadBufferSize(t *testing.T) {
+	for _, tt := range []struct {
+		readBufferSize int
+		want           int
+	}{
+		{0, 4096}, // net/http reader
+		{512, 512},
+		{64 * 1024, 64 * 1024},
+	} {
+		sizes := make(chan int, 1)
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			u := Upgrader{ReadBufferSize: tt.readBufferSize}
+			c, err := u.Upgrade(w, r, nil)
+			if err != nil {
+				sizes <- -1
+				return
+			}
+			defer c.Close()
+			if _, p, err := c.ReadMessage(); err != nil || string(p) != "hello" {
+				sizes <- -1
+				return
+			}
+			sizes <- c.br.Size()
+		}))
+		c, _, err := DefaultDialer.Dial(strings.Replace(s.URL, "http", "ws", 1), nil)
+		if err != nil {
+			t.Fatalf("Dial() returned %v", err)
+		}
+		c.WriteMessage(OpText, []byte("hello"))
+		if size := <-sizes; size != tt.want {
+			t.Errorf("ReadBufferSize %d: read buffer size = %d, want %d", tt.readBufferSize, size, tt.want)
+		}
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestUpgraderQueryParams(t *testing.T) {
+	u := Upgrader{QueryParams: []QueryParam{
+		{Name: "version", Required: true, Validate: IntParam(1, 3)},
+		{Name: "client"},
+	}}
+	done := make(chan string, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := u.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		version, _ := c.QueryInt("version")
+		debug, _ := c.QueryBool("debug")
+		done <- fmt.Sprintf("%d %s %v", version, c.Query("client"), debug)
+		c.Close()
+	}))
+	defer s.Close()
+	wsURL := strings.Replace(s.URL, "http", "ws", 1)
+
+	for _, tt := range []struct {
+		query  string
+		status int
+	}{
+		{"?version=2&client=abc&debug=true", http.StatusSwitchingProtocols},
+		{"", http.StatusBadRequest},
+		{"?version=x", http.StatusBadRequest},
+		{"?version=4", http.StatusBadRequest},
+	} {
+		c, resp, err := DefaultDialer.Dial(wsURL+tt.query, nil)
+		if c != nil {
+			c.Close()
+		}
+		if resp == nil {
+			t.Errorf("%q: Dial() returned %v", tt.query, err)
+			continue
+		}
+		if resp.StatusCode != tt.status {
+			t.Errorf("%q: status = %d, want %d", tt.query, resp.StatusCode, tt.status)
+		}
+	}
+	if got := <-done; got != "2 abc true" {
+		t.Errorf("version, client, debug = %s, want 2 abc true", got)
+	}
+}
+
+func TestUpgraderJSONErrors(t *testing.T) {
+	u := Upgrader{JSONErrors: true}
+	for _, tt := range []struct {
+		method, version string
+		status          int
+		body            string
+	}{
+		{"GET", "8", http.StatusBadRequest, `{"error":"bad_websocket_version","supported":[13]}`},
+		{"POST", "13", http.StatusMethodNotAllowed, `{"error":"method_not_allowed"}`},
+	} {
+		r := httptest.NewRequest(tt.method, "/", nil)
+		r.Header.Set("Connection", "upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Sec-Websocket-Version", tt.version)
+		r.Header.Set("Sec-Websocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		w := httptest.NewRecorder()
+		if _, err := u.Upgrade(w, r, nil); err == nil {
+			t.Errorf("%s %s: Upgrade() returned nil error", tt.method, tt.version)
+			continue
+		}
+		if w.Code != tt.status || w.Body.String() != tt.body || w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s %s: response = %d, %q, %q, want %d, %q, application/json", tt.method, tt.version, w.Code, w.Body.String(), w.Header().Get("Content-Type"), tt.status, tt.body)
+		}
+	}
+}
+
+func TestUpgraderAdmit(t *testing.T) {
+	for _, tt := range []struct {
+		ok         bool
+		retryAfter time.Duration
+		status     int
+		header     string
+	}{
+		{true, 0, http.StatusSwitchingProtocols, ""},
+		{false, 0, http.StatusServiceUnavailable, ""},
+		{false, 1500 * time.Millisecond, http.StatusServiceUnavailable, "2"},
+	} {
+		var conns int64 = -1
+		u := Upgrader{Admit: func(r *http.Request, usage MemoryUsage) (bool, time.Duration) {
+			conns = usage.Conns
+			return tt.ok, tt.retryAfter
+		}}
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if c, err := u.Upgrade(w, r, nil); err == nil {
+				c.Close()
+			}
+		}))
+		c, resp, err := DefaultDialer.Dial(strings.Replace(s.URL, "http", "ws", 1), nil)
+		s.Close()
+		if c != nil {
+			c.Close()
+		}
+		name := fmt.Sprintf("ok=%v, retryAfter=%v", tt.ok, tt.retryAfter)
+		if resp == nil {
+			t.Errorf("%s: Dial() returned %v", name, err)
+			continue
+		}
+		if resp.StatusCode != tt.status || resp.Header.Get("Retry-After") != tt.header {
+			t.Errorf("%s: status, Retry-After = %d, %q, want %d, %q", name, resp.StatusCode, resp.Header.Get("Retry-After"), tt.status, tt.header)
+		}
+		if conns < 0 {
+			t.Errorf("%s: Admit not called", name)
+		}
+	}
+}
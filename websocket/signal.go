@@ -0,0 +1,57 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// DrainOnSignal drains the registry with the CloseGoingAway close code when
+// the process receives one of the signals. If no signals are specified,
+// then SIGINT and SIGTERM are used. The grace period specifies the time
+// allowed for the application to close the connections before the remaining
+// connections are closed. See the DrainAll method for details.
+//
+// The result of the drain is sent to the returned channel. Typically, the
+// application waits for the result and exits:
+//
+//  done := registry.DrainOnSignal(10 * time.Second)
+//  go http.ListenAndServe(addr, nil)
+//  result := <-done
+//  log.Printf("drained: %d closed, %d cut off", result.Closed, result.CutOff)
+//
+// The signals are no longer handled by the package after the first signal is
+// received. A second signal terminates the process with the default
+// behavior for the signal.
+func (r *Registry) DrainOnSignal(grace time.Duration, signals ...os.Signal) <-chan DrainResult {
+	if len(signals) == 0 {
+		signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+	done := make(chan DrainResult, 1)
+	go func() {
+		<-ch
+		signal.Stop(ch)
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+		done <- r.DrainAll(ctx, CloseGoingAway, "server shutting down")
+	}()
+	return done
+}
@@ -0,0 +1,71 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+//go:build unix
+
+package websocket_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/garyburd/go-websocket/websocket"
+)
+
+func TestRegistryDrainOnSignal(t *testing.T) {
+	var registry websocket.Registry
+	upgrader := websocket.Upgrader{Registry: &registry}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			if _, _, err := ws.NextReader(); err != nil {
+				return
+			}
+		}
+	}))
+	defer s.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+	for i := 0; registry.Len() != 1; i++ {
+		if i > 100 {
+			t.Fatalf("registry.Len() = %d, want 1", registry.Len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	done := registry.DrainOnSignal(5*time.Second, syscall.SIGHUP)
+	p, _ := os.FindProcess(os.Getpid())
+	if err := p.Signal(syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("ReadMessage() returned %v, want going away", err)
+	}
+	if result := <-done; result != (websocket.DrainResult{Closed: 1}) {
+		t.Errorf("result = %+v, want 1 closed", result)
+	}
+}
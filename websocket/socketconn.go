@@ -0,0 +1,262 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// messageSocket is a message-oriented WebSocket provided by the platform,
+// such as the browser WebSocket object. The platform handles framing,
+// masking and the ping and pong messages.
+type messageSocket interface {
+	// Send sends a text or binary message.
+	Send(opCode MessageType, p []byte) error
+
+	// Close starts the closing handshake. A close code of zero sends the
+	// close message without a code.
+	Close(closeCode int, text string) error
+}
+
+// socketConn adapts a messageSocket to the net.Conn interface so that a Conn
+// can run on the socket. Messages received from the socket are encoded as
+// server frames for the Conn to read. Frames written by the Conn are decoded
+// and sent as messages on the socket.
+type socketConn struct {
+	s      messageSocket
+	remote net.Addr
+
+	// maskReads specifies whether received messages are encoded as masked
+	// client frames for a server Conn.
+	maskReads bool
+
+	// closeConn closes the underlying network connection, if any.
+	closeConn func() error
+
+	// setWriteDeadline sets the write deadline on the underlying network
+	// connection, if any.
+	setWriteDeadline func(t time.Time) error
+
+	// Read fields, protected by mu.
+	mu           sync.Mutex
+	rbuf         []byte
+	readErr      error
+	readDeadline time.Time
+	ready        chan struct{} // signaled when rbuf or readErr changes.
+	drained      chan struct{} // signaled when rbuf is emptied or readErr is set.
+
+	// Write fields. The Conn serializes writes.
+	wbuf  []byte      // data not yet decoded.
+	msgOp MessageType // opcode of the message in msg or -1.
+	msg   []byte
+}
+
+func newSocketConn(s messageSocket, remote net.Addr) *socketConn {
+	return &socketConn{s: s, remote: remote, ready: make(chan struct{}, 1), drained: make(chan struct{}, 1), msgOp: -1}
+}
+
+func (sc *socketConn) signal() {
+	select {
+	case sc.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (sc *socketConn) signalDrained() {
+	select {
+	case sc.drained <- struct{}{}:
+	default:
+	}
+}
+
+// waitDrained waits until the Conn reads all queued data. A reader of a
+// network connection calls waitDrained before deliver to bound the data
+// queued when the application reads slowly. WaitDrained returns false if the
+// stream of received data ended.
+func (sc *socketConn) waitDrained() bool {
+	for {
+		sc.mu.Lock()
+		n, err := len(sc.rbuf), sc.readErr
+		sc.mu.Unlock()
+		if err != nil {
+			return false
+		}
+		if n == 0 {
+			return true
+		}
+		<-sc.drained
+	}
+}
+
+// deliver queues a message received from the socket. Deliver does not block.
+// Callers that can wait for the application use waitDrained to limit the
+// amount of queued data.
+func (sc *socketConn) deliver(opCode MessageType, p []byte) {
+	sc.mu.Lock()
+	// A zero masking key leaves the payload unchanged.
+	sc.rbuf = EncodeFrameHeader(sc.rbuf, FrameHeader{Final: true, OpCode: opCode, Masked: sc.maskReads, Length: int64(len(p))})
+	sc.rbuf = append(sc.rbuf, p...)
+	sc.mu.Unlock()
+	sc.signal()
+}
+
+// deliverClose queues a close message received from the socket and ends the
+// stream of received data.
+func (sc *socketConn) deliverClose(closeCode int, text string) {
+	var p []byte
+	if closeCode != CloseNoStatusReceived {
+		p = FormatCloseMessage(closeCode, text)
+	}
+	sc.deliver(OpClose, p)
+	sc.fail(io.EOF)
+}
+
+// fail ends the stream of received data with err.
+func (sc *socketConn) fail(err error) {
+	sc.mu.Lock()
+	if sc.readErr == nil {
+		sc.readErr = err
+	}
+	sc.mu.Unlock()
+	sc.signal()
+	sc.signalDrained()
+}
+
+func (sc *socketConn) Read(p []byte) (int, error) {
+	for {
+		sc.mu.Lock()
+		if len(sc.rbuf) > 0 {
+			n := copy(p, sc.rbuf)
+			sc.rbuf = sc.rbuf[:copy(sc.rbuf, sc.rbuf[n:])]
+			empty := len(sc.rbuf) == 0
+			sc.mu.Unlock()
+			if empty {
+				sc.signalDrained()
+			}
+			return n, nil
+		}
+		err := sc.readErr
+		deadline := sc.readDeadline
+		sc.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+
+		if deadline.IsZero() {
+			<-sc.ready
+			continue
+		}
+		d := deadline.Sub(time.Now())
+		if d <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		select {
+		case <-sc.ready:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (sc *socketConn) Write(p []byte) (int, error) {
+	sc.wbuf = append(sc.wbuf, p...)
+	for {
+		h, n, err := DecodeFrameHeader(sc.wbuf)
+		if err == io.ErrUnexpectedEOF || int64(len(sc.wbuf)-n) < h.Length {
+			// Wait for the rest of the frame.
+			return len(p), nil
+		} else if err != nil {
+			return 0, err
+		}
+		payload := sc.wbuf[n : n+int(h.Length)]
+		if h.Masked {
+			maskBytes(h.MaskKey, 0, payload)
+		}
+		if err := sc.handleFrame(h, payload); err != nil {
+			return 0, err
+		}
+		sc.wbuf = sc.wbuf[:copy(sc.wbuf, sc.wbuf[n+int(h.Length):])]
+	}
+}
+
+// handleFrame sends the message or close message completed by a frame. The
+// platform does not support fragmented messages. A fragmented message is
+// sent when the final frame is written.
+func (sc *socketConn) handleFrame(h FrameHeader, payload []byte) error {
+	switch h.OpCode {
+	case OpText, OpBinary:
+		sc.msgOp = h.OpCode
+		sc.msg = append(sc.msg[:0], payload...)
+	case OpContinuation:
+		sc.msg = append(sc.msg, payload...)
+	case OpClose:
+		closeCode, text := 0, ""
+		if len(payload) >= 2 {
+			closeCode = int(binary.BigEndian.Uint16(payload))
+			text = string(payload[2:])
+		}
+		return sc.s.Close(closeCode, text)
+	default:
+		// The platform sends pings and pongs.
+		return nil
+	}
+	if !h.Final {
+		return nil
+	}
+	op := sc.msgOp
+	sc.msgOp = -1
+	return sc.s.Send(op, sc.msg)
+}
+
+func (sc *socketConn) Close() error {
+	sc.fail(net.ErrClosed)
+	err := sc.s.Close(0, "")
+	if sc.closeConn != nil {
+		err = sc.closeConn()
+	}
+	return err
+}
+
+func (sc *socketConn) LocalAddr() net.Addr  { return stringAddr("") }
+func (sc *socketConn) RemoteAddr() net.Addr { return sc.remote }
+
+func (sc *socketConn) SetDeadline(t time.Time) error {
+	sc.SetReadDeadline(t)
+	return sc.SetWriteDeadline(t)
+}
+
+func (sc *socketConn) SetReadDeadline(t time.Time) error {
+	sc.mu.Lock()
+	sc.readDeadline = t
+	sc.mu.Unlock()
+	sc.signal()
+	return nil
+}
+
+// SetWriteDeadline sets the deadline on the underlying network connection,
+// if any. Writes to a platform socket without a network connection do not
+// block.
+func (sc *socketConn) SetWriteDeadline(t time.Time) error {
+	if sc.setWriteDeadline != nil {
+		return sc.setWriteDeadline(t)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+type sentMessage struct {
+	opCode MessageType
+	data   string
+}
+
+// fakeSocket records the messages sent on a messageSocket.
+type fakeSocket struct {
+	sent      []sentMessage
+	closeCode int
+	closed    bool
+}
+
+func (s *fakeSocket) Send(opCode MessageType, p []byte) error {
+	s.sent = append(s.sent, sentMessage{opCode, string(p)})
+	return nil
+}
+
+func (s *fakeSocket) Close(closeCode int, text string) error {
+	s.closeCode = closeCode
+	s.closed = true
+	return nil
+}
+
+func TestSocketConnWrite(t *testing.T) {
+	s := &fakeSocket{}
+	c := newConn(newSocketConn(s, nil), false, 1024, 16)
+
+	c.WriteMessage(OpText, []byte("hello"))
+	w, _ := c.NextWriter(OpBinary)
+	w.Write(bytes.Repeat([]byte("x"), 20))
+	w.Write(bytes.Repeat([]byte("y"), 20))
+	w.Close()
+	c.WriteControl(OpPing, nil, time.Time{})
+	c.WriteControl(OpClose, FormatCloseMessage(CloseGoingAway, ""), time.Time{})
+
+	want := []sentMessage{
+		{OpText, "hello"},
+		{OpBinary, string(bytes.Repeat([]byte("x"), 20)) + string(bytes.Repeat([]byte("y"), 20))},
+	}
+	if len(s.sent) != len(want) {
+		t.Fatalf("sent %d messages, want %d", len(s.sent), len(want))
+	}
+	for i := range want {
+		if s.sent[i] != want[i] {
+			t.Errorf("message %d = %v, want %v", i, s.sent[i], want[i])
+		}
+	}
+	if !s.closed || s.closeCode != CloseGoingAway {
+		t.Errorf("close code = %d, closed = %v", s.closeCode, s.closed)
+	}
+}
+
+func TestSocketConnRead(t *testing.T) {
+	sc := newSocketConn(&fakeSocket{}, nil)
+	c := newConn(sc, false, 1024, 1024)
+
+	sc.deliver(OpText, []byte("hello"))
+	sc.deliver(OpBinary, make([]byte, 2000))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		sc.deliverClose(CloseNormalClosure, "")
+	}()
+
+	op, p, err := c.ReadMessage()
+	if err != nil || op != OpText || string(p) != "hello" {
+		t.Fatalf("ReadMessage() returned %v, %q, %v", op, p, err)
+	}
+	op, p, err = c.ReadMessage()
+	if err != nil || op != OpBinary || len(p) != 2000 {
+		t.Fatalf("ReadMessage() returned %v, %d bytes, %v", op, len(p), err)
+	}
+	if _, _, err := c.ReadMessage(); !IsCloseError(err, CloseNormalClosure) {
+		t.Fatalf("ReadMessage() returned %v, want close %d", err, CloseNormalClosure)
+	}
+}
+
+func TestSocketConnReadDeadline(t *testing.T) {
+	sc := newSocketConn(&fakeSocket{}, nil)
+	c := newConn(sc, false, 1024, 1024)
+	c.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, _, err := c.ReadMessage()
+	if e, ok := err.(interface {
+		Timeout() bool
+	}); !ok || !e.Timeout() {
+		t.Fatalf("ReadMessage() returned %v, want timeout", err)
+	}
+}
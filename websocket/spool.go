@@ -0,0 +1,95 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// SpooledMessage is a complete message read by ReadMessageSpooled. The
+// payload is held in memory or in a temporary file. The application must call
+// Close to remove the temporary file.
+type SpooledMessage struct {
+	io.ReadSeeker
+	f    *os.File
+	size int64
+}
+
+// Size returns the size of the message payload in bytes.
+func (m *SpooledMessage) Size() int64 {
+	return m.size
+}
+
+// Spooled returns true if the payload is stored in a temporary file.
+func (m *SpooledMessage) Spooled() bool {
+	return m.f != nil
+}
+
+// Close releases the resources for the message and removes the temporary
+// file, if any.
+func (m *SpooledMessage) Close() error {
+	if m.f == nil {
+		return nil
+	}
+	f := m.f
+	m.f = nil
+	err := f.Close()
+	if rerr := os.Remove(f.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// ReadMessageSpooled reads the next message. Payloads up to threshold bytes
+// are held in memory. Larger payloads are written to a temporary file in dir
+// so that memory use does not depend on the size of the message. If dir is
+// the empty string, then the default directory for temporary files is used.
+//
+// The returned message is positioned at the start of the payload.
+func (c *Conn) ReadMessageSpooled(threshold int64, dir string) (MessageType, *SpooledMessage, error) {
+	opCode, r, err := c.NextReader()
+	if err != nil {
+		return opCode, nil, err
+	}
+
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, r, threshold+1)
+	if err == io.EOF {
+		return opCode, &SpooledMessage{ReadSeeker: bytes.NewReader(buf.Bytes()), size: n}, nil
+	} else if err != nil {
+		return opCode, nil, err
+	}
+
+	f, err := ioutil.TempFile(dir, "websocket")
+	if err != nil {
+		return opCode, nil, err
+	}
+	m := &SpooledMessage{ReadSeeker: f, f: f}
+	if m.size, err = buf.WriteTo(f); err == nil {
+		n, err = io.Copy(f, r)
+		m.size += n
+	}
+	if err == nil {
+		_, err = f.Seek(0, 0)
+	}
+	if err != nil {
+		m.Close()
+		return opCode, nil, err
+	}
+	return opCode, m, nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReadMessageSpooled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var connBuf bytes.Buffer
+	wc := newConn(fakeNetConn{Reader: nil, Writer: &connBuf}, true, 1024, 1024)
+	rc := newConn(fakeNetConn{Reader: &connBuf, Writer: nil}, false, 1024, 1024)
+
+	for _, n := range []int{0, 100, 101, 5000} {
+		data := bytes.Repeat([]byte{'x'}, n)
+		wc.WriteMessage(OpBinary, data)
+
+		op, m, err := rc.ReadMessageSpooled(100, dir)
+		if err != nil || op != OpBinary {
+			t.Fatalf("n:%d: ReadMessageSpooled() returned %d, %v", n, op, err)
+		}
+		if m.Size() != int64(n) || m.Spooled() != (n > 100) {
+			t.Fatalf("n:%d: Size() = %d, Spooled() = %v", n, m.Size(), m.Spooled())
+		}
+		p, err := ioutil.ReadAll(m)
+		if err != nil || !bytes.Equal(p, data) {
+			t.Fatalf("n:%d: ReadAll() returned %d bytes, %v", n, len(p), err)
+		}
+		if err := m.Close(); err != nil {
+			t.Fatalf("n:%d: Close() returned %v", n, err)
+		}
+		if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+			t.Fatalf("n:%d: %d files left in spool directory", n, len(files))
+		}
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var errTicketInvalid = errors.New("ticket missing, invalid or expired")
+
+// TicketStore stores one-time tickets issued by a TicketAuthenticator.
+// Implementations must be safe for concurrent use.
+type TicketStore interface {
+	// Put stores the value for ticket until the expiration time.
+	Put(ticket string, value interface{}, expires time.Time) error
+
+	// Take removes ticket from the store and returns the ticket's value. Take
+	// returns false if the ticket is not in the store or has expired.
+	Take(ticket string) (value interface{}, ok bool)
+}
+
+// TicketAuthenticator authenticates WebSocket handshake requests using
+// one-time tickets. The application issues a ticket from an HTTP handler
+// protected by the application's usual authentication and CSRF defenses and
+// passes the ticket to the client. The client includes the ticket in the
+// query string of the WebSocket URL. Use the Authenticate method as the
+// Upgrader Authenticate function:
+//
+//  tickets := &websocket.TicketAuthenticator{Store: websocket.NewMemoryTicketStore()}
+//  upgrader := websocket.Upgrader{Authenticate: tickets.Authenticate}
+//
+// The principal for an authenticated connection is the value passed to
+// Issue.
+type TicketAuthenticator struct {
+	// Store stores the issued tickets.
+	Store TicketStore
+
+	// QueryParam is the name of the query parameter containing the ticket.
+	// If QueryParam is empty, then "ticket" is used.
+	QueryParam string
+
+	// TTL is the time a ticket is valid after it is issued. If TTL is zero,
+	// then a default value of 30 seconds is used.
+	TTL time.Duration
+}
+
+// Issue returns a new ticket for value.
+func (a *TicketAuthenticator) Issue(value interface{}) (string, error) {
+	p := make([]byte, 18)
+	if _, err := io.ReadFull(rand.Reader, p); err != nil {
+		return "", err
+	}
+	ticket := base64.URLEncoding.EncodeToString(p)
+	ttl := a.TTL
+	if ttl == 0 {
+		ttl = 30 * time.Second
+	}
+	if err := a.Store.Put(ticket, value, time.Now().Add(ttl)); err != nil {
+		return "", err
+	}
+	return ticket, nil
+}
+
+// Authenticate redeems the ticket in the request and returns the ticket's
+// value.
+func (a *TicketAuthenticator) Authenticate(r *http.Request) (interface{}, error) {
+	name := a.QueryParam
+	if name == "" {
+		name = "ticket"
+	}
+	ticket := r.URL.Query().Get(name)
+	if ticket == "" {
+		return nil, errTicketInvalid
+	}
+	value, ok := a.Store.Take(ticket)
+	if !ok {
+		return nil, errTicketInvalid
+	}
+	return value, nil
+}
+
+type memoryTicket struct {
+	value   interface{}
+	expires time.Time
+}
+
+// MemoryTicketStore is a TicketStore implementation that stores tickets in
+// memory.
+type MemoryTicketStore struct {
+	mu      sync.Mutex
+	tickets map[string]memoryTicket
+	sweepAt int
+}
+
+// NewMemoryTicketStore returns a new in-memory ticket store.
+func NewMemoryTicketStore() *MemoryTicketStore {
+	return &MemoryTicketStore{tickets: make(map[string]memoryTicket)}
+}
+
+// Put implements the TicketStore interface.
+func (s *MemoryTicketStore) Put(ticket string, value interface{}, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.tickets) >= s.sweepAt {
+		// Remove expired tickets when the map doubles in size.
+		now := time.Now()
+		for k, t := range s.tickets {
+			if now.After(t.expires) {
+				delete(s.tickets, k)
+			}
+		}
+		s.sweepAt = 2*len(s.tickets) + 64
+	}
+	s.tickets[ticket] = memoryTicket{value, expires}
+	return nil
+}
+
+// Take implements the TicketStore interface.
+func (s *MemoryTicketStore) Take(ticket string) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tickets[ticket]
+	if !ok {
+		return nil, false
+	}
+	delete(s.tickets, ticket)
+	if time.Now().After(t.expires) {
+		return nil, false
+	}
+	return t.value, true
+}
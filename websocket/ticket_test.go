@@ -0,0 +1,46 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTicketAuthenticator(t *testing.T) {
+	a := &TicketAuthenticator{Store: NewMemoryTicketStore()}
+	ticket, err := a.Issue("gopher")
+	if err != nil {
+		t.Fatalf("Issue() returned %v", err)
+	}
+	r := &http.Request{URL: &url.URL{RawQuery: "ticket=" + url.QueryEscape(ticket)}}
+
+	p, err := a.Authenticate(r)
+	if err != nil || p != "gopher" {
+		t.Fatalf("Authenticate() returned %v, %v", p, err)
+	}
+	if _, err := a.Authenticate(r); err == nil {
+		t.Fatal("ticket redeemed twice")
+	}
+
+	a.TTL = -time.Second
+	ticket, _ = a.Issue("gopher")
+	r.URL.RawQuery = "ticket=" + url.QueryEscape(ticket)
+	if _, err := a.Authenticate(r); err == nil {
+		t.Fatal("expired ticket redeemed")
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+// utf8Tests are tricky UTF-8 sequences. The tests also seed the fuzz corpus.
+var utf8Tests = []struct {
+	name  string
+	text  string
+	valid bool
+}{
+	{"empty", "", true},
+	{"ascii", "hello", true},
+	{"two byte", "\xc2\xa9", true},
+	{"three byte", "\xe4\xb8\x96", true},
+	{"four byte", "\xf0\x9f\x98\x80", true},
+	{"kosme", "\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5", true},
+	{"last code point", "\xf4\x8f\xbf\xbf", true},
+	{"last before surrogates", "\xed\x9f\xbf", true},
+	{"first after surrogates", "\xee\x80\x80", true},
+	{"noncharacter U+FFFF", "\xef\xbf\xbf", true},
+	{"overlong slash 2", "\xc0\xaf", false},
+	{"overlong slash 3", "\xe0\x80\xaf", false},
+	{"overlong slash 4", "\xf0\x80\x80\xaf", false},
+	{"overlong max 2", "\xc1\xbf", false},
+	{"overlong max 3", "\xe0\x9f\xbf", false},
+	{"overlong max 4", "\xf0\x8f\xbf\xbf", false},
+	{"overlong nul", "\xc0\x80", false},
+	{"high surrogate", "\xed\xa0\x80", false},
+	{"low surrogate", "\xed\xbf\xbf", false},
+	{"surrogate pair", "\xed\xa0\x80\xed\xb0\x80", false},
+	{"above U+10FFFF", "\xf4\x90\x80\x80", false},
+	{"f5 lead", "\xf5\x80\x80\x80", false},
+	{"ff", "\xff", false},
+	{"lone continuation", "\x80", false},
+	{"truncated two byte", "a\xc2", false},
+	{"truncated three byte", "a\xe4\xb8", false},
+	{"truncated four byte", "a\xf0\x9f\x98", false},
+	{"invalid after valid", "\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5\xed\xa0\x80edited", false},
+	{"missing continuation", "\xe4\xb8a", false},
+}
+
+// validateSplit validates p split at i as two parts of a message.
+func validateSplit(p []byte, i int) bool {
+	var v UTF8Validator
+	return v.Validate(p[:i]) && v.Validate(p[i:]) && v.Complete()
+}
+
+func TestUTF8Validator(t *testing.T) {
+	for _, tt := range utf8Tests {
+		p := []byte(tt.text)
+		if utf8.Valid(p) != tt.valid {
+			t.Fatalf("%s: test table disagrees with utf8.Valid", tt.name)
+		}
+		// Split the text at every byte as a message is split across
+		// frames.
+		for i := 0; i <= len(p); i++ {
+			if got := validateSplit(p, i); got != tt.valid {
+				t.Errorf("%s: split at %d: valid = %v, want %v", tt.name, i, got, tt.valid)
+			}
+		}
+	}
+
+	var v UTF8Validator
+	if v.Validate([]byte("\xff")) || v.Validate([]byte("a")) {
+		t.Error("validator accepted text after invalid text")
+	}
+	v.Reset()
+	if !v.Validate([]byte("a")) || !v.Complete() {
+		t.Error("validator rejected text after Reset")
+	}
+}
+
+func FuzzUTF8Validator(f *testing.F) {
+	for _, tt := range utf8Tests {
+		for i := 0; i <= len(tt.text); i++ {
+			f.Add([]byte(tt.text), i)
+		}
+	}
+	f.Fuzz(func(t *testing.T, p []byte, i int) {
+		if i < 0 || i > len(p) {
+			i = len(p) / 2
+		}
+		if got, want := validateSplit(p, i), utf8.Valid(p); got != want {
+			t.Fatalf("valid(%q split at %d) = %v, want %v", p, i, got, want)
+		}
+	})
+}
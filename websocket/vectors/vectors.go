@@ -0,0 +1,318 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package vectors provides WebSocket protocol test vectors.
+//
+// The vectors include the examples from section 5.7 of RFC 6455 and frames
+// that violate the protocol. Frames are encoded as hexadecimal strings so
+// that the vectors can be printed, compared and copied to other
+// implementations.
+//
+// The package does not import the websocket package. Implementations and
+// extensions can validate against the vectors without depending on the
+// websocket package.
+package vectors
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+// Opcodes used in the vectors. The values are defined in section 11.8 of
+// RFC 6455.
+const (
+	OpContinuation = 0
+	OpText         = 1
+	OpBinary       = 2
+	OpClose        = 8
+	OpPing         = 9
+	OpPong         = 10
+)
+
+// Frame is a frame test vector.
+type Frame struct {
+	// Name describes the vector.
+	Name string
+
+	// Wire is the hexadecimal encoding of the complete frame.
+	Wire string
+
+	// FromClient is true if the frame is sent by a client. Clients mask all
+	// frames. Servers do not mask frames.
+	FromClient bool
+
+	// The expected header fields.
+	Final   bool
+	RSV     int
+	OpCode  int
+	Masked  bool
+	MaskKey [4]byte
+	Length  int64
+
+	// Payload is the hexadecimal encoding of the unmasked payload.
+	Payload string
+}
+
+// Bytes returns the wire encoding of the frame.
+func (f *Frame) Bytes() []byte {
+	return mustDecode(f.Wire)
+}
+
+// PayloadBytes returns the unmasked payload of the frame.
+func (f *Frame) PayloadBytes() []byte {
+	return mustDecode(f.Payload)
+}
+
+// Message is a message test vector. A message vector is a sequence of frames
+// that a peer reads as a single message or as a protocol error.
+type Message struct {
+	// Name describes the vector.
+	Name string
+
+	// Wire is the hexadecimal encoding of the frames.
+	Wire []string
+
+	// FromClient is true if the frames are sent by a client.
+	FromClient bool
+
+	// OpCode and Payload are the expected message opcode and the
+	// hexadecimal encoding of the expected message payload.
+	OpCode  int
+	Payload string
+
+	// Err describes the protocol violation in the frames. Err is empty if
+	// the frames are valid. A peer that reads invalid frames fails the
+	// connection.
+	Err string
+}
+
+// Bytes returns the wire encoding of the frames.
+func (m *Message) Bytes() []byte {
+	return mustDecode(strings.Join(m.Wire, ""))
+}
+
+// PayloadBytes returns the expected message payload.
+func (m *Message) PayloadBytes() []byte {
+	return mustDecode(m.Payload)
+}
+
+func mustDecode(s string) []byte {
+	p, err := hex.DecodeString(s)
+	if err != nil {
+		panic("vectors: bad hex in vector: " + err.Error())
+	}
+	return p
+}
+
+// rfcMaskKey is the masking key used in the examples in RFC 6455.
+var rfcMaskKey = [4]byte{0x37, 0xfa, 0x21, 0x3d}
+
+const hello = "48656c6c6f"
+
+// Frames is the list of frame test vectors. All of the frames are valid.
+var Frames = []Frame{
+	{
+		Name:    "RFC 6455 5.7: single-frame unmasked text message",
+		Wire:    "810548656c6c6f",
+		Final:   true,
+		OpCode:  OpText,
+		Length:  5,
+		Payload: hello,
+	},
+	{
+		Name:       "RFC 6455 5.7: single-frame masked text message",
+		Wire:       "818537fa213d7f9f4d5158",
+		FromClient: true,
+		Final:      true,
+		OpCode:     OpText,
+		Masked:     true,
+		MaskKey:    rfcMaskKey,
+		Length:     5,
+		Payload:    hello,
+	},
+	{
+		Name:    "RFC 6455 5.7: first fragment of unmasked text message",
+		Wire:    "010348656c",
+		OpCode:  OpText,
+		Length:  3,
+		Payload: "48656c",
+	},
+	{
+		Name:    "RFC 6455 5.7: last fragment of unmasked text message",
+		Wire:    "80026c6f",
+		Final:   true,
+		OpCode:  OpContinuation,
+		Length:  2,
+		Payload: "6c6f",
+	},
+	{
+		Name:    "RFC 6455 5.7: unmasked ping",
+		Wire:    "890548656c6c6f",
+		Final:   true,
+		OpCode:  OpPing,
+		Length:  5,
+		Payload: hello,
+	},
+	{
+		Name:       "RFC 6455 5.7: masked pong",
+		Wire:       "8a8537fa213d7f9f4d5158",
+		FromClient: true,
+		Final:      true,
+		OpCode:     OpPong,
+		Masked:     true,
+		MaskKey:    rfcMaskKey,
+		Length:     5,
+		Payload:    hello,
+	},
+	{
+		Name:    "RFC 6455 5.7: 256 bytes binary message, 16-bit length",
+		Wire:    "827e0100" + strings.Repeat("00", 256),
+		Final:   true,
+		OpCode:  OpBinary,
+		Length:  256,
+		Payload: strings.Repeat("00", 256),
+	},
+	{
+		Name:    "RFC 6455 5.7: 64KiB binary message, 64-bit length",
+		Wire:    "827f0000000000010000" + strings.Repeat("00", 65536),
+		Final:   true,
+		OpCode:  OpBinary,
+		Length:  65536,
+		Payload: strings.Repeat("00", 65536),
+	},
+	{
+		Name:   "empty binary message",
+		Wire:   "8200",
+		Final:  true,
+		OpCode: OpBinary,
+	},
+	{
+		Name:    "125 bytes, largest 7-bit length",
+		Wire:    "827d" + strings.Repeat("ab", 125),
+		Final:   true,
+		OpCode:  OpBinary,
+		Length:  125,
+		Payload: strings.Repeat("ab", 125),
+	},
+	{
+		Name:    "close with normal closure code",
+		Wire:    "880203e8",
+		Final:   true,
+		OpCode:  OpClose,
+		Length:  2,
+		Payload: "03e8",
+	},
+	{
+		Name:       "masked close with going away code and text",
+		Wire:       "888537fa213d3413434452",
+		FromClient: true,
+		Final:      true,
+		OpCode:     OpClose,
+		Masked:     true,
+		MaskKey:    rfcMaskKey,
+		Length:     5,
+		Payload:    "03e9627965",
+	},
+}
+
+// Messages is the list of message test vectors.
+var Messages = []Message{
+	{
+		Name:    "RFC 6455 5.7: single-frame unmasked text message",
+		Wire:    []string{"810548656c6c6f"},
+		OpCode:  OpText,
+		Payload: hello,
+	},
+	{
+		Name:       "RFC 6455 5.7: single-frame masked text message",
+		Wire:       []string{"818537fa213d7f9f4d5158"},
+		FromClient: true,
+		OpCode:     OpText,
+		Payload:    hello,
+	},
+	{
+		Name:    "RFC 6455 5.7: fragmented unmasked text message",
+		Wire:    []string{"010348656c", "80026c6f"},
+		OpCode:  OpText,
+		Payload: hello,
+	},
+	{
+		Name:    "fragmented message with ping between fragments",
+		Wire:    []string{"010348656c", "8900", "80026c6f"},
+		OpCode:  OpText,
+		Payload: hello,
+	},
+	{
+		Name:    "fragmented message with empty fragments",
+		Wire:    []string{"0200", "0003010203", "8000"},
+		OpCode:  OpBinary,
+		Payload: "010203",
+	},
+	{
+		Name: "reserved bits set without extension",
+		Wire: []string{"c10548656c6c6f"},
+		Err:  "unexpected reserved bits",
+	},
+	{
+		Name: "reserved opcode",
+		Wire: []string{"8300"},
+		Err:  "unknown opcode",
+	},
+	{
+		Name: "reserved control opcode",
+		Wire: []string{"8b00"},
+		Err:  "unknown opcode",
+	},
+	{
+		Name: "fragmented ping",
+		Wire: []string{"0900"},
+		Err:  "control frame not final",
+	},
+	{
+		Name: "ping payload longer than 125 bytes",
+		Wire: []string{"897e007e" + strings.Repeat("00", 126)},
+		Err:  "control frame length > 125",
+	},
+	{
+		Name: "continuation without message start",
+		Wire: []string{"80026c6f"},
+		Err:  "continuation after final message frame",
+	},
+	{
+		Name: "message start before final fragment",
+		Wire: []string{"010348656c", "81026c6f"},
+		Err:  "message start before final message frame",
+	},
+	{
+		Name: "64-bit length with most significant bit set",
+		Wire: []string{"827f8000000000000000"},
+		Err:  "frame length has most significant bit set",
+	},
+	{
+		Name:       "unmasked frame from client",
+		Wire:       []string{"810548656c6c6f"},
+		FromClient: true,
+		Err:        "incorrect mask flag",
+	},
+	{
+		Name: "masked frame from server",
+		Wire: []string{"818537fa213d7f9f4d5158"},
+		Err:  "incorrect mask flag",
+	},
+	{
+		Name: "invalid UTF-8 in text message",
+		Wire: []string{"810ecebae1bdb9cf83cebcceb5eda080"},
+		Err:  "invalid UTF-8",
+	},
+}
@@ -0,0 +1,68 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/garyburd/go-websocket/websocket/vectors"
+)
+
+func TestFrameVectors(t *testing.T) {
+	for _, v := range vectors.Frames {
+		p := v.Bytes()
+		h, n, err := DecodeFrameHeader(p)
+		if err != nil {
+			t.Errorf("%s: DecodeFrameHeader() returned %v", v.Name, err)
+			continue
+		}
+		want := FrameHeader{Final: v.Final, RSV: v.RSV, OpCode: MessageType(v.OpCode), Masked: v.Masked, MaskKey: v.MaskKey, Length: v.Length}
+		if h != want {
+			t.Errorf("%s: DecodeFrameHeader() = %+v, want %+v", v.Name, h, want)
+			continue
+		}
+		if e := EncodeFrameHeader(nil, h); !bytes.Equal(e, p[:n]) {
+			t.Errorf("%s: EncodeFrameHeader() = %x, want %x", v.Name, e, p[:n])
+		}
+		payload := p[n:]
+		if h.Masked {
+			maskBytes(h.MaskKey, 0, payload)
+		}
+		if !bytes.Equal(payload, v.PayloadBytes()) {
+			t.Errorf("%s: payload = %x, want %s", v.Name, payload, v.Payload)
+		}
+	}
+}
+
+func TestMessageVectors(t *testing.T) {
+	for _, v := range vectors.Messages {
+		c := newConn(fakeNetConn{Reader: bytes.NewReader(v.Bytes()), Writer: ioutil.Discard}, v.FromClient, 1024, 1024)
+		c.SetValidateUTF8(true)
+		op, p, err := c.ReadMessage()
+		switch {
+		case v.Err != "":
+			if err == nil || !strings.Contains(err.Error(), v.Err) {
+				t.Errorf("%s: ReadMessage() returned %v, want error containing %q", v.Name, err, v.Err)
+			}
+		case err != nil:
+			t.Errorf("%s: ReadMessage() returned %v", v.Name, err)
+		case op != MessageType(v.OpCode) || !bytes.Equal(p, v.PayloadBytes()):
+			t.Errorf("%s: ReadMessage() = %v, %x, want %v, %s", v.Name, op, p, MessageType(v.OpCode), v.Payload)
+		}
+	}
+}
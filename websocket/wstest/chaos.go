@@ -0,0 +1,145 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package wstest provides utilities for testing WebSocket applications.
+package wstest
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ChaosConfig specifies the misbehavior injected by a ChaosConn. The zero
+// value injects nothing.
+type ChaosConfig struct {
+	// Latency is added before each read and before each chunk of a write.
+	Latency time.Duration
+
+	// Jitter is the maximum random duration added to Latency.
+	Jitter time.Duration
+
+	// MaxRead limits the number of bytes returned by a read. Each read
+	// returns between one and MaxRead bytes. Zero means no limit.
+	MaxRead int
+
+	// MaxWrite limits the number of bytes written to the underlying
+	// connection at once. Writes are split into chunks of between one and
+	// MaxWrite bytes. Zero means no limit.
+	MaxWrite int
+
+	// ResetRate is the probability that a read or a chunk of a write resets
+	// the connection. A write reset after some chunks are written is a
+	// partial write.
+	ResetRate float64
+
+	// Seed seeds the random source. Connections with the same
+	// configuration and seed make the same random choices.
+	Seed int64
+}
+
+// ChaosConn wraps a net.Conn to inject latency, short reads, partial writes
+// and connection resets. Use ChaosConn beneath a websocket.Conn to test
+// application timeout and reconnect logic. For example, a client can wrap
+// the network connection using the Dialer NetDial field:
+//
+//  d := websocket.Dialer{NetDial: func(network, addr string) (net.Conn, error) {
+//      c, err := net.Dial(network, addr)
+//      if err != nil {
+//          return nil, err
+//      }
+//      return wstest.NewChaosConn(c, config), nil
+//  }}
+type ChaosConn struct {
+	net.Conn
+	config ChaosConfig
+
+	mu    sync.Mutex
+	rand  *rand.Rand
+	reset bool
+}
+
+// NewChaosConn returns a connection that injects the misbehavior specified
+// by config into c.
+func NewChaosConn(c net.Conn, config ChaosConfig) *ChaosConn {
+	return &ChaosConn{Conn: c, config: config, rand: rand.New(rand.NewSource(config.Seed))}
+}
+
+// Reset closes the underlying connection. Subsequent reads and writes
+// return an error matching syscall.ECONNRESET.
+func (c *ChaosConn) Reset() {
+	c.mu.Lock()
+	c.reset = true
+	c.mu.Unlock()
+	c.Conn.Close()
+}
+
+// next returns the delay, the chunk size limited to n and whether to reset
+// the connection for the next operation.
+func (c *ChaosConn) next(n, max int) (time.Duration, int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reset {
+		return 0, 0, true
+	}
+	d := c.config.Latency
+	if c.config.Jitter > 0 {
+		d += time.Duration(c.rand.Int63n(int64(c.config.Jitter)))
+	}
+	if max > 0 && n > max {
+		n = 1 + c.rand.Intn(max)
+	}
+	if c.config.ResetRate > 0 && c.rand.Float64() < c.config.ResetRate {
+		c.reset = true
+		go c.Conn.Close()
+		return d, n, true
+	}
+	return d, n, false
+}
+
+func resetError(op string, c net.Conn) error {
+	return &net.OpError{Op: op, Net: "chaos", Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: syscall.ECONNRESET}
+}
+
+func (c *ChaosConn) Read(p []byte) (int, error) {
+	d, n, reset := c.next(len(p), c.config.MaxRead)
+	if d > 0 {
+		time.Sleep(d)
+	}
+	if reset {
+		return 0, resetError("read", c.Conn)
+	}
+	return c.Conn.Read(p[:n])
+}
+
+func (c *ChaosConn) Write(p []byte) (int, error) {
+	written := 0
+	for {
+		d, n, reset := c.next(len(p), c.config.MaxWrite)
+		if d > 0 {
+			time.Sleep(d)
+		}
+		if reset {
+			return written, resetError("write", c.Conn)
+		}
+		m, err := c.Conn.Write(p[:n])
+		written += m
+		p = p[m:]
+		if err != nil || len(p) == 0 {
+			return written, err
+		}
+	}
+}
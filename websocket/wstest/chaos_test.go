@@ -0,0 +1,93 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package wstest
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/garyburd/go-websocket/websocket"
+)
+
+func TestChaosConnShortReadsAndWrites(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Upgrade(w, r.Header, nil, 1024, 1024)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			op, p, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			ws.WriteMessage(op, p)
+		}
+	}))
+	defer s.Close()
+
+	config := ChaosConfig{MaxRead: 3, MaxWrite: 5, Latency: time.Microsecond, Seed: 1}
+	d := websocket.Dialer{NetDial: func(network, addr string) (net.Conn, error) {
+		c, err := net.Dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return NewChaosConn(c, config), nil
+	}}
+	ws, _, err := d.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+
+	data := bytes.Repeat([]byte("chaos"), 100)
+	if err := ws.WriteMessage(websocket.OpBinary, data); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, p, err := ws.ReadMessage()
+	if err != nil || !bytes.Equal(p, data) {
+		t.Fatalf("ReadMessage() returned %d bytes, %v", len(p), err)
+	}
+}
+
+func TestChaosConnReset(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	c := NewChaosConn(c1, ChaosConfig{MaxWrite: 4, ResetRate: 0.5, Seed: 2})
+	go func() {
+		var buf [64]byte
+		for {
+			if _, err := c2.Read(buf[:]); err != nil {
+				return
+			}
+		}
+	}()
+
+	n, err := c.Write(make([]byte, 1024))
+	if !errors.Is(err, syscall.ECONNRESET) || n >= 1024 {
+		t.Fatalf("Write() returned %d, %v, want partial write and ECONNRESET", n, err)
+	}
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("Read() after reset returned %v, want ECONNRESET", err)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package wstest
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/go-websocket/websocket"
+)
+
+// sendableCloseCodes are the close codes that an endpoint can send. The codes
+// CloseNoStatusReceived, CloseAbnormalClosure and CloseTLSHandshake are
+// reserved for reporting and are not sent in a close message.
+var sendableCloseCodes = []int{
+	websocket.CloseNormalClosure,
+	websocket.CloseGoingAway,
+	websocket.CloseProtocolError,
+	websocket.CloseUnsupportedData,
+	websocket.CloseInvalidFramePayloadData,
+	websocket.ClosePolicyViolation,
+	websocket.CloseMessageTooBig,
+	websocket.CloseMandatoryExtension,
+	websocket.CloseInternalServerErr,
+	3000, // registered with IANA
+	4000, // private use
+}
+
+// closeTimeout limits the time for each close test.
+const closeTimeout = 5 * time.Second
+
+// RunCloseTests runs a conformance suite for the closing handshake as
+// subtests of t. The suite sends every close code that an endpoint can send
+// from the client and from the server and checks the error returned to the
+// receiver, the close message echoed to the sender, the reporting of close
+// messages without a code and the truncation of long close text. Each test
+// calls newConnPair to create a connected pair of connections.
+//
+// Applications that wrap Conn in their own abstractions can run the suite
+// with a newConnPair function that creates connections using their dialer and
+// upgrader.
+func RunCloseTests(t *testing.T, newConnPair func() (client, server *websocket.Conn, err error)) {
+	for _, side := range []string{"client", "server"} {
+		for _, code := range sendableCloseCodes {
+			code, side := code, side
+			t.Run(side+"/"+strconv.Itoa(code), func(t *testing.T) {
+				text := "closing with " + strconv.Itoa(code)
+				runCloseTest(t, newConnPair, side == "client", websocket.FormatCloseMessage(code, text), code, text)
+			})
+		}
+		side := side
+		t.Run(side+"/no-status", func(t *testing.T) {
+			runCloseTest(t, newConnPair, side == "client", []byte{}, websocket.CloseNoStatusReceived, "")
+		})
+		t.Run(side+"/long-text", func(t *testing.T) {
+			text := strings.Repeat("x", 200)
+			p := websocket.FormatCloseMessage(websocket.CloseGoingAway, text)
+			if len(p) != 125 {
+				t.Fatalf("FormatCloseMessage() returned %d bytes, want 125", len(p))
+			}
+			runCloseTest(t, newConnPair, side == "client", p, websocket.CloseGoingAway, text[:123])
+		})
+	}
+	t.Run("abnormal", func(t *testing.T) {
+		client, server, err := newConnPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		client.Close()
+		server.SetReadDeadline(time.Now().Add(closeTimeout))
+		if _, _, err := server.ReadMessage(); err == nil || websocket.IsCloseError(err, sendableCloseCodes...) {
+			t.Fatalf("ReadMessage() after peer closed network connection returned %v, want non-close error", err)
+		}
+	})
+}
+
+// runCloseTest sends the close message payload p from the client or the
+// server and checks the closing handshake.
+func runCloseTest(t *testing.T, newConnPair func() (client, server *websocket.Conn, err error), fromClient bool, p []byte, code int, text string) {
+	client, server, err := newConnPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+	sender, receiver := server, client
+	if fromClient {
+		sender, receiver = client, server
+	}
+	deadline := time.Now().Add(closeTimeout)
+	sender.SetReadDeadline(deadline)
+	receiver.SetReadDeadline(deadline)
+
+	// The sender writes the close message and reads the response from the
+	// receiver. The read runs concurrently with the receiver because the
+	// network connection may not buffer the response.
+	senderErr := make(chan error, 1)
+	go func() {
+		if err := sender.WriteControl(websocket.OpClose, p, deadline); err != nil {
+			senderErr <- err
+			return
+		}
+		_, _, err := readClose(sender)
+		senderErr <- err
+	}()
+
+	_, _, err = readClose(receiver)
+	var e *websocket.CloseError
+	if !errors.As(err, &e) {
+		t.Fatalf("receiver ReadMessage() returned %v, want *CloseError", err)
+	}
+	if e.Code != code || e.Text != text {
+		t.Errorf("receiver got close %d %q, want %d %q", e.Code, e.Text, code, text)
+	}
+	normal := code == websocket.CloseNormalClosure || code == websocket.CloseGoingAway || code == websocket.CloseNoStatusReceived
+	if websocket.IsCloseError(err) != normal {
+		t.Errorf("IsCloseError(%v) = %v, want %v", err, !normal, normal)
+	}
+	if !websocket.IsCloseError(err, code) {
+		t.Errorf("IsCloseError(%v, %d) = false, want true", err, code)
+	}
+
+	if err := <-senderErr; !errors.As(err, &e) {
+		t.Fatalf("sender returned %v, want *CloseError from the response", err)
+	}
+	if err := receiver.WriteMessage(websocket.OpText, []byte("late")); err == nil {
+		t.Errorf("receiver WriteMessage() after close returned nil error")
+	}
+}
+
+// readClose reads messages until an error is returned.
+func readClose(c *websocket.Conn) (websocket.MessageType, []byte, error) {
+	for {
+		op, p, err := c.ReadMessage()
+		if err != nil {
+			return op, p, err
+		}
+	}
+}
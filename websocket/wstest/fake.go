@@ -0,0 +1,170 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package wstest
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/garyburd/go-websocket/websocket"
+)
+
+var errFakeClosed = errors.New("wstest: fake connection closed")
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "wstest: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// FakeConn is an in-memory implementation of websocket.MessageConn for unit
+// testing application code. The test delivers messages for the application
+// to read with Deliver and inspects the messages written by the application
+// with Sent. FakeConn methods can be called concurrently.
+type FakeConn struct {
+	mu            sync.Mutex
+	incoming      []websocket.Message
+	readErr       error
+	sent          []websocket.Message
+	closed        bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+	ready         chan struct{} // signaled when incoming, readErr or closed changes.
+}
+
+var _ websocket.MessageConn = (*FakeConn)(nil)
+
+// NewFakeConn returns a new fake connection.
+func NewFakeConn() *FakeConn {
+	return &FakeConn{ready: make(chan struct{}, 1)}
+}
+
+func (f *FakeConn) signal() {
+	select {
+	case f.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Deliver queues a message for the application to read.
+func (f *FakeConn) Deliver(opCode websocket.MessageType, data []byte) {
+	f.mu.Lock()
+	f.incoming = append(f.incoming, websocket.Message{OpCode: opCode, Data: append([]byte(nil), data...)})
+	f.mu.Unlock()
+	f.signal()
+}
+
+// DeliverError sets the error returned by ReadMessage after the queued
+// messages are read. Use a *websocket.CloseError to simulate a close
+// message from the peer.
+func (f *FakeConn) DeliverError(err error) {
+	f.mu.Lock()
+	f.readErr = err
+	f.mu.Unlock()
+	f.signal()
+}
+
+// Sent returns the messages written by the application.
+func (f *FakeConn) Sent() []websocket.Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]websocket.Message(nil), f.sent...)
+}
+
+// Closed returns whether the application closed the connection.
+func (f *FakeConn) Closed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+// ReadMessage returns the next delivered message. ReadMessage blocks until a
+// message or error is delivered, the connection is closed or the read
+// deadline expires.
+func (f *FakeConn) ReadMessage() (websocket.MessageType, []byte, error) {
+	for {
+		f.mu.Lock()
+		if len(f.incoming) > 0 {
+			m := f.incoming[0]
+			f.incoming = f.incoming[1:]
+			f.mu.Unlock()
+			return m.OpCode, m.Data, nil
+		}
+		err := f.readErr
+		if f.closed {
+			err = errFakeClosed
+		}
+		deadline := f.readDeadline
+		f.mu.Unlock()
+		if err != nil {
+			return -1, nil, err
+		}
+
+		if deadline.IsZero() {
+			<-f.ready
+			continue
+		}
+		d := deadline.Sub(time.Now())
+		if d <= 0 {
+			return -1, nil, timeoutError{}
+		}
+		timer := time.NewTimer(d)
+		select {
+		case <-f.ready:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// WriteMessage records the message. WriteMessage returns an error if the
+// connection is closed or if the write deadline has expired.
+func (f *FakeConn) WriteMessage(opCode websocket.MessageType, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return errFakeClosed
+	}
+	if !f.writeDeadline.IsZero() && !time.Now().Before(f.writeDeadline) {
+		return timeoutError{}
+	}
+	f.sent = append(f.sent, websocket.Message{OpCode: opCode, Data: append([]byte(nil), data...)})
+	return nil
+}
+
+// Close closes the connection. Blocked reads return an error.
+func (f *FakeConn) Close() error {
+	f.mu.Lock()
+	f.closed = true
+	f.mu.Unlock()
+	f.signal()
+	return nil
+}
+
+func (f *FakeConn) SetReadDeadline(t time.Time) error {
+	f.mu.Lock()
+	f.readDeadline = t
+	f.mu.Unlock()
+	f.signal()
+	return nil
+}
+
+func (f *FakeConn) SetWriteDeadline(t time.Time) error {
+	f.mu.Lock()
+	f.writeDeadline = t
+	f.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package wstest
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/garyburd/go-websocket/websocket"
+)
+
+// echo is application code written against websocket.MessageConn.
+func echo(c websocket.MessageConn) error {
+	defer c.Close()
+	for {
+		op, p, err := c.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if err := c.WriteMessage(op, bytes.ToUpper(p)); err != nil {
+			return err
+		}
+	}
+}
+
+func TestFakeConn(t *testing.T) {
+	f := NewFakeConn()
+	f.Deliver(websocket.OpText, []byte("hello"))
+	f.Deliver(websocket.OpBinary, []byte("world"))
+	f.DeliverError(&websocket.CloseError{Code: websocket.CloseGoingAway})
+
+	err := echo(f)
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("echo() returned %v, want close error", err)
+	}
+	sent := f.Sent()
+	if len(sent) != 2 || sent[0].OpCode != websocket.OpText || string(sent[0].Data) != "HELLO" || string(sent[1].Data) != "WORLD" {
+		t.Fatalf("Sent() = %v", sent)
+	}
+	if !f.Closed() {
+		t.Fatal("Closed() = false, want true")
+	}
+}
+
+func TestFakeConnReadDeadline(t *testing.T) {
+	f := NewFakeConn()
+	f.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, _, err := f.ReadMessage()
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Fatalf("ReadMessage() returned %v, want timeout", err)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package wstest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"time"
+
+	"github.com/garyburd/go-websocket/websocket"
+)
+
+// Pattern specifies how a message is split into frames.
+type Pattern struct {
+	// Name describes the pattern.
+	Name string
+
+	// Sizes is the payload size of each frame in the message.
+	Sizes []int
+
+	// Pings is the set of indexes in Sizes of the frames followed by a
+	// ping.
+	Pings map[int]bool
+}
+
+// randomPatterns is the number of random patterns returned by Patterns.
+const randomPatterns = 16
+
+// Patterns returns the fragmentation patterns for a message with n bytes of
+// payload. The patterns include a single frame, one byte per frame, empty
+// frames, pings between frames and random splits chosen using seed. The
+// same arguments always return the same patterns.
+func Patterns(n int, seed int64) []Pattern {
+	patterns := []Pattern{
+		{Name: "single frame", Sizes: []int{n}},
+		{Name: "empty first and last frames", Sizes: []int{0, n, 0}},
+	}
+	if n > 1 {
+		patterns = append(patterns,
+			Pattern{Name: "two frames", Sizes: []int{n / 2, n - n/2}},
+			Pattern{Name: "two frames with ping", Sizes: []int{n / 2, n - n/2}, Pings: map[int]bool{0: true}})
+	}
+	if n > 2 {
+		sizes := make([]int, n)
+		pings := make(map[int]bool)
+		for i := range sizes {
+			sizes[i] = 1
+			pings[i] = true
+		}
+		patterns = append(patterns,
+			Pattern{Name: "one byte per frame", Sizes: sizes},
+			Pattern{Name: "one byte per frame with pings", Sizes: sizes, Pings: pings})
+	}
+
+	r := rand.New(rand.NewSource(seed))
+	for i := 0; i < randomPatterns; i++ {
+		p := Pattern{Name: fmt.Sprintf("random %d", i), Pings: make(map[int]bool)}
+		for remaining := n; remaining > 0 || len(p.Sizes) == 0; {
+			size := r.Intn(remaining + 1)
+			if r.Intn(4) == 0 {
+				p.Pings[len(p.Sizes)] = true
+			}
+			p.Sizes = append(p.Sizes, size)
+			remaining -= size
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns
+}
+
+// fragmentTimeout limits the time to deliver a message to the handler.
+const fragmentTimeout = 5 * time.Second
+
+// FragmentMessage delivers a message to handler under each of the patterns
+// returned by Patterns(len(data), seed). For each pattern, FragmentMessage
+// creates a Pipe, runs handler with the server connection and writes the
+// message from the client followed by a close message. Handlers check that
+// the application received the message and return an error if not. Code that
+// assumes that a message is a single frame or that a single read returns the
+// message fails with some of the patterns.
+//
+// FragmentMessage returns the first error returned by the handler.
+func FragmentMessage(opCode websocket.MessageType, data []byte, seed int64, handler func(c *websocket.Conn) error) error {
+	for _, p := range Patterns(len(data), seed) {
+		if err := fragmentMessage(opCode, data, p, handler); err != nil {
+			return fmt.Errorf("wstest: pattern %s: %v", p.Name, err)
+		}
+	}
+	return nil
+}
+
+func fragmentMessage(opCode websocket.MessageType, data []byte, p Pattern, handler func(c *websocket.Conn) error) error {
+	nc, client, server, err := pipe()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		done <- handler(server)
+	}()
+	// Discard pongs and the close message from the server.
+	go io.Copy(ioutil.Discard, nc)
+
+	nc.SetWriteDeadline(time.Now().Add(fragmentTimeout))
+	var frames []byte
+	for i, size := range p.Sizes {
+		h := websocket.FrameHeader{Final: i == len(p.Sizes)-1, OpCode: opCode}
+		if i > 0 {
+			h.OpCode = websocket.OpContinuation
+		}
+		frames = appendMaskedFrame(frames, h, data[:size])
+		data = data[size:]
+		if p.Pings[i] {
+			frames = appendMaskedFrame(frames, websocket.FrameHeader{Final: true, OpCode: websocket.OpPing}, []byte("ping"))
+		}
+	}
+	frames = appendMaskedFrame(frames, websocket.FrameHeader{Final: true, OpCode: websocket.OpClose}, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+
+	// Write each frame separately so that the handler observes frames
+	// arriving over time.
+	for len(frames) > 0 {
+		h, n, _ := websocket.DecodeFrameHeader(frames)
+		n += int(h.Length)
+		if _, err := nc.Write(frames[:n]); err != nil {
+			// The handler returned or stopped reading.
+			nc.Close()
+			break
+		}
+		frames = frames[n:]
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(fragmentTimeout):
+		nc.Close()
+		return errors.New("handler did not return")
+	}
+}
+
+// appendMaskedFrame appends a masked client frame to p.
+func appendMaskedFrame(p []byte, h websocket.FrameHeader, payload []byte) []byte {
+	h.Masked = true
+	h.MaskKey = [4]byte{0x37, 0xfa, 0x21, 0x3d}
+	h.Length = int64(len(payload))
+	p = websocket.EncodeFrameHeader(p, h)
+	for i, b := range payload {
+		p = append(p, b^h.MaskKey[i%4])
+	}
+	return p
+}
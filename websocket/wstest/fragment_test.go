@@ -0,0 +1,76 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package wstest
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/garyburd/go-websocket/websocket"
+)
+
+func TestPatterns(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 100} {
+		for _, p := range Patterns(n, 1) {
+			total := 0
+			for _, size := range p.Sizes {
+				total += size
+			}
+			if total != n || len(p.Sizes) == 0 {
+				t.Errorf("n=%d, pattern %s: sizes %v", n, p.Name, p.Sizes)
+			}
+		}
+	}
+	a, b := Patterns(100, 7), Patterns(100, 7)
+	if fmt.Sprint(a) != fmt.Sprint(b) {
+		t.Error("Patterns() is not deterministic")
+	}
+}
+
+func TestFragmentMessage(t *testing.T) {
+	data := []byte("hello, fragmented world")
+
+	err := FragmentMessage(websocket.OpText, data, 1, func(c *websocket.Conn) error {
+		op, p, err := c.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if op != websocket.OpText || !bytes.Equal(p, data) {
+			return fmt.Errorf("got %v %q", op, p)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("FragmentMessage(correct handler) returned %v", err)
+	}
+
+	// The handler incorrectly assumes that one read returns the message.
+	err = FragmentMessage(websocket.OpText, data, 1, func(c *websocket.Conn) error {
+		_, r, err := c.NextReader()
+		if err != nil {
+			return err
+		}
+		p := make([]byte, len(data))
+		n, _ := r.Read(p)
+		if !bytes.Equal(p[:n], data) {
+			return fmt.Errorf("got %q", p[:n])
+		}
+		return nil
+	})
+	if err == nil {
+		t.Fatal("FragmentMessage(single read handler) returned nil")
+	}
+}
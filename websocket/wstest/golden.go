@@ -0,0 +1,144 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package wstest
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/garyburd/go-websocket/websocket"
+)
+
+// recordConn records the data written to a network connection after the
+// opening handshake. While recording, writes are not sent to the peer and
+// reads return io.EOF.
+type recordConn struct {
+	net.Conn
+
+	mu        sync.Mutex
+	recording bool
+	buf       bytes.Buffer
+}
+
+func (c *recordConn) start() {
+	c.mu.Lock()
+	c.recording = true
+	c.mu.Unlock()
+}
+
+func (c *recordConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	recording := c.recording
+	c.mu.Unlock()
+	if recording {
+		return 0, io.EOF
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.recording {
+		return c.buf.Write(p)
+	}
+	return c.Conn.Write(p)
+}
+
+// maskKeys is a deterministic source of masking keys for recorded client
+// connections. All keys are the key used in the examples in RFC 6455.
+type maskKeys struct{}
+
+func (maskKeys) Read(p []byte) (int, error) {
+	key := [4]byte{0x37, 0xfa, 0x21, 0x3d}
+	for i := range p {
+		p[i] = key[i%4]
+	}
+	return len(p), nil
+}
+
+// Record runs script with a client or server connection and returns the
+// bytes written by the connection after the opening handshake. Client
+// connections use a fixed masking key so that the recording is the same on
+// every run. While script runs, writes are not sent to a peer and reads
+// return io.EOF.
+func Record(client bool, script func(c *websocket.Conn) error) ([]byte, error) {
+	c1, c2 := net.Pipe()
+	var rc *recordConn
+	if client {
+		rc = &recordConn{Conn: c1}
+		c1 = rc
+	} else {
+		rc = &recordConn{Conn: c2}
+		c2 = rc
+	}
+	wsClient, wsServer, err := handshake(c1, c2)
+	if err != nil {
+		return nil, err
+	}
+	rc.start()
+
+	ws, peer := wsServer, wsClient
+	if client {
+		ws, peer = wsClient, wsServer
+		ws.SetMaskKeySource(maskKeys{})
+	}
+	peer.Close()
+	defer ws.Close()
+
+	if err := script(ws); err != nil {
+		return nil, err
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]byte(nil), rc.buf.Bytes()...), nil
+}
+
+// UpdateGolden specifies whether CheckGolden writes the golden files instead
+// of comparing against them. The default is true when the
+// WSTEST_UPDATE_GOLDEN environment variable is not empty.
+var UpdateGolden = os.Getenv("WSTEST_UPDATE_GOLDEN") != ""
+
+// CheckGolden compares got with the golden file testdata/name.golden and
+// reports an error to t if the contents differ. The golden file contains a
+// hex dump of the bytes so that differences are easy to read in a diff.
+func CheckGolden(t testing.TB, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	dump := hex.Dump(got)
+	if UpdateGolden {
+		if err := os.MkdirAll("testdata", 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(dump), 0666); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (set WSTEST_UPDATE_GOLDEN=1 to create)", err)
+	}
+	if string(want) != dump {
+		t.Errorf("%s: recording does not match golden file\ngot:\n%swant:\n%s", name, dump, want)
+	}
+}
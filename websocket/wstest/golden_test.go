@@ -0,0 +1,63 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package wstest
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/garyburd/go-websocket/websocket"
+)
+
+// script writes messages with 7-bit and 16-bit lengths, a message using a
+// writer, a ping and a close message.
+func script(c *websocket.Conn) error {
+	if err := c.WriteMessage(websocket.OpText, []byte("Hello")); err != nil {
+		return err
+	}
+	if err := c.WriteMessage(websocket.OpBinary, bytes.Repeat([]byte{0xab}, 200)); err != nil {
+		return err
+	}
+	w, err := c.NextWriter(websocket.OpText)
+	if err != nil {
+		return err
+	}
+	io.WriteString(w, "writer")
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := c.WriteControl(websocket.OpPing, []byte("ping"), time.Now().Add(time.Second)); err != nil {
+		return err
+	}
+	return c.WriteControl(websocket.OpClose, websocket.FormatCloseMessage(websocket.CloseGoingAway, "bye"), time.Now().Add(time.Second))
+}
+
+func TestGoldenServer(t *testing.T) {
+	p, err := Record(false, script)
+	if err != nil {
+		t.Fatalf("Record() returned %v", err)
+	}
+	CheckGolden(t, "server", p)
+}
+
+func TestGoldenClient(t *testing.T) {
+	p, err := Record(true, script)
+	if err != nil {
+		t.Fatalf("Record() returned %v", err)
+	}
+	CheckGolden(t, "client", p)
+}
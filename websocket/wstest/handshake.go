@@ -0,0 +1,242 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package wstest
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/garyburd/go-websocket/websocket"
+)
+
+// Misbehavior specifies how a HandshakeServer responds to an opening
+// handshake.
+type Misbehavior int
+
+const (
+	// Behave completes the handshake correctly. The server echoes messages
+	// on the connection.
+	Behave Misbehavior = iota
+
+	// BadAccept responds with an incorrect Sec-WebSocket-Accept header.
+	BadAccept
+
+	// MissingAccept omits the Sec-WebSocket-Accept header.
+	MissingAccept
+
+	// MissingUpgrade omits the Upgrade header.
+	MissingUpgrade
+
+	// MissingConnection omits the Connection header.
+	MissingConnection
+
+	// BadStatus responds with 200 OK.
+	BadStatus
+
+	// ServiceUnavailable responds with 503 Service Unavailable and a
+	// Retry-After header of one second.
+	ServiceUnavailable
+
+	// Stall reads the request and never responds.
+	Stall
+
+	// StallMidResponse writes part of the response status line and stalls.
+	StallMidResponse
+
+	// CloseEarly closes the connection after reading the request.
+	CloseEarly
+)
+
+var misbehaviorNames = []string{
+	Behave:             "Behave",
+	BadAccept:          "BadAccept",
+	MissingAccept:      "MissingAccept",
+	MissingUpgrade:     "MissingUpgrade",
+	MissingConnection:  "MissingConnection",
+	BadStatus:          "BadStatus",
+	ServiceUnavailable: "ServiceUnavailable",
+	Stall:              "Stall",
+	StallMidResponse:   "StallMidResponse",
+	CloseEarly:         "CloseEarly",
+}
+
+func (m Misbehavior) String() string {
+	if m >= 0 && int(m) < len(misbehaviorNames) {
+		return misbehaviorNames[m]
+	}
+	return "Misbehavior(?)"
+}
+
+// HandshakeServer is a WebSocket server on the loopback interface that
+// misbehaves during the opening handshake as scripted. Use HandshakeServer
+// to test Dialer error handling and application retry logic.
+type HandshakeServer struct {
+	// URL is the ws:// URL of the server.
+	URL string
+
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu     sync.Mutex
+	script []Misbehavior
+	count  int
+	conns  map[net.Conn]bool
+}
+
+// NewHandshakeServer starts a server that responds to the nth handshake with
+// script[n]. After the script is exhausted, the server completes handshakes
+// correctly.
+func NewHandshakeServer(script ...Misbehavior) (*HandshakeServer, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &HandshakeServer{
+		URL:      "ws://" + l.Addr().String() + "/",
+		listener: l,
+		script:   script,
+		conns:    make(map[net.Conn]bool),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Handshakes returns the number of handshakes started by clients.
+func (s *HandshakeServer) Handshakes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+// Close stops the server and closes all connections.
+func (s *HandshakeServer) Close() {
+	s.listener.Close()
+	s.mu.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *HandshakeServer) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[c] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.handle(c)
+	}
+}
+
+func (s *HandshakeServer) handle(c net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		c.Close()
+	}()
+
+	br := bufio.NewReader(c)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	m := Behave
+	if s.count < len(s.script) {
+		m = s.script[s.count]
+	}
+	s.count++
+	s.mu.Unlock()
+
+	switch m {
+	case Behave:
+		ws, err := websocket.Upgrade(hijacker{c, br}, req.Header, nil, 1024, 1024)
+		if err != nil {
+			return
+		}
+		for {
+			op, p, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if op != websocket.OpPong {
+				ws.WriteMessage(op, p)
+			}
+		}
+	case Stall, StallMidResponse:
+		if m == StallMidResponse {
+			io.WriteString(c, "HTTP/1.1 10")
+		}
+		// Wait for the client or the server to close the connection.
+		io.Copy(ioutil.Discard, c)
+		return
+	case CloseEarly:
+		return
+	}
+
+	status := "101 Switching Protocols"
+	header := http.Header{
+		"Upgrade":              {"websocket"},
+		"Connection":           {"Upgrade"},
+		"Sec-Websocket-Accept": {acceptKey(req.Header.Get("Sec-Websocket-Key"))},
+	}
+	switch m {
+	case BadAccept:
+		header.Set("Sec-Websocket-Accept", acceptKey("bad"))
+	case MissingAccept:
+		header.Del("Sec-Websocket-Accept")
+	case MissingUpgrade:
+		header.Del("Upgrade")
+	case MissingConnection:
+		header.Del("Connection")
+	case BadStatus:
+		status = "200 OK"
+		header = http.Header{"Content-Length": {"0"}}
+	case ServiceUnavailable:
+		status = "503 Service Unavailable"
+		header = http.Header{"Content-Length": {"0"}, "Retry-After": {"1"}}
+	}
+	bw := bufio.NewWriter(c)
+	bw.WriteString("HTTP/1.1 " + status + "\r\n")
+	header.Write(bw)
+	bw.WriteString("\r\n")
+	bw.Flush()
+	io.Copy(ioutil.Discard, c)
+}
+
+var keyGUID = []byte("258EAFA5-E914-47DA-95CA-C5AB0DC85B11")
+
+func acceptKey(challengeKey string) string {
+	h := sha1.New()
+	h.Write([]byte(challengeKey))
+	h.Write(keyGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,54 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package wstest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/garyburd/go-websocket/websocket"
+)
+
+func TestHandshakeServer(t *testing.T) {
+	script := []Misbehavior{BadAccept, MissingAccept, MissingUpgrade, MissingConnection, BadStatus, ServiceUnavailable, Stall, StallMidResponse, CloseEarly}
+	s, err := NewHandshakeServer(script...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	d := websocket.Dialer{HandshakeTimeout: 100 * time.Millisecond}
+	for _, m := range script {
+		ws, _, err := d.Dial(s.URL, nil)
+		if err == nil {
+			ws.Close()
+			t.Errorf("%v: Dial() returned nil error", m)
+		}
+	}
+
+	ws, _, err := d.Dial(s.URL, nil)
+	if err != nil {
+		t.Fatalf("Dial() after script returned %v", err)
+	}
+	defer ws.Close()
+	ws.WriteMessage(websocket.OpText, []byte("hello"))
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	if _, p, err := ws.ReadMessage(); err != nil || string(p) != "hello" {
+		t.Fatalf("ReadMessage() returned %q, %v", p, err)
+	}
+	if n := s.Handshakes(); n != len(script)+1 {
+		t.Errorf("Handshakes() = %d, want %d", n, len(script)+1)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package wstest
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/garyburd/go-websocket/websocket"
+)
+
+// hijacker hijacks the server end of a pipe.
+type hijacker struct {
+	c  net.Conn
+	br *bufio.Reader
+}
+
+func (h hijacker) Hijack() (net.Conn, *bufio.Reader, error) { return h.c, h.br, nil }
+
+// Pipe returns a connected pair of WebSocket connections. The connections
+// run over an in-memory net.Pipe after a regular opening handshake.
+func Pipe() (client, server *websocket.Conn, err error) {
+	_, client, server, err = pipe()
+	return client, server, err
+}
+
+// pipe returns the client end of the network connection with the WebSocket
+// connections.
+func pipe() (net.Conn, *websocket.Conn, *websocket.Conn, error) {
+	c1, c2 := net.Pipe()
+	client, server, err := handshake(c1, c2)
+	return c1, client, server, err
+}
+
+// handshake runs the opening handshake on a connected pair of network
+// connections and returns the WebSocket connections.
+func handshake(c1, c2 net.Conn) (*websocket.Conn, *websocket.Conn, error) {
+
+	type result struct {
+		ws  *websocket.Conn
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		br := bufio.NewReader(c2)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			done <- result{nil, err}
+			return
+		}
+		ws, err := websocket.Upgrade(hijacker{c2, br}, req.Header, nil, 1024, 1024)
+		done <- result{ws, err}
+	}()
+
+	u := &url.URL{Scheme: "ws", Host: "pipe", Path: "/"}
+	client, _, err := websocket.NewClient(c1, u, nil, 1024, 1024)
+	if err != nil {
+		c1.Close()
+		c2.Close()
+		<-done
+		return nil, nil, err
+	}
+	r := <-done
+	if r.err != nil {
+		c1.Close()
+		c2.Close()
+		return nil, nil, r.err
+	}
+	return client, r.ws, nil
+}
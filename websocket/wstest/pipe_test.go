@@ -0,0 +1,36 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package wstest
+
+import (
+	"testing"
+
+	"github.com/garyburd/go-websocket/websocket"
+)
+
+func TestPipe(t *testing.T) {
+	client, server, err := Pipe()
+	if err != nil {
+		t.Fatalf("Pipe() returned %v", err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	go client.WriteMessage(websocket.OpText, []byte("hello"))
+	op, p, err := server.ReadMessage()
+	if err != nil || op != websocket.OpText || string(p) != "hello" {
+		t.Fatalf("ReadMessage() returned %v, %q, %v", op, p, err)
+	}
+}
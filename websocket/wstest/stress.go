@@ -0,0 +1,238 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package wstest
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/garyburd/go-websocket/websocket"
+)
+
+// StressConfig specifies the load applied by Stress. Zero fields use the
+// defaults.
+type StressConfig struct {
+	// Pairs is the number of connection pairs. The default is 8.
+	Pairs int
+
+	// Messages is the number of messages written by each side of a pair.
+	// The default is 100.
+	Messages int
+
+	// MaxSize is the maximum message payload size. The default is 1024.
+	MaxSize int
+
+	// Pings is the number of pings written by each side of a pair. The
+	// default is 10.
+	Pings int
+
+	// CloseRate is the probability that a pair is closed by one side while
+	// the messages are in flight.
+	CloseRate float64
+
+	// Timeout limits the time for each pair to finish. The default is 10
+	// seconds.
+	Timeout time.Duration
+
+	// Seed seeds the random choices of sizes, delays and closes.
+	Seed int64
+}
+
+// Stress hammers connection pairs with concurrent reads, writes, pings and
+// closes. Run Stress from a test with the race detector enabled to find
+// races in code that wraps or uses a Conn. If newPair is nil, then Stress
+// uses Pipe to create the pairs.
+//
+// Stress returns an error if a message is corrupted, if the messages are
+// not delivered to a pair that is not closed early or if a pair does not
+// finish before the timeout. Errors from reads and writes after a close are
+// expected and ignored.
+func Stress(newPair func() (client, server *websocket.Conn, err error), config StressConfig) error {
+	if newPair == nil {
+		newPair = Pipe
+	}
+	if config.Pairs <= 0 {
+		config.Pairs = 8
+	}
+	if config.Messages <= 0 {
+		config.Messages = 100
+	}
+	if config.MaxSize <= 0 {
+		config.MaxSize = 1024
+	}
+	if config.Pings <= 0 {
+		config.Pings = 10
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+
+	r := rand.New(rand.NewSource(config.Seed))
+	errs := make(chan error, config.Pairs)
+	for i := 0; i < config.Pairs; i++ {
+		client, server, err := newPair()
+		if err != nil {
+			return err
+		}
+		closeEarly := r.Float64() < config.CloseRate
+		go func(i int, seed int64) {
+			if err := stressPair(client, server, config, closeEarly, seed); err != nil {
+				errs <- fmt.Errorf("wstest: pair %d: %v", i, err)
+				return
+			}
+			errs <- nil
+		}(i, r.Int63())
+	}
+
+	var first error
+	for i := 0; i < config.Pairs; i++ {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// stressPayload returns a payload of size n. The payload encodes its size
+// so that the reader can detect corruption.
+func stressPayload(n int) []byte {
+	p := make([]byte, n)
+	for i := range p {
+		p[i] = byte(n + i)
+	}
+	return p
+}
+
+func checkPayload(p []byte) error {
+	for i, b := range p {
+		if b != byte(len(p)+i) {
+			return fmt.Errorf("corrupt message of %d bytes at offset %d", len(p), i)
+		}
+	}
+	return nil
+}
+
+func stressPair(client, server *websocket.Conn, config StressConfig, closeEarly bool, seed int64) error {
+	defer client.Close()
+	defer server.Close()
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		pairErr error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if pairErr == nil {
+			pairErr = err
+		}
+		mu.Unlock()
+	}
+
+	r := rand.New(rand.NewSource(seed))
+	conns := []*websocket.Conn{client, server}
+	for _, c := range conns {
+		sizes := make([]int, config.Messages)
+		for i := range sizes {
+			sizes[i] = r.Intn(config.MaxSize + 1)
+		}
+		wg.Add(3)
+
+		// received is closed when the reader has all of the messages from
+		// the peer or stops reading.
+		received := make(chan struct{})
+		var once sync.Once
+		doneReceiving := func() { once.Do(func() { close(received) }) }
+
+		// Reader.
+		go func(c *websocket.Conn) {
+			defer wg.Done()
+			defer doneReceiving()
+			n := 0
+			for {
+				op, p, err := c.ReadMessage()
+				if err != nil {
+					if !closeEarly && n != config.Messages {
+						fail(fmt.Errorf("read %d messages, want %d: %v", n, config.Messages, err))
+					}
+					return
+				}
+				if op == websocket.OpPong {
+					continue
+				}
+				if err := checkPayload(p); err != nil {
+					fail(err)
+					return
+				}
+				n++
+				if n == config.Messages {
+					doneReceiving()
+				}
+			}
+		}(c)
+
+		// Writer. The writer starts the closing handshake after writing
+		// the messages and receiving the messages from the peer.
+		go func(c *websocket.Conn, sizes []int) {
+			defer wg.Done()
+			for _, size := range sizes {
+				if err := c.WriteMessage(websocket.OpBinary, stressPayload(size)); err != nil {
+					return
+				}
+			}
+			<-received
+			c.CloseHandshake(websocket.CloseNormalClosure, "", time.Now().Add(config.Timeout))
+		}(c, sizes)
+
+		// Pinger.
+		go func(c *websocket.Conn) {
+			defer wg.Done()
+			for i := 0; i < config.Pings; i++ {
+				if err := c.WriteControl(websocket.OpPing, []byte("stress"), time.Now().Add(config.Timeout)); err != nil {
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}(c)
+	}
+
+	if closeEarly {
+		c := conns[r.Intn(2)]
+		delay := time.Duration(r.Int63n(int64(5 * time.Millisecond)))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			time.Sleep(delay)
+			c.Close()
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(config.Timeout):
+		client.Close()
+		server.Close()
+		<-done
+		return fmt.Errorf("pair did not finish before the timeout (%v)", pairErr)
+	}
+	return pairErr
+}
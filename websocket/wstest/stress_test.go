@@ -0,0 +1,29 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package wstest
+
+import "testing"
+
+func TestStress(t *testing.T) {
+	if err := Stress(nil, StressConfig{Pairs: 4, Messages: 50}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStressCloseEarly(t *testing.T) {
+	if err := Stress(nil, StressConfig{Pairs: 8, Messages: 50, CloseRate: 1, Seed: 1}); err != nil {
+		t.Fatal(err)
+	}
+}